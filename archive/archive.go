@@ -0,0 +1,517 @@
+// Package archive - Export and import of a whole library
+//
+// An Archive is a versioned JSON document holding every user, resource
+// and rating of a library together with the peers its node knows, so a
+// library can be backed up or moved to another server. Export reads it
+// from a storage backend; Import checks that everything it refers to is
+// there and writes it back in a single transaction, either merged into
+// the existing data or replacing it.
+//
+// Passwords are left out unless the export asks for them. The transfer
+// ledger is not archived: it only means something to the peers that
+// signed its receipts.
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"p2p-library/errors"
+	"p2p-library/interfaces"
+	"p2p-library/models"
+)
+
+// ============================================================================
+// ARCHIVE FORMAT
+// ============================================================================
+
+// Format identifies an archive file
+const Format = "p2p-library-archive"
+
+// CurrentVersion is the archive version Export writes. Read accepts any
+// version up to it.
+const CurrentVersion = 1
+
+// Archive is everything Export saves
+type Archive struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Passwords bool      `json:"passwords"` // whether Users carry their passwords
+
+	Users     []User                   `json:"users"`
+	Resources []*models.Resource       `json:"resources"`
+	Ratings   []*models.ResourceRating `json:"ratings"`
+	Peers     []models.Peer            `json:"peers"`
+
+	// Skipped counts the resources and ratings Export left out because
+	// the user or resource they refer to is gone. It is not written.
+	Skipped int `json:"-"`
+}
+
+// User is an archived user. models.User keeps its password out of JSON,
+// so it is carried next to it.
+type User struct {
+	*models.User
+	Password string `json:"password,omitempty"`
+}
+
+// Write encodes a as indented JSON
+func Write(w io.Writer, a *Archive) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(a)
+}
+
+// Read decodes an archive, refusing other files and versions newer than
+// this build understands
+func Read(r io.Reader) (*Archive, error) {
+	var a Archive
+	if err := json.NewDecoder(r).Decode(&a); err != nil {
+		return nil, errors.NewOperationError("Read", "not a valid archive", err)
+	}
+	if a.Format != Format {
+		return nil, errors.NewValidationError("format", fmt.Sprintf("%q is not a library archive", a.Format))
+	}
+	if a.Version < 1 || a.Version > CurrentVersion {
+		return nil, errors.NewValidationError("version",
+			fmt.Sprintf("archive version %d is not supported; this build reads up to %d", a.Version, CurrentVersion))
+	}
+	return &a, nil
+}
+
+// ============================================================================
+// EXPORT
+// ============================================================================
+
+// ExportOptions control what Export includes
+type ExportOptions struct {
+	Passwords bool // include user passwords
+}
+
+// Export reads the whole library from db. peers is the node's known peer
+// list. Records are sorted by ID so two exports of the same library are
+// identical apart from CreatedAt. Resources whose uploader is gone and
+// ratings whose user or resource is gone are left out and counted in
+// Skipped, as an import could not place them.
+func Export(db interfaces.StorageBackend, peers []models.Peer, opts ExportOptions) (*Archive, error) {
+	users, err := db.Users().GetAll()
+	if err != nil {
+		return nil, errors.NewOperationError("Export", "failed to read users", err)
+	}
+	resources, err := db.Resources().GetAll()
+	if err != nil {
+		return nil, errors.NewOperationError("Export", "failed to read resources", err)
+	}
+	ratings, err := db.Ratings().GetAll()
+	if err != nil {
+		return nil, errors.NewOperationError("Export", "failed to read ratings", err)
+	}
+
+	a := &Archive{
+		Format:    Format,
+		Version:   CurrentVersion,
+		CreatedAt: models.TimeNow(),
+		Passwords: opts.Passwords,
+		Users:     make([]User, 0, len(users)),
+		Resources: make([]*models.Resource, 0, len(resources)),
+		Ratings:   make([]*models.ResourceRating, 0, len(ratings)),
+		Peers:     append([]models.Peer{}, peers...),
+	}
+
+	known := make(map[models.UserID]bool, len(users))
+	for _, user := range users {
+		known[user.ID] = true
+		archived := User{User: user}
+		if opts.Passwords {
+			archived.Password = user.Password
+		}
+		user.Password = ""
+		a.Users = append(a.Users, archived)
+	}
+	exported := make(map[models.ContentID]bool, len(resources))
+	for _, resource := range resources {
+		if !known[resource.UploadedBy] {
+			a.Skipped++
+			continue
+		}
+		exported[resource.ID] = true
+		a.Resources = append(a.Resources, resource)
+	}
+	for _, rating := range ratings {
+		if !known[rating.UserID] || !exported[rating.ResourceID] {
+			a.Skipped++
+			continue
+		}
+		a.Ratings = append(a.Ratings, rating)
+	}
+
+	sort.Slice(a.Users, func(i, j int) bool { return a.Users[i].ID < a.Users[j].ID })
+	sort.Slice(a.Resources, func(i, j int) bool { return a.Resources[i].ID < a.Resources[j].ID })
+	sort.Slice(a.Ratings, func(i, j int) bool { return a.Ratings[i].ID < a.Ratings[j].ID })
+	sort.Slice(a.Peers, func(i, j int) bool { return a.Peers[i].ID < a.Peers[j].ID })
+	return a, nil
+}
+
+// ============================================================================
+// IMPORT
+// ============================================================================
+
+// Mode says what happens to the data already in the library
+type Mode string
+
+const (
+	// ModeMerge keeps existing records. Archived records are added, and
+	// replace existing ones with the same ID.
+	ModeMerge Mode = "merge"
+
+	// ModeReplace deletes every existing user, resource and rating first
+	ModeReplace Mode = "replace"
+)
+
+// ParseMode checks a mode given on the command line
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(s); mode {
+	case ModeMerge, ModeReplace:
+		return mode, nil
+	}
+	return "", errors.NewValidationError("mode", fmt.Sprintf("%q is not merge or replace", s))
+}
+
+// Summary counts what Import wrote
+type Summary struct {
+	Users     int `json:"users"`
+	Resources int `json:"resources"`
+	Ratings   int `json:"ratings"`
+	Deleted   int `json:"deleted"` // existing records removed by ModeReplace
+}
+
+// Import writes a into db in one transaction. It first checks that every
+// reference in the archive resolves - uploaders, raters and rated
+// resources, against the archive and, when merging, the existing library
+// - and writes nothing if one does not. Merged users keep their existing
+// password when the archive has none, and merged resources have their
+// rating totals recounted from the ratings stored after the merge.
+func Import(db interfaces.StorageBackend, a *Archive, mode Mode) (*Summary, error) {
+	if _, err := ParseMode(string(mode)); err != nil {
+		return nil, err
+	}
+
+	var summary Summary
+	err := db.RunInTx(func(tx interfaces.Tx) error {
+		summary = Summary{}
+		existing := &library{}
+		if mode == ModeMerge {
+			var err error
+			if existing, err = loadExisting(tx); err != nil {
+				return err
+			}
+		}
+		if problems := validate(a, existing); len(problems) > 0 {
+			return errors.NewValidationError("archive", strings.Join(problems, "; "))
+		}
+
+		if mode == ModeReplace {
+			deleted, err := deleteAll(tx)
+			if err != nil {
+				return err
+			}
+			summary.Deleted = deleted
+		}
+		for _, user := range a.Users {
+			if err := importUser(tx, user, a.Passwords); err != nil {
+				return err
+			}
+			summary.Users++
+		}
+		for _, resource := range a.Resources {
+			if err := importResource(tx, resource); err != nil {
+				return err
+			}
+			summary.Resources++
+		}
+		for _, rating := range a.Ratings {
+			if err := importRating(tx, rating); err != nil {
+				return err
+			}
+			summary.Ratings++
+		}
+		if mode == ModeMerge {
+			return recountRatings(tx, a)
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.IsValidationError(err) {
+			return nil, err
+		}
+		return nil, errors.NewOperationError("Import", "failed to write the archive", err)
+	}
+	return &summary, nil
+}
+
+// MergePeers returns the peer list to save after importing a: the
+// archived peers added to current, or in place of it for ModeReplace.
+// The list keeps current's Capacity; past it, the peers seen least
+// recently are dropped.
+func MergePeers(current *models.PeerList, a *Archive, mode Mode) *models.PeerList {
+	list := models.NewPeerList(current.Capacity)
+	if mode == ModeMerge {
+		for _, peer := range current.Peers {
+			list.Add(peer)
+		}
+	}
+	for _, peer := range a.Peers {
+		list.Add(peer)
+	}
+	return list
+}
+
+// library is the part of the existing data validation looks at
+type library struct {
+	users     map[models.UserID]string // user ID -> email
+	resources map[models.ContentID]bool
+}
+
+func loadExisting(tx interfaces.Tx) (*library, error) {
+	users, err := tx.Users().GetAll()
+	if err != nil {
+		return nil, err
+	}
+	resources, err := tx.Resources().GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	lib := &library{
+		users:     make(map[models.UserID]string, len(users)),
+		resources: make(map[models.ContentID]bool, len(resources)),
+	}
+	for _, user := range users {
+		lib.users[user.ID] = user.Email
+	}
+	for _, resource := range resources {
+		lib.resources[resource.ID] = true
+	}
+	return lib, nil
+}
+
+// validate lists every broken reference and duplicate in a. existing is
+// the library a is merged into, empty when it is replaced.
+func validate(a *Archive, existing *library) []string {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// Archived users replace existing ones with the same ID, so their
+	// emails are checked against the existing users they do not replace
+	users := make(map[models.UserID]bool)
+	emails := make(map[string]models.UserID)
+	for i, user := range a.Users {
+		switch {
+		case user.User == nil || user.ID == "":
+			report("user %d has no ID", i)
+			continue
+		case users[user.ID]:
+			report("user %s appears twice", user.ID)
+		}
+		users[user.ID] = true
+
+		if owner, taken := emails[user.Email]; taken && owner != user.ID {
+			report("users %s and %s share email %s", owner, user.ID, user.Email)
+		}
+		emails[user.Email] = user.ID
+	}
+	for id, email := range existing.users {
+		if owner, taken := emails[email]; taken && !users[id] {
+			report("user %s has email %s, which belongs to existing user %s", owner, email, id)
+		}
+		users[id] = true
+	}
+
+	resources := make(map[models.ContentID]bool)
+	for id := range existing.resources {
+		resources[id] = true
+	}
+	seenResources := make(map[models.ContentID]bool)
+	for i, resource := range a.Resources {
+		switch {
+		case resource == nil || resource.ID == "":
+			report("resource %d has no ID", i)
+			continue
+		case seenResources[resource.ID]:
+			report("resource %s appears twice", resource.ID)
+		}
+		seenResources[resource.ID] = true
+		resources[resource.ID] = true
+
+		if !users[resource.UploadedBy] {
+			report("resource %s was uploaded by unknown user %q", resource.ID, resource.UploadedBy)
+		}
+	}
+
+	seenRatings := make(map[string]bool)
+	for i, rating := range a.Ratings {
+		switch {
+		case rating == nil || rating.ID == "":
+			report("rating %d has no ID", i)
+			continue
+		case seenRatings[rating.ID]:
+			report("rating %s appears twice", rating.ID)
+		}
+		seenRatings[rating.ID] = true
+
+		// Rating IDs are how the store keeps one rating per user and
+		// resource, so an archive can't choose its own
+		if want := string(rating.ResourceID) + "-" + string(rating.UserID); rating.ID != want {
+			report("rating %s should have ID %s", rating.ID, want)
+		}
+		if !rating.IsValid() {
+			report("rating %s has %v stars; want 1 to 5", rating.ID, rating.Rating)
+		}
+		if !resources[rating.ResourceID] {
+			report("rating %s is for unknown resource %q", rating.ID, rating.ResourceID)
+		}
+		if !users[rating.UserID] {
+			report("rating %s is by unknown user %q", rating.ID, rating.UserID)
+		}
+	}
+
+	for i, peer := range a.Peers {
+		if peer.ID == "" {
+			report("peer %d has no ID", i)
+		}
+	}
+	return problems
+}
+
+// deleteAll removes every user, resource and rating, returning how many
+func deleteAll(tx interfaces.Tx) (int, error) {
+	users, err := tx.Users().GetAll()
+	if err != nil {
+		return 0, err
+	}
+	resources, err := tx.Resources().GetAll()
+	if err != nil {
+		return 0, err
+	}
+	ratings, err := tx.Ratings().GetAll()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, rating := range ratings {
+		if err := tx.Ratings().Delete(rating.ID); err != nil {
+			return 0, err
+		}
+	}
+	for _, resource := range resources {
+		if err := tx.Resources().Delete(resource.ID); err != nil {
+			return 0, err
+		}
+	}
+	for _, user := range users {
+		if err := tx.Users().Delete(user.ID); err != nil {
+			return 0, err
+		}
+	}
+	return len(ratings) + len(resources) + len(users), nil
+}
+
+// importUser creates the user or overwrites the existing one. The
+// archive is never modified; the store gets a copy.
+func importUser(tx interfaces.Tx, archived User, passwords bool) error {
+	user := archived.User.Clone()
+	user.Password = archived.Password
+
+	err := tx.Users().UpdateUser(user.ID, func(stored *models.User) error {
+		password := stored.Password
+		*stored = *user.Clone()
+		if !passwords {
+			stored.Password = password
+		}
+		return nil
+	})
+	if errors.IsNotFound(err) {
+		return tx.Users().Create(user)
+	}
+	return err
+}
+
+// importResource stores the resource or overwrites the existing one
+func importResource(tx interfaces.Tx, archived *models.Resource) error {
+	err := tx.Resources().UpdateResource(archived.ID, func(stored *models.Resource) error {
+		*stored = *archived.Clone()
+		return nil
+	})
+	if errors.IsNotFound(err) {
+		return tx.Resources().Store(archived.Clone())
+	}
+	return err
+}
+
+// recountRatings sets the rating totals of every resource a merge touched
+// from the ratings now stored for it. The archived totals count only the
+// archived ratings, and existing totals miss the merged ones.
+func recountRatings(tx interfaces.Tx, a *Archive) error {
+	touched := make(map[models.ContentID]bool)
+	for _, resource := range a.Resources {
+		touched[resource.ID] = true
+	}
+	for _, rating := range a.Ratings {
+		touched[rating.ResourceID] = true
+	}
+
+	for id := range touched {
+		ratings, err := tx.Ratings().GetByResource(id)
+		if err != nil {
+			return err
+		}
+		var sum float64
+		for _, rating := range ratings {
+			sum += float64(rating.Rating)
+		}
+		average := 0.0
+		if len(ratings) > 0 {
+			average = sum / float64(len(ratings))
+		}
+
+		// Leave a resource whose totals are right at its version
+		stored, err := tx.Resources().Get(id)
+		if err != nil {
+			return err
+		}
+		if stored.TotalRatings == len(ratings) && stored.RatingSum == sum && stored.AverageRating == average {
+			continue
+		}
+		err = tx.Resources().UpdateResource(id, func(r *models.Resource) error {
+			r.TotalRatings = len(ratings)
+			r.RatingSum = sum
+			r.AverageRating = average
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importRating creates the rating or overwrites the existing one
+func importRating(tx interfaces.Tx, archived *models.ResourceRating) error {
+	rating := archived.Clone()
+	stored, err := tx.Ratings().Get(rating.ID)
+	if err == errors.ErrRatingNotFound {
+		return tx.Ratings().Create(rating)
+	}
+	if err != nil {
+		return err
+	}
+	rating.Version = stored.Version
+	return tx.Ratings().Update(rating)
+}
@@ -0,0 +1,406 @@
+// Package archive - Unit tests for library export and import
+package archive
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-library/errors"
+	"p2p-library/interfaces"
+	"p2p-library/models"
+	"p2p-library/store"
+)
+
+// testBackends opens each storage backend fresh for a test
+var testBackends = []struct {
+	name string
+	open func(t *testing.T) interfaces.StorageBackend
+}{
+	{"memory", func(t *testing.T) interfaces.StorageBackend { return store.NewMemoryStore() }},
+	{"bolt", func(t *testing.T) interfaces.StorageBackend {
+		b, err := store.OpenBoltStore(filepath.Join(t.TempDir(), "library.db"))
+		if err != nil {
+			t.Fatalf("OpenBoltStore failed: %v", err)
+		}
+		t.Cleanup(func() { b.Close() })
+		return b
+	}},
+}
+
+func eachBackend(t *testing.T, test func(t *testing.T, open func() interfaces.StorageBackend)) {
+	for _, backend := range testBackends {
+		open := backend.open
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, func() interfaces.StorageBackend { return open(t) })
+		})
+	}
+}
+
+// seedLibrary fills db with two users, a resource by Alice and Bob's
+// rating of it
+func seedLibrary(t *testing.T, db interfaces.StorageBackend) (*models.Resource, *models.ResourceRating) {
+	t.Helper()
+
+	alice := models.NewUser("user-alice", "alice", "alice@test.com")
+	alice.Password = "alice-secret"
+	alice.Reputation = 42
+	db.Users().Create(alice)
+	db.Users().Create(models.NewUser("user-bob", "bob", "bob@test.com"))
+
+	notes := models.NewResource("notes.pdf", 1024, "user-alice")
+	notes.Subject = "Biology"
+	notes.Tags = []string{"cells"}
+	rating := models.NewResourceRating(notes.ID, "user-bob", 4, "clear")
+	notes.AddRating(rating.Rating)
+	if err := db.Resources().Store(notes); err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	if err := db.Ratings().Create(rating); err != nil {
+		t.Fatalf("CreateRating failed: %v", err)
+	}
+	return notes, rating
+}
+
+// roundTrip writes a and reads it back, as export and import do
+func roundTrip(t *testing.T, a *Archive) *Archive {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := Write(&buf, a); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	return got
+}
+
+// ============================================================================
+// TESTS
+// ============================================================================
+
+func TestExportImportRoundTrip(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() interfaces.StorageBackend) {
+		source := open()
+		notes, rating := seedLibrary(t, source)
+		peers := []models.Peer{{ID: "peer-alice-001", UserID: "user-alice", IPAddress: "10.0.0.1", Port: 9000}}
+
+		a, err := Export(source, peers, ExportOptions{Passwords: true})
+		if err != nil {
+			t.Fatalf("Export failed: %v", err)
+		}
+		target := open()
+		summary, err := Import(target, roundTrip(t, a), ModeMerge)
+		if err != nil {
+			t.Fatalf("Import failed: %v", err)
+		}
+		if summary.Users != 2 || summary.Resources != 1 || summary.Ratings != 1 {
+			t.Errorf("Summary = %+v; want 2 users, 1 resource, 1 rating", summary)
+		}
+
+		alice, err := target.Users().Get("user-alice")
+		if err != nil || alice.Reputation != 42 || alice.Password != "alice-secret" {
+			t.Errorf("Imported Alice = %+v, %v; want reputation 42 and her password", alice, err)
+		}
+		got, err := target.Resources().Get(notes.ID)
+		if err != nil || got.Subject != "Biology" || got.UploadedBy != "user-alice" {
+			t.Errorf("Imported resource = %+v, %v; want the Biology notes by Alice", got, err)
+		}
+		if got, _ := target.Ratings().Get(rating.ID); got == nil || got.Rating != 4 || got.Comment != "clear" {
+			t.Errorf("Imported rating = %+v; want Bob's 4 stars", got)
+		}
+		if list := MergePeers(models.NewPeerList(0), a, ModeMerge); list.FindByID("peer-alice-001") == nil {
+			t.Error("Archived peer is missing from the merged peer list")
+		}
+	})
+}
+
+func TestExportLeavesPasswordsOut(t *testing.T) {
+	db := store.NewMemoryStore()
+	seedLibrary(t, db)
+
+	a, err := Export(db, nil, ExportOptions{})
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	var buf bytes.Buffer
+	Write(&buf, a)
+	if strings.Contains(buf.String(), "alice-secret") {
+		t.Error("Archive holds a password although none were asked for")
+	}
+	if a.Passwords {
+		t.Error("Archive claims to hold passwords")
+	}
+}
+
+func TestReadRejectsOtherFormatsAndVersions(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not json", "users: alice"},
+		{"other format", `{"format": "something-else", "version": 1}`},
+		{"newer version", `{"format": "p2p-library-archive", "version": 2}`},
+		{"no version", `{"format": "p2p-library-archive"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Read(strings.NewReader(tt.data)); err == nil {
+				t.Error("Read accepted the file")
+			}
+		})
+	}
+}
+
+func TestImportRejectsBrokenReferences(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() interfaces.StorageBackend) {
+		db := open()
+		notes := models.NewResource("notes.pdf", 1024, "user-ghost")
+		overrated := models.NewResourceRating(notes.ID, "user-alice", 9, "")
+		renamed := models.NewResourceRating(notes.ID, "user-bob", 4, "")
+		renamed.ID = "rating-of-my-choosing"
+		a := &Archive{
+			Format:  Format,
+			Version: CurrentVersion,
+			Users: []User{
+				{User: models.NewUser("user-alice", "alice", "shared@test.com")},
+				{User: models.NewUser("user-bob", "bob", "shared@test.com")},
+			},
+			Resources: []*models.Resource{notes},
+			Ratings: []*models.ResourceRating{
+				models.NewResourceRating("missing-resource", "user-alice", 4, ""),
+				overrated,
+				renamed,
+			},
+		}
+
+		_, err := Import(db, a, ModeMerge)
+		if !errors.IsValidationError(err) {
+			t.Fatalf("Import error = %v; want a validation error", err)
+		}
+		for _, problem := range []string{"unknown user \"user-ghost\"", "unknown resource \"missing-resource\"", "share email",
+			"9 stars", "rating-of-my-choosing should have ID"} {
+			if !strings.Contains(err.Error(), problem) {
+				t.Errorf("Error %q does not mention %s", err, problem)
+			}
+		}
+		if users, _ := db.Users().GetAll(); len(users) != 0 {
+			t.Errorf("Import wrote %d users from an invalid archive", len(users))
+		}
+	})
+}
+
+func TestMergeResolvesReferencesToExistingData(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() interfaces.StorageBackend) {
+		db := open()
+		notes, _ := seedLibrary(t, db)
+
+		// The archive only holds a new rating of an existing resource by
+		// an existing user
+		a := &Archive{
+			Format:  Format,
+			Version: CurrentVersion,
+			Ratings: []*models.ResourceRating{models.NewResourceRating(notes.ID, "user-alice", 5, "")},
+		}
+		if _, err := Import(db, a, ModeMerge); err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+		if ratings, _ := db.Ratings().GetByResource(notes.ID); len(ratings) != 2 {
+			t.Errorf("Resource has %d ratings; want the existing one and the merged one", len(ratings))
+		}
+
+		// Replacing would leave the rating pointing at nothing
+		if _, err := Import(db, a, ModeReplace); !errors.IsValidationError(err) {
+			t.Errorf("Replace error = %v; want a validation error", err)
+		}
+	})
+}
+
+func TestMergeOverwritesMatchingRecords(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() interfaces.StorageBackend) {
+		db := open()
+		notes, _ := seedLibrary(t, db)
+
+		alice, _ := db.Users().Get("user-alice")
+		alice.Reputation = 7
+		changed := notes.Clone()
+		changed.Title = "Cell Biology"
+		a := &Archive{
+			Format:    Format,
+			Version:   CurrentVersion,
+			Users:     []User{{User: alice}},
+			Resources: []*models.Resource{changed},
+		}
+		if _, err := Import(db, a, ModeMerge); err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+
+		got, _ := db.Users().Get("user-alice")
+		if got.Reputation != 7 || got.Password != "alice-secret" {
+			t.Errorf("Alice = reputation %d, password %q; want 7 and her existing password", got.Reputation, got.Password)
+		}
+		if got, _ := db.Resources().Get(notes.ID); got.Title != "Cell Biology" || got.Version != 2 {
+			t.Errorf("Resource = %q version %d; want the archived title at version 2", got.Title, got.Version)
+		}
+		if _, err := db.Users().Get("user-bob"); err != nil {
+			t.Errorf("Bob, who is not in the archive, was lost: %v", err)
+		}
+	})
+}
+
+func TestMergeRecountsRatingTotals(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() interfaces.StorageBackend) {
+		db := open()
+		notes, _ := seedLibrary(t, db)
+
+		// A merged rating of an existing resource joins Bob's
+		a := &Archive{
+			Format:  Format,
+			Version: CurrentVersion,
+			Ratings: []*models.ResourceRating{models.NewResourceRating(notes.ID, "user-alice", 5, "")},
+		}
+		if _, err := Import(db, a, ModeMerge); err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+		if got, _ := db.Resources().Get(notes.ID); got.TotalRatings != 2 || got.AverageRating != 4.5 {
+			t.Errorf("Resource has %d ratings averaging %.2f; want 2 averaging 4.50", got.TotalRatings, got.AverageRating)
+		}
+
+		// A merged resource brings totals that count only its archive
+		stale := notes.Clone()
+		stale.TotalRatings, stale.RatingSum, stale.AverageRating = 1, 1, 1
+		a = &Archive{Format: Format, Version: CurrentVersion, Resources: []*models.Resource{stale}}
+		if _, err := Import(db, a, ModeMerge); err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+		if got, _ := db.Resources().Get(notes.ID); got.TotalRatings != 2 || got.RatingSum != 9 || got.AverageRating != 4.5 {
+			t.Errorf("Resource has %d ratings summing to %.0f averaging %.2f; want the stored 2, 9 and 4.50",
+				got.TotalRatings, got.RatingSum, got.AverageRating)
+		}
+	})
+}
+
+func TestReplaceDeletesExistingData(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() interfaces.StorageBackend) {
+		db := open()
+		notes, _ := seedLibrary(t, db)
+
+		a := &Archive{
+			Format:  Format,
+			Version: CurrentVersion,
+			Users:   []User{{User: models.NewUser("user-carol", "carol", "carol@test.com")}},
+		}
+		summary, err := Import(db, a, ModeReplace)
+		if err != nil {
+			t.Fatalf("Replace failed: %v", err)
+		}
+		if summary.Deleted != 4 {
+			t.Errorf("Deleted %d records; want 2 users, 1 resource and 1 rating", summary.Deleted)
+		}
+
+		users, _ := db.Users().GetAll()
+		if len(users) != 1 || users[0].ID != "user-carol" {
+			t.Errorf("Users after replace = %d; want only Carol", len(users))
+		}
+		if _, err := db.Resources().Get(notes.ID); err == nil {
+			t.Error("Existing resource survived the replace")
+		}
+		if ratings, _ := db.Ratings().GetByResource(notes.ID); len(ratings) != 0 {
+			t.Errorf("%d existing ratings survived the replace", len(ratings))
+		}
+	})
+}
+
+func TestMergePeers(t *testing.T) {
+	current := models.NewPeerList(10)
+	current.Add(models.Peer{ID: "peer-old"})
+	current.Add(models.Peer{ID: "peer-both", Port: 1})
+	a := &Archive{Peers: []models.Peer{{ID: "peer-both", Port: 2}, {ID: "peer-new"}}}
+
+	merged := MergePeers(current, a, ModeMerge)
+	if merged.Count() != 3 || merged.FindByID("peer-both").Port != 2 {
+		t.Errorf("Merged list has %d peers; want 3 with the archived address", merged.Count())
+	}
+	if current.Count() != 2 {
+		t.Error("MergePeers changed the current list")
+	}
+
+	replaced := MergePeers(current, a, ModeReplace)
+	if replaced.Count() != 2 || replaced.FindByID("peer-old") != nil {
+		t.Errorf("Replaced list has %d peers; want only the archived ones", replaced.Count())
+	}
+	if replaced.Capacity != 10 {
+		t.Errorf("Capacity = %d; want the current list's 10", replaced.Capacity)
+	}
+}
+
+func TestExportLeavesOutOrphans(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() interfaces.StorageBackend) {
+		source := open()
+		notes, _ := seedLibrary(t, source)
+
+		// A resource whose uploader was deleted, with a rating, and a
+		// rating of a resource that was deleted
+		orphan := models.NewResource("orphan.pdf", 2048, "user-ghost")
+		source.Resources().Store(orphan)
+		source.Ratings().Create(models.NewResourceRating(orphan.ID, "user-bob", 3, ""))
+		source.Ratings().Create(models.NewResourceRating("deleted-resource", "user-alice", 2, ""))
+
+		a, err := Export(source, nil, ExportOptions{})
+		if err != nil {
+			t.Fatalf("Export failed: %v", err)
+		}
+		if len(a.Resources) != 1 || a.Resources[0].ID != notes.ID || len(a.Ratings) != 1 {
+			t.Errorf("Archive has %d resources and %d ratings; want only the notes and Bob's rating", len(a.Resources), len(a.Ratings))
+		}
+		if a.Skipped != 3 {
+			t.Errorf("Skipped = %d; want the orphan resource and both orphan ratings", a.Skipped)
+		}
+
+		if _, err := Import(open(), roundTrip(t, a), ModeReplace); err != nil {
+			t.Errorf("Import of the export failed: %v", err)
+		}
+	})
+}
+
+func TestReplaceDeletesOrphanedRatings(t *testing.T) {
+	eachBackend(t, func(t *testing.T, open func() interfaces.StorageBackend) {
+		db := open()
+		db.Ratings().Create(models.NewResourceRating("deleted-resource", "deleted-user", 2, ""))
+
+		summary, err := Import(db, &Archive{Format: Format, Version: CurrentVersion}, ModeReplace)
+		if err != nil {
+			t.Fatalf("Replace failed: %v", err)
+		}
+		if summary.Deleted != 1 {
+			t.Errorf("Deleted %d records; want the orphaned rating", summary.Deleted)
+		}
+		if ratings, _ := db.Ratings().GetAll(); len(ratings) != 0 {
+			t.Errorf("%d orphaned ratings survived the replace", len(ratings))
+		}
+	})
+}
+
+func TestMergePeersKeepsCapacity(t *testing.T) {
+	now := models.TimeNow()
+	current := models.NewPeerList(3)
+	current.Add(models.Peer{ID: "peer-stale", LastPingAt: now.Add(-time.Hour)})
+	current.Add(models.Peer{ID: "peer-recent", LastPingAt: now})
+	a := &Archive{Peers: []models.Peer{
+		{ID: "peer-a", LastPingAt: now.Add(-time.Minute)},
+		{ID: "peer-b", LastPingAt: now.Add(-2 * time.Minute)},
+	}}
+
+	merged := MergePeers(current, a, ModeMerge)
+	if merged.Count() != 3 {
+		t.Fatalf("Merged list has %d peers; want its capacity of 3", merged.Count())
+	}
+	if merged.FindByID("peer-stale") != nil {
+		t.Error("The least recently seen peer was kept over capacity")
+	}
+}
@@ -0,0 +1,218 @@
+// P2P Academic Library - Command line subcommands
+//
+// Run without arguments the binary starts the server. The subcommands
+// here work on the same data directory and storage backend, selected by
+// the same environment variables. They take the data directory lock (see
+// lock.go), so they refuse to run while the server is up:
+//
+//	p2p-library export [-passwords] FILE
+//	p2p-library import [-mode merge|replace] FILE
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"p2p-library/archive"
+	"p2p-library/interfaces"
+	"p2p-library/models"
+)
+
+// runCommand runs the subcommand name and returns the exit status
+func runCommand(dataDir, name string, args []string) int {
+	var command func(dataDir string, args []string) error
+	switch name {
+	case "export":
+		command = exportCommand
+	case "import":
+		command = importCommand
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q; want export or import\n", name)
+		return 2
+	}
+
+	lock, err := lockDataDir(dataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", name, err)
+		return 1
+	}
+	defer lock.Close()
+
+	err = command(dataDir, args)
+
+	if err == flag.ErrHelp {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// exportCommand writes the whole library to an archive file
+func exportCommand(dataDir string, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	passwords := flags.Bool("passwords", false, "include user passwords in the archive")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: p2p-library export [-passwords] FILE")
+		flags.PrintDefaults()
+	}
+	path, err := parseFileArg(flags, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := openArchiveStorage(dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	peers, err := loadPeerList(dataDir)
+	if err != nil {
+		return err
+	}
+	a, err := archive.Export(db, peers.Peers, archive.ExportOptions{Passwords: *passwords})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := archive.Write(file, a); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("📦 Exported %d users, %d resources, %d ratings and %d peers to %s\n",
+		len(a.Users), len(a.Resources), len(a.Ratings), len(a.Peers), path)
+	if a.Skipped > 0 {
+		fmt.Printf("⚠️  Left out %d resources and ratings whose user or resource no longer exists\n", a.Skipped)
+	}
+	return nil
+}
+
+// importCommand loads an archive file into the library
+func importCommand(dataDir string, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	modeName := flags.String("mode", string(archive.ModeMerge),
+		"merge: add to the existing data, replacing records with the same ID; replace: delete the existing data first")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: p2p-library import [-mode merge|replace] FILE")
+		flags.PrintDefaults()
+	}
+	path, err := parseFileArg(flags, args)
+	if err != nil {
+		return err
+	}
+	mode, err := archive.ParseMode(*modeName)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	a, err := archive.Read(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	db, err := openArchiveStorage(dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	summary, err := archive.Import(db, a, mode)
+	if err != nil {
+		return err
+	}
+
+	peers, err := loadPeerList(dataDir)
+	if err != nil {
+		return err
+	}
+	peers = archive.MergePeers(peers, a, mode)
+	if err := savePeerList(dataDir, peers); err != nil {
+		return err
+	}
+
+	if summary.Deleted > 0 {
+		fmt.Printf("🗑️  Deleted %d existing records\n", summary.Deleted)
+	}
+	fmt.Printf("📥 Imported %d users, %d resources, %d ratings and %d peers from %s\n",
+		summary.Users, summary.Resources, summary.Ratings, len(a.Peers), path)
+	return nil
+}
+
+// parseFileArg parses flags and returns the single file argument
+func parseFileArg(flags *flag.FlagSet, args []string) (string, error) {
+	if err := flags.Parse(args); err != nil {
+		return "", err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return "", flag.ErrHelp
+	}
+	return flags.Arg(0), nil
+}
+
+// openArchiveStorage opens the configured backend, refusing the memory
+// backend, which has nothing to export and would forget an import
+func openArchiveStorage(dataDir string) (interfaces.StorageBackend, error) {
+	if backend := os.Getenv("P2P_STORE"); backend == "" || backend == "memory" {
+		return nil, fmt.Errorf("P2P_STORE=memory keeps no data between runs; set P2P_STORE to wal or bolt")
+	}
+	return openStorage(dataDir)
+}
+
+// peerListPath is where the node keeps its known peers (see startPeerNode)
+func peerListPath(dataDir string) string {
+	return filepath.Join(dataDir, "peers.json")
+}
+
+// loadPeerList reads the node's saved peer list. A missing file is an
+// empty list.
+func loadPeerList(dataDir string) (*models.PeerList, error) {
+	list := models.NewPeerList(0)
+	data, err := os.ReadFile(peerListPath(dataDir))
+	if os.IsNotExist(err) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, fmt.Errorf("corrupt peer list: %w", err)
+	}
+	return list, nil
+}
+
+// savePeerList replaces the node's saved peer list, as Node.SavePeers does
+func savePeerList(dataDir string, list *models.PeerList) error {
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return err
+	}
+
+	path := peerListPath(dataDir)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
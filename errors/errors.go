@@ -9,6 +9,7 @@
 package errors
 
 import (
+	stderrors "errors"
 	"fmt"
 )
 
@@ -28,6 +29,8 @@ var (
 	
 	ErrAlreadyExists     = fmt.Errorf("resource already exists")
 	ErrUserAlreadyExists = fmt.Errorf("user already exists")
+	ErrEmailTaken        = fmt.Errorf("email is already used by another user")
+	ErrAlreadyRated      = fmt.Errorf("user has already rated this resource")
 	
 	ErrInvalidInput      = fmt.Errorf("invalid input")
 	ErrInvalidRating     = fmt.Errorf("rating must be between 1 and 5")
@@ -39,6 +42,21 @@ var (
 	
 	ErrConnectionFailed  = fmt.Errorf("peer connection failed")
 	ErrTransferFailed    = fmt.Errorf("file transfer failed")
+	ErrHandshakeFailed   = fmt.Errorf("peer handshake failed")
+	ErrVersionMismatch   = fmt.Errorf("peer protocol version mismatch")
+	ErrPeerNotConnected  = fmt.Errorf("peer not connected")
+	ErrRequestTimeout    = fmt.Errorf("peer request timed out")
+	ErrNodeClosed        = fmt.Errorf("peer node is closed")
+	ErrChecksumMismatch  = fmt.Errorf("chunk checksum mismatch")
+	ErrNoPeersAvailable  = fmt.Errorf("no peers available for resource")
+	ErrContentMismatch   = fmt.Errorf("content does not match its content ID")
+	ErrInvalidProof      = fmt.Errorf("chunk proof does not match content ID")
+	ErrInvalidSignature  = fmt.Errorf("signature does not match the signing peer")
+	ErrChoked            = fmt.Errorf("peer is choked, no upload slot free")
+	ErrInvalidReceipt    = fmt.Errorf("transfer receipt is missing or invalid")
+	ErrReceiptReplayed   = fmt.Errorf("transfer receipt was already used")
+	ErrSelfReceipt       = fmt.Errorf("transfer receipt credits its own signer")
+	ErrUnboundUser       = fmt.Errorf("transfer names a user not bound to its peer")
 )
 
 // ============================================================================
@@ -150,6 +168,35 @@ func NewReputationError(userID string, required, current int, action string) Rep
 	}
 }
 
+// ============================================================================
+// CONFLICT ERROR
+// ============================================================================
+
+// ConflictError reports an update based on a version of a record that is
+// no longer the stored one: someone else changed it since it was read
+type ConflictError struct {
+	ResourceType string // Type of record (user, resource, rating)
+	Identifier   string // The ID of the record
+	Version      uint64 // The version the update was based on
+	Current      uint64 // The version that is stored
+}
+
+// Error implements the error interface
+func (e ConflictError) Error() string {
+	return fmt.Sprintf("%s '%s' was changed concurrently: update is based on version %d, current version is %d",
+		e.ResourceType, e.Identifier, e.Version, e.Current)
+}
+
+// NewConflictError creates a new ConflictError
+func NewConflictError(resourceType, identifier string, version, current uint64) ConflictError {
+	return ConflictError{
+		ResourceType: resourceType,
+		Identifier:   identifier,
+		Version:      version,
+		Current:      current,
+	}
+}
+
 // ============================================================================
 // ERROR HELPER FUNCTIONS
 // ============================================================================
@@ -177,6 +224,17 @@ func IsReputationError(err error) bool {
 	return ok
 }
 
+// IsConflict checks if the error, or any error it wraps, is a ConflictError
+func IsConflict(err error) bool {
+	var conflict ConflictError
+	return stderrors.As(err, &conflict)
+}
+
+// Is reports whether err, or any error it wraps, is target
+func Is(err, target error) bool {
+	return stderrors.Is(err, target)
+}
+
 // WrapError wraps an error with additional context
 func WrapError(operation string, err error) error {
 	if err == nil {
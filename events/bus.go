@@ -0,0 +1,177 @@
+// Package events - Change events published by the storage backends
+//
+// Every successful write to a storage backend publishes an Event on the
+// backend's Bus: which kind of record changed, how, and the record as it
+// was stored. Dashboards, search reindexing and notifications subscribe
+// to the bus instead of polling the store.
+//
+// Delivery is buffered per subscriber and never blocks the writer. A
+// subscriber that falls so far behind that its buffer fills up misses
+// events; each Event carries a sequence number, so a gap in Seq tells it
+// to reload what it keeps from the store.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"p2p-library/models"
+)
+
+// ============================================================================
+// EVENTS
+// ============================================================================
+
+// Entity is the kind of record an event is about
+type Entity string
+
+const (
+	EntityResource Entity = "resource"
+	EntityUser     Entity = "user"
+	EntityRating   Entity = "rating"
+)
+
+// Op is what happened to the record
+type Op string
+
+const (
+	OpCreate Op = "create"
+	OpUpdate Op = "update"
+	OpDelete Op = "delete"
+)
+
+// Event describes one committed change. The field for Entity holds a copy
+// of the record as stored; it is nil for deletes, which only carry ID.
+// All subscribers get the same copy, so treat it as read-only.
+type Event struct {
+	Seq    uint64    `json:"seq"` // Position on the bus, counting from 1
+	Entity Entity    `json:"entity"`
+	Op     Op        `json:"op"`
+	ID     string    `json:"id"`
+	At     time.Time `json:"at"` // When the change was published
+
+	Resource *models.Resource       `json:"resource,omitempty"`
+	User     *models.User           `json:"user,omitempty"` // Password is always cleared
+	Rating   *models.ResourceRating `json:"rating,omitempty"`
+}
+
+// ResourceEvent returns the event for a change to resource. For a delete
+// pass only the ID.
+func ResourceEvent(op Op, id models.ContentID, resource *models.Resource) Event {
+	e := Event{Entity: EntityResource, Op: op, ID: string(id)}
+	if resource != nil {
+		e.Resource = resource.Clone()
+	}
+	return e
+}
+
+// UserEvent returns the event for a change to user, without its password
+func UserEvent(op Op, id models.UserID, user *models.User) Event {
+	e := Event{Entity: EntityUser, Op: op, ID: string(id)}
+	if user != nil {
+		e.User = user.Clone()
+		e.User.Password = ""
+	}
+	return e
+}
+
+// RatingEvent returns the event for a change to rating
+func RatingEvent(op Op, id string, rating *models.ResourceRating) Event {
+	e := Event{Entity: EntityRating, Op: op, ID: id}
+	if rating != nil {
+		e.Rating = rating.Clone()
+	}
+	return e
+}
+
+// ============================================================================
+// BUS
+// ============================================================================
+
+// DefaultBuffer is the subscription buffer used when Subscribe is given
+// a size below 1
+const DefaultBuffer = 256
+
+// Bus delivers events to its subscribers in the order they are published
+type Bus struct {
+	mu   sync.Mutex
+	seq  uint64
+	subs map[*Subscription]bool
+}
+
+// NewBus creates a bus with no subscribers
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]bool)}
+}
+
+// Subscription receives the events published after it was created
+type Subscription struct {
+	c       chan Event
+	dropped uint64 // guarded by the bus mutex
+	bus     *Bus
+}
+
+// Events returns the channel events are delivered on. It is closed by
+// Unsubscribe.
+func (s *Subscription) Events() <-chan Event {
+	return s.c
+}
+
+// Dropped returns how many events were not delivered because the buffer
+// was full
+func (s *Subscription) Dropped() uint64 {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	return s.dropped
+}
+
+// Subscribe adds a subscriber whose channel buffers up to buffer events
+func (b *Bus) Subscribe(buffer int) *Subscription {
+	if buffer < 1 {
+		buffer = DefaultBuffer
+	}
+	s := &Subscription{c: make(chan Event, buffer), bus: b}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[s] = true
+	return s
+}
+
+// Unsubscribe removes a subscriber and closes its channel. Events still
+// in the buffer can be drained after. Unsubscribing twice is harmless.
+func (b *Bus) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[s] {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+// HasSubscribers reports whether anyone is listening, so publishers can
+// skip building events no one will get
+func (b *Bus) HasSubscribers() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs) > 0
+}
+
+// Publish numbers an event and hands it to every subscriber that has room
+// for it. It never waits: a subscriber with a full buffer misses the
+// event and its Dropped count goes up.
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e.Seq = b.seq
+	e.At = time.Now()
+	for s := range b.subs {
+		select {
+		case s.c <- e:
+		default:
+			s.dropped++
+		}
+	}
+}
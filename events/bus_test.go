@@ -0,0 +1,159 @@
+// Package events - Unit tests for the event bus
+package events
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p-library/models"
+)
+
+// receive takes the next event off s, failing if none arrives
+func receive(t *testing.T, s *Subscription) Event {
+	t.Helper()
+	select {
+	case e := <-s.Events():
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("No event delivered")
+		return Event{}
+	}
+}
+
+// ============================================================================
+// TESTS
+// ============================================================================
+
+func TestEventsArriveInPublishOrder(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe(10)
+
+	for i := 1; i <= 5; i++ {
+		bus.Publish(ResourceEvent(OpUpdate, models.ContentID(fmt.Sprintf("res-%d", i)), nil))
+	}
+	for i := 1; i <= 5; i++ {
+		e := receive(t, sub)
+		if e.Seq != uint64(i) || e.ID != fmt.Sprintf("res-%d", i) {
+			t.Errorf("Event %d = seq %d %q; want seq %d res-%d", i, e.Seq, e.ID, i, i)
+		}
+	}
+}
+
+func TestEverySubscriberGetsEveryEvent(t *testing.T) {
+	bus := NewBus()
+	first, second := bus.Subscribe(10), bus.Subscribe(10)
+
+	bus.Publish(UserEvent(OpCreate, "user-alice", models.NewUser("user-alice", "alice", "alice@test.com")))
+	for _, sub := range []*Subscription{first, second} {
+		if e := receive(t, sub); e.Entity != EntityUser || e.Op != OpCreate || e.ID != "user-alice" {
+			t.Errorf("Event = %s %s %s; want user create user-alice", e.Entity, e.Op, e.ID)
+		}
+	}
+}
+
+func TestLateSubscriberOnlySeesLaterEvents(t *testing.T) {
+	bus := NewBus()
+	bus.Publish(RatingEvent(OpDelete, "rating-1", nil))
+
+	sub := bus.Subscribe(10)
+	bus.Publish(RatingEvent(OpDelete, "rating-2", nil))
+	if e := receive(t, sub); e.ID != "rating-2" || e.Seq != 2 {
+		t.Errorf("First event = %q seq %d; want rating-2 seq 2", e.ID, e.Seq)
+	}
+}
+
+func TestUnsubscribeClosesTheChannel(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe(10)
+	bus.Publish(RatingEvent(OpDelete, "rating-1", nil))
+	bus.Unsubscribe(sub)
+	bus.Unsubscribe(sub)
+	bus.Publish(RatingEvent(OpDelete, "rating-2", nil))
+
+	// The buffered event can still be drained
+	if e, ok := <-sub.Events(); !ok || e.ID != "rating-1" {
+		t.Errorf("Drained %q, %v; want rating-1", e.ID, ok)
+	}
+	if e, ok := <-sub.Events(); ok {
+		t.Errorf("Received %q after unsubscribing", e.ID)
+	}
+	if bus.HasSubscribers() {
+		t.Error("HasSubscribers = true after the only subscriber left")
+	}
+}
+
+func TestSlowSubscriberDoesNotBlockPublish(t *testing.T) {
+	bus := NewBus()
+	slow := bus.Subscribe(2)
+	fast := bus.Subscribe(10)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			bus.Publish(ResourceEvent(OpDelete, models.ContentID(fmt.Sprintf("res-%d", i)), nil))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a full subscriber")
+	}
+
+	if got := slow.Dropped(); got != 3 {
+		t.Errorf("Slow subscriber dropped %d events; want 3", got)
+	}
+	if got := fast.Dropped(); got != 0 {
+		t.Errorf("Fast subscriber dropped %d events; want 0", got)
+	}
+	// What the slow subscriber did get is the start, in order
+	for i := 1; i <= 2; i++ {
+		if e := receive(t, slow); e.Seq != uint64(i) {
+			t.Errorf("Slow subscriber event seq = %d; want %d", e.Seq, i)
+		}
+	}
+}
+
+func TestConcurrentPublishersKeepSeqOrder(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe(1000)
+
+	var wg sync.WaitGroup
+	for p := 0; p < 10; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				bus.Publish(RatingEvent(OpDelete, "rating", nil))
+			}
+		}()
+	}
+	wg.Wait()
+	bus.Unsubscribe(sub)
+
+	var last uint64
+	for e := range sub.Events() {
+		if e.Seq != last+1 {
+			t.Fatalf("Event seq %d follows %d", e.Seq, last)
+		}
+		last = e.Seq
+	}
+	if last != 1000 {
+		t.Errorf("Received %d events; want 1000", last)
+	}
+}
+
+func TestUserEventHasNoPassword(t *testing.T) {
+	user := models.NewUser("user-alice", "alice", "alice@test.com")
+	user.Password = "secret"
+
+	e := UserEvent(OpCreate, user.ID, user)
+	if e.User.Password != "" {
+		t.Error("User event carries the password")
+	}
+	if user.Password != "secret" {
+		t.Error("UserEvent cleared the caller's password")
+	}
+}
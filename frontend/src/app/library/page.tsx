@@ -57,7 +57,7 @@ export default function LibraryPage() {
 
     const handleRate = async (rating: number, comment: string) => {
         if (ratingTarget) {
-            try { await api.rateResource(ratingTarget.id, rating, comment); }
+            try { await api.rateResource(ratingTarget.id, rating, 'demo-user', comment); }
             catch { /* still close */ }
         }
     };
@@ -54,7 +54,7 @@ export default function SearchPage() {
 
     const handleRate = async (rating: number, comment: string) => {
         if (ratingTarget) {
-            try { await api.rateResource(ratingTarget.id, rating, comment); }
+            try { await api.rateResource(ratingTarget.id, rating, 'demo-user', comment); }
             catch { /* still close */ }
         }
     };
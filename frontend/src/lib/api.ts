@@ -73,9 +73,10 @@ export async function downloadResource(id: string, userId: string) {
     });
 }
 
-export async function rateResource(id: string, rating: number, comment = '') {
+export async function rateResource(id: string, rating: number, userId: string, comment = '') {
     return fetchJSON<{ resource_id: string; new_rating: number }>(`/resources/${id}/rate`, {
         method: 'POST',
+        headers: { 'X-User-ID': userId },
         body: JSON.stringify({ rating, comment }),
     });
 }
@@ -6,4 +6,7 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/mux v1.8.1
 	github.com/rs/cors v1.10.1
+	go.etcd.io/bbolt v1.3.10
 )
+
+require golang.org/x/sys v0.16.0 // indirect
@@ -9,11 +9,15 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	
+	"p2p-library/errors"
+	"p2p-library/interfaces"
 	"p2p-library/models"
 	"p2p-library/services"
 )
@@ -24,6 +28,7 @@ type APIHandler struct {
 	libraryService    *services.LibraryService
 	reputationService *services.ReputationService
 	searchService     *services.SearchService
+	peers             interfaces.PeerManager
 }
 
 // NewAPIHandler creates a new API handler
@@ -41,6 +46,13 @@ func NewAPIHandler(
 	}
 }
 
+// SetPeerManager attaches the peer node whose live view of the network
+// is reported by /api/peers. Without one, peers are listed with the
+// status stored on their users.
+func (h *APIHandler) SetPeerManager(peers interfaces.PeerManager) {
+	h.peers = peers
+}
+
 // Response types for JSON marshaling
 type APIResponse struct {
 	Success bool        `json:"success"`
@@ -61,6 +73,21 @@ type CreateResourceRequest struct {
 	Subject     string   `json:"subject"`
 	Tags        []string `json:"tags"`
 	Size        int64    `json:"size"`
+	Content     []byte   `json:"content,omitempty"` // base64 file bytes (optional)
+}
+
+// UpdateUserRequest replaces a user's editable details
+type UpdateUserRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// UpdateResourceRequest replaces a resource's editable details
+type UpdateResourceRequest struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Subject     string   `json:"subject"`
+	Tags        []string `json:"tags"`
 }
 
 type RateResourceRequest struct {
@@ -88,6 +115,50 @@ func writeError(w http.ResponseWriter, status int, msg string) {
 	writeJSON(w, status, APIResponse{Success: false, Error: msg})
 }
 
+// ============================================================================
+// VERSIONS AND ETAGS
+// ============================================================================
+// Users and resources are served with their store Version as a strong
+// ETag. A PUT may send it back in If-Match: if the record changed in the
+// meantime the PUT fails with 412 Precondition Failed instead of
+// overwriting the other change.
+
+// etag formats a record version as an ETag
+func etag(version uint64) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+// ifMatch reports whether the request's If-Match header accepts a record
+// at version. A request without the header accepts any version.
+func ifMatch(r *http.Request, version uint64) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeUpdateError reports a failed update. A version conflict is 412 if
+// the client asked for a version with If-Match, and 409 otherwise, as is
+// an email another user already has.
+func writeUpdateError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.IsConflict(err) && r.Header.Get("If-Match") != "":
+		status = http.StatusPreconditionFailed
+	case errors.IsConflict(err), errors.Is(err, errors.ErrEmailTaken):
+		status = http.StatusConflict
+	case errors.Is(err, errors.ErrUserNotFound), errors.Is(err, errors.ErrResourceNotFound):
+		status = http.StatusNotFound
+	}
+	writeError(w, status, err.Error())
+}
+
 // ============================================================================
 // AUTH ENDPOINTS
 // ============================================================================
@@ -133,6 +204,10 @@ func (h *APIHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	user, err := h.userService.CreateUser(req.Username, req.Email, req.Password)
+	if errors.Is(err, errors.ErrEmailTaken) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -152,6 +227,47 @@ func (h *APIHandler) GetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	w.Header().Set("ETag", etag(user.Version))
+	writeSuccess(w, user)
+}
+
+// UpdateUser handles PUT /api/users/{id}, honouring If-Match. Users may
+// only change their own details.
+func (h *APIHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	id := models.UserID(mux.Vars(r)["id"])
+	switch models.UserID(r.Header.Get("X-User-ID")) {
+	case "":
+		writeError(w, http.StatusUnauthorized, "User ID required")
+		return
+	case id:
+	default:
+		writeError(w, http.StatusForbidden, errors.ErrForbidden.Error())
+		return
+	}
+	
+	var req UpdateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	
+	user, err := h.userService.GetUser(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if !ifMatch(r, user.Version) {
+		w.Header().Set("ETag", etag(user.Version))
+		writeError(w, http.StatusPreconditionFailed, "user was changed since it was read")
+		return
+	}
+	
+	if err := h.userService.UpdateDetails(user, req.Username, req.Email); err != nil {
+		writeUpdateError(w, r, err)
+		return
+	}
+	
+	w.Header().Set("ETag", etag(user.Version))
 	writeSuccess(w, user)
 }
 
@@ -208,7 +324,15 @@ func (h *APIHandler) CreateResource(w http.ResponseWriter, r *http.Request) {
 	resource.Subject = req.Subject
 	resource.Tags = req.Tags
 	
-	if err := h.libraryService.Upload(resource); err != nil {
+	// Publish the file bytes when they are included in the request
+	// Identical content returns the resource that already holds it
+	var err error
+	if len(req.Content) > 0 {
+		resource, err = h.libraryService.UploadContent(resource, req.Content)
+	} else {
+		err = h.libraryService.Upload(resource)
+	}
+	if err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
@@ -227,6 +351,54 @@ func (h *APIHandler) GetResource(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	w.Header().Set("ETag", etag(resource.Version))
+	writeSuccess(w, resource)
+}
+
+// UpdateResource handles PUT /api/resources/{id}, honouring If-Match.
+// Only the uploader may edit a resource.
+func (h *APIHandler) UpdateResource(w http.ResponseWriter, r *http.Request) {
+	userID := models.UserID(r.Header.Get("X-User-ID"))
+	if userID == "" {
+		writeError(w, http.StatusUnauthorized, "User ID required")
+		return
+	}
+	
+	var req UpdateResourceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	if strings.TrimSpace(req.Title) == "" {
+		writeError(w, http.StatusBadRequest, errors.NewValidationError("title", "title is required").Error())
+		return
+	}
+	
+	resource, err := h.libraryService.GetResource(models.ContentID(mux.Vars(r)["id"]))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if resource.UploadedBy != userID {
+		writeError(w, http.StatusForbidden, errors.ErrForbidden.Error())
+		return
+	}
+	if !ifMatch(r, resource.Version) {
+		w.Header().Set("ETag", etag(resource.Version))
+		writeError(w, http.StatusPreconditionFailed, "resource was changed since it was read")
+		return
+	}
+	
+	resource.Title = req.Title
+	resource.Description = req.Description
+	resource.Subject = req.Subject
+	resource.Tags = req.Tags
+	if err := h.libraryService.UpdateResource(resource); err != nil {
+		writeUpdateError(w, r, err)
+		return
+	}
+	
+	w.Header().Set("ETag", etag(resource.Version))
 	writeSuccess(w, resource)
 }
 
@@ -235,10 +407,18 @@ func (h *APIHandler) DownloadResource(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	resourceID := models.ContentID(vars["id"])
 	userID := models.UserID(r.Header.Get("X-User-ID"))
+	if userID == "" {
+		writeError(w, http.StatusUnauthorized, "User ID required")
+		return
+	}
 	
 	resource, err := h.libraryService.Download(resourceID, userID)
 	if err != nil {
-		writeError(w, http.StatusNotFound, err.Error())
+		status := http.StatusNotFound
+		if !errors.IsNotFound(err) {
+			status = http.StatusBadGateway // content transfer from peers failed
+		}
+		writeError(w, status, err.Error())
 		return
 	}
 	
@@ -339,6 +519,20 @@ func (h *APIHandler) GetReputation(w http.ResponseWriter, r *http.Request) {
 	writeSuccess(w, info)
 }
 
+// GetTransfers handles GET /api/users/{id}/transfers
+func (h *APIHandler) GetTransfers(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := models.UserID(vars["id"])
+	
+	transfers, err := h.reputationService.GetTransfers(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	
+	writeSuccess(w, transfers)
+}
+
 // GetNetworkStats handles GET /api/stats
 func (h *APIHandler) GetNetworkStats(w http.ResponseWriter, r *http.Request) {
 	stats, err := h.reputationService.GetNetworkStats()
@@ -360,13 +554,26 @@ func (h *APIHandler) RateResource(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	resource, err := h.libraryService.GetResource(resourceID)
-	if err != nil {
-		writeError(w, http.StatusNotFound, err.Error())
+	// Ratings are signed on behalf of the rating user
+	userID := models.UserID(r.Header.Get("X-User-ID"))
+	if userID == "" {
+		writeError(w, http.StatusUnauthorized, "User ID required")
 		return
 	}
 	
-	resource.AddRating(models.Rating(req.Rating))
+	rating := models.NewResourceRating(resourceID, userID, models.Rating(req.Rating), req.Comment)
+	resource, err := h.libraryService.Rate(rating)
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.IsNotFound(err):
+			status = http.StatusNotFound
+		case errors.Is(err, errors.ErrAlreadyRated):
+			status = http.StatusConflict
+		}
+		writeError(w, status, err.Error())
+		return
+	}
 	
 	// Update uploader reputation based on rating
 	h.reputationService.RecalculateAll()
@@ -404,10 +611,33 @@ func (h *APIHandler) GetPeers(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+
+	// The peer node knows who is actually reachable right now
+	live := make(map[models.PeerID]*models.Peer)
+	traffic := make(map[models.PeerID]models.PeerConnection)
+	if h.peers != nil {
+		known, err := h.peers.GetAll()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, p := range known {
+			live[p.ID] = p
+		}
+		for _, c := range h.peers.Connections() {
+			traffic[c.RemotePeer] = c
+		}
+	}
+	addTraffic := func(entry map[string]interface{}, peerID models.PeerID) {
+		if c, ok := traffic[peerID]; ok {
+			entry["bytes_sent"] = c.BytesSent
+			entry["bytes_received"] = c.BytesReceived
+		}
+	}
 	
 	peers := make([]map[string]interface{}, 0)
 	for _, u := range users {
-		peers = append(peers, map[string]interface{}{
+		entry := map[string]interface{}{
 			"id":               u.PeerID,
 			"user_id":          u.ID,
 			"username":         u.Username,
@@ -416,7 +646,32 @@ func (h *APIHandler) GetPeers(w http.ResponseWriter, r *http.Request) {
 			"classification":   u.Classification,
 			"shared_resources": u.TotalUploads,
 			"ip_address":       u.IPAddress,
-		})
+		}
+		if p, ok := live[u.PeerID]; ok {
+			entry["status"] = p.Status
+			entry["ip_address"] = p.IPAddress
+			entry["last_ping_at"] = p.LastPingAt
+			entry["latency"] = p.Latency
+			entry["discovered_via"] = p.DiscoveredVia
+			addTraffic(entry, u.PeerID)
+			delete(live, u.PeerID)
+		}
+		peers = append(peers, entry)
+	}
+
+	// Peers whose user this node hasn't heard of
+	for _, p := range live {
+		entry := map[string]interface{}{
+			"id":             p.ID,
+			"user_id":        p.UserID,
+			"status":         p.Status,
+			"ip_address":     p.IPAddress,
+			"last_ping_at":   p.LastPingAt,
+			"latency":        p.Latency,
+			"discovered_via": p.DiscoveredVia,
+		}
+		addTraffic(entry, p.ID)
+		peers = append(peers, entry)
 	}
 	writeSuccess(w, peers)
 }
@@ -432,7 +687,9 @@ func (h *APIHandler) SetupRoutes(r *mux.Router) {
 	api.HandleFunc("/users", h.CreateUser).Methods("POST")
 	api.HandleFunc("/users", h.GetAllUsers).Methods("GET")
 	api.HandleFunc("/users/{id}", h.GetUser).Methods("GET")
+	api.HandleFunc("/users/{id}", h.UpdateUser).Methods("PUT")
 	api.HandleFunc("/users/{id}/reputation", h.GetReputation).Methods("GET")
+	api.HandleFunc("/users/{id}/transfers", h.GetTransfers).Methods("GET")
 	api.HandleFunc("/leaderboard", h.GetLeaderboard).Methods("GET")
 	
 	// Resources
@@ -441,6 +698,7 @@ func (h *APIHandler) SetupRoutes(r *mux.Router) {
 	api.HandleFunc("/resources/popular", h.GetPopularResources).Methods("GET")
 	api.HandleFunc("/resources/recent", h.GetRecentResources).Methods("GET")
 	api.HandleFunc("/resources/{id}", h.GetResource).Methods("GET")
+	api.HandleFunc("/resources/{id}", h.UpdateResource).Methods("PUT")
 	api.HandleFunc("/resources/{id}/download", h.DownloadResource).Methods("POST")
 	api.HandleFunc("/resources/{id}/rate", h.RateResource).Methods("POST")
 	
@@ -0,0 +1,354 @@
+// Package handlers - Unit tests for the HTTP API
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"p2p-library/interfaces"
+	"p2p-library/models"
+	"p2p-library/services"
+	"p2p-library/store"
+)
+
+// testAPI is an API handler over a fresh memory store, with the services
+// wired as main wires them
+type testAPI struct {
+	db      interfaces.StorageBackend
+	users   *services.UserService
+	library *services.LibraryService
+	router  *mux.Router
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	return newTestAPIOn(t, store.NewMemoryStore())
+}
+
+// newTestAPIOn is newTestAPI over the given backend
+func newTestAPIOn(t *testing.T, db interfaces.StorageBackend) *testAPI {
+	t.Helper()
+
+	users := services.NewUserService(db)
+	library := services.NewLibraryService(db, users)
+	h := NewAPIHandler(
+		users,
+		library,
+		services.NewReputationService(db),
+		services.NewSearchService(db.Resources()),
+	)
+
+	router := mux.NewRouter()
+	h.SetupRoutes(router)
+	return &testAPI{db: db, users: users, library: library, router: router}
+}
+
+// do sends a request through the router. header holds pairs of names
+// and values.
+func (a *testAPI) do(method, path string, body interface{}, header ...string) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	rec := httptest.NewRecorder()
+	a.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// seedResource stores a user and a resource they uploaded
+func (a *testAPI) seedResource(t *testing.T) (*models.User, *models.Resource) {
+	t.Helper()
+
+	user, err := a.users.CreateUser("alice", "alice@test.com", "pass")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	resource := models.NewResource("notes.pdf", 1024, user.ID)
+	resource.Title = "Cell Biology Notes"
+	if err := a.library.Upload(resource); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	return user, resource
+}
+
+// decode reads an API response, failing the test if it isn't one
+func decode(t *testing.T, rec *httptest.ResponseRecorder) APIResponse {
+	t.Helper()
+
+	var resp APIResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Response %q is not JSON: %v", rec.Body.String(), err)
+	}
+	return resp
+}
+
+// racingBackend is a backend on which another writer changes a resource
+// right after it is first read, as a concurrent request could
+type racingBackend struct {
+	interfaces.StorageBackend
+	race func(resources interfaces.ResourceStorage, id models.ContentID)
+}
+
+func (b racingBackend) Resources() interfaces.ResourceStorage {
+	return &racingResources{ResourceStorage: b.StorageBackend.Resources(), race: b.race}
+}
+
+type racingResources struct {
+	interfaces.ResourceStorage
+	race func(resources interfaces.ResourceStorage, id models.ContentID)
+	once sync.Once
+}
+
+func (r *racingResources) Get(id models.ContentID) (*models.Resource, error) {
+	resource, err := r.ResourceStorage.Get(id)
+	if err == nil && r.race != nil {
+		r.once.Do(func() { r.race(r.ResourceStorage, id) })
+	}
+	return resource, err
+}
+
+// ============================================================================
+// TESTS
+// ============================================================================
+
+func TestRateResourceRequiresUser(t *testing.T) {
+	api := newTestAPI(t)
+	_, resource := api.seedResource(t)
+
+	rec := api.do("POST", "/api/resources/"+string(resource.ID)+"/rate", RateResourceRequest{Rating: 4})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Status = %d; want 401 without X-User-ID", rec.Code)
+	}
+
+	rec = api.do("POST", "/api/resources/"+string(resource.ID)+"/rate", RateResourceRequest{Rating: 4},
+		"X-User-ID", "user-bob")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Status = %d (%s); want 200 with X-User-ID", rec.Code, decode(t, rec).Error)
+	}
+	ratings, _ := api.db.Ratings().GetByResource(resource.ID)
+	if len(ratings) != 1 || ratings[0].UserID != "user-bob" {
+		t.Errorf("Ratings = %+v; want one by user-bob", ratings)
+	}
+}
+
+func TestRateResourceTwiceConflicts(t *testing.T) {
+	api := newTestAPI(t)
+	_, resource := api.seedResource(t)
+	path := "/api/resources/" + string(resource.ID) + "/rate"
+
+	if rec := api.do("POST", path, RateResourceRequest{Rating: 5}, "X-User-ID", "user-bob"); rec.Code != http.StatusOK {
+		t.Fatalf("First rating status = %d; want 200", rec.Code)
+	}
+	rec := api.do("POST", path, RateResourceRequest{Rating: 1}, "X-User-ID", "user-bob")
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("Second rating status = %d; want 409", rec.Code)
+	}
+	if msg := decode(t, rec).Error; !strings.Contains(msg, "already rated") {
+		t.Errorf("Error = %q; want it to say the resource was already rated", msg)
+	}
+
+	got, _ := api.library.GetResource(resource.ID)
+	if got.TotalRatings != 1 || got.AverageRating != 5 {
+		t.Errorf("Resource has %d ratings averaging %.1f; want only the first", got.TotalRatings, got.AverageRating)
+	}
+}
+
+func TestReadsAndUpdatesServeTheVersionAsETag(t *testing.T) {
+	api := newTestAPI(t)
+	user, resource := api.seedResource(t)
+
+	// The upload credited Alice, so she is at version 2
+	stored, _ := api.users.GetUser(user.ID)
+	if rec := api.do("GET", "/api/users/"+string(user.ID), nil); rec.Header().Get("ETag") != etag(stored.Version) {
+		t.Errorf("User ETag = %q; want %q", rec.Header().Get("ETag"), etag(stored.Version))
+	}
+	rec := api.do("GET", "/api/resources/"+string(resource.ID), nil)
+	if got := rec.Header().Get("ETag"); got != `"1"` {
+		t.Errorf("Resource ETag = %q; want \"1\"", got)
+	}
+
+	rec = api.do("PUT", "/api/resources/"+string(resource.ID),
+		UpdateResourceRequest{Title: "Cell Biology", Subject: "Biology"}, "X-User-ID", string(user.ID), "If-Match", `"1"`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT status = %d (%s); want 200", rec.Code, decode(t, rec).Error)
+	}
+	if got := rec.Header().Get("ETag"); got != `"2"` {
+		t.Errorf("ETag after the PUT = %q; want \"2\"", got)
+	}
+}
+
+func TestStaleIfMatchFailsThePrecondition(t *testing.T) {
+	api := newTestAPI(t)
+	user, resource := api.seedResource(t)
+	path := "/api/resources/" + string(resource.ID)
+
+	if rec := api.do("PUT", path, UpdateResourceRequest{Title: "First edit"}, "X-User-ID", string(user.ID), "If-Match", `"1"`); rec.Code != http.StatusOK {
+		t.Fatalf("First PUT status = %d; want 200", rec.Code)
+	}
+	rec := api.do("PUT", path, UpdateResourceRequest{Title: "Second edit"}, "X-User-ID", string(user.ID), "If-Match", `"1"`)
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("PUT with a stale If-Match status = %d; want 412", rec.Code)
+	}
+	if got := rec.Header().Get("ETag"); got != `"2"` {
+		t.Errorf("ETag on the 412 = %q; want the current \"2\"", got)
+	}
+	if got, _ := api.library.GetResource(resource.ID); got.Title != "First edit" {
+		t.Errorf("Title = %q; want the first edit kept", got.Title)
+	}
+
+	rec = api.do("PUT", "/api/users/"+string(user.ID), UpdateUserRequest{Username: "alice", Email: "alice@uni.edu"},
+		"X-User-ID", string(user.ID), "If-Match", `"7"`)
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("User PUT with a stale If-Match status = %d; want 412", rec.Code)
+	}
+}
+
+func TestUpdateRacingAnotherWriteConflicts(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string
+		want   int
+	}{
+		{"without If-Match", nil, http.StatusConflict},
+		{"with If-Match", []string{"If-Match", `"1"`}, http.StatusPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Another writer changes the resource between the handler's
+			// read and its update
+			api := newTestAPIOn(t, racingBackend{
+				StorageBackend: store.NewMemoryStore(),
+				race: func(resources interfaces.ResourceStorage, id models.ContentID) {
+					resources.UpdateResource(id, func(r *models.Resource) error {
+						r.Title = "Concurrent edit"
+						return nil
+					})
+				},
+			})
+			user, resource := api.seedResource(t)
+
+			header := append([]string{"X-User-ID", string(user.ID)}, tt.header...)
+			rec := api.do("PUT", "/api/resources/"+string(resource.ID), UpdateResourceRequest{Title: "Lost edit"}, header...)
+			if rec.Code != tt.want {
+				t.Fatalf("Status = %d (%s); want %d", rec.Code, decode(t, rec).Error, tt.want)
+			}
+			if got, _ := api.library.GetResource(resource.ID); got.Title != "Concurrent edit" {
+				t.Errorf("Title = %q; want the concurrent edit kept", got.Title)
+			}
+		})
+	}
+}
+
+func TestUpdateResourceChecksCallerAndTitle(t *testing.T) {
+	api := newTestAPI(t)
+	alice, resource := api.seedResource(t)
+	bob, err := api.users.CreateUser("bob", "bob@test.com", "pass")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	path := "/api/resources/" + string(resource.ID)
+
+	tests := []struct {
+		name   string
+		caller models.UserID
+		req    UpdateResourceRequest
+		want   int
+	}{
+		{"no caller", "", UpdateResourceRequest{Title: "Hijacked"}, http.StatusUnauthorized},
+		{"another user", bob.ID, UpdateResourceRequest{Title: "Hijacked"}, http.StatusForbidden},
+		{"empty title", alice.ID, UpdateResourceRequest{Title: "  "}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header []string
+			if tt.caller != "" {
+				header = []string{"X-User-ID", string(tt.caller)}
+			}
+			if rec := api.do("PUT", path, tt.req, header...); rec.Code != tt.want {
+				t.Errorf("Status = %d (%s); want %d", rec.Code, decode(t, rec).Error, tt.want)
+			}
+		})
+	}
+	if got, _ := api.library.GetResource(resource.ID); got.Title != resource.Title || got.Version != resource.Version {
+		t.Errorf("Resource = %q version %d after rejected PUTs; want it unchanged", got.Title, got.Version)
+	}
+
+	rec := api.do("PUT", path, UpdateResourceRequest{Title: "Cell Biology"}, "X-User-ID", string(alice.ID))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Uploader's PUT status = %d (%s); want 200", rec.Code, decode(t, rec).Error)
+	}
+	if got, _ := api.library.GetResource(resource.ID); got.Title != "Cell Biology" {
+		t.Errorf("Title = %q; want the uploader's edit", got.Title)
+	}
+}
+
+func TestCreateUserWithTakenEmailConflicts(t *testing.T) {
+	api := newTestAPI(t)
+	api.seedResource(t)
+
+	rec := api.do("POST", "/api/users", CreateUserRequest{Username: "mallory", Email: "alice@test.com", Password: "pass"})
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Status = %d (%s); want 409 for Alice's email", rec.Code, decode(t, rec).Error)
+	}
+	if users, _ := api.users.GetAllUsers(); len(users) != 1 {
+		t.Errorf("Store has %d users; want only Alice", len(users))
+	}
+}
+
+func TestUpdateUserChecksCallerAndDetails(t *testing.T) {
+	api := newTestAPI(t)
+	alice, _ := api.seedResource(t)
+	bob, err := api.users.CreateUser("bob", "bob@test.com", "pass")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	path := "/api/users/" + string(alice.ID)
+	before, _ := api.users.GetUser(alice.ID)
+
+	tests := []struct {
+		name   string
+		caller models.UserID
+		req    UpdateUserRequest
+		want   int
+	}{
+		{"no caller", "", UpdateUserRequest{Username: "alice", Email: "alice@uni.edu"}, http.StatusUnauthorized},
+		{"another user", bob.ID, UpdateUserRequest{Username: "mallory", Email: "alice@uni.edu"}, http.StatusForbidden},
+		{"empty username", alice.ID, UpdateUserRequest{Username: "  ", Email: "alice@uni.edu"}, http.StatusBadRequest},
+		{"bad email", alice.ID, UpdateUserRequest{Username: "alice", Email: "alice at uni"}, http.StatusBadRequest},
+		{"taken email", alice.ID, UpdateUserRequest{Username: "alice", Email: "bob@test.com"}, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header []string
+			if tt.caller != "" {
+				header = []string{"X-User-ID", string(tt.caller)}
+			}
+			if rec := api.do("PUT", path, tt.req, header...); rec.Code != tt.want {
+				t.Errorf("Status = %d (%s); want %d", rec.Code, decode(t, rec).Error, tt.want)
+			}
+		})
+	}
+	if got, _ := api.users.GetUser(alice.ID); got.Username != "alice" || got.Email != "alice@test.com" || got.Version != before.Version {
+		t.Errorf("Alice = %s <%s> version %d after rejected PUTs; want her unchanged", got.Username, got.Email, got.Version)
+	}
+
+	rec := api.do("PUT", path, UpdateUserRequest{Username: "alice.s", Email: "alice@uni.edu"}, "X-User-ID", string(alice.ID))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Own PUT status = %d (%s); want 200", rec.Code, decode(t, rec).Error)
+	}
+	if got, err := api.users.GetUserByEmail("alice@uni.edu"); err != nil || got.ID != alice.ID {
+		t.Errorf("GetUserByEmail(alice@uni.edu) = %v, %v; want Alice", got, err)
+	}
+}
@@ -8,6 +8,7 @@
 package interfaces
 
 import (
+	"p2p-library/events"
 	"p2p-library/models"
 )
 
@@ -26,9 +27,16 @@ type ResourceStorage interface {
 	// Read retrieves a resource by ID
 	Get(id models.ContentID) (*models.Resource, error)
 
-	// Update modifies an existing resource
+	// Update modifies an existing resource. It fails with a ConflictError
+	// unless resource.Version is the stored version, and on success sets
+	// resource.Version to the new one
 	Update(resource *models.Resource) error
 
+	// UpdateResource changes a resource atomically: change gets a copy of
+	// the latest version, which is stored with the next Version if change
+	// returns nil
+	UpdateResource(id models.ContentID, change func(*models.Resource) error) error
+
 	// Delete removes a resource from storage
 	Delete(id models.ContentID) error
 
@@ -40,6 +48,12 @@ type ResourceStorage interface {
 
 	// GetByUser returns resources uploaded by a specific user
 	GetByUser(userID models.UserID) ([]*models.Resource, error)
+
+	// GetBySubject returns the resources in a subject, ignoring case
+	GetBySubject(subject string) ([]*models.Resource, error)
+
+	// GetByTag returns the resources carrying a tag, ignoring case
+	GetByTag(tag string) ([]*models.Resource, error)
 }
 
 // UserStorage defines operations for user storage
@@ -53,9 +67,12 @@ type UserStorage interface {
 	// GetByEmail retrieves a user by email
 	GetByEmail(email string) (*models.User, error)
 
-	// Update modifies user data
+	// Update modifies user data, checking Version like ResourceStorage.Update
 	Update(user *models.User) error
 
+	// UpdateUser changes a user atomically, like UpdateResource
+	UpdateUser(id models.UserID, change func(*models.User) error) error
+
 	// Delete removes a user
 	Delete(id models.UserID) error
 
@@ -80,13 +97,32 @@ type RatingStorage interface {
 	// GetByUser returns all ratings by a user
 	GetByUser(userID models.UserID) ([]*models.ResourceRating, error)
 
-	// Update modifies a rating
+	// GetAll returns every rating, including any whose resource or user
+	// no longer exists
+	GetAll() ([]*models.ResourceRating, error)
+
+	// Update modifies a rating, checking Version like ResourceStorage.Update
 	Update(rating *models.ResourceRating) error
 
 	// Delete removes a rating
 	Delete(id string) error
 }
 
+// TransferStorage defines operations for the append-only transfer ledger
+type TransferStorage interface {
+	// Add appends a record; a record ID can only be added once
+	Add(record *models.TransferRecord) error
+
+	// Has reports whether a record with this ID was added
+	Has(id string) bool
+
+	// GetAll returns the whole ledger, oldest first
+	GetAll() ([]*models.TransferRecord, error)
+
+	// GetByUser returns the records a user served or received, oldest first
+	GetByUser(userID models.UserID) ([]*models.TransferRecord, error)
+}
+
 // ============================================================================
 // INTERFACE COMPOSITION NOTE
 // ============================================================================
@@ -95,6 +131,39 @@ type RatingStorage interface {
 // Get, Delete), they cannot be composed directly. In this project, each
 // storage interface (ResourceStorage, UserStorage, RatingStorage) is used
 // independently, demonstrating how Go interfaces enable flexible abstraction.
+// A StorageBackend hands out one of each instead.
+
+// Tx is the storage seen inside a transaction. Changes made through it
+// are kept only if the transaction function returns nil.
+type Tx interface {
+	Resources() ResourceStorage
+	Users() UserStorage
+	Ratings() RatingStorage
+	Transfers() TransferStorage
+}
+
+// StorageBackend is a storage engine chosen at startup. The services only
+// see the storage interfaces it returns, never the engine itself.
+type StorageBackend interface {
+	Resources() ResourceStorage
+	Users() UserStorage
+	Ratings() RatingStorage
+	Transfers() TransferStorage
+
+	// RunInTx runs fn as one all-or-nothing transaction over resources,
+	// users, ratings and the transfer ledger: if fn returns an error,
+	// none of its changes are kept. Transactions are serialized with
+	// every other write. fn must only use tx, never the backend itself,
+	// or it deadlocks.
+	RunInTx(fn func(tx Tx) error) error
+
+	// Events returns the bus every committed write to resources, users
+	// and ratings is published on
+	Events() *events.Bus
+
+	// Close flushes and releases the backend
+	Close() error
+}
 
 // ============================================================================
 // PEER INTERFACE
@@ -111,6 +180,9 @@ type PeerManager interface {
 	// GetOnline returns all online peers
 	GetOnline() ([]*models.Peer, error)
 
+	// GetAll returns every known peer, online or not
+	GetAll() ([]*models.Peer, error)
+
 	// Connect establishes connection to a peer
 	Connect(peerID models.PeerID) error
 
@@ -119,4 +191,20 @@ type PeerManager interface {
 
 	// Ping checks if a peer is alive
 	Ping(peerID models.PeerID) (int64, error)
+
+	// Connections returns the live connections and their traffic
+	Connections() []models.PeerConnection
+}
+
+// ============================================================================
+// CONTENT TRANSFER INTERFACE
+// ============================================================================
+
+// ContentTransfer defines how resource content moves between peers
+type ContentTransfer interface {
+	// Publish stores a resource's content locally so peers can fetch it
+	Publish(resource *models.Resource, data []byte) error
+
+	// Fetch downloads a resource's content from the peers in AvailableOn
+	Fetch(resource *models.Resource) error
 }
@@ -0,0 +1,31 @@
+// P2P Academic Library - Data directory lock
+//
+// The server and the export and import subcommands each hold an
+// exclusive lock on P2P_DATA_DIR/lock while they run, so a subcommand
+// cannot write the library or peer list behind a running server's back,
+// and two servers cannot share a directory.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockDataDir takes the lock on dataDir, creating the directory if
+// needed. It fails at once if another process holds the lock. The lock is
+// released when the returned file is closed or the process exits.
+func lockDataDir(dataDir string) (*os.File, error) {
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dataDir, "lock"), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s is in use by another p2p-library process; stop the server first: %w", dataDir, err)
+	}
+	return file, nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+// P2P Academic Library - Data directory lock elsewhere
+package main
+
+import "os"
+
+// lockFile does nothing: without flock the data directory is not
+// guarded, and subcommands must be run while the server is stopped
+func lockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+// P2P Academic Library - Data directory lock on Unix
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on file without waiting for it
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
@@ -7,30 +7,157 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 
+	"p2p-library/errors"
 	"p2p-library/handlers"
+	"p2p-library/interfaces"
 	"p2p-library/models"
+	"p2p-library/p2p"
+	"p2p-library/p2p/dht"
+	"p2p-library/p2p/gossip"
 	"p2p-library/services"
 	"p2p-library/store"
 )
 
 func main() {
+	dataDir := os.Getenv("P2P_DATA_DIR")
+	if dataDir == "" {
+		dataDir = "data"
+	}
+
+	// Subcommands such as export and import run instead of the server
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(dataDir, os.Args[1], os.Args[2:]))
+	}
+
+	// Hold the data directory while the server runs (see lock.go)
+	lock, err := lockDataDir(dataDir)
+	if err != nil {
+		log.Fatalf("Failed to lock data directory: %v", err)
+	}
+	defer lock.Close()
+
 	// Initialize storage
-	memoryStore := store.NewMemoryStore()
+	db, err := openStorage(dataDir)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
+	defer db.Close()
 
 	// Initialize services
-	userService := services.NewUserService(memoryStore)
-	libraryService := services.NewLibraryService(memoryStore, userService)
-	reputationService := services.NewReputationService(memoryStore)
-	searchService := services.NewSearchService(memoryStore)
+	userService := services.NewUserService(db)
+	libraryService := services.NewLibraryService(db, userService)
+	reputationService := services.NewReputationService(db)
+	searchService := services.NewSearchService(db.Resources())
+
+	// Start the P2P node
+	node, err := startPeerNode(dataDir)
+	if err != nil {
+		log.Fatalf("Failed to start P2P node: %v", err)
+	}
+	defer node.Close()
+
+	// Move file content between peers in chunks
+	content, err := p2p.NewContentStore(filepath.Join(dataDir, "content"))
+	if err != nil {
+		log.Fatalf("Failed to open content store: %v", err)
+	}
+	// Rates and upload slots follow the user a peer claims only if that
+	// user's record is bound to the peer's identity key
+	node.SetUserVerifier(func(peerID models.PeerID, userID models.UserID) bool {
+		user, err := userService.GetUser(userID)
+		return err == nil && user.PeerID == peerID
+	})
+	if userID := node.UserID(); userID != "" {
+		if err := userService.BindPeer(userID, node.ID()); err != nil {
+			log.Printf("P2P_USER_ID %s not bound to this node: %v", userID, err)
+		}
+	}
+
+	transfer := p2p.NewTransfer(node, content)
+	transfer.SetThrottle(throttleConfig(reputationService))
+	transfer.SetChoker(p2p.NewChoker(chokeConfig(reputationService)))
+	transfer.SetMisbehaviorHandler(func(peerID models.PeerID, userID models.UserID, cid models.ContentID) {
+		log.Printf("Peer %s served a bad chunk of %s", peerID, cid)
+		if userID == "" {
+			return
+		}
+		if err := reputationService.RecordMisbehavior(userID); err != nil {
+			log.Printf("Misbehavior of %s not recorded: %v", userID, err)
+		}
+	})
+	transfer.SetLedger(func(record models.TransferRecord) {
+		if err := reputationService.RecordTransfer(&record); err != nil {
+			log.Printf("Transfer %s not credited: %v", record.ID, err)
+		}
+	})
+	libraryService.SetTransfer(transfer)
+	libraryService.SetIdentity(node.Identity())
+
+	// Announce held content and look up providers in the DHT
+	locator := p2p.NewDHT(node, dht.DefaultConfig())
+	locator.Start()
+	defer locator.Close()
+	transfer.SetDHT(locator)
+
+	// Track which peers are alive and keep their users' status current
+	membership := p2p.NewMembership(node, gossip.DefaultConfig())
+	// Only firsthand news about a user already bound to the member's key
+	// is written: a relayed update is just another peer's claim
+	membership.OnUpdate(func(m gossip.Member) {
+		if m.UserID == "" || !m.Direct {
+			return
+		}
+		status := models.StatusOnline
+		if m.State == gossip.StateDead {
+			status = models.StatusOffline
+		}
+		host, _, _ := net.SplitHostPort(m.Addr)
+		// Members whose user isn't bound to them here are expected
+		err := userService.UpdatePeerStatus(m.UserID, m.ID, status, host)
+		if err != nil && !errors.IsValidationError(err) {
+			log.Printf("Status of %s not recorded: %v", m.UserID, err)
+		}
+	})
+	membership.Start()
+	defer membership.Close()
 
-	// Seed demo data
-	seedDemoData(memoryStore, userService, libraryService)
+	// Find peers on the local network if asked to
+	if lan := startLANDiscovery(node); lan != nil {
+		defer lan.Close()
+	}
+
+	// Find the network through the bootstrap peers, then introduce
+	// ourselves to everyone we know
+	if err := node.Bootstrap(bootstrapAddrs()...); err != nil {
+		log.Printf("Bootstrap failed: %v", err)
+	}
+	joinNetwork(node, locator, membership)
+
+	// Continue downloads interrupted by the last shutdown
+	if resumed, err := transfer.ResumePending(); err != nil {
+		log.Printf("Failed to resume downloads: %v", err)
+	} else if len(resumed) > 0 {
+		fmt.Printf("⏯️  Resuming %d unfinished downloads\n", len(resumed))
+	}
+
+	// Credit this node's user for the content it seeds
+	go reportSeeding(transfer, reputationService, node.UserID(), time.Minute)
+
+	// Seed demo data into an empty library
+	if users, _ := db.Users().GetAll(); len(users) == 0 {
+		seedDemoData(db.Resources(), userService, libraryService)
+	}
 
 	// Recalculate all reputations after seeding
 	reputationService.RecalculateAll()
@@ -42,6 +169,7 @@ func main() {
 		reputationService,
 		searchService,
 	)
+	apiHandler.SetPeerManager(node)
 
 	// Setup router
 	router := mux.NewRouter()
@@ -57,6 +185,7 @@ func main() {
 		AllowedOrigins:   []string{"http://localhost:3000", "http://localhost:5173", "http://localhost:8080"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
+		ExposedHeaders:   []string{"ETag"},
 		AllowCredentials: true,
 	})
 
@@ -70,38 +199,211 @@ func main() {
 
 	fmt.Printf("🚀 P2P Academic Library Server running on http://localhost:%s\n", port)
 	fmt.Println("📚 API endpoints available at /api")
+	fmt.Printf("🔗 P2P node %s listening on port %d\n", node.ID(), node.Port())
 	fmt.Println("📖 Documentation: See P2P_Academic_Library_Documentation.md")
 
 	log.Fatal(http.ListenAndServe(":"+port, handler))
 }
 
+// startPeerNode starts the P2P node using settings from the environment
+func startPeerNode(dataDir string) (*p2p.Node, error) {
+	p2pPort := os.Getenv("P2P_PORT")
+	if p2pPort == "" {
+		p2pPort = "9000"
+	}
+
+	// The PeerID is derived from a keypair kept between runs
+	identity, err := p2p.LoadIdentity(filepath.Join(dataDir, "identity.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := p2p.NewNode(p2p.Config{
+		ListenAddr: ":" + p2pPort,
+		Identity:   identity,
+		UserID:     models.UserID(os.Getenv("P2P_USER_ID")),
+
+		PeerListPath: peerListPath(dataDir),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := node.Start(); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// bootstrapAddrs reads the comma-separated "host:port" list in P2P_BOOTSTRAP
+func bootstrapAddrs() []string {
+	var addrs []string
+	for _, addr := range strings.Split(os.Getenv("P2P_BOOTSTRAP"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// startLANDiscovery starts multicast discovery when P2P_LAN_DISCOVERY is
+// set. It returns nil when discovery is off or unavailable.
+func startLANDiscovery(node *p2p.Node) *p2p.LANDiscovery {
+	if enabled, _ := strconv.ParseBool(os.Getenv("P2P_LAN_DISCOVERY")); !enabled {
+		return nil
+	}
+
+	lan, err := p2p.NewLANDiscovery(node, p2p.LANConfig{Group: os.Getenv("P2P_LAN_GROUP")})
+	if err == nil {
+		err = lan.Start()
+	}
+	if err != nil {
+		log.Printf("LAN discovery unavailable: %v", err)
+		return nil
+	}
+
+	// Give the first answers a moment to arrive before joining the network
+	time.Sleep(500 * time.Millisecond)
+	return lan
+}
+
+// reportSeeding credits the node's user with the time it spent seeding,
+// once per interval. Bytes served are credited through the ledger.
+func reportSeeding(transfer *p2p.Transfer, reputationService *services.ReputationService, userID models.UserID, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report := transfer.TakeSeedReport()
+		if userID == "" || report.Seeded == 0 {
+			continue
+		}
+		if err := reputationService.RecordSeeding(userID, report.Seeded); err != nil {
+			log.Printf("Failed to record seeding: %v", err)
+		}
+	}
+}
+
+// joinNetwork seeds the DHT and gossip membership with every known peer
+func joinNetwork(node *p2p.Node, locator *dht.DHT, membership *gossip.Gossip) {
+	var (
+		contacts []dht.Contact
+		members  []gossip.Member
+	)
+	for _, peer := range node.Peers() {
+		if c, err := node.ContactFor(peer.ID); err == nil {
+			contacts = append(contacts, c)
+		}
+		if m, err := node.MemberFor(peer.ID); err == nil {
+			members = append(members, m)
+		}
+	}
+	if len(contacts) == 0 {
+		return
+	}
+
+	if err := locator.Bootstrap(contacts...); err != nil {
+		log.Printf("DHT bootstrap failed: %v", err)
+	}
+	if err := membership.Join(members...); err != nil {
+		log.Printf("Gossip join failed: %v", err)
+	}
+}
+
+// throttleConfig limits served chunks by the requesting user's reputation
+func throttleConfig(reputationService *services.ReputationService) p2p.ThrottleConfig {
+	baseRate := int64(10 << 20) // 10MB/s for Contributors
+	if v := os.Getenv("P2P_BASE_BANDWIDTH"); v != "" {
+		if parsed, err := strconv.ParseInt(v, 10, 64); err == nil {
+			baseRate = parsed
+		}
+	}
+
+	return p2p.ThrottleConfig{
+		BaseRate: baseRate,
+		Multiplier: func(userID models.UserID) float64 {
+			multiplier, err := reputationService.GetThrottleSpeed(userID)
+			if err != nil {
+				// Unknown users get the Leecher rate
+				return services.GetThrottleMultiplier(models.ClassLeecher)
+			}
+			return multiplier
+		},
+	}
+}
+
+// chokeConfig shares upload slots tit-for-tat, preferring peers whose
+// users have a good reputation
+func chokeConfig(reputationService *services.ReputationService) p2p.ChokeConfig {
+	cfg := p2p.DefaultChokeConfig()
+	if v := os.Getenv("P2P_UPLOAD_SLOTS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil {
+			cfg.Slots = parsed
+		}
+	}
+
+	cfg.Reputation = func(userID models.UserID) models.ReputationScore {
+		score, err := reputationService.Calculate(userID)
+		if err != nil {
+			return models.LowReputation
+		}
+		return score
+	}
+	return cfg
+}
+
+// openStorage opens the backend named by P2P_STORE: "memory" (the
+// default) keeps nothing across restarts, "wal" keeps the memory store
+// with a write-ahead log in the P2P_STORE_PATH directory (default
+// library in the data directory), and "bolt" keeps everything in the
+// P2P_STORE_PATH file (default library.db in the data directory)
+func openStorage(dataDir string) (interfaces.StorageBackend, error) {
+	switch backend := os.Getenv("P2P_STORE"); backend {
+	case "", "memory":
+		return store.NewMemoryStore(), nil
+	case "wal":
+		path := os.Getenv("P2P_STORE_PATH")
+		if path == "" {
+			path = filepath.Join(dataDir, "library")
+		}
+		fmt.Printf("💾 Logging library writes to %s\n", path)
+		return store.OpenMemoryStore(path, store.WALConfig{})
+	case "bolt":
+		path := os.Getenv("P2P_STORE_PATH")
+		if path == "" {
+			if err := os.MkdirAll(dataDir, 0700); err != nil {
+				return nil, err
+			}
+			path = filepath.Join(dataDir, "library.db")
+		}
+		fmt.Printf("💾 Storing library in %s\n", path)
+		return store.OpenBoltStore(path)
+	default:
+		return nil, fmt.Errorf("unknown P2P_STORE %q; want memory, wal or bolt", backend)
+	}
+}
+
 // seedDemoData creates sample data for testing
-func seedDemoData(store *store.MemoryStore, userService *services.UserService, libService *services.LibraryService) {
-	// Create demo users with peer info
+func seedDemoData(resourceStore interfaces.ResourceStorage, userService *services.UserService, libService *services.LibraryService) {
+	// Create demo users. They run no node, so they are not bound to a
+	// PeerID: a binding is only believed for the user's own identity key.
 	alice, _ := userService.CreateUser("alice", "alice@university.edu", "password")
-	alice.PeerID = "peer-alice-001"
 	alice.IPAddress = "192.168.1.10"
-	alice.Status = models.StatusOnline
 
 	bob, _ := userService.CreateUser("bob", "bob@university.edu", "password")
-	bob.PeerID = "peer-bob-002"
 	bob.IPAddress = "192.168.1.11"
-	bob.Status = models.StatusOnline
 
 	charlie, _ := userService.CreateUser("charlie", "charlie@university.edu", "password")
-	charlie.PeerID = "peer-charlie-003"
 	charlie.IPAddress = "192.168.1.12"
-	charlie.Status = models.StatusOffline
 
 	diana, _ := userService.CreateUser("diana", "diana@university.edu", "password")
-	diana.PeerID = "peer-diana-004"
 	diana.IPAddress = "192.168.1.13"
-	diana.Status = models.StatusOnline
 
 	eve, _ := userService.CreateUser("eve", "eve@university.edu", "password")
-	eve.PeerID = "peer-eve-005"
 	eve.IPAddress = "192.168.1.14"
-	eve.Status = models.StatusOffline
+
+	for _, user := range []*models.User{alice, bob, charlie, diana, eve} {
+		userService.UpdateUser(user)
+	}
 
 	// Make Alice a top contributor
 	for i := 0; i < 50; i++ {
@@ -176,14 +478,12 @@ func seedDemoData(store *store.MemoryStore, userService *services.UserService, l
 		resource.Tags = r.tags
 		resource.Description = "Comprehensive academic resource for " + r.title
 
-		// Add peers
-		resource.AddPeer(models.PeerID("peer-alice-001"))
-		if r.uploader != alice.ID {
-			resource.AddPeer(models.PeerID("peer-bob-002"))
+		resource, err := libService.UploadContent(resource, demoContent(r.title, r.size))
+		if err != nil {
+			log.Printf("Failed to seed %s: %v", r.filename, err)
+			continue
 		}
 
-		libService.Upload(resource)
-
 		// Add varied ratings
 		resource.AddRating(models.Rating(4.0))
 		resource.AddRating(models.Rating(4.5))
@@ -191,7 +491,18 @@ func seedDemoData(store *store.MemoryStore, userService *services.UserService, l
 
 		// Add some downloads
 		resource.DownloadCount = int(r.size / 100000)
+		resourceStore.Update(resource)
 	}
 
 	fmt.Println("✅ Demo data seeded: 5 users, 15 resources")
 }
+
+// demoContent generates placeholder file bytes of the given size
+func demoContent(title string, size int64) []byte {
+	var sb strings.Builder
+	sb.Grow(int(size))
+	for page := 1; int64(sb.Len()) < size; page++ {
+		fmt.Fprintf(&sb, "%s - page %d\n", title, page)
+	}
+	return []byte(sb.String()[:size])
+}
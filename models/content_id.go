@@ -0,0 +1,100 @@
+// Package models - Content addressing
+//
+// A ContentID is the root of a hash tree built over a file's 1MB chunks.
+// Two uploads of the same bytes always get the same ID, and anyone holding
+// the bytes can recompute the root to check that they match the ID.
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Domain separation prefixes keep a leaf hash from ever being mistaken for
+// an interior node hash
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// ============================================================================
+// HASH TREE
+// ============================================================================
+
+// ChunkHash returns the leaf hash of one chunk of data
+func ChunkHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// HashTreeRoot combines leaf hashes pairwise until one root is left.
+// A node without a sibling is promoted to the next level unchanged.
+func HashTreeRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return ChunkHash(nil)
+	}
+	levels := hashTreeLevels(leaves)
+	return levels[len(levels)-1][0]
+}
+
+// hashTreeLevels returns every level of the tree, leaves first and the
+// root last
+func hashTreeLevels(leaves [][]byte) [][][]byte {
+	levels := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, hashPair(level[i], level[i+1]))
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// hashPair returns the interior node hash of two children
+func hashPair(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// ============================================================================
+// CONTENT IDS
+// ============================================================================
+
+// ChunkHashes splits data into ChunkSize pieces and returns their leaf hashes
+func ChunkHashes(data []byte) [][]byte {
+	leaves := make([][]byte, 0, ChunkCountFor(int64(len(data))))
+	for start := 0; start < len(data); start += ChunkSize {
+		end := start + ChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		leaves = append(leaves, ChunkHash(data[start:end]))
+	}
+	return leaves
+}
+
+// ContentIDFromHashes returns the ContentID for a file's chunk leaf hashes
+func ContentIDFromHashes(leaves [][]byte) ContentID {
+	return ContentID(hex.EncodeToString(HashTreeRoot(leaves)))
+}
+
+// ComputeContentID returns the ContentID of a file's bytes
+func ComputeContentID(data []byte) ContentID {
+	return ContentIDFromHashes(ChunkHashes(data))
+}
+
+// VerifyContent reports whether data is the content named by id
+func VerifyContent(id ContentID, data []byte) bool {
+	return ComputeContentID(data) == id
+}
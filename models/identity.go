@@ -0,0 +1,95 @@
+// Package models - Peer identities
+//
+// Every node owns an ed25519 keypair and its PeerID is the hex encoding of
+// the public key. Anyone holding a PeerID can therefore check a signature
+// made by that peer without any other key exchange, and nobody can claim a
+// PeerID without the matching private key.
+package models
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// ============================================================================
+// IDENTITY
+// ============================================================================
+
+// Identity is a node's signing keypair
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+// NewIdentity generates a fresh random identity
+func NewIdentity() (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{PublicKey: pub, PrivateKey: priv}, nil
+}
+
+// IdentityFromSeed rebuilds an identity from its 32-byte private seed
+func IdentityFromSeed(seed []byte) (*Identity, bool) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, false
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	return &Identity{PublicKey: priv.Public().(ed25519.PublicKey), PrivateKey: priv}, true
+}
+
+// Seed returns the private seed the identity can be rebuilt from
+func (id *Identity) Seed() []byte {
+	return id.PrivateKey.Seed()
+}
+
+// PeerID returns the PeerID derived from the public key
+func (id *Identity) PeerID() PeerID {
+	return PeerIDFromPublicKey(id.PublicKey)
+}
+
+// Sign signs data with the private key
+func (id *Identity) Sign(data []byte) []byte {
+	return ed25519.Sign(id.PrivateKey, data)
+}
+
+// ============================================================================
+// VERIFICATION
+// ============================================================================
+
+// PeerIDFromPublicKey derives the PeerID owned by a public key
+func PeerIDFromPublicKey(pub ed25519.PublicKey) PeerID {
+	return PeerID(hex.EncodeToString(pub))
+}
+
+// PublicKeyFromPeerID recovers the public key a PeerID was derived from
+func PublicKeyFromPeerID(id PeerID) (ed25519.PublicKey, bool) {
+	pub, err := hex.DecodeString(string(id))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, false
+	}
+	return ed25519.PublicKey(pub), true
+}
+
+// VerifySignature reports whether sig is a signature of data made by the
+// peer named id
+func VerifySignature(id PeerID, data, sig []byte) bool {
+	pub, ok := PublicKeyFromPeerID(id)
+	if !ok || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(pub, data, sig)
+}
+
+// signingBytes joins the fields of a signed record behind a domain tag,
+// so a signature over one kind of record can't be passed off as another
+func signingBytes(domain string, fields ...string) []byte {
+	buf := []byte(domain)
+	for _, f := range fields {
+		buf = append(buf, 0)
+		buf = append(buf, f...)
+	}
+	return buf
+}
@@ -0,0 +1,104 @@
+// Package models - Chunk manifests
+//
+// A Manifest lists the leaf hash of every chunk of a resource. The hash
+// tree over those leaves has the ContentID as its root, so a peer serving
+// a chunk can attach the sibling hashes on the path to the root (a proof)
+// and the downloader can check that single chunk against the ContentID
+// without having any of the others.
+package models
+
+import (
+	"bytes"
+	"encoding/hex"
+)
+
+// ============================================================================
+// MANIFEST
+// ============================================================================
+
+// Manifest describes the chunks that make up a resource's content
+type Manifest struct {
+	Root        ContentID `json:"root"`         // Hash tree root, equal to the resource ID
+	Size        int64     `json:"size"`         // Total content size in bytes
+	ChunkHashes [][]byte  `json:"chunk_hashes"` // Leaf hash of each chunk, in order
+}
+
+// NewManifest builds the manifest for a file's bytes
+func NewManifest(data []byte) *Manifest {
+	return NewManifestFromHashes(int64(len(data)), ChunkHashes(data))
+}
+
+// NewManifestFromHashes builds a manifest from already computed leaf hashes
+func NewManifestFromHashes(size int64, leaves [][]byte) *Manifest {
+	return &Manifest{
+		Root:        ContentIDFromHashes(leaves),
+		Size:        size,
+		ChunkHashes: leaves,
+	}
+}
+
+// Valid reports whether the manifest is internally consistent: it has one
+// leaf per chunk and the leaves hash to its root
+func (m *Manifest) Valid() bool {
+	if m == nil || len(m.ChunkHashes) != ChunkCountFor(m.Size) {
+		return false
+	}
+	return ContentIDFromHashes(m.ChunkHashes) == m.Root
+}
+
+// Proof returns the sibling hashes on the path from chunk index to the
+// root. Levels where the node has no sibling contribute nothing.
+func (m *Manifest) Proof(index int) [][]byte {
+	if index < 0 || index >= len(m.ChunkHashes) {
+		return nil
+	}
+
+	var proof [][]byte
+	for _, level := range hashTreeLevels(m.ChunkHashes) {
+		if len(level) == 1 {
+			break
+		}
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		index /= 2
+	}
+	return proof
+}
+
+// ============================================================================
+// PROOF VERIFICATION
+// ============================================================================
+
+// VerifyChunkProof checks that data is chunk index of the total chunks of
+// the content named by root, using the proof supplied with the chunk
+func VerifyChunkProof(root ContentID, index, total int, data []byte, proof [][]byte) bool {
+	if index < 0 || index >= total {
+		return false
+	}
+
+	hash := ChunkHash(data)
+	used := 0
+	for width := total; width > 1; width = (width + 1) / 2 {
+		sibling := index ^ 1
+		if sibling < width {
+			if used == len(proof) {
+				return false
+			}
+			if index%2 == 0 {
+				hash = hashPair(hash, proof[used])
+			} else {
+				hash = hashPair(proof[used], hash)
+			}
+			used++
+		}
+		index /= 2
+	}
+
+	expected, err := hex.DecodeString(string(root))
+	if err != nil {
+		return false
+	}
+	return used == len(proof) && bytes.Equal(hash, expected)
+}
@@ -5,6 +5,7 @@
 package models
 
 import (
+	"sort"
 	"time"
 )
 
@@ -14,11 +15,12 @@ import (
 
 // Peer represents a node in the P2P network
 type Peer struct {
-	ID            PeerID     `json:"id"`
-	UserID        UserID     `json:"user_id"`
-	IPAddress     string     `json:"ip_address"`
-	Port          int        `json:"port"`
-	Status        PeerStatus `json:"status"`
+	ID            PeerID          `json:"id"`
+	UserID        UserID          `json:"user_id"`
+	IPAddress     string          `json:"ip_address"`
+	Port          int             `json:"port"`
+	Status        PeerStatus      `json:"status"`
+	DiscoveredVia DiscoverySource `json:"discovered_via,omitempty"` // how we first heard of the peer
 	
 	// Statistics
 	SharedResources int   `json:"shared_resources"` // Count of shared files
@@ -57,7 +59,9 @@ type PeerConnection struct {
 // PEER LIST (Slice Operations)
 // ============================================================================
 
-// PeerList manages a collection of peers using slices
+// PeerList manages a collection of peers using slices. When Capacity is
+// positive the list never holds more than Capacity peers; adding one more
+// evicts the peer that was seen least recently (oldest LastPingAt).
 type PeerList struct {
 	Peers    []Peer `json:"peers"`
 	Capacity int    `json:"capacity"`
@@ -72,9 +76,53 @@ func NewPeerList(capacity int) *PeerList {
 	}
 }
 
-// Add adds a peer to the list
-func (pl *PeerList) Add(peer Peer) {
+// Add adds a peer to the list, or refreshes its entry if it is already
+// there. If the list grows past Capacity the least recently seen peer is
+// removed and returned.
+func (pl *PeerList) Add(peer Peer) *Peer {
+	if existing := pl.FindByID(peer.ID); existing != nil {
+		lastSeen := existing.LastPingAt
+		*existing = peer
+		if lastSeen.After(peer.LastPingAt) {
+			existing.LastPingAt = lastSeen
+		}
+		return nil
+	}
+
 	pl.Peers = append(pl.Peers, peer)
+	if pl.Capacity <= 0 || len(pl.Peers) <= pl.Capacity {
+		return nil
+	}
+
+	oldest := 0
+	for i := range pl.Peers {
+		if pl.Peers[i].LastPingAt.Before(pl.Peers[oldest].LastPingAt) {
+			oldest = i
+		}
+	}
+	evicted := pl.Peers[oldest]
+	pl.Peers = append(pl.Peers[:oldest], pl.Peers[oldest+1:]...)
+	return &evicted
+}
+
+// Touch marks a peer as seen now
+func (pl *PeerList) Touch(peerID PeerID) {
+	if p := pl.FindByID(peerID); p != nil {
+		p.LastPingAt = TimeNow()
+	}
+}
+
+// MostRecent returns up to n peers, most recently seen first
+func (pl *PeerList) MostRecent(n int) []Peer {
+	sorted := make([]Peer, len(pl.Peers))
+	copy(sorted, pl.Peers)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].LastPingAt.After(sorted[j].LastPingAt)
+	})
+	if n >= 0 && n < len(sorted) {
+		sorted = sorted[:n]
+	}
+	return sorted
 }
 
 // Remove removes a peer by ID
@@ -4,6 +4,7 @@
 package models
 
 import (
+	"strconv"
 	"time"
 )
 
@@ -19,6 +20,9 @@ type ResourceRating struct {
 	Rating     Rating    `json:"rating"`      // 1-5 stars
 	Comment    string    `json:"comment"`
 	CreatedAt  time.Time `json:"created_at"`
+	SignedBy   PeerID    `json:"signed_by,omitempty"` // Peer that vouched for the rating
+	Signature  []byte    `json:"signature,omitempty"` // SignedBy's signature over SigningBytes
+	Version    uint64    `json:"version"`             // Bumped by the store on every change
 }
 
 // RatingRequest is used for API requests
@@ -56,3 +60,36 @@ func NewResourceRating(resourceID ContentID, userID UserID, rating Rating, comme
 func (r *ResourceRating) IsValid() bool {
 	return IsValidRating(r.Rating)
 }
+
+// Clone returns a copy that shares no slices with the original
+func (r *ResourceRating) Clone() *ResourceRating {
+	c := *r
+	c.Signature = cloneBytes(r.Signature)
+	return &c
+}
+
+// ============================================================================
+// SIGNATURES
+// ============================================================================
+
+// SigningBytes returns what a rater signs
+func (r *ResourceRating) SigningBytes() []byte {
+	return signingBytes("p2p-library/rating", r.ID, string(r.ResourceID), string(r.UserID),
+		strconv.FormatFloat(float64(r.Rating), 'g', -1, 64), r.Comment, r.CreatedAt.UTC().Format(time.RFC3339Nano))
+}
+
+// Sign records id as the peer vouching for the rating
+func (r *ResourceRating) Sign(id *Identity) {
+	r.SignedBy = id.PeerID()
+	r.Signature = id.Sign(r.SigningBytes())
+}
+
+// IsSigned reports whether the rating carries a signature
+func (r *ResourceRating) IsSigned() bool {
+	return r.SignedBy != "" || len(r.Signature) > 0
+}
+
+// VerifySignature reports whether the rating is validly signed by SignedBy
+func (r *ResourceRating) VerifySignature() bool {
+	return VerifySignature(r.SignedBy, r.SigningBytes(), r.Signature)
+}
@@ -13,6 +13,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -44,6 +45,9 @@ type Resource struct {
 	UploadedBy  UserID   `json:"uploaded_by"`
 	AvailableOn []PeerID `json:"available_on"`   // Slice of peers having this file
 	ChunkCount  int      `json:"chunk_count"`    // Number of chunks
+	Manifest    *Manifest `json:"manifest,omitempty"` // Chunk hashes under the CID
+	SignedBy    PeerID   `json:"signed_by,omitempty"`  // Peer that vouched for the upload
+	Signature   []byte   `json:"signature,omitempty"`  // SignedBy's signature over SigningBytes
 	
 	// Rating information
 	TotalRatings  int     `json:"total_ratings"`
@@ -54,6 +58,10 @@ type Resource struct {
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 	DownloadCount int     `json:"download_count"`
+	
+	// Version counts the stored changes; an update based on an older
+	// version is rejected by the store
+	Version uint64 `json:"version"`
 }
 
 // ============================================================================
@@ -67,6 +75,26 @@ type ResourceChunk struct {
 	TotalChunks int       `json:"total_chunks"`
 	Data        []byte    `json:"data"`         // Slice of bytes
 	Checksum    string    `json:"checksum"`     // Chunk verification
+	Proof       [][]byte  `json:"proof,omitempty"` // Manifest path to the CID
+}
+
+// ChecksumChunk returns the hex-encoded SHA-256 of a chunk's data
+func ChecksumChunk(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// Verify checks that the chunk data matches its checksum
+func (c *ResourceChunk) Verify() bool {
+	return c.Checksum == ChecksumChunk(c.Data)
+}
+
+// ChunkCountFor returns how many ChunkSize pieces a file of size bytes needs
+func ChunkCountFor(size int64) int {
+	if size <= 0 {
+		return 0
+	}
+	return int((size + ChunkSize - 1) / ChunkSize)
 }
 
 // ============================================================================
@@ -107,7 +135,9 @@ type TopResources struct {
 // CONSTRUCTOR AND METHODS
 // ============================================================================
 
-// NewResource creates a new resource with generated CID
+// NewResource creates a new resource with generated CID.
+// Without the file bytes the CID is only a placeholder derived from the
+// filename and time; use NewResourceFromContent when the content is known.
 func NewResource(filename string, size int64, uploadedBy UserID) *Resource {
 	now := TimeNow()
 	ext := strings.ToLower(filepath.Ext(filename))
@@ -125,6 +155,7 @@ func NewResource(filename string, size int64, uploadedBy UserID) *Resource {
 		UploadedBy:    uploadedBy,
 		Tags:          make([]string, 0),        // Initialize empty slice
 		AvailableOn:   make([]PeerID, 0),        // Initialize empty slice
+		ChunkCount:    ChunkCountFor(size),
 		TotalRatings:  0,
 		AverageRating: 0,
 		CreatedAt:     now,
@@ -132,6 +163,16 @@ func NewResource(filename string, size int64, uploadedBy UserID) *Resource {
 	}
 }
 
+// NewResourceFromContent creates a resource whose CID is computed from
+// the file bytes, so identical files always share one ID. The chunk
+// manifest is attached so peers can verify each chunk as it arrives.
+func NewResourceFromContent(filename string, data []byte, uploadedBy UserID) *Resource {
+	resource := NewResource(filename, int64(len(data)), uploadedBy)
+	resource.Manifest = NewManifest(data)
+	resource.ID = resource.Manifest.Root
+	return resource
+}
+
 // getResourceType maps file extension to resource type
 func getResourceType(ext string) ResourceType {
 	switch ext {
@@ -223,3 +264,52 @@ func (r *Resource) HasTag(tag string) bool {
 	}
 	return false
 }
+
+// Clone returns a copy that shares no slices with the original, so
+// changing one never shows up in the other. The manifest is never
+// changed once built and is shared.
+func (r *Resource) Clone() *Resource {
+	c := *r
+	if r.Tags != nil {
+		c.Tags = append(make([]string, 0, len(r.Tags)), r.Tags...)
+	}
+	if r.AvailableOn != nil {
+		c.AvailableOn = append(make([]PeerID, 0, len(r.AvailableOn)), r.AvailableOn...)
+	}
+	c.Signature = cloneBytes(r.Signature)
+	return &c
+}
+
+// cloneBytes copies a byte slice, keeping nil as nil
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
+
+// ============================================================================
+// SIGNATURES
+// ============================================================================
+
+// SigningBytes returns what an uploader signs: the content, who uploaded
+// it and under which name
+func (r *Resource) SigningBytes() []byte {
+	return signingBytes("p2p-library/resource", string(r.ID), string(r.UploadedBy), r.Filename, strconv.FormatInt(r.Size, 10))
+}
+
+// Sign records id as the peer vouching for the upload
+func (r *Resource) Sign(id *Identity) {
+	r.SignedBy = id.PeerID()
+	r.Signature = id.Sign(r.SigningBytes())
+}
+
+// IsSigned reports whether the resource carries a signature
+func (r *Resource) IsSigned() bool {
+	return r.SignedBy != "" || len(r.Signature) > 0
+}
+
+// VerifySignature reports whether the resource is validly signed by SignedBy
+func (r *Resource) VerifySignature() bool {
+	return VerifySignature(r.SignedBy, r.SigningBytes(), r.Signature)
+}
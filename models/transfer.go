@@ -0,0 +1,88 @@
+// Package models - Transfer ledger definitions
+//
+// Every chunk that moves between two peers is written to the transfer
+// ledger. Reputation is computed from the ledger's byte totals, so a user
+// who serves gigabytes outranks one who uploads many tiny files. A record
+// only counts when it carries a receipt: the receiving peer's signature,
+// which the sender cannot make up for itself.
+package models
+
+import (
+	"strconv"
+	"time"
+)
+
+// ============================================================================
+// TRANSFER RECORD
+// ============================================================================
+
+// TransferRecord is one completed chunk transfer from one peer to another
+type TransferRecord struct {
+	ID           string    `json:"id"`
+	ContentID    ContentID `json:"content_id"`
+	ChunkIndex   int       `json:"chunk_index"`
+	Bytes        int64     `json:"bytes"`
+	ServedBy     PeerID    `json:"served_by"`
+	ServerUser   UserID    `json:"server_user,omitempty"`
+	ReceivedBy   PeerID    `json:"received_by"`
+	ReceiverUser UserID    `json:"receiver_user,omitempty"`
+	CompletedAt  time.Time `json:"completed_at"`
+	Receipt      []byte    `json:"receipt,omitempty"` // ReceivedBy's signature over SigningBytes
+}
+
+// NewTransferRecord records that servedBy sent a chunk to receivedBy now
+func NewTransferRecord(cid ContentID, index int, bytes int64, servedBy, receivedBy PeerID) *TransferRecord {
+	now := TimeNow()
+	return &TransferRecord{
+		ID: string(cid) + "/" + strconv.Itoa(index) + "/" + string(servedBy) + "/" +
+			string(receivedBy) + "/" + strconv.FormatInt(now.UnixNano(), 10),
+		ContentID:   cid,
+		ChunkIndex:  index,
+		Bytes:       bytes,
+		ServedBy:    servedBy,
+		ReceivedBy:  receivedBy,
+		CompletedAt: now,
+	}
+}
+
+// IsValid checks that the record describes a real transfer between two
+// different peers
+func (r *TransferRecord) IsValid() bool {
+	return r.ContentID != "" && r.ChunkIndex >= 0 && r.Bytes > 0 &&
+		r.ServedBy != "" && r.ReceivedBy != "" && r.ServedBy != r.ReceivedBy
+}
+
+// SigningBytes returns what the receiving peer signs
+func (r *TransferRecord) SigningBytes() []byte {
+	return signingBytes("p2p-library/receipt", r.ID, string(r.ContentID), strconv.Itoa(r.ChunkIndex),
+		strconv.FormatInt(r.Bytes, 10), string(r.ServedBy), string(r.ServerUser),
+		string(r.ReceivedBy), string(r.ReceiverUser), r.CompletedAt.UTC().Format(time.RFC3339Nano))
+}
+
+// SignReceipt signs the record as its receiver. The identity must be the
+// receiving peer's, otherwise the receipt will not verify.
+func (r *TransferRecord) SignReceipt(id *Identity) {
+	r.Receipt = id.Sign(r.SigningBytes())
+}
+
+// HasReceipt reports whether the record carries a receipt
+func (r *TransferRecord) HasReceipt() bool {
+	return len(r.Receipt) > 0
+}
+
+// VerifyReceipt reports whether the receipt is ReceivedBy's signature
+func (r *TransferRecord) VerifyReceipt() bool {
+	return VerifySignature(r.ReceivedBy, r.SigningBytes(), r.Receipt)
+}
+
+// Involves reports whether a user is on either side of the transfer
+func (r *TransferRecord) Involves(userID UserID) bool {
+	return r.ServerUser == userID || r.ReceiverUser == userID
+}
+
+// Clone returns a copy that shares no slices with the original
+func (r *TransferRecord) Clone() *TransferRecord {
+	c := *r
+	c.Receipt = cloneBytes(r.Receipt)
+	return &c
+}
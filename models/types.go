@@ -57,6 +57,9 @@ const (
 	UploadWeight         = 2    // Uploads count double
 	DownloadWeight       = 1    // Downloads subtract
 	RatingWeight         = 10   // Rating multiplier
+	MisbehaviorWeight    = 10   // Each bad chunk served subtracts
+	BytesPerUpload       = 10 << 20 // Every 10MB served counts as an upload, received as a download
+	SeedHoursPerUpload   = 24       // Every day spent seeding counts as an upload
 )
 
 // UserClassification represents the user's contribution status
@@ -90,6 +93,19 @@ const (
 	StatusTransferring PeerStatus = "transferring"
 )
 
+// DiscoverySource records how a node first heard of a peer
+type DiscoverySource string
+
+const (
+	DiscoveredManual    DiscoverySource = "manual"    // registered directly
+	DiscoveredInbound   DiscoverySource = "inbound"   // connected to us
+	DiscoveredBootstrap DiscoverySource = "bootstrap" // a configured bootstrap address
+	DiscoveredPEX       DiscoverySource = "pex"       // shared by another peer
+	DiscoveredGossip    DiscoverySource = "gossip"    // gossip membership
+	DiscoveredDHT       DiscoverySource = "dht"       // DHT routing or provider records
+	DiscoveredLAN       DiscoverySource = "lan"       // local network multicast
+)
+
 // ============================================================================
 // PACKAGE VARIABLES
 // ============================================================================
@@ -34,6 +34,10 @@ type User struct {
 	TotalUploads   int     `json:"total_uploads"`   // Number of resources uploaded
 	TotalDownloads int     `json:"total_downloads"` // Number of resources downloaded
 	AverageRating  float64 `json:"average_rating"`  // Average rating received
+	BadChunks      int     `json:"bad_chunks"`      // Chunks served that failed verification
+	BytesServed    int64   `json:"bytes_served"`    // Bytes uploaded to other peers, from the transfer ledger
+	BytesReceived  int64   `json:"bytes_received"`  // Bytes downloaded from other peers, from the transfer ledger
+	SeedingSeconds int64   `json:"seeding_seconds"` // Time spent seeding downloaded or uploaded content
 
 	// Timestamps
 	CreatedAt    time.Time `json:"created_at"`     // Account creation
@@ -43,6 +47,9 @@ type User struct {
 	PeerID    PeerID     `json:"peer_id"`    // Network peer identifier
 	Status    PeerStatus `json:"status"`     // Online/Offline status
 	IPAddress string     `json:"ip_address"` // Current IP (for P2P)
+
+	// Optimistic concurrency: bumped by the store on every change
+	Version uint64 `json:"version"`
 }
 
 // ============================================================================
@@ -144,7 +151,18 @@ func (u *User) GetThrottleMultiplier() float64 {
 	}
 }
 
+// SeedCredit returns how many uploads the user's seeding time is worth
+func (u *User) SeedCredit() int {
+	return int(u.SeedingSeconds / (SeedHoursPerUpload * 3600))
+}
+
 // UpdateActivity updates the last active timestamp
 func (u *User) UpdateActivity() {
 	u.LastActiveAt = TimeNow()
 }
+
+// Clone returns a copy of the user
+func (u *User) Clone() *User {
+	c := *u
+	return &c
+}
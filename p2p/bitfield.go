@@ -0,0 +1,50 @@
+// Package p2p - Chunk bitfields
+package p2p
+
+// Bitfield records which chunks of a resource are present, one bit per chunk
+type Bitfield []byte
+
+// NewBitfield creates an empty bitfield for n chunks
+func NewBitfield(n int) Bitfield {
+	return make(Bitfield, (n+7)/8)
+}
+
+// FullBitfield creates a bitfield with all n chunks set
+func FullBitfield(n int) Bitfield {
+	b := NewBitfield(n)
+	for i := 0; i < n; i++ {
+		b.Set(i)
+	}
+	return b
+}
+
+// Set marks chunk i as present
+func (b Bitfield) Set(i int) {
+	if i >= 0 && i/8 < len(b) {
+		b[i/8] |= 1 << uint(i%8)
+	}
+}
+
+// Has reports whether chunk i is present
+func (b Bitfield) Has(i int) bool {
+	if i < 0 || i/8 >= len(b) {
+		return false
+	}
+	return b[i/8]&(1<<uint(i%8)) != 0
+}
+
+// Count returns how many of the first n chunks are present
+func (b Bitfield) Count(n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if b.Has(i) {
+			count++
+		}
+	}
+	return count
+}
+
+// Clone returns an independent copy of the bitfield
+func (b Bitfield) Clone() Bitfield {
+	return append(Bitfield(nil), b...)
+}
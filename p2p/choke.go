@@ -0,0 +1,333 @@
+// Package p2p - Tit-for-tat upload slots
+//
+// A node serves chunks to a fixed number of peers at a time. Peers that
+// are allowed to download are "unchoked"; everyone else is "choked" and
+// gets errors.ErrChoked until a slot opens. Every RechokeInterval the
+// regular slots go to the interested peers that uploaded the most to us
+// recently, with ReputationScore breaking ties, so peers that give get
+// served first. One more slot is an optimistic unchoke: it rotates through
+// the remaining peers every OptimisticInterval so newcomers with nothing
+// to offer yet still get a chance to start.
+//
+// All timing uses models.TimeNow, and rechoking happens lazily as requests
+// arrive, so tests drive the scheduler with a fake clock.
+package p2p
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"p2p-library/models"
+)
+
+// ChokeConfig tunes the upload slot scheduler
+type ChokeConfig struct {
+	// Slots is how many peers may download from us at once, including the
+	// optimistic slot. At least 2.
+	Slots int
+
+	// RechokeInterval is how often the regular slots are reassigned
+	RechokeInterval time.Duration
+
+	// OptimisticInterval is how often the optimistic slot moves on
+	OptimisticInterval time.Duration
+
+	// RateWindow is how far back uploads to us count as recent
+	RateWindow time.Duration
+
+	// InterestTimeout is how long a peer counts as interested after its
+	// last chunk request
+	InterestTimeout time.Duration
+
+	// Reputation returns a user's current score. Nil treats everyone alike.
+	Reputation func(userID models.UserID) models.ReputationScore
+}
+
+// DefaultChokeConfig returns the settings used when none are given
+func DefaultChokeConfig() ChokeConfig {
+	return ChokeConfig{
+		Slots:              4,
+		RechokeInterval:    10 * time.Second,
+		OptimisticInterval: 30 * time.Second,
+		RateWindow:         20 * time.Second,
+		InterestTimeout:    30 * time.Second,
+	}
+}
+
+// withDefaults fills in zero fields
+func (c ChokeConfig) withDefaults() ChokeConfig {
+	defaults := DefaultChokeConfig()
+	if c.Slots < 2 {
+		c.Slots = defaults.Slots
+	}
+	if c.RechokeInterval <= 0 {
+		c.RechokeInterval = defaults.RechokeInterval
+	}
+	if c.OptimisticInterval <= 0 {
+		c.OptimisticInterval = defaults.OptimisticInterval
+	}
+	if c.RateWindow <= 0 {
+		c.RateWindow = defaults.RateWindow
+	}
+	if c.InterestTimeout <= 0 {
+		c.InterestTimeout = defaults.InterestTimeout
+	}
+	return c
+}
+
+// uploadSample is a number of bytes a peer uploaded to us at some time
+type uploadSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// chokePeer is what the scheduler knows about one peer
+type chokePeer struct {
+	userID         models.UserID
+	lastRequest    time.Time      // zero if the peer never asked us for data
+	uploads        []uploadSample // oldest first, within RateWindow
+	lastOptimistic time.Time      // when it last held the optimistic slot
+}
+
+// ============================================================================
+// CHOKER
+// ============================================================================
+
+// Choker decides which peers may download from us
+type Choker struct {
+	cfg ChokeConfig
+
+	mu             sync.Mutex
+	peers          map[models.PeerID]*chokePeer
+	unchoked       map[models.PeerID]bool
+	optimistic     models.PeerID
+	nextRechoke    time.Time
+	nextOptimistic time.Time
+}
+
+// NewChoker creates a scheduler with every peer choked
+func NewChoker(cfg ChokeConfig) *Choker {
+	return &Choker{
+		cfg:      cfg.withDefaults(),
+		peers:    make(map[models.PeerID]*chokePeer),
+		unchoked: make(map[models.PeerID]bool),
+	}
+}
+
+// Allow records that a peer wants a chunk and reports whether it may have
+// one now. A free slot is handed out straight away rather than at the next
+// rechoke, so an idle node never makes its first requester wait. userID
+// must be the verified user of the request (Request.FromUser), or "" for
+// a peer whose claim could not be checked.
+func (c *Choker) Allow(peerID models.PeerID, userID models.UserID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := models.TimeNow()
+	p := c.peer(peerID)
+	p.userID = userID
+	p.lastRequest = now
+
+	if !now.Before(c.nextRechoke) {
+		c.rechoke(now)
+	}
+	if !c.unchoked[peerID] && len(c.unchoked) < c.cfg.Slots {
+		c.unchoked[peerID] = true
+	}
+	return c.unchoked[peerID]
+}
+
+// Received records bytes a peer uploaded to us
+func (c *Choker) Received(peerID models.PeerID, n int) {
+	if n <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := c.peer(peerID)
+	p.uploads = append(p.uploads, uploadSample{at: models.TimeNow(), bytes: int64(n)})
+}
+
+// Rechoke reassigns the slots now instead of waiting for the interval
+func (c *Choker) Rechoke() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rechoke(models.TimeNow())
+}
+
+// IsUnchoked reports whether a peer currently holds a slot
+func (c *Choker) IsUnchoked(peerID models.PeerID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.unchoked[peerID]
+}
+
+// Unchoked returns the peers holding a slot, sorted by ID
+func (c *Choker) Unchoked() []models.PeerID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ids := make([]models.PeerID, 0, len(c.unchoked))
+	for id := range c.unchoked {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Optimistic returns the peer in the optimistic slot, or "" if none
+func (c *Choker) Optimistic() models.PeerID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.optimistic
+}
+
+// RecentUpload returns how many bytes a peer uploaded to us within the
+// rate window
+func (c *Choker) RecentUpload(peerID models.PeerID) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.peers[peerID]
+	if !ok {
+		return 0
+	}
+	return c.recentUpload(p, models.TimeNow())
+}
+
+// ============================================================================
+// SCHEDULING
+// ============================================================================
+
+// peer returns the entry for a peer, creating it if needed (mu held)
+func (c *Choker) peer(peerID models.PeerID) *chokePeer {
+	p, ok := c.peers[peerID]
+	if !ok {
+		p = &chokePeer{}
+		c.peers[peerID] = p
+	}
+	return p
+}
+
+// recentUpload drops samples older than the rate window and sums the rest
+// (mu held)
+func (c *Choker) recentUpload(p *chokePeer, now time.Time) int64 {
+	cutoff := now.Add(-c.cfg.RateWindow)
+	keep := 0
+	for keep < len(p.uploads) && !p.uploads[keep].at.After(cutoff) {
+		keep++
+	}
+	p.uploads = p.uploads[keep:]
+
+	var total int64
+	for _, s := range p.uploads {
+		total += s.bytes
+	}
+	return total
+}
+
+// reputation returns a peer's score, or 0 without a Reputation function
+func (c *Choker) reputation(p *chokePeer) models.ReputationScore {
+	if c.cfg.Reputation == nil || p.userID == "" {
+		return 0
+	}
+	return c.cfg.Reputation(p.userID)
+}
+
+// rechoke gives the regular slots to the best interested peers and moves
+// the optimistic slot when it is due (mu held)
+func (c *Choker) rechoke(now time.Time) {
+	c.nextRechoke = now.Add(c.cfg.RechokeInterval)
+
+	type candidate struct {
+		id         models.PeerID
+		p          *chokePeer
+		recent     int64
+		reputation models.ReputationScore
+	}
+
+	var interested []candidate
+	for id, p := range c.peers {
+		recent := c.recentUpload(p, now)
+		if p.lastRequest.IsZero() || now.Sub(p.lastRequest) > c.cfg.InterestTimeout {
+			// Peers that neither ask nor give are forgotten
+			if recent == 0 {
+				delete(c.peers, id)
+			}
+			continue
+		}
+		interested = append(interested, candidate{id, p, recent, c.reputation(p)})
+	}
+
+	sort.Slice(interested, func(i, j int) bool {
+		a, b := interested[i], interested[j]
+		if a.recent != b.recent {
+			return a.recent > b.recent
+		}
+		if a.reputation != b.reputation {
+			return a.reputation > b.reputation
+		}
+		return a.id < b.id
+	})
+
+	regular := c.cfg.Slots - 1
+	if regular > len(interested) {
+		regular = len(interested)
+	}
+	c.unchoked = make(map[models.PeerID]bool, c.cfg.Slots)
+	for _, cand := range interested[:regular] {
+		c.unchoked[cand.id] = true
+	}
+
+	// Keep the optimistic peer until its turn is over, unless it stopped
+	// asking or earned a regular slot
+	rest := interested[regular:]
+	current := -1
+	for i, cand := range rest {
+		if cand.id == c.optimistic {
+			current = i
+		}
+	}
+	if current >= 0 && now.Before(c.nextOptimistic) {
+		c.unchoked[c.optimistic] = true
+		return
+	}
+
+	// The peer that waited longest since its last turn goes next
+	c.optimistic = ""
+	if len(rest) == 0 {
+		return
+	}
+	next := rest[0]
+	for _, cand := range rest[1:] {
+		if cand.p.lastOptimistic.Before(next.p.lastOptimistic) ||
+			(cand.p.lastOptimistic.Equal(next.p.lastOptimistic) && cand.id < next.id) {
+			next = cand
+		}
+	}
+	next.p.lastOptimistic = now
+	c.optimistic = next.id
+	c.nextOptimistic = now.Add(c.cfg.OptimisticInterval)
+	c.unchoked[next.id] = true
+}
+
+// ============================================================================
+// TRANSFER INTEGRATION
+// ============================================================================
+
+// SetChoker limits how many peers are served at once. Nil serves everyone.
+func (t *Transfer) SetChoker(c *Choker) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.chokes = c
+}
+
+// choker returns the upload slot scheduler, or nil
+func (t *Transfer) choker() *Choker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.chokes
+}
@@ -0,0 +1,291 @@
+// Package p2p - Unit tests for the upload slot scheduler
+package p2p
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// chokeClock replaces models.TimeNow with a clock the test moves by hand
+type chokeClock struct {
+	now time.Time
+}
+
+// useChokeClock installs a fake clock and restores the real one at cleanup
+func useChokeClock(t *testing.T) *chokeClock {
+	t.Helper()
+
+	clock := &chokeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	restore := models.TimeNow
+	models.TimeNow = func() time.Time { return clock.now }
+	t.Cleanup(func() { models.TimeNow = restore })
+	return clock
+}
+
+func (c *chokeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// askAll has every peer request a chunk
+func askAll(c *Choker, peers ...models.PeerID) {
+	for _, id := range peers {
+		c.Allow(id, models.UserID("user-"+id))
+	}
+}
+
+// ============================================================================
+// TESTS
+// ============================================================================
+
+func TestChokerFillsFreeSlotsImmediately(t *testing.T) {
+	useChokeClock(t)
+	c := NewChoker(ChokeConfig{Slots: 2})
+
+	if !c.Allow("peer-a", "user-a") || !c.Allow("peer-b", "user-b") {
+		t.Fatal("Peers asking an idle node were choked")
+	}
+	if c.Allow("peer-c", "user-c") {
+		t.Error("Third peer was unchoked with only two slots")
+	}
+}
+
+func TestChokerFavorsPeersThatUploadToUs(t *testing.T) {
+	clock := useChokeClock(t)
+	cfg := DefaultChokeConfig()
+	cfg.Slots = 3
+	c := NewChoker(cfg)
+
+	askAll(c, "peer-a", "peer-b", "peer-c", "peer-d", "peer-e")
+	c.Received("peer-d", 3000)
+	c.Received("peer-e", 2000)
+	c.Received("peer-a", 100)
+
+	clock.advance(cfg.RechokeInterval)
+	askAll(c, "peer-a", "peer-b", "peer-c", "peer-d", "peer-e")
+
+	if !c.IsUnchoked("peer-d") || !c.IsUnchoked("peer-e") {
+		t.Errorf("Unchoked = %v; want the two biggest uploaders among them", c.Unchoked())
+	}
+	if got := len(c.Unchoked()); got != cfg.Slots {
+		t.Errorf("Got %d unchoked peers; want %d", got, cfg.Slots)
+	}
+	opt := c.Optimistic()
+	if opt == "" || opt == "peer-d" || opt == "peer-e" {
+		t.Errorf("Optimistic = %q; want one of the choked peers", opt)
+	}
+}
+
+func TestChokerBreaksTiesByReputation(t *testing.T) {
+	useChokeClock(t)
+	scores := map[models.UserID]models.ReputationScore{
+		"user-peer-a": 10,
+		"user-peer-b": 90,
+		"user-peer-c": 50,
+		"user-peer-d": 70,
+	}
+	c := NewChoker(ChokeConfig{
+		Slots:      3,
+		Reputation: func(userID models.UserID) models.ReputationScore { return scores[userID] },
+	})
+
+	askAll(c, "peer-a", "peer-b", "peer-c", "peer-d")
+	c.Rechoke()
+
+	if !c.IsUnchoked("peer-b") || !c.IsUnchoked("peer-d") {
+		t.Errorf("Unchoked = %v; want the two best-reputed peers", c.Unchoked())
+	}
+	if opt := c.Optimistic(); opt != "peer-a" && opt != "peer-c" {
+		t.Errorf("Optimistic = %q; want peer-a or peer-c", opt)
+	}
+}
+
+func TestOptimisticUnchokeRotates(t *testing.T) {
+	clock := useChokeClock(t)
+	cfg := ChokeConfig{
+		Slots:              2,
+		RechokeInterval:    10 * time.Second,
+		OptimisticInterval: 30 * time.Second,
+	}
+	c := NewChoker(cfg)
+
+	// peer-x keeps the regular slot by uploading; the rest take turns
+	others := []models.PeerID{"peer-a", "peer-b", "peer-c"}
+	seen := make(map[models.PeerID]bool)
+	for round := 0; round < len(others); round++ {
+		c.Received("peer-x", 1000)
+		askAll(c, append(others, "peer-x")...)
+		c.Rechoke()
+
+		opt := c.Optimistic()
+		if seen[opt] {
+			t.Fatalf("Round %d: %s got the optimistic slot twice before everyone had a turn", round, opt)
+		}
+		seen[opt] = true
+		if !c.IsUnchoked("peer-x") || !c.IsUnchoked(opt) {
+			t.Fatalf("Round %d: unchoked = %v; want peer-x and %s", round, c.Unchoked(), opt)
+		}
+
+		// A rechoke before the optimistic interval keeps the same peer
+		clock.advance(cfg.RechokeInterval)
+		askAll(c, append(others, "peer-x")...)
+		c.Rechoke()
+		if c.Optimistic() != opt {
+			t.Fatalf("Round %d: optimistic slot moved from %s to %s early", round, opt, c.Optimistic())
+		}
+
+		clock.advance(cfg.OptimisticInterval)
+	}
+	for _, id := range others {
+		if !seen[id] {
+			t.Errorf("%s never got the optimistic slot", id)
+		}
+	}
+}
+
+func TestRecentUploadsExpire(t *testing.T) {
+	clock := useChokeClock(t)
+	cfg := DefaultChokeConfig()
+	c := NewChoker(cfg)
+
+	c.Received("peer-a", 500)
+	clock.advance(cfg.RateWindow / 2)
+	c.Received("peer-a", 300)
+
+	if got := c.RecentUpload("peer-a"); got != 800 {
+		t.Errorf("RecentUpload = %d; want 800", got)
+	}
+	clock.advance(cfg.RateWindow/2 + time.Second)
+	if got := c.RecentUpload("peer-a"); got != 300 {
+		t.Errorf("RecentUpload after the window = %d; want 300", got)
+	}
+}
+
+func TestChokerDropsPeersThatStopAsking(t *testing.T) {
+	clock := useChokeClock(t)
+	cfg := DefaultChokeConfig()
+	cfg.Slots = 2
+	c := NewChoker(cfg)
+
+	askAll(c, "peer-a", "peer-b")
+	clock.advance(cfg.InterestTimeout + time.Second)
+
+	// peer-a and peer-b went quiet, so a newcomer gets a slot at once
+	if !c.Allow("peer-c", "user-c") {
+		t.Error("Newcomer choked although the slot holders lost interest")
+	}
+	if c.IsUnchoked("peer-a") && c.IsUnchoked("peer-b") {
+		t.Errorf("Unchoked = %v; idle peers kept both slots", c.Unchoked())
+	}
+}
+
+func TestChokedPeerIsTurnedAway(t *testing.T) {
+	seeder := newTestTransfer(t, "seeder")
+	seeder.SetChoker(NewChoker(ChokeConfig{Slots: 2}))
+
+	data := testContent(models.ChunkSize)
+	resource := models.NewResourceFromContent("lecture.pdf", data, "user-seeder")
+	if err := seeder.Publish(resource, data); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	var errs []error
+	for _, name := range []string{"alice", "bob", "carol"} {
+		leecher := newTestTransfer(t, name)
+		register(t, leecher.node, seeder.node)
+		_, err := leecher.FetchChunk(seeder.node.ID(), resource.ID, 0)
+		errs = append(errs, err)
+	}
+
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("First two leechers failed: %v, %v", errs[0], errs[1])
+	}
+	if !errors.Is(errs[2], errors.ErrChoked) {
+		t.Errorf("Third leecher: err = %v; want %v", errs[2], errors.ErrChoked)
+	}
+}
+
+func TestChokerOnlyRanksVerifiedUsers(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		asked = make(map[models.UserID]bool)
+	)
+	seeder := newTestTransfer(t, "seeder")
+	choker := NewChoker(ChokeConfig{
+		Slots: 2,
+		Reputation: func(userID models.UserID) models.ReputationScore {
+			mu.Lock()
+			defer mu.Unlock()
+			asked[userID] = true
+			return 100
+		},
+	})
+	seeder.SetChoker(choker)
+
+	data := testContent(models.ChunkSize)
+	resource := models.NewResourceFromContent("lecture.pdf", data, "user-seeder")
+	if err := seeder.Publish(resource, data); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	// The impostor claims the contributor's UserID, which the seeder has
+	// bound to the contributor's own peer
+	contributor := newTestNode(t, "contributor")
+	impostor := newTestTransfer(t, "contributor")
+	honest := newTestTransfer(t, "honest")
+	trustUsers(seeder.node, contributor, honest.node)
+	for _, leecher := range []*Transfer{impostor, honest} {
+		register(t, leecher.node, seeder.node)
+		if _, err := leecher.FetchChunk(seeder.node.ID(), resource.ID, 0); err != nil {
+			t.Fatalf("FetchChunk failed: %v", err)
+		}
+	}
+	choker.Rechoke()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if asked[contributor.UserID()] {
+		t.Error("The impostor was ranked by the reputation of the user it claimed")
+	}
+	if !asked[honest.node.UserID()] {
+		t.Error("The verified user's reputation was not consulted")
+	}
+}
+
+func TestSwarmWaitsOutChoke(t *testing.T) {
+	seeder := newTestTransfer(t, "seeder")
+	choker := NewChoker(ChokeConfig{
+		Slots:           2,
+		RechokeInterval: 50 * time.Millisecond,
+		InterestTimeout: 150 * time.Millisecond,
+	})
+	seeder.SetChoker(choker)
+
+	data := testContent(3*models.ChunkSize + 10)
+	resource := models.NewResourceFromContent("lecture.pdf", data, "user-seeder")
+	if err := seeder.Publish(resource, data); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	// Two other peers hold both slots, then go quiet
+	askAll(choker, "peer-x", "peer-y")
+
+	leecher := newTestTransfer(t, "leecher")
+	leecher.SetSwarmOptions(SwarmOptions{ChokeBackoff: 20 * time.Millisecond})
+	register(t, leecher.node, seeder.node)
+	resource.AddPeer(seeder.node.ID())
+
+	progress, err := leecher.Download(resource)
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if err := progress.Wait(); err != nil {
+		t.Fatalf("Download gave up on a choking peer: %v", err)
+	}
+	got, _ := leecher.Content().Get(resource.ID)
+	if !bytes.Equal(got, data) {
+		t.Error("Downloaded content does not match the original")
+	}
+}
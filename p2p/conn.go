@@ -0,0 +1,278 @@
+// Package p2p - Peer connection handling
+//
+// Each established connection runs a read loop in its own goroutine.
+// Replies are routed back to the waiting caller through a channel keyed
+// by request ID, and incoming requests are dispatched to the node's
+// registered handlers.
+package p2p
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// ============================================================================
+// PEER CONNECTION
+// ============================================================================
+
+// peerConn is a live, handshaken connection to a remote peer
+type peerConn struct {
+	node     *Node
+	conn     *meteredConn
+	remote   Hello
+	outbound bool // true if we dialed this connection
+
+	// info is the public view of this connection (guarded by mu)
+	mu   sync.Mutex
+	info models.PeerConnection
+
+	// limiter caps the rate at which we serve data on this connection
+	limiter *TokenBucket
+
+	// writeMu serialises frames so concurrent writers don't interleave
+	writeMu sync.Mutex
+
+	// pending maps outstanding request IDs to their reply channels
+	pendingMu sync.Mutex
+	pending   map[uint64]chan *Message
+	nextID    uint64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// newPeerConn wraps an already handshaken connection
+func newPeerConn(node *Node, conn net.Conn, remote Hello) *peerConn {
+	return &peerConn{
+		node:   node,
+		conn:   &meteredConn{Conn: conn},
+		remote: remote,
+		info: models.PeerConnection{
+			LocalPeer:       node.cfg.PeerID,
+			RemotePeer:      remote.PeerID,
+			Status:          models.StatusOnline,
+			ActiveTransfers: make([]models.ContentID, 0),
+			EstablishedAt:   models.TimeNow(),
+		},
+		pending: make(map[uint64]chan *Message),
+		closed:  make(chan struct{}),
+	}
+}
+
+// send writes a single frame to the connection
+func (c *peerConn) send(msg *Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.node.cfg.WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.node.cfg.WriteTimeout))
+	}
+	return writeFrame(c.conn, msg)
+}
+
+// request sends a request and blocks until the reply arrives,
+// the timeout expires or the connection closes
+func (c *peerConn) request(typ MessageType, req, resp interface{}, timeout time.Duration) error {
+	payload, err := encodePayload(req)
+	if err != nil {
+		return err
+	}
+
+	id := atomic.AddUint64(&c.nextID, 1)
+	replyCh := make(chan *Message, 1)
+
+	c.pendingMu.Lock()
+	c.pending[id] = replyCh
+	c.pendingMu.Unlock()
+
+	defer func() {
+		c.pendingMu.Lock()
+		delete(c.pending, id)
+		c.pendingMu.Unlock()
+	}()
+
+	if err := c.send(&Message{Type: typ, ID: id, Payload: payload}); err != nil {
+		return errors.NewOperationError(string(typ), "failed to send request", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case reply := <-replyCh:
+		if reply.Error != "" {
+			return errors.NewOperationError(string(typ), reply.Error, wireError(reply.Error))
+		}
+		if resp != nil && len(reply.Payload) > 0 {
+			return json.Unmarshal(reply.Payload, resp)
+		}
+		return nil
+	case <-timer.C:
+		return errors.ErrRequestTimeout
+	case <-c.closed:
+		return errors.ErrPeerNotConnected
+	}
+}
+
+// wireErrors are the sentinels a caller may need to recognise in a
+// remote peer's error reply
+var wireErrors = []error{errors.ErrChoked}
+
+// wireError returns the sentinel a remote error message stands for, if any
+func wireError(msg string) error {
+	for _, err := range wireErrors {
+		if msg == err.Error() {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLoop processes incoming frames until the connection fails
+func (c *peerConn) readLoop() {
+	defer c.close()
+
+	for {
+		msg, err := readFrame(c.conn)
+		if err != nil {
+			return
+		}
+
+		// Only the first reply to a request is delivered; the entry
+		// is taken out so a duplicate finds nothing, and the send
+		// never blocks the loop
+		if msg.Reply {
+			c.pendingMu.Lock()
+			replyCh, ok := c.pending[msg.ID]
+			delete(c.pending, msg.ID)
+			c.pendingMu.Unlock()
+			if ok {
+				select {
+				case replyCh <- msg:
+				default:
+				}
+			}
+			continue
+		}
+
+		// Handle requests concurrently so a slow handler doesn't
+		// stall replies to our own outstanding requests
+		go c.dispatch(msg)
+	}
+}
+
+// dispatch runs the handler for an incoming request and sends the reply
+func (c *peerConn) dispatch(msg *Message) {
+	reply := &Message{Type: msg.Type, ID: msg.ID, Reply: true}
+
+	handler := c.node.handler(msg.Type)
+	if handler == nil {
+		reply.Error = "unsupported message type: " + string(msg.Type)
+	} else {
+		result, err := handler(&Request{
+			From:     c.remote.PeerID,
+			FromUser: c.node.verifiedUser(c.remote.PeerID, c.remote.UserID),
+			Payload:  msg.Payload,
+			conn:     c,
+		})
+		if err != nil {
+			reply.Error = err.Error()
+		} else if reply.Payload, err = encodePayload(result); err != nil {
+			reply.Error = err.Error()
+		}
+	}
+
+	c.send(reply)
+}
+
+// close tears the connection down exactly once
+func (c *peerConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+
+		c.mu.Lock()
+		c.info.Status = models.StatusOffline
+		c.mu.Unlock()
+
+		c.node.connectionClosed(c)
+	})
+}
+
+// sendLimiter returns the connection's rate limiter, creating it on first use
+func (c *peerConn) sendLimiter(create func() *TokenBucket) *TokenBucket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.limiter == nil {
+		c.limiter = create()
+	}
+	return c.limiter
+}
+
+// snapshot returns a copy of the public connection info
+func (c *peerConn) snapshot() models.PeerConnection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := c.info
+	info.BytesSent = atomic.LoadInt64(&c.conn.sent)
+	info.BytesReceived = atomic.LoadInt64(&c.conn.received)
+	info.ActiveTransfers = append([]models.ContentID(nil), c.info.ActiveTransfers...)
+	return info
+}
+
+// meteredConn counts the bytes that cross a connection
+type meteredConn struct {
+	net.Conn
+	sent     int64
+	received int64
+}
+
+// Read counts bytes read from the peer
+func (m *meteredConn) Read(p []byte) (int, error) {
+	n, err := m.Conn.Read(p)
+	atomic.AddInt64(&m.received, int64(n))
+	return n, err
+}
+
+// Write counts bytes written to the peer
+func (m *meteredConn) Write(p []byte) (int, error) {
+	n, err := m.Conn.Write(p)
+	atomic.AddInt64(&m.sent, int64(n))
+	return n, err
+}
+
+// ============================================================================
+// INCOMING REQUESTS
+// ============================================================================
+
+// Request is an incoming request passed to a HandlerFunc. FromUser is
+// the user the peer claimed in its handshake, set only if the node's
+// UserVerifier accepted the claim; rates and slots based on it cannot be
+// had by claiming someone else's UserID.
+type Request struct {
+	From     models.PeerID
+	FromUser models.UserID
+	Payload  json.RawMessage
+
+	conn *peerConn
+}
+
+// Decode unmarshals the request payload into v
+func (r *Request) Decode(v interface{}) error {
+	if len(r.Payload) == 0 {
+		return errors.NewValidationError("payload", "request payload is empty")
+	}
+	return json.Unmarshal(r.Payload, v)
+}
+
+// HandlerFunc serves one request type. The returned value is sent back
+// as the reply payload; a non-nil error is sent back as the reply error.
+type HandlerFunc func(req *Request) (interface{}, error)
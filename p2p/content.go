@@ -0,0 +1,289 @@
+// Package p2p - Local content storage
+//
+// ContentStore keeps the bytes of every resource this node holds as one
+// file per ContentID. Downloads are written to a ".part" file first and
+// only renamed into place once every chunk has been verified.
+package p2p
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// partialSuffix marks files that are still being downloaded
+const partialSuffix = ".part"
+
+// ============================================================================
+// CONTENT STORE
+// ============================================================================
+
+// ContentStore stores resource content on disk, keyed by ContentID
+type ContentStore struct {
+	dir string
+	mu  sync.RWMutex
+}
+
+// NewContentStore opens (creating if necessary) a content directory
+func NewContentStore(dir string) (*ContentStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.NewOperationError("NewContentStore", "failed to create "+dir, err)
+	}
+	return &ContentStore{dir: dir}, nil
+}
+
+// Dir returns the directory backing the store
+func (s *ContentStore) Dir() string {
+	return s.dir
+}
+
+// path returns the file path for a content ID after validating it
+func (s *ContentStore) path(cid models.ContentID) (string, error) {
+	id := string(cid)
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", errors.NewValidationError("content_id", "invalid content ID")
+	}
+	return filepath.Join(s.dir, id), nil
+}
+
+// Has reports whether the complete content for cid is stored locally
+func (s *ContentStore) Has(cid models.ContentID) bool {
+	path, err := s.path(cid)
+	if err != nil {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// Size returns the size in bytes of stored content
+func (s *ContentStore) Size(cid models.ContentID) (int64, error) {
+	path, err := s.path(cid)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, errors.NewNotFoundError("content", string(cid))
+	}
+	return info.Size(), nil
+}
+
+// Put stores complete content for cid, replacing any previous copy
+func (s *ContentStore) Put(cid models.ContentID, data []byte) error {
+	path, err := s.path(cid)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return errors.NewOperationError("Put", "failed to write content", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get returns the complete content for cid
+func (s *ContentStore) Get(cid models.ContentID) ([]byte, error) {
+	path, err := s.path(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewNotFoundError("content", string(cid))
+	}
+	return data, nil
+}
+
+// List returns the ContentIDs of every complete file in the store
+func (s *ContentStore) List() ([]models.ContentID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cids := make([]models.ContentID, 0, len(entries))
+	for _, e := range entries {
+		// Partial downloads, state and manifests all carry a suffix
+		if e.Type().IsRegular() && !strings.Contains(e.Name(), ".") {
+			cids = append(cids, models.ContentID(e.Name()))
+		}
+	}
+	return cids, nil
+}
+
+// Delete removes stored content (complete or partial) for cid
+func (s *ContentStore) Delete(cid models.ContentID) error {
+	path, err := s.path(cid)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	os.Remove(path + partialSuffix)
+	os.Remove(path + stateSuffix)
+	os.Remove(path + manifestSuffix)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ReadChunk reads chunk index of cid and fills in its checksum
+func (s *ContentStore) ReadChunk(cid models.ContentID, index int) (*models.ResourceChunk, error) {
+	path, err := s.path(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.NewNotFoundError("content", string(cid))
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return readChunk(f, cid, index, info.Size())
+}
+
+// readChunk reads one chunk of a file whose final size is known
+func readChunk(f io.ReaderAt, cid models.ContentID, index int, size int64) (*models.ResourceChunk, error) {
+	total := models.ChunkCountFor(size)
+	if index < 0 || index >= total {
+		return nil, errors.NewValidationError("chunk_index", "chunk index out of range")
+	}
+
+	offset := int64(index) * models.ChunkSize
+	length := size - offset
+	if length > models.ChunkSize {
+		length = models.ChunkSize
+	}
+
+	data := make([]byte, length)
+	n, err := f.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	data = data[:n]
+
+	return &models.ResourceChunk{
+		ResourceID:  cid,
+		ChunkIndex:  index,
+		TotalChunks: total,
+		Data:        data,
+		Checksum:    models.ChecksumChunk(data),
+	}, nil
+}
+
+// ============================================================================
+// PARTIAL DOWNLOADS
+// ============================================================================
+
+// openPartial opens (creating if necessary) the partial file for cid
+func (s *ContentStore) openPartial(cid models.ContentID) (*os.File, error) {
+	path, err := s.path(cid)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path+partialSuffix, os.O_RDWR|os.O_CREATE, 0o644)
+}
+
+// readPartialChunk reads a chunk that has already been verified from an
+// in-progress download, so peers can serve each other mid-transfer
+func (s *ContentStore) readPartialChunk(cid models.ContentID, index int, size int64) (*models.ResourceChunk, error) {
+	path, err := s.path(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f, err := os.Open(path + partialSuffix)
+	if err != nil {
+		return nil, errors.NewNotFoundError("content", string(cid))
+	}
+	defer f.Close()
+
+	return readChunk(f, cid, index, size)
+}
+
+// verifyPartial recomputes the content ID of a finished partial file
+func (s *ContentStore) verifyPartial(cid models.ContentID, size int64) error {
+	path, err := s.path(cid)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f, err := os.Open(path + partialSuffix)
+	if err != nil {
+		return errors.NewNotFoundError("content", string(cid))
+	}
+	defer f.Close()
+
+	total := models.ChunkCountFor(size)
+	leaves := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		chunk, err := readChunk(f, cid, i, size)
+		if err != nil {
+			return err
+		}
+		leaves = append(leaves, models.ChunkHash(chunk.Data))
+	}
+
+	if models.ContentIDFromHashes(leaves) != cid {
+		return errors.ErrContentMismatch
+	}
+	return nil
+}
+
+// commitPartial moves a finished partial file into place
+func (s *ContentStore) commitPartial(cid models.ContentID, size int64) error {
+	path, err := s.path(cid)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Truncate(path+partialSuffix, size); err != nil {
+		return err
+	}
+	return os.Rename(path+partialSuffix, path)
+}
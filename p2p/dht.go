@@ -0,0 +1,146 @@
+// Package p2p - DHT over peer connections
+//
+// The dht package is transport independent. This file carries its
+// messages over the peer node's request/reply protocol and lets Transfer
+// announce the content it holds and find providers beyond the ones listed
+// in a resource's AvailableOn.
+package p2p
+
+import (
+	"net"
+	"strconv"
+
+	"p2p-library/models"
+	"p2p-library/p2p/dht"
+)
+
+// DHT message types
+const (
+	MsgDHT MessageType = "dht"
+)
+
+// ============================================================================
+// NODE TRANSPORT
+// ============================================================================
+
+// nodeTransport delivers DHT messages over a Node's connections
+type nodeTransport struct {
+	node *Node
+}
+
+// NewDHT creates a DHT node that talks to other peers through node
+func NewDHT(node *Node, cfg dht.Config) *dht.DHT {
+	if cfg.Identity == nil {
+		cfg.Identity = node.Identity()
+	}
+	self := dht.Contact{ID: node.ID(), Addr: net.JoinHostPort("", strconv.Itoa(node.Port()))}
+	d := dht.New(self, cfg, &nodeTransport{node: node})
+
+	node.Handle(MsgDHT, func(req *Request) (interface{}, error) {
+		var msg dht.Message
+		if err := req.Decode(&msg); err != nil {
+			return nil, err
+		}
+
+		// Trust the handshake, not the message, for who the sender is,
+		// and reach them at the address we actually see them on
+		msg.Sender = dht.Contact{ID: req.From}
+		if peer, err := node.Peer(req.From); err == nil {
+			msg.Sender.Addr = net.JoinHostPort(peer.IPAddress, strconv.Itoa(peer.Port))
+		}
+		return d.HandleMessage(&msg), nil
+	})
+	return d
+}
+
+// Send implements dht.Transport. Contacts the node hasn't met before are
+// added to its address book first.
+func (t *nodeTransport) Send(to dht.Contact, msg *dht.Message) (*dht.Response, error) {
+	if err := t.node.registerContact(to); err != nil {
+		return nil, err
+	}
+
+	var resp dht.Response
+	if err := t.node.Request(to.ID, MsgDHT, msg, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// registerContact adds a DHT contact to the address book if it is new
+func (n *Node) registerContact(c dht.Contact) error {
+	return n.registerAddr(c.ID, "", c.Addr, models.DiscoveredDHT)
+}
+
+// ContactFor returns the DHT contact of a registered peer
+func (n *Node) ContactFor(peerID models.PeerID) (dht.Contact, error) {
+	peer, err := n.Peer(peerID)
+	if err != nil {
+		return dht.Contact{}, err
+	}
+	return dht.Contact{ID: peer.ID, Addr: net.JoinHostPort(peer.IPAddress, strconv.Itoa(peer.Port))}, nil
+}
+
+// ============================================================================
+// TRANSFER INTEGRATION
+// ============================================================================
+
+// SetDHT makes the transfer announce its content in the DHT and look up
+// providers there when downloading. Content already stored is announced
+// in the background.
+func (t *Transfer) SetDHT(d *dht.DHT) {
+	t.mu.Lock()
+	t.locator = d
+	t.mu.Unlock()
+
+	cids, err := t.content.List()
+	if err != nil {
+		return
+	}
+	go func() {
+		for _, cid := range cids {
+			d.Announce(cid)
+		}
+	}()
+}
+
+// dhtLocator returns the DHT, if one is set
+func (t *Transfer) dhtLocator() *dht.DHT {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.locator
+}
+
+// announce advertises a ContentID in the DHT without blocking the caller
+func (t *Transfer) announce(cid models.ContentID) {
+	if d := t.dhtLocator(); d != nil {
+		go d.Announce(cid)
+	}
+}
+
+// candidatePeers returns the peers in AvailableOn plus any providers the
+// DHT knows of. DHT providers are added to the address book.
+func (t *Transfer) candidatePeers(resource *models.Resource) []models.PeerID {
+	peers := append([]models.PeerID(nil), resource.AvailableOn...)
+
+	d := t.dhtLocator()
+	if d == nil {
+		return peers
+	}
+	providers, err := d.FindProviders(resource.ID)
+	if err != nil {
+		return peers
+	}
+
+	listed := make(map[models.PeerID]bool, len(peers))
+	for _, p := range peers {
+		listed[p] = true
+	}
+	for _, c := range providers {
+		if listed[c.ID] || c.ID == t.node.ID() || t.node.registerContact(c) != nil {
+			continue
+		}
+		peers = append(peers, c.ID)
+	}
+	return peers
+}
@@ -0,0 +1,471 @@
+// Package dht implements a Kademlia-style distributed hash table used to
+// find which peers hold a resource.
+//
+// Peers announce the ContentIDs they hold by storing provider records on
+// the K nodes whose keys are closest (by XOR distance) to the content's
+// key. Anyone can then find providers with an iterative lookup that asks
+// ever closer nodes until it reaches that neighbourhood. Records expire
+// after ProviderTTL, so providers republish them periodically.
+//
+// The DHT is independent of the wire protocol: messages are delivered by a
+// Transport, which is a TCP peer node in production and an in-process
+// SimNetwork in tests.
+package dht
+
+import (
+	"sync"
+	"time"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// ============================================================================
+// MESSAGES
+// ============================================================================
+
+// MessageKind identifies a DHT request
+type MessageKind string
+
+// DHT request kinds
+const (
+	KindPing          MessageKind = "ping"
+	KindFindNode      MessageKind = "find_node"
+	KindFindProviders MessageKind = "find_providers"
+	KindAddProvider   MessageKind = "add_provider"
+)
+
+// Message is a request from one DHT node to another. For add_provider the
+// sender is the provider being announced; nodes cannot announce others.
+type Message struct {
+	Kind      MessageKind      `json:"kind"`
+	Sender    Contact          `json:"sender"`
+	Target    Key              `json:"target,omitempty"`
+	ContentID models.ContentID `json:"content_id,omitempty"`
+
+	// The provider record for add_provider
+	IssuedAt  time.Time     `json:"issued_at"`
+	TTL       time.Duration `json:"ttl,omitempty"`
+	Signature []byte        `json:"signature,omitempty"`
+}
+
+// Response answers a Message
+type Response struct {
+	Contacts  []Contact  `json:"contacts,omitempty"`  // closest known nodes to the target
+	Providers []Provider `json:"providers,omitempty"` // for find_providers
+}
+
+// Transport delivers a message to another node and returns its response
+type Transport interface {
+	Send(to Contact, msg *Message) (*Response, error)
+}
+
+// ============================================================================
+// CONFIGURATION
+// ============================================================================
+
+// Config tunes the DHT
+type Config struct {
+	K                 int           // bucket size and replication factor
+	Alpha             int           // parallel requests per lookup round
+	ProviderTTL       time.Duration // how long a provider record lives
+	RepublishInterval time.Duration // how often local records are re-announced
+
+	// Identity signs this node's provider records. When set, provider
+	// records from other nodes are only accepted with a valid signature.
+	Identity *models.Identity
+}
+
+// DefaultConfig returns the standard Kademlia parameters
+func DefaultConfig() Config {
+	return Config{
+		K:                 20,
+		Alpha:             3,
+		ProviderTTL:       24 * time.Hour,
+		RepublishInterval: 12 * time.Hour,
+	}
+}
+
+// withDefaults fills in zero fields
+func (c Config) withDefaults() Config {
+	d := DefaultConfig()
+	if c.K <= 0 {
+		c.K = d.K
+	}
+	if c.Alpha <= 0 {
+		c.Alpha = d.Alpha
+	}
+	if c.ProviderTTL <= 0 {
+		c.ProviderTTL = d.ProviderTTL
+	}
+	if c.RepublishInterval <= 0 {
+		c.RepublishInterval = d.RepublishInterval
+	}
+	return c
+}
+
+// ============================================================================
+// DHT NODE
+// ============================================================================
+
+// DHT is one node's view of the distributed hash table
+type DHT struct {
+	self      Contact
+	cfg       Config
+	transport Transport
+	table     *RoutingTable
+	providers *providerStore
+
+	mu       sync.Mutex
+	provided map[models.ContentID]bool // content this node announces
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// New creates a DHT node that sends messages through transport
+func New(self Contact, cfg Config, transport Transport) *DHT {
+	cfg = cfg.withDefaults()
+	return &DHT{
+		self:      self,
+		cfg:       cfg,
+		transport: transport,
+		table:     NewRoutingTable(self.Key(), cfg.K),
+		providers: newProviderStore(),
+		provided:  make(map[models.ContentID]bool),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Self returns this node's contact
+func (d *DHT) Self() Contact {
+	return d.self
+}
+
+// Table returns the routing table
+func (d *DHT) Table() *RoutingTable {
+	return d.table
+}
+
+// Start republishes local provider records and drops expired ones in the
+// background until Close is called
+func (d *DHT) Start() {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(d.cfg.RepublishInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				d.Expire()
+				d.Republish()
+			}
+		}
+	}()
+}
+
+// Close stops background work
+func (d *DHT) Close() {
+	d.stopOnce.Do(func() { close(d.stop) })
+	d.wg.Wait()
+}
+
+// Bootstrap adds known contacts and looks up our own key so that nodes
+// near us learn about us and we learn about them
+func (d *DHT) Bootstrap(contacts ...Contact) error {
+	for _, c := range contacts {
+		d.table.Add(c)
+	}
+	if d.table.Size() == 0 {
+		return errors.NewOperationError("Bootstrap", "no contacts to bootstrap from", errors.ErrNoPeersAvailable)
+	}
+	d.lookup(d.self.Key(), "")
+	return nil
+}
+
+// ============================================================================
+// PUBLIC OPERATIONS
+// ============================================================================
+
+// Announce tells the network that this node provides cid. The record is
+// republished every RepublishInterval until Withdraw is called.
+func (d *DHT) Announce(cid models.ContentID) error {
+	d.mu.Lock()
+	d.provided[cid] = true
+	d.mu.Unlock()
+
+	return d.announce(cid)
+}
+
+// Withdraw stops republishing cid. Existing records expire on their own.
+func (d *DHT) Withdraw(cid models.ContentID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.provided, cid)
+}
+
+// Republish re-announces every ContentID this node provides
+func (d *DHT) Republish() {
+	d.mu.Lock()
+	cids := make([]models.ContentID, 0, len(d.provided))
+	for cid := range d.provided {
+		cids = append(cids, cid)
+	}
+	d.mu.Unlock()
+
+	for _, cid := range cids {
+		d.announce(cid)
+	}
+}
+
+// Expire drops provider records that have passed their TTL
+func (d *DHT) Expire() {
+	d.providers.expire(models.TimeNow())
+}
+
+// FindProviders looks up the peers that provide cid
+func (d *DHT) FindProviders(cid models.ContentID) ([]Contact, error) {
+	_, providers := d.lookup(ContentKey(cid), cid)
+	if len(providers) == 0 {
+		return nil, errors.NewNotFoundError("providers", string(cid))
+	}
+
+	contacts := make([]Contact, len(providers))
+	for i, p := range providers {
+		contacts[i] = p.Contact
+	}
+	return contacts, nil
+}
+
+// FindClosest returns the K nodes closest to key that the network knows of
+func (d *DHT) FindClosest(key Key) []Contact {
+	closest, _ := d.lookup(key, "")
+	return closest
+}
+
+// announce stores a provider record for this node on the closest nodes
+func (d *DHT) announce(cid models.ContentID) error {
+	self := Provider{Contact: d.self, IssuedAt: models.TimeNow().UTC(), TTL: d.cfg.ProviderTTL}
+	if d.cfg.Identity != nil {
+		self.Signature = d.cfg.Identity.Sign(providerBytes(cid, d.self.ID, self.IssuedAt, self.TTL))
+	}
+	d.providers.add(cid, self, self.Expires())
+
+	closest, _ := d.lookup(ContentKey(cid), "")
+	if len(closest) == 0 {
+		// Alone in the network; the local record is all there is
+		return nil
+	}
+
+	stored := 0
+	for _, c := range closest {
+		msg := &Message{
+			Kind:      KindAddProvider,
+			Sender:    d.self,
+			ContentID: cid,
+			IssuedAt:  self.IssuedAt,
+			TTL:       self.TTL,
+			Signature: self.Signature,
+		}
+		if _, err := d.send(c, msg); err == nil {
+			stored++
+		}
+	}
+	if stored == 0 {
+		return errors.NewOperationError("Announce", "no node accepted the provider record", errors.ErrTransferFailed)
+	}
+	return nil
+}
+
+// ============================================================================
+// MESSAGE HANDLING
+// ============================================================================
+
+// HandleMessage answers a request from another node
+func (d *DHT) HandleMessage(msg *Message) *Response {
+	d.observe(msg.Sender)
+
+	switch msg.Kind {
+	case KindFindNode:
+		return &Response{Contacts: d.closestExcept(msg.Target, msg.Sender.ID)}
+	case KindFindProviders:
+		return &Response{
+			Contacts:  d.closestExcept(ContentKey(msg.ContentID), msg.Sender.ID),
+			Providers: d.providers.get(msg.ContentID, models.TimeNow()),
+		}
+	case KindAddProvider:
+		provider := Provider{Contact: msg.Sender, IssuedAt: msg.IssuedAt, TTL: msg.TTL, Signature: msg.Signature}
+		if d.accepts(msg.ContentID, provider) {
+			// Kept until the record runs out, but no longer than our own TTL
+			expires := provider.Expires()
+			if limit := models.TimeNow().Add(d.cfg.ProviderTTL); limit.Before(expires) {
+				expires = limit
+			}
+			d.providers.add(msg.ContentID, provider, expires)
+		}
+		return &Response{}
+	default:
+		return &Response{}
+	}
+}
+
+// accepts reports whether a provider record may be stored or used: it
+// must not have expired, and with an identity configured it must be
+// signed by the provider.
+func (d *DHT) accepts(cid models.ContentID, p Provider) bool {
+	if !models.TimeNow().Before(p.Expires()) {
+		return false
+	}
+	return d.cfg.Identity == nil || p.verify(cid)
+}
+
+// closestExcept returns our K closest contacts to target, leaving out the
+// node that asked
+func (d *DHT) closestExcept(target Key, exclude models.PeerID) []Contact {
+	contacts := d.table.Closest(target, d.cfg.K+1)
+	out := contacts[:0]
+	for _, c := range contacts {
+		if c.ID != exclude {
+			out = append(out, c)
+		}
+	}
+	if len(out) > d.cfg.K {
+		out = out[:d.cfg.K]
+	}
+	return out
+}
+
+// observe records a contact we heard from. If its bucket is full the
+// oldest contact is pinged and only replaced if it doesn't answer.
+func (d *DHT) observe(c Contact) {
+	if c.ID == "" || c.ID == d.self.ID {
+		return
+	}
+
+	oldest, full := d.table.Add(c)
+	if !full {
+		return
+	}
+	go func() {
+		if _, err := d.transport.Send(oldest, &Message{Kind: KindPing, Sender: d.self}); err != nil {
+			d.table.Replace(oldest, c)
+		} else {
+			d.table.Add(oldest)
+		}
+	}()
+}
+
+// send delivers a message and keeps the routing table up to date
+func (d *DHT) send(to Contact, msg *Message) (*Response, error) {
+	resp, err := d.transport.Send(to, msg)
+	if err != nil {
+		d.table.Remove(to.ID)
+		return nil, err
+	}
+	d.observe(to)
+	return resp, nil
+}
+
+// ============================================================================
+// ITERATIVE LOOKUP
+// ============================================================================
+
+// lookup walks towards target, querying Alpha of the closest unqueried
+// nodes per round, until the K closest nodes seen have all answered. When
+// cid is set it asks for providers and stops as soon as some are found.
+// It returns the K closest live nodes and any providers.
+func (d *DHT) lookup(target Key, cid models.ContentID) ([]Contact, []Provider) {
+	var (
+		shortlist = d.table.Closest(target, d.cfg.K)
+		seen      = map[models.PeerID]bool{d.self.ID: true}
+		queried   = make(map[models.PeerID]bool)
+		alive     = make(map[models.PeerID]bool)
+		providers = make(map[models.PeerID]Provider)
+	)
+	for _, c := range shortlist {
+		seen[c.ID] = true
+	}
+	if cid != "" {
+		for _, p := range d.providers.get(cid, models.TimeNow()) {
+			providers[p.ID] = p
+		}
+	}
+
+	kind := KindFindNode
+	if cid != "" {
+		kind = KindFindProviders
+	}
+
+	for len(providers) == 0 || cid == "" {
+		// Pick up to Alpha unqueried nodes among the K closest
+		round := make([]Contact, 0, d.cfg.Alpha)
+		for i := 0; i < len(shortlist) && i < d.cfg.K && len(round) < d.cfg.Alpha; i++ {
+			if !queried[shortlist[i].ID] {
+				round = append(round, shortlist[i])
+			}
+		}
+		if len(round) == 0 {
+			break
+		}
+
+		var (
+			mu sync.Mutex
+			wg sync.WaitGroup
+		)
+		for _, c := range round {
+			queried[c.ID] = true
+			wg.Add(1)
+			go func(c Contact) {
+				defer wg.Done()
+				resp, err := d.send(c, &Message{Kind: kind, Sender: d.self, Target: target, ContentID: cid})
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					return
+				}
+				alive[c.ID] = true
+				for _, p := range resp.Providers {
+					if d.accepts(cid, p) {
+						providers[p.ID] = p
+					}
+				}
+				for _, n := range resp.Contacts {
+					if !seen[n.ID] {
+						seen[n.ID] = true
+						shortlist = append(shortlist, n)
+					}
+				}
+			}(c)
+		}
+		wg.Wait()
+
+		// Drop nodes that failed to answer and re-sort what is left
+		live := shortlist[:0]
+		for _, c := range shortlist {
+			if !queried[c.ID] || alive[c.ID] {
+				live = append(live, c)
+			}
+		}
+		shortlist = live
+		sortByDistance(target, shortlist)
+	}
+
+	closest := make([]Contact, 0, d.cfg.K)
+	for _, c := range shortlist {
+		if alive[c.ID] && len(closest) < d.cfg.K {
+			closest = append(closest, c)
+		}
+	}
+
+	found := make([]Provider, 0, len(providers))
+	for _, p := range providers {
+		found = append(found, p)
+	}
+	return closest, found
+}
@@ -0,0 +1,299 @@
+// Package dht - Unit tests for the DHT
+package dht
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"p2p-library/models"
+)
+
+// simCluster builds a simulated network of n nodes. Each node bootstraps
+// from a random node that joined before it.
+func simCluster(t *testing.T, n int, cfg Config) (*SimNetwork, []*DHT) {
+	t.Helper()
+
+	rng := rand.New(rand.NewSource(1))
+	net := NewSimNetwork()
+	nodes := make([]*DHT, 0, n)
+	for i := 0; i < n; i++ {
+		node := net.AddNode(models.PeerID(fmt.Sprintf("node-%02d", i)), cfg)
+		if i > 0 {
+			if err := node.Bootstrap(nodes[rng.Intn(i)].Self()); err != nil {
+				t.Fatalf("Bootstrap failed: %v", err)
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return net, nodes
+}
+
+// lookupRate announces one ContentID from each provider and returns the
+// fraction of (online node, ContentID) lookups that find the provider
+func lookupRate(t *testing.T, net *SimNetwork, nodes []*DHT, providers []*DHT, offline map[int]bool) float64 {
+	t.Helper()
+
+	attempts, found := 0, 0
+	for i, node := range nodes {
+		if offline[i] {
+			continue
+		}
+		for _, p := range providers {
+			cid := models.ContentID("cid-of-" + string(p.Self().ID))
+			attempts++
+
+			got, err := node.FindProviders(cid)
+			if err != nil {
+				continue
+			}
+			for _, c := range got {
+				if c.ID == p.Self().ID {
+					found++
+					break
+				}
+			}
+		}
+	}
+	return float64(found) / float64(attempts)
+}
+
+func TestKeyDistance(t *testing.T) {
+	a, b := KeyFor("a"), KeyFor("b")
+
+	if a.Distance(a) != (Key{}) {
+		t.Error("Distance to self is not zero")
+	}
+	if a.Distance(b) != b.Distance(a) {
+		t.Error("Distance is not symmetric")
+	}
+	if a.CommonPrefixLen(a) != KeyBits {
+		t.Errorf("CommonPrefixLen(self) = %d; want %d", a.CommonPrefixLen(a), KeyBits)
+	}
+
+	var x, y Key
+	y[0] = 0x10 // differs in bit 3
+	if got := x.CommonPrefixLen(y); got != 3 {
+		t.Errorf("CommonPrefixLen = %d; want 3", got)
+	}
+	if !closer(x, x, y) || closer(x, y, x) {
+		t.Error("closer gave the wrong order")
+	}
+}
+
+func TestRoutingTableFavoursOldContacts(t *testing.T) {
+	var self Key
+	table := NewRoutingTable(self, 2)
+
+	// Find three peers that land in the same bucket
+	var same []Contact
+	for i := 0; len(same) < 3; i++ {
+		c := Contact{ID: models.PeerID(fmt.Sprintf("peer-%d", i))}
+		if self.CommonPrefixLen(c.Key()) == 0 {
+			same = append(same, c)
+		}
+	}
+
+	table.Add(same[0])
+	table.Add(same[1])
+	oldest, full := table.Add(same[2])
+	if !full || oldest.ID != same[0].ID {
+		t.Fatalf("Add to full bucket = (%s, %v); want (%s, true)", oldest.ID, full, same[0].ID)
+	}
+
+	// Seeing the oldest contact again makes the other one the oldest
+	table.Add(same[0])
+	if oldest, _ := table.Add(same[2]); oldest.ID != same[1].ID {
+		t.Errorf("Oldest = %s; want %s", oldest.ID, same[1].ID)
+	}
+
+	table.Replace(same[1], same[2])
+	if got := table.Closest(self, 10); len(got) != 2 {
+		t.Errorf("Table has %d contacts; want 2", len(got))
+	}
+}
+
+func TestLookupSuccessRate(t *testing.T) {
+	net, nodes := simCluster(t, 64, Config{K: 8})
+
+	providers := nodes[:16]
+	for _, p := range providers {
+		if err := p.Announce(models.ContentID("cid-of-" + string(p.Self().ID))); err != nil {
+			t.Fatalf("Announce failed: %v", err)
+		}
+	}
+
+	rate := lookupRate(t, net, nodes, providers, nil)
+	t.Logf("Lookup success rate with 64 nodes: %.3f", rate)
+	if rate < 0.99 {
+		t.Errorf("Success rate = %.3f; want >= 0.99", rate)
+	}
+
+	// Lookups take O(log n) hops, so nobody needs to know everyone
+	for _, node := range nodes {
+		if node.Table().Size() >= len(nodes)-1 {
+			t.Errorf("%s knows every node; the table should be sparse", node.Self().ID)
+			break
+		}
+	}
+}
+
+func TestLookupSurvivesChurn(t *testing.T) {
+	net, nodes := simCluster(t, 64, Config{K: 8})
+
+	providers := nodes[:16]
+	for _, p := range providers {
+		p.Announce(models.ContentID("cid-of-" + string(p.Self().ID)))
+	}
+
+	// A quarter of the non-provider nodes drop off the network
+	offline := make(map[int]bool)
+	for i := len(providers); i < len(nodes); i += 4 {
+		offline[i] = true
+		net.SetOnline(nodes[i].Self().ID, false)
+	}
+
+	rate := lookupRate(t, net, nodes, providers, offline)
+	t.Logf("Lookup success rate with %d of 64 nodes offline: %.3f", len(offline), rate)
+	if rate < 0.95 {
+		t.Errorf("Success rate = %.3f; want >= 0.95", rate)
+	}
+}
+
+func TestProviderRecordsExpireAndRepublish(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	restore := models.TimeNow
+	models.TimeNow = func() time.Time { return now }
+	defer func() { models.TimeNow = restore }()
+
+	_, nodes := simCluster(t, 24, Config{K: 4, ProviderTTL: time.Hour})
+	provider, seeker := nodes[3], nodes[17]
+	cid := models.ContentID("cid-lecture")
+
+	provider.Announce(cid)
+	if _, err := seeker.FindProviders(cid); err != nil {
+		t.Fatalf("FindProviders failed before expiry: %v", err)
+	}
+
+	// Past the TTL without a republish the record is gone
+	now = now.Add(2 * time.Hour)
+	for _, node := range nodes {
+		node.Expire()
+	}
+	if got, err := seeker.FindProviders(cid); err == nil {
+		t.Fatalf("FindProviders found %v after expiry", got)
+	}
+
+	provider.Republish()
+	got, err := seeker.FindProviders(cid)
+	if err != nil || len(got) != 1 || got[0].ID != provider.Self().ID {
+		t.Errorf("FindProviders after republish = %v, %v; want [%s]", got, err, provider.Self().ID)
+	}
+
+	// Withdrawn content is no longer republished
+	provider.Withdraw(cid)
+	now = now.Add(2 * time.Hour)
+	provider.Republish()
+	for _, node := range nodes {
+		node.Expire()
+	}
+	if _, err := seeker.FindProviders(cid); err == nil {
+		t.Error("Withdrawn content was still found")
+	}
+}
+
+func TestProviderRecordsMustBeSigned(t *testing.T) {
+	net := NewSimNetwork()
+	nodes := make([]*DHT, 12)
+	identities := make([]*models.Identity, len(nodes))
+	for i := range nodes {
+		identities[i], _ = models.NewIdentity()
+		nodes[i] = net.AddNode(identities[i].PeerID(), Config{K: 4, Identity: identities[i]})
+		if i > 0 {
+			if err := nodes[i].Bootstrap(nodes[0].Self()); err != nil {
+				t.Fatalf("Bootstrap failed: %v", err)
+			}
+		}
+	}
+	provider, liar, victim, seeker := nodes[2], nodes[5], nodes[7], nodes[11]
+
+	// A signed announcement is found as usual
+	honest := models.ContentID("cid-honest")
+	if err := provider.Announce(honest); err != nil {
+		t.Fatalf("Announce failed: %v", err)
+	}
+	got, err := seeker.FindProviders(honest)
+	if err != nil || len(got) != 1 || got[0].ID != provider.Self().ID {
+		t.Fatalf("FindProviders = %v, %v; want [%s]", got, err, provider.Self().ID)
+	}
+
+	// The liar announces the victim as a provider, once signing with its
+	// own key and once not signing at all
+	forged := models.ContentID("cid-forged")
+	issued := models.TimeNow()
+	for _, sig := range [][]byte{identities[5].Sign(providerBytes(forged, victim.Self().ID, issued, time.Hour)), nil} {
+		for _, node := range nodes {
+			if node != liar {
+				node.HandleMessage(&Message{
+					Kind:      KindAddProvider,
+					Sender:    victim.Self(),
+					ContentID: forged,
+					IssuedAt:  issued,
+					TTL:       time.Hour,
+					Signature: sig,
+				})
+			}
+		}
+	}
+	if got, err := seeker.FindProviders(forged); err == nil {
+		t.Errorf("Forged provider records were accepted: %v", got)
+	}
+}
+
+func TestExpiredProviderRecordsAreRejected(t *testing.T) {
+	net := NewSimNetwork()
+	nodes := make([]*DHT, 8)
+	identities := make([]*models.Identity, len(nodes))
+	for i := range nodes {
+		identities[i], _ = models.NewIdentity()
+		nodes[i] = net.AddNode(identities[i].PeerID(), Config{K: 4, Identity: identities[i]})
+		if i > 0 {
+			if err := nodes[i].Bootstrap(nodes[0].Self()); err != nil {
+				t.Fatalf("Bootstrap failed: %v", err)
+			}
+		}
+	}
+	provider, seeker := nodes[2], nodes[6]
+	cid := models.ContentID("cid-old")
+
+	// A record the provider really signed, but long ago, is replayed
+	issued := models.TimeNow().Add(-48 * time.Hour)
+	record := &Message{
+		Kind:      KindAddProvider,
+		Sender:    provider.Self(),
+		ContentID: cid,
+		IssuedAt:  issued,
+		TTL:       24 * time.Hour,
+		Signature: identities[2].Sign(providerBytes(cid, provider.Self().ID, issued, 24*time.Hour)),
+	}
+	for _, node := range nodes {
+		if node != provider {
+			node.HandleMessage(record)
+		}
+	}
+	if got, err := seeker.FindProviders(cid); err == nil {
+		t.Errorf("An expired provider record was accepted: %v", got)
+	}
+
+	// Stretching the TTL breaks the signature
+	record.TTL = 72 * time.Hour
+	for _, node := range nodes {
+		if node != provider {
+			node.HandleMessage(record)
+		}
+	}
+	if got, err := seeker.FindProviders(cid); err == nil {
+		t.Errorf("A provider record with a forged TTL was accepted: %v", got)
+	}
+}
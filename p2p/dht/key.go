@@ -0,0 +1,91 @@
+// Package dht - Keys and XOR distance
+//
+// Node IDs and content IDs live in the same 256-bit key space: a key is
+// the SHA-256 of the PeerID or ContentID. The distance between two keys is
+// their XOR read as a big-endian number, so "closer" means sharing a
+// longer common prefix.
+package dht
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/bits"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// KeyBits is the size of the key space in bits
+const KeyBits = 256
+
+// Key is a point in the DHT key space
+type Key [KeyBits / 8]byte
+
+// KeyFor hashes any identifier into the key space
+func KeyFor(id string) Key {
+	return Key(sha256.Sum256([]byte(id)))
+}
+
+// PeerKey returns the key of a peer
+func PeerKey(id models.PeerID) Key {
+	return KeyFor(string(id))
+}
+
+// ContentKey returns the key under which providers of cid are stored
+func ContentKey(cid models.ContentID) Key {
+	return KeyFor(string(cid))
+}
+
+// String returns the key in hex
+func (k Key) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+// MarshalText encodes the key as hex for JSON
+func (k Key) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText decodes a hex key
+func (k *Key) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil || len(b) != len(k) {
+		return errors.NewValidationError("key", "invalid DHT key")
+	}
+	copy(k[:], b)
+	return nil
+}
+
+// Distance returns the XOR distance between two keys
+func (k Key) Distance(other Key) Key {
+	var d Key
+	for i := range k {
+		d[i] = k[i] ^ other[i]
+	}
+	return d
+}
+
+// Less reports whether distance d is smaller than other
+func (d Key) Less(other Key) bool {
+	for i := range d {
+		if d[i] != other[i] {
+			return d[i] < other[i]
+		}
+	}
+	return false
+}
+
+// CommonPrefixLen returns how many leading bits two keys share
+func (k Key) CommonPrefixLen(other Key) int {
+	for i := range k {
+		if x := k[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return KeyBits
+}
+
+// closer reports whether a is closer to target than b
+func closer(target, a, b Key) bool {
+	return target.Distance(a).Less(target.Distance(b))
+}
@@ -0,0 +1,102 @@
+// Package dht - Provider records
+//
+// A provider record says that a peer holds the content for a ContentID.
+// Records are stored on the K nodes closest to the content's key and
+// expire after ProviderTTL unless the provider republishes them. When the
+// DHT runs with an identity, each record is signed by its provider so that
+// the nodes relaying it cannot invent providers. The signature covers when
+// the record was issued and how long it lives, so a node holding an old
+// record cannot keep serving it after the provider stopped announcing.
+package dht
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"p2p-library/models"
+)
+
+// Provider is a peer that holds some content, with its signature over
+// the claim and the claim's lifetime
+type Provider struct {
+	Contact
+	IssuedAt  time.Time     `json:"issued_at"`
+	TTL       time.Duration `json:"ttl"`
+	Signature []byte        `json:"signature,omitempty"`
+}
+
+// Expires returns when the provider's claim runs out
+func (p Provider) Expires() time.Time {
+	return p.IssuedAt.Add(p.TTL)
+}
+
+// providerBytes is what a provider signs to announce cid
+func providerBytes(cid models.ContentID, provider models.PeerID, issuedAt time.Time, ttl time.Duration) []byte {
+	return []byte("p2p-library/provider\x00" + string(cid) + "\x00" + string(provider) +
+		"\x00" + issuedAt.UTC().Format(time.RFC3339Nano) + "\x00" + strconv.FormatInt(int64(ttl), 10))
+}
+
+// verify reports whether the provider really signed its claim to cid
+func (p Provider) verify(cid models.ContentID) bool {
+	return models.VerifySignature(p.ID, providerBytes(cid, p.ID, p.IssuedAt, p.TTL), p.Signature)
+}
+
+// providerRecord is one peer's claim to hold a piece of content
+type providerRecord struct {
+	provider Provider
+	expires  time.Time
+}
+
+// providerStore holds the provider records this node is responsible for
+type providerStore struct {
+	mu      sync.Mutex
+	records map[models.ContentID]map[models.PeerID]providerRecord
+}
+
+// newProviderStore creates an empty store
+func newProviderStore() *providerStore {
+	return &providerStore{records: make(map[models.ContentID]map[models.PeerID]providerRecord)}
+}
+
+// add stores or refreshes a provider record
+func (s *providerStore) add(cid models.ContentID, provider Provider, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.records[cid] == nil {
+		s.records[cid] = make(map[models.PeerID]providerRecord)
+	}
+	s.records[cid][provider.ID] = providerRecord{provider: provider, expires: expires}
+}
+
+// get returns the unexpired providers of cid
+func (s *providerStore) get(cid models.ContentID, now time.Time) []Provider {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	providers := make([]Provider, 0, len(s.records[cid]))
+	for _, rec := range s.records[cid] {
+		if now.Before(rec.expires) {
+			providers = append(providers, rec.provider)
+		}
+	}
+	return providers
+}
+
+// expire drops every record that has passed its expiry time
+func (s *providerStore) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for cid, recs := range s.records {
+		for id, rec := range recs {
+			if !now.Before(rec.expires) {
+				delete(recs, id)
+			}
+		}
+		if len(recs) == 0 {
+			delete(s.records, cid)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Package dht - Routing table
+//
+// The routing table keeps up to K contacts per k-bucket, where bucket i
+// holds contacts whose key shares exactly i leading bits with ours. Each
+// bucket is ordered from least to most recently seen. A full bucket only
+// admits a newcomer once its oldest contact stops answering, which favours
+// long-lived peers.
+package dht
+
+import (
+	"sort"
+	"sync"
+
+	"p2p-library/models"
+)
+
+// Contact is how one DHT node reaches another
+type Contact struct {
+	ID   models.PeerID `json:"id"`
+	Addr string        `json:"addr"` // host:port of the peer's node
+}
+
+// Key returns the contact's position in the key space
+func (c Contact) Key() Key {
+	return PeerKey(c.ID)
+}
+
+// ============================================================================
+// ROUTING TABLE
+// ============================================================================
+
+// RoutingTable stores known contacts in k-buckets
+type RoutingTable struct {
+	self    Key
+	k       int
+	mu      sync.Mutex
+	buckets [KeyBits + 1][]Contact
+}
+
+// NewRoutingTable creates an empty table for the node with key self
+func NewRoutingTable(self Key, k int) *RoutingTable {
+	return &RoutingTable{self: self, k: k}
+}
+
+// bucketFor returns the bucket index for a key
+func (rt *RoutingTable) bucketFor(key Key) int {
+	return rt.self.CommonPrefixLen(key)
+}
+
+// Add records that a contact was seen. It returns the bucket's oldest
+// contact if the bucket is full and the newcomer was not added.
+func (rt *RoutingTable) Add(c Contact) (oldest Contact, full bool) {
+	key := c.Key()
+	if key == rt.self {
+		return Contact{}, false
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	i := rt.bucketFor(key)
+	bucket := rt.buckets[i]
+	for j, existing := range bucket {
+		if existing.ID == c.ID {
+			// Move to the most recently seen end
+			bucket = append(bucket[:j], bucket[j+1:]...)
+			rt.buckets[i] = append(bucket, c)
+			return Contact{}, false
+		}
+	}
+
+	if len(bucket) < rt.k {
+		rt.buckets[i] = append(bucket, c)
+		return Contact{}, false
+	}
+	return bucket[0], true
+}
+
+// Replace evicts a contact that stopped answering in favour of another
+func (rt *RoutingTable) Replace(stale, fresh Contact) {
+	rt.Remove(stale.ID)
+	rt.Add(fresh)
+}
+
+// Remove drops a contact from the table
+func (rt *RoutingTable) Remove(id models.PeerID) {
+	i := rt.bucketFor(PeerKey(id))
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	bucket := rt.buckets[i]
+	for j, existing := range bucket {
+		if existing.ID == id {
+			rt.buckets[i] = append(bucket[:j], bucket[j+1:]...)
+			return
+		}
+	}
+}
+
+// Closest returns up to n known contacts nearest to target
+func (rt *RoutingTable) Closest(target Key, n int) []Contact {
+	rt.mu.Lock()
+	all := make([]Contact, 0, rt.sizeLocked())
+	for _, bucket := range rt.buckets {
+		all = append(all, bucket...)
+	}
+	rt.mu.Unlock()
+
+	sortByDistance(target, all)
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// Size returns the number of contacts in the table
+func (rt *RoutingTable) Size() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.sizeLocked()
+}
+
+// sizeLocked counts contacts (mu must be held)
+func (rt *RoutingTable) sizeLocked() int {
+	n := 0
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+// sortByDistance orders contacts from nearest to farthest from target
+func sortByDistance(target Key, contacts []Contact) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return closer(target, contacts[i].Key(), contacts[j].Key())
+	})
+}
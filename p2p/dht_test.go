@@ -0,0 +1,72 @@
+// Package p2p - Unit tests for the DHT over peer connections
+package p2p
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"p2p-library/models"
+	"p2p-library/p2p/dht"
+)
+
+func TestDownloadFindsProvidersThroughDHT(t *testing.T) {
+	// Six nodes that each only know the first one
+	transfers := make([]*Transfer, 6)
+	tables := make([]*dht.DHT, 6)
+	for i := range transfers {
+		transfers[i] = newTestTransfer(t, fmt.Sprintf("dht-%d", i))
+		tables[i] = NewDHT(transfers[i].node, dht.Config{K: 4})
+		transfers[i].SetDHT(tables[i])
+
+		if i > 0 {
+			register(t, transfers[i].node, transfers[0].node)
+			contact, _ := transfers[i].node.ContactFor(transfers[0].node.ID())
+			if err := tables[i].Bootstrap(contact); err != nil {
+				t.Fatalf("Bootstrap failed: %v", err)
+			}
+		}
+	}
+
+	seeder, leecher := transfers[4], transfers[5]
+	data := testContent(2*models.ChunkSize + 5)
+	resource := swarmResource(data)
+	if err := seeder.Publish(resource, data); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	waitFor(t, "provider record", func() bool {
+		providers, err := tables[5].FindProviders(resource.ID)
+		return err == nil && len(providers) == 1 && providers[0].ID == seeder.node.ID()
+	})
+
+	// The leecher has never heard of the seeder and the resource lists
+	// no peers; the DHT has to connect them
+	bare := *resource
+	bare.AvailableOn = nil
+	if err := leecher.Fetch(&bare); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	got, _ := leecher.Content().Get(resource.ID)
+	if !bytes.Equal(got, data) {
+		t.Error("Downloaded content does not match the original")
+	}
+
+	// Having verified the content, the leecher announces itself as a
+	// seeder. A provider lookup stops at the first node holding records,
+	// which may only know the seeder, so ask every other node.
+	waitFor(t, "leecher provider record", func() bool {
+		for _, table := range tables[:5] {
+			providers, err := table.FindProviders(resource.ID)
+			if err != nil {
+				continue
+			}
+			for _, p := range providers {
+				if p.ID == leecher.node.ID() {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,656 @@
+// Package gossip implements SWIM-style group membership and failure
+// detection.
+//
+// Every ProbeInterval a node pings one member, cycling through them in a
+// shuffled order. If there is no ack within ProbeTimeout it asks a few
+// other members to ping the target on its behalf. If none of them gets an
+// ack either, the target is suspected. A suspect that doesn't refute the
+// suspicion (by gossiping itself alive with a higher incarnation number)
+// within SuspicionTimeout is declared dead.
+//
+// State changes are not broadcast separately: they are piggybacked on the
+// ping and ack messages that flow anyway, each update being retransmitted
+// a number of times that grows with the logarithm of the group size.
+package gossip
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// ============================================================================
+// MEMBERS
+// ============================================================================
+
+// State is what the group believes about a member
+type State string
+
+// Member states
+const (
+	StateAlive   State = "alive"
+	StateSuspect State = "suspect"
+	StateDead    State = "dead"
+)
+
+// Member is one node of the group
+type Member struct {
+	ID          models.PeerID `json:"id"`
+	UserID      models.UserID `json:"user_id"`
+	Addr        string        `json:"addr"`
+	State       State         `json:"state"`
+	Incarnation uint64        `json:"incarnation"` // bumped by the member to refute suspicion
+
+	// LastSeen is when this node last heard from the member directly
+	// (local only, never gossiped)
+	LastSeen time.Time `json:"-"`
+
+	// Direct is set on the records passed to OnUpdate listeners when this
+	// node saw the change itself: the member messaged or acked it, or its
+	// own probes declared the member suspect or dead. Updates relayed by
+	// other members never have it. (local only, never gossiped)
+	Direct bool `json:"-"`
+}
+
+// ============================================================================
+// MESSAGES
+// ============================================================================
+
+// MessageKind identifies a gossip message
+type MessageKind string
+
+// Gossip message kinds
+const (
+	KindPing    MessageKind = "ping"
+	KindAck     MessageKind = "ack"
+	KindNack    MessageKind = "nack"     // a ping_req whose target didn't answer
+	KindPingReq MessageKind = "ping_req" // ask the receiver to ping Target for us
+	KindSync    MessageKind = "sync"     // exchange full member lists on join
+)
+
+// Message is exchanged between members. Updates carries piggybacked
+// membership changes.
+type Message struct {
+	Kind    MessageKind `json:"kind"`
+	From    Member      `json:"from"`
+	Target  *Member     `json:"target,omitempty"`
+	Updates []Member    `json:"updates,omitempty"`
+}
+
+// Transport delivers a message to a member and returns its reply
+type Transport interface {
+	Send(to Member, msg *Message) (*Message, error)
+}
+
+// ============================================================================
+// CONFIGURATION
+// ============================================================================
+
+// Config tunes the failure detector
+type Config struct {
+	ProbeInterval    time.Duration // time between probes
+	ProbeTimeout     time.Duration // how long to wait for an ack
+	IndirectProbes   int           // members asked to probe on our behalf
+	SuspicionTimeout time.Duration // how long a suspect has to refute
+	RetransmitMult   int           // each update is sent RetransmitMult*log(n+1) times
+	MaxPiggyback     int           // updates attached to one message
+}
+
+// DefaultConfig returns settings suited to a LAN or small WAN group
+func DefaultConfig() Config {
+	return Config{
+		ProbeInterval:    time.Second,
+		ProbeTimeout:     500 * time.Millisecond,
+		IndirectProbes:   3,
+		SuspicionTimeout: 5 * time.Second,
+		RetransmitMult:   4,
+		MaxPiggyback:     8,
+	}
+}
+
+// withDefaults fills in zero fields
+func (c Config) withDefaults() Config {
+	d := DefaultConfig()
+	if c.ProbeInterval <= 0 {
+		c.ProbeInterval = d.ProbeInterval
+	}
+	if c.ProbeTimeout <= 0 {
+		c.ProbeTimeout = d.ProbeTimeout
+	}
+	if c.IndirectProbes <= 0 {
+		c.IndirectProbes = d.IndirectProbes
+	}
+	if c.SuspicionTimeout <= 0 {
+		c.SuspicionTimeout = d.SuspicionTimeout
+	}
+	if c.RetransmitMult <= 0 {
+		c.RetransmitMult = d.RetransmitMult
+	}
+	if c.MaxPiggyback <= 0 {
+		c.MaxPiggyback = d.MaxPiggyback
+	}
+	return c
+}
+
+// ============================================================================
+// GOSSIP NODE
+// ============================================================================
+
+// broadcast is an update waiting to be piggybacked
+type broadcast struct {
+	member    Member
+	transmits int
+}
+
+// Gossip is one node's membership view
+type Gossip struct {
+	cfg       Config
+	transport Transport
+
+	mu          sync.Mutex
+	self        Member
+	members     map[models.PeerID]*Member
+	suspected   map[models.PeerID]time.Time // when each suspicion started
+	ourSuspects map[models.PeerID]bool      // suspicions raised by our own probes
+	probeOrder  []models.PeerID
+	probeNext   int
+	queue       []*broadcast
+	listeners   []func(Member)
+	rng         *rand.Rand
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// New creates a membership node for self
+func New(self Member, cfg Config, transport Transport) *Gossip {
+	self.State = StateAlive
+	return &Gossip{
+		cfg:         cfg.withDefaults(),
+		transport:   transport,
+		self:        self,
+		members:     make(map[models.PeerID]*Member),
+		suspected:   make(map[models.PeerID]time.Time),
+		ourSuspects: make(map[models.PeerID]bool),
+		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		stop:        make(chan struct{}),
+	}
+}
+
+// OnUpdate registers a function called whenever a member changes state or
+// answers a probe. It is called without locks held. Only records with
+// Direct set were observed by this node rather than relayed to it.
+func (g *Gossip) OnUpdate(fn func(Member)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.listeners = append(g.listeners, fn)
+}
+
+// Self returns this node's own member record
+func (g *Gossip) Self() Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.self
+}
+
+// Members returns every known member except this node
+func (g *Gossip) Members() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	out := make([]Member, 0, len(g.members))
+	for _, m := range g.members {
+		out = append(out, *m)
+	}
+	return out
+}
+
+// Member returns what this node believes about one member
+func (g *Gossip) Member(id models.PeerID) (Member, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	m, ok := g.members[id]
+	if !ok {
+		return Member{}, errors.NewNotFoundError("member", string(id))
+	}
+	return *m, nil
+}
+
+// Join exchanges member lists with the given contacts. It succeeds if at
+// least one of them answers.
+func (g *Gossip) Join(contacts ...Member) error {
+	joined := 0
+	for _, c := range contacts {
+		reply, err := g.transport.Send(c, &Message{Kind: KindSync, From: g.Self(), Updates: g.snapshot()})
+		if err != nil {
+			continue
+		}
+		g.receive(reply)
+		joined++
+	}
+	if joined == 0 {
+		return errors.NewOperationError("Join", "no contact answered", errors.ErrNoPeersAvailable)
+	}
+	return nil
+}
+
+// Start runs the probe loop in the background until Close is called
+func (g *Gossip) Start() {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		ticker := time.NewTicker(g.cfg.ProbeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-g.stop:
+				return
+			case <-ticker.C:
+				g.Probe()
+			}
+		}
+	}()
+}
+
+// Close stops the probe loop and waits for indirect pings still out
+func (g *Gossip) Close() {
+	g.stopOnce.Do(func() { close(g.stop) })
+	g.wg.Wait()
+}
+
+// ============================================================================
+// PROBING
+// ============================================================================
+
+// Probe runs one protocol period: ping the next member, fall back to
+// indirect pings, suspect it if nobody gets an ack, and declare suspects
+// whose timeout ran out dead
+func (g *Gossip) Probe() {
+	defer g.expireSuspects()
+
+	target, ok := g.nextTarget()
+	if !ok {
+		return
+	}
+
+	if g.ping(target) {
+		return
+	}
+	if g.indirectPing(target) {
+		return
+	}
+
+	g.apply(Member{
+		ID:          target.ID,
+		UserID:      target.UserID,
+		Addr:        target.Addr,
+		State:       StateSuspect,
+		Incarnation: target.Incarnation,
+		Direct:      true,
+	})
+}
+
+// nextTarget returns the next member to probe, reshuffling the order
+// after every full pass
+func (g *Gossip) nextTarget() (Member, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for attempts := 0; attempts < 2; attempts++ {
+		for g.probeNext < len(g.probeOrder) {
+			id := g.probeOrder[g.probeNext]
+			g.probeNext++
+			if m, ok := g.members[id]; ok && m.State != StateDead {
+				return *m, true
+			}
+		}
+
+		g.probeOrder = g.probeOrder[:0]
+		for id := range g.members {
+			g.probeOrder = append(g.probeOrder, id)
+		}
+		g.rng.Shuffle(len(g.probeOrder), func(i, j int) {
+			g.probeOrder[i], g.probeOrder[j] = g.probeOrder[j], g.probeOrder[i]
+		})
+		g.probeNext = 0
+	}
+	return Member{}, false
+}
+
+// ping sends a direct ping and reports whether an ack arrived in time
+func (g *Gossip) ping(target Member) bool {
+	reply, err := g.sendTimeout(target, &Message{Kind: KindPing, From: g.Self(), Updates: g.piggyback()})
+	if err != nil || reply.Kind != KindAck {
+		return false
+	}
+	g.receive(reply)
+	return true
+}
+
+// indirectPing asks IndirectProbes random members to ping target
+func (g *Gossip) indirectPing(target Member) bool {
+	helpers := g.randomMembers(g.cfg.IndirectProbes, target.ID)
+	if len(helpers) == 0 {
+		return false
+	}
+
+	acks := make(chan bool, len(helpers))
+	for _, h := range helpers {
+		g.wg.Add(1)
+		go func(h Member) {
+			defer g.wg.Done()
+			msg := &Message{Kind: KindPingReq, From: g.Self(), Target: &target, Updates: g.piggyback()}
+			reply, err := g.sendTimeout(h, msg)
+			if err == nil {
+				g.receive(reply)
+			}
+			acks <- err == nil && reply.Kind == KindAck
+		}(h)
+	}
+
+	for range helpers {
+		if <-acks {
+			g.touch(target.ID, false)
+			return true
+		}
+	}
+	return false
+}
+
+// sendTimeout sends a message but gives up after ProbeTimeout
+func (g *Gossip) sendTimeout(to Member, msg *Message) (*Message, error) {
+	type result struct {
+		reply *Message
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reply, err := g.transport.Send(to, msg)
+		done <- result{reply, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.reply, r.err
+	case <-time.After(g.cfg.ProbeTimeout):
+		return nil, errors.ErrRequestTimeout
+	}
+}
+
+// randomMembers picks up to n live members other than exclude
+func (g *Gossip) randomMembers(n int, exclude models.PeerID) []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	candidates := make([]Member, 0, len(g.members))
+	for _, m := range g.members {
+		if m.ID != exclude && m.State == StateAlive {
+			candidates = append(candidates, *m)
+		}
+	}
+	g.rng.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+// expireSuspects declares suspects dead once their timeout has passed
+func (g *Gossip) expireSuspects() {
+	now := models.TimeNow()
+
+	g.mu.Lock()
+	var expired []Member
+	for id, since := range g.suspected {
+		if now.Sub(since) >= g.cfg.SuspicionTimeout {
+			if m, ok := g.members[id]; ok {
+				dead := *m
+				dead.State = StateDead
+				dead.Direct = g.ourSuspects[id]
+				expired = append(expired, dead)
+			}
+		}
+	}
+	g.mu.Unlock()
+
+	for _, m := range expired {
+		g.apply(m)
+	}
+}
+
+// ============================================================================
+// MESSAGE HANDLING
+// ============================================================================
+
+// HandleMessage answers a message from another member
+func (g *Gossip) HandleMessage(msg *Message) *Message {
+	g.receive(msg)
+
+	switch msg.Kind {
+	case KindPing:
+		return &Message{Kind: KindAck, From: g.Self(), Updates: g.replyUpdates(msg.From)}
+
+	case KindPingReq:
+		// Reply with an ack only if the target acked us
+		if msg.Target != nil && g.ping(*msg.Target) {
+			return &Message{Kind: KindAck, From: g.Self(), Updates: g.replyUpdates(msg.From)}
+		}
+		return &Message{Kind: KindNack, From: g.Self(), Updates: g.piggyback()}
+
+	case KindSync:
+		return &Message{Kind: KindAck, From: g.Self(), Updates: g.snapshot()}
+
+	default:
+		return &Message{Kind: KindAck, From: g.Self()}
+	}
+}
+
+// receive merges the sender and piggybacked updates from a message
+func (g *Gossip) receive(msg *Message) {
+	if msg.From.ID != "" {
+		from := msg.From
+		from.State = StateAlive
+		from.Direct = true
+		g.apply(from)
+		g.touch(from.ID, true)
+	}
+	for _, m := range msg.Updates {
+		m.Direct = false
+		g.apply(m)
+	}
+}
+
+// replyUpdates returns piggybacked updates, plus our record of the sender
+// if we think it is suspect or dead so that it can refute
+func (g *Gossip) replyUpdates(sender Member) []Member {
+	updates := g.piggyback()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if m, ok := g.members[sender.ID]; ok && m.State != StateAlive {
+		updates = append(updates, *m)
+	}
+	return updates
+}
+
+// snapshot returns every member record including our own
+func (g *Gossip) snapshot() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	out := make([]Member, 0, len(g.members)+1)
+	out = append(out, g.self)
+	for _, m := range g.members {
+		out = append(out, *m)
+	}
+	return out
+}
+
+// touch records that we just heard from a member, directly or through
+// an indirect probe
+func (g *Gossip) touch(id models.PeerID, direct bool) {
+	g.mu.Lock()
+	m, ok := g.members[id]
+	if !ok {
+		g.mu.Unlock()
+		return
+	}
+	m.LastSeen = models.TimeNow()
+	snapshot := *m
+	snapshot.Direct = direct
+	listeners := g.listeners
+	g.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(snapshot)
+	}
+}
+
+// ============================================================================
+// STATE MERGING
+// ============================================================================
+
+// apply merges one membership update using SWIM's precedence rules:
+// a higher incarnation always wins; at the same incarnation dead beats
+// suspect, which beats alive. Updates about ourselves that claim we are
+// suspect or dead are refuted by bumping our incarnation.
+func (g *Gossip) apply(update Member) {
+	g.mu.Lock()
+
+	if update.ID == g.self.ID {
+		if update.State != StateAlive && update.Incarnation >= g.self.Incarnation {
+			g.self.Incarnation = update.Incarnation + 1
+			g.enqueue(g.self)
+		}
+		g.mu.Unlock()
+		return
+	}
+
+	current, known := g.members[update.ID]
+	if known && !supersedes(update, *current) {
+		// Fill in an address learned later, but otherwise ignore
+		if current.Addr == "" && update.Addr != "" {
+			current.Addr = update.Addr
+		}
+		// A suspicion we were told of first is ours too once our own
+		// probe fails
+		if update.Direct && update.State == StateSuspect && current.State == StateSuspect &&
+			update.Incarnation == current.Incarnation {
+			g.ourSuspects[update.ID] = true
+		}
+		g.mu.Unlock()
+		return
+	}
+
+	if !known {
+		current = &Member{}
+		g.members[update.ID] = current
+	}
+	previous, addr, lastSeen := current.State, current.Addr, current.LastSeen
+	*current = update
+	current.LastSeen = lastSeen
+	current.Direct = false
+	if current.Addr == "" {
+		current.Addr = addr
+	}
+
+	switch update.State {
+	case StateSuspect:
+		if _, ok := g.suspected[update.ID]; !ok {
+			g.suspected[update.ID] = models.TimeNow()
+		}
+		if update.Direct {
+			g.ourSuspects[update.ID] = true
+		}
+	default:
+		delete(g.suspected, update.ID)
+		delete(g.ourSuspects, update.ID)
+	}
+
+	g.enqueue(update)
+	changed := previous != update.State
+	snapshot := *current
+	snapshot.Direct = update.Direct
+	listeners := g.listeners
+	g.mu.Unlock()
+
+	if changed {
+		for _, fn := range listeners {
+			fn(snapshot)
+		}
+	}
+}
+
+// supersedes reports whether update should replace current
+func supersedes(update, current Member) bool {
+	if update.Incarnation != current.Incarnation {
+		return update.Incarnation > current.Incarnation
+	}
+	return rank(update.State) > rank(current.State)
+}
+
+// rank orders states for updates at the same incarnation
+func rank(s State) int {
+	switch s {
+	case StateSuspect:
+		return 1
+	case StateDead:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// ============================================================================
+// DISSEMINATION
+// ============================================================================
+
+// enqueue queues an update for piggybacking, replacing any older update
+// about the same member (mu must be held)
+func (g *Gossip) enqueue(m Member) {
+	m.LastSeen = time.Time{}
+	m.Direct = false
+	for i, b := range g.queue {
+		if b.member.ID == m.ID {
+			g.queue = append(g.queue[:i], g.queue[i+1:]...)
+			break
+		}
+	}
+	g.queue = append(g.queue, &broadcast{member: m})
+}
+
+// piggyback takes up to MaxPiggyback updates, least transmitted first,
+// and drops those that have been sent often enough
+func (g *Gossip) piggyback() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	limit := g.cfg.RetransmitMult * int(math.Ceil(math.Log10(float64(len(g.members)+2))))
+	sort.SliceStable(g.queue, func(i, j int) bool {
+		return g.queue[i].transmits < g.queue[j].transmits
+	})
+
+	out := make([]Member, 0, g.cfg.MaxPiggyback)
+	kept := g.queue[:0]
+	for _, b := range g.queue {
+		if len(out) < g.cfg.MaxPiggyback {
+			out = append(out, b.member)
+			b.transmits++
+		}
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	g.queue = kept
+	return out
+}
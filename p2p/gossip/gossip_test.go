@@ -0,0 +1,270 @@
+// Package gossip - Unit tests for SWIM membership
+package gossip
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p-library/models"
+)
+
+// testClock replaces models.TimeNow with a clock the test advances
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func useTestClock(t *testing.T) *testClock {
+	c := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	restore := models.TimeNow
+	models.TimeNow = c.Now
+	t.Cleanup(func() { models.TimeNow = restore })
+	return c
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// simGroup starts n nodes that all join through the first one
+func simGroup(t *testing.T, n int) (*SimNetwork, []*Gossip) {
+	t.Helper()
+
+	net := NewSimNetwork()
+	nodes := make([]*Gossip, n)
+	cfg := Config{SuspicionTimeout: 10 * time.Second}
+	for i := range nodes {
+		nodes[i] = net.AddNode(models.PeerID(fmt.Sprintf("node-%02d", i)), cfg)
+		t.Cleanup(nodes[i].Close)
+		if i > 0 {
+			if err := nodes[i].Join(nodes[0].Self()); err != nil {
+				t.Fatalf("Join failed: %v", err)
+			}
+		}
+	}
+	return net, nodes
+}
+
+// rounds runs protocol periods on every node that isn't skipped
+func rounds(n int, nodes []*Gossip, skip ...*Gossip) {
+	down := make(map[*Gossip]bool)
+	for _, g := range skip {
+		down[g] = true
+	}
+	for r := 0; r < n; r++ {
+		for _, g := range nodes {
+			if !down[g] {
+				g.Probe()
+			}
+		}
+	}
+}
+
+// stateOf returns what observer believes about a member
+func stateOf(observer, member *Gossip) State {
+	m, err := observer.Member(member.Self().ID)
+	if err != nil {
+		return ""
+	}
+	return m.State
+}
+
+func TestMembershipConverges(t *testing.T) {
+	_, nodes := simGroup(t, 20)
+	// Late joiners are only spread by random gossip; 10 rounds were
+	// occasionally not enough for every node to hear of every other
+	rounds(20, nodes)
+
+	for _, g := range nodes {
+		alive := 0
+		for _, m := range g.Members() {
+			if m.State == StateAlive {
+				alive++
+			}
+		}
+		if alive != len(nodes)-1 {
+			t.Errorf("%s sees %d alive members; want %d", g.Self().ID, alive, len(nodes)-1)
+		}
+	}
+}
+
+func TestFailedNodeIsSuspectedThenDeclaredDead(t *testing.T) {
+	clock := useTestClock(t)
+	net, nodes := simGroup(t, 12)
+	rounds(5, nodes)
+
+	victim := nodes[7]
+	net.SetOnline(victim.Self().ID, false)
+	rounds(15, nodes, victim)
+
+	for _, g := range nodes {
+		if g != victim && stateOf(g, victim) != StateSuspect {
+			t.Errorf("%s sees victim as %q; want suspect", g.Self().ID, stateOf(g, victim))
+		}
+	}
+
+	// Nobody refutes the suspicion, so it turns into a failure
+	clock.Advance(11 * time.Second)
+	rounds(10, nodes, victim)
+
+	for _, g := range nodes {
+		if g != victim && stateOf(g, victim) != StateDead {
+			t.Errorf("%s sees victim as %q; want dead", g.Self().ID, stateOf(g, victim))
+		}
+	}
+}
+
+func TestSuspectedNodeRefutes(t *testing.T) {
+	net, nodes := simGroup(t, 8)
+	rounds(5, nodes)
+
+	// A brief outage gets the node suspected but not declared dead
+	flaky := nodes[3]
+	net.SetOnline(flaky.Self().ID, false)
+	rounds(8, nodes, flaky)
+	net.SetOnline(flaky.Self().ID, true)
+	rounds(10, nodes)
+
+	if flaky.Self().Incarnation == 0 {
+		t.Error("Suspected node never refuted")
+	}
+	for _, g := range nodes {
+		if g != flaky && stateOf(g, flaky) != StateAlive {
+			t.Errorf("%s sees the refuted node as %q; want alive", g.Self().ID, stateOf(g, flaky))
+		}
+	}
+}
+
+func TestIndirectProbeAvoidsFalseSuspicion(t *testing.T) {
+	net, nodes := simGroup(t, 6)
+	rounds(5, nodes)
+
+	// Only the link between node 0 and node 1 is broken
+	net.Cut(nodes[0].Self().ID, nodes[1].Self().ID, true)
+	rounds(10, nodes)
+
+	for _, g := range nodes[1:] {
+		if stateOf(nodes[0], g) != StateAlive {
+			t.Errorf("node-00 sees %s as %q; want alive", g.Self().ID, stateOf(nodes[0], g))
+		}
+	}
+}
+
+func TestUpdatesReportLastSeen(t *testing.T) {
+	clock := useTestClock(t)
+	_, nodes := simGroup(t, 3)
+
+	var (
+		mu   sync.Mutex
+		seen = make(map[models.PeerID]time.Time)
+	)
+	nodes[0].OnUpdate(func(m Member) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[m.ID] = m.LastSeen
+	})
+
+	clock.Advance(time.Minute)
+	rounds(2, nodes[:1])
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 2 {
+		t.Fatalf("Updates for %d members; want 2", len(seen))
+	}
+	for id, at := range seen {
+		if !at.Equal(clock.Now()) {
+			t.Errorf("LastSeen for %s = %v; want %v", id, at, clock.Now())
+		}
+	}
+}
+
+// directUpdates records, per member, whether observer's listener was
+// ever told about it firsthand and whether it heard of it at all
+type directUpdates struct {
+	mu     sync.Mutex
+	heard  map[models.PeerID]bool
+	direct map[models.PeerID]bool
+	dead   map[models.PeerID]bool // dead updates that were Direct
+}
+
+func watchDirect(observer *Gossip) *directUpdates {
+	d := &directUpdates{
+		heard:  make(map[models.PeerID]bool),
+		direct: make(map[models.PeerID]bool),
+		dead:   make(map[models.PeerID]bool),
+	}
+	observer.OnUpdate(func(m Member) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.heard[m.ID] = true
+		if m.Direct {
+			d.direct[m.ID] = true
+			if m.State == StateDead {
+				d.dead[m.ID] = true
+			}
+		}
+	})
+	return d
+}
+
+func TestRelayedUpdatesAreNotDirect(t *testing.T) {
+	net, nodes := simGroup(t, 3)
+	rounds(2, nodes)
+
+	// node-00 can only hear of node-02 through node-01
+	updates := watchDirect(nodes[0])
+	net.Cut(nodes[0].Self().ID, nodes[2].Self().ID, true)
+	rounds(5, nodes)
+
+	updates.mu.Lock()
+	defer updates.mu.Unlock()
+	if !updates.direct[nodes[1].Self().ID] {
+		t.Error("Messages from node-01 were not reported as Direct")
+	}
+	if !updates.heard[nodes[2].Self().ID] {
+		t.Fatal("node-00 heard nothing of node-02")
+	}
+	if updates.direct[nodes[2].Self().ID] {
+		t.Error("An update about node-02, which node-00 cannot reach, was reported as Direct")
+	}
+}
+
+func TestOnlyOwnSuspicionsDeclareDeathDirectly(t *testing.T) {
+	clock := useTestClock(t)
+	net, nodes := simGroup(t, 4)
+	rounds(3, nodes)
+
+	// node-00 never probes, so it only learns of the failure from others
+	prober, bystander := watchDirect(nodes[1]), watchDirect(nodes[0])
+	victim := nodes[3]
+	net.SetOnline(victim.Self().ID, false)
+	rounds(10, nodes, victim, nodes[0])
+	clock.Advance(11 * time.Second)
+	rounds(5, nodes, victim, nodes[0])
+	nodes[0].expireSuspects()
+
+	if stateOf(nodes[0], victim) != StateDead {
+		t.Fatalf("node-00 sees the victim as %q; want dead", stateOf(nodes[0], victim))
+	}
+	prober.mu.Lock()
+	defer prober.mu.Unlock()
+	if !prober.dead[victim.Self().ID] {
+		t.Error("The prober's own verdict was not reported as Direct")
+	}
+	bystander.mu.Lock()
+	defer bystander.mu.Unlock()
+	if bystander.dead[victim.Self().ID] {
+		t.Error("A relayed death was reported as Direct")
+	}
+}
@@ -0,0 +1,72 @@
+// Package gossip - In-process simulated network
+//
+// SimNetwork connects gossip nodes by direct function calls so tests can
+// run a whole group in one process and kill nodes at will.
+package gossip
+
+import (
+	"sync"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// SimNetwork delivers messages between gossip nodes in the same process
+type SimNetwork struct {
+	mu      sync.RWMutex
+	nodes   map[models.PeerID]*Gossip
+	offline map[models.PeerID]bool
+	cut     map[[2]models.PeerID]bool
+}
+
+// NewSimNetwork creates an empty simulated network
+func NewSimNetwork() *SimNetwork {
+	return &SimNetwork{
+		nodes:   make(map[models.PeerID]*Gossip),
+		offline: make(map[models.PeerID]bool),
+		cut:     make(map[[2]models.PeerID]bool),
+	}
+}
+
+// AddNode creates a gossip node attached to the network
+func (n *SimNetwork) AddNode(id models.PeerID, cfg Config) *Gossip {
+	g := New(Member{ID: id, Addr: "sim/" + string(id)}, cfg, n)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[id] = g
+	return g
+}
+
+// SetOnline takes a node off the network or brings it back. An offline
+// node can neither send nor receive.
+func (n *SimNetwork) SetOnline(id models.PeerID, online bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.offline[id] = !online
+}
+
+// Cut breaks (or restores) the link between two nodes in both directions
+// while leaving their other links alone
+func (n *SimNetwork) Cut(a, b models.PeerID, broken bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cut[[2]models.PeerID{a, b}] = broken
+	n.cut[[2]models.PeerID{b, a}] = broken
+}
+
+// Send implements Transport
+func (n *SimNetwork) Send(to Member, msg *Message) (*Message, error) {
+	n.mu.RLock()
+	target, ok := n.nodes[to.ID]
+	down := n.offline[to.ID] || n.offline[msg.From.ID] || n.cut[[2]models.PeerID{msg.From.ID, to.ID}]
+	n.mu.RUnlock()
+
+	if !ok {
+		return nil, errors.NewNotFoundError("member", string(to.ID))
+	}
+	if down {
+		return nil, errors.ErrPeerNotConnected
+	}
+	return target.HandleMessage(msg), nil
+}
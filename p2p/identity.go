@@ -0,0 +1,117 @@
+// Package p2p - Node identity keys
+//
+// A node's PeerID is its ed25519 public key (see models.Identity). The
+// private seed is kept in a file so the node keeps its PeerID across
+// restarts. During the handshake each side signs a random nonce chosen by
+// the other, binding the connection to the owner of the key.
+//
+// The handshake also carries the UserID the peer says it belongs to. The
+// signature only proves the key owner made that claim, not that it is
+// true, so the claim is checked against the node's UserVerifier before
+// anything is based on it.
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// nonceSize is the length of a handshake challenge
+const nonceSize = 32
+
+// LoadIdentity reads the identity seed saved at path, or generates a new
+// identity and saves it there if the file does not exist
+func LoadIdentity(path string) (*models.Identity, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, errors.NewOperationError("LoadIdentity", "corrupt identity file", err)
+		}
+		identity, ok := models.IdentityFromSeed(seed)
+		if !ok {
+			return nil, errors.NewOperationError("LoadIdentity", "corrupt identity file", nil)
+		}
+		return identity, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.NewOperationError("LoadIdentity", "failed to read identity", err)
+	}
+
+	identity, err := models.NewIdentity()
+	if err != nil {
+		return nil, errors.NewOperationError("LoadIdentity", "failed to generate identity", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, errors.NewOperationError("LoadIdentity", "failed to create directory", err)
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(identity.Seed())+"\n"), 0o600); err != nil {
+		return nil, errors.NewOperationError("LoadIdentity", "failed to save identity", err)
+	}
+	return identity, nil
+}
+
+// newNonce returns a fresh random handshake challenge
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// authBytes is what a node signs to answer a handshake challenge: the
+// verifier's nonce, the signer's claimed identity and who it is talking to
+func authBytes(nonce []byte, signer Hello, verifier models.PeerID) []byte {
+	buf := []byte("p2p-library/handshake")
+	for _, f := range [][]byte{nonce, []byte(signer.PeerID), []byte(signer.UserID), []byte(verifier)} {
+		buf = append(buf, 0)
+		buf = append(buf, f...)
+	}
+	return buf
+}
+
+// UserVerifier reports whether userID really belongs to the peer with
+// the given PeerID, typically by checking that the user's record names
+// that PeerID
+type UserVerifier func(peerID models.PeerID, userID models.UserID) bool
+
+// SetUserVerifier sets how the UserIDs peers claim in their handshake are
+// checked. Without one no claim is trusted and requests carry no user.
+func (n *Node) SetUserVerifier(verify UserVerifier) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.verifyUser = verify
+}
+
+// verifiedUser returns the user a peer claimed if the UserVerifier
+// accepts the claim, and "" otherwise
+func (n *Node) verifiedUser(peerID models.PeerID, claimed models.UserID) models.UserID {
+	n.mu.RLock()
+	verify := n.verifyUser
+	n.mu.RUnlock()
+
+	if claimed == "" || verify == nil || !verify(peerID, claimed) {
+		return ""
+	}
+	return claimed
+}
+
+// connUser returns the verified user of the live connection to peerID,
+// or "" if there is none
+func (n *Node) connUser(peerID models.PeerID) models.UserID {
+	n.mu.RLock()
+	c, ok := n.conns[peerID]
+	n.mu.RUnlock()
+
+	if !ok {
+		return ""
+	}
+	return n.verifiedUser(c.remote.PeerID, c.remote.UserID)
+}
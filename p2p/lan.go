@@ -0,0 +1,195 @@
+// Package p2p - Local network discovery
+//
+// Nodes on the same LAN find each other without a bootstrap address by
+// announcing their PeerID and port to a multicast group. A node that hears
+// an announcement from a peer it doesn't know adds it to its address book
+// and answers with an announcement of its own, so a newcomer is found by
+// everyone and finds everyone within one round trip. Announcements are
+// only hints: the peer still has to prove its PeerID in the handshake.
+package p2p
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// DefaultLANGroup is the multicast group nodes announce themselves on
+const DefaultLANGroup = "239.255.77.77:9977"
+
+// lanMagic marks datagrams sent by this protocol
+const lanMagic = "p2p-library/lan/1"
+
+// maxAnnouncementSize bounds a single announcement datagram
+const maxAnnouncementSize = 1024
+
+// LANConfig tunes local network discovery
+type LANConfig struct {
+	Group     string         // multicast "ip:port"; DefaultLANGroup when empty
+	Interface *net.Interface // interface to use; the system default when nil
+	Interval  time.Duration  // time between announcements
+}
+
+// withDefaults fills in zero fields
+func (c LANConfig) withDefaults() LANConfig {
+	if c.Group == "" {
+		c.Group = DefaultLANGroup
+	}
+	if c.Interval <= 0 {
+		c.Interval = 10 * time.Second
+	}
+	return c
+}
+
+// Announcement is the datagram a node multicasts to make itself known
+type Announcement struct {
+	Magic  string        `json:"magic"`
+	PeerID models.PeerID `json:"peer_id"`
+	UserID models.UserID `json:"user_id"`
+	Port   int           `json:"port"`
+}
+
+// ============================================================================
+// LAN DISCOVERY
+// ============================================================================
+
+// LANDiscovery announces a node on the local network and registers the
+// peers it hears from
+type LANDiscovery struct {
+	node  *Node
+	cfg   LANConfig
+	group *net.UDPAddr
+
+	recv *net.UDPConn
+	send *net.UDPConn
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewLANDiscovery prepares LAN discovery for node; call Start to begin
+func NewLANDiscovery(node *Node, cfg LANConfig) (*LANDiscovery, error) {
+	cfg = cfg.withDefaults()
+	group, err := net.ResolveUDPAddr("udp4", cfg.Group)
+	if err != nil || !group.IP.IsMulticast() {
+		return nil, errors.NewValidationError("group", "invalid multicast group "+cfg.Group)
+	}
+	return &LANDiscovery{
+		node:  node,
+		cfg:   cfg,
+		group: group,
+		stop:  make(chan struct{}),
+	}, nil
+}
+
+// Start joins the multicast group and announces the node every Interval
+// until Close is called. It fails if the network has no multicast support.
+func (l *LANDiscovery) Start() error {
+	recv, err := net.ListenMulticastUDP("udp4", l.cfg.Interface, l.group)
+	if err != nil {
+		return errors.NewOperationError("LANDiscovery", "failed to join multicast group", err)
+	}
+	send, err := net.DialUDP("udp4", nil, l.group)
+	if err != nil {
+		recv.Close()
+		return errors.NewOperationError("LANDiscovery", "failed to open multicast sender", err)
+	}
+	l.recv, l.send = recv, send
+
+	if err := l.Announce(); err != nil {
+		l.recv.Close()
+		l.send.Close()
+		return err
+	}
+
+	l.wg.Add(2)
+	go l.listen()
+	go l.announceLoop()
+	return nil
+}
+
+// Close leaves the multicast group and stops announcing
+func (l *LANDiscovery) Close() {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+		if l.recv != nil {
+			l.recv.Close()
+			l.send.Close()
+		}
+	})
+	l.wg.Wait()
+}
+
+// Announce multicasts this node's PeerID and port once
+func (l *LANDiscovery) Announce() error {
+	data, err := json.Marshal(Announcement{
+		Magic:  lanMagic,
+		PeerID: l.node.ID(),
+		UserID: l.node.UserID(),
+		Port:   l.node.Port(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := l.send.Write(data); err != nil {
+		return errors.NewOperationError("LANDiscovery", "failed to send announcement", err)
+	}
+	return nil
+}
+
+// announceLoop repeats the announcement every Interval
+func (l *LANDiscovery) announceLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.Announce()
+		}
+	}
+}
+
+// listen registers the peers whose announcements arrive
+func (l *LANDiscovery) listen() {
+	defer l.wg.Done()
+
+	buf := make([]byte, maxAnnouncementSize)
+	for {
+		n, src, err := l.recv.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-l.stop:
+				return
+			default:
+				continue
+			}
+		}
+
+		var a Announcement
+		if json.Unmarshal(buf[:n], &a) != nil || a.Magic != lanMagic {
+			continue
+		}
+		if a.PeerID == "" || a.PeerID == l.node.ID() || a.Port <= 0 {
+			continue
+		}
+
+		// Answer newcomers so they learn of us straight away
+		_, err = l.node.Peer(a.PeerID)
+		isNew := err != nil
+		addr := net.JoinHostPort(src.IP.String(), strconv.Itoa(a.Port))
+		if l.node.registerAddr(a.PeerID, a.UserID, addr, models.DiscoveredLAN) == nil && isNew {
+			l.Announce()
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Package p2p - Unit tests for local network discovery
+package p2p
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"p2p-library/models"
+)
+
+// testLANGroup picks a multicast group of its own for each test run
+func testLANGroup() string {
+	return fmt.Sprintf("239.255.77.%d:%d", 1+rand.Intn(250), 20000+rand.Intn(20000))
+}
+
+// startLAN starts LAN discovery for a node, skipping the test when the
+// sandbox has no working multicast
+func startLAN(t *testing.T, node *Node, group string) *LANDiscovery {
+	t.Helper()
+
+	lan, err := NewLANDiscovery(node, LANConfig{Group: group, Interval: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewLANDiscovery failed: %v", err)
+	}
+	if err := lan.Start(); err != nil {
+		t.Skipf("Multicast unavailable: %v", err)
+	}
+	t.Cleanup(lan.Close)
+	return lan
+}
+
+// newLANNode starts a node on all interfaces, since announcements arrive
+// from the LAN address rather than loopback
+func newLANNode(t *testing.T, name string) *Node {
+	t.Helper()
+
+	node, err := NewNode(Config{ListenAddr: ":0", UserID: models.UserID("user-" + name)})
+	if err != nil {
+		t.Fatalf("NewNode(%s) failed: %v", name, err)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatalf("Start(%s) failed: %v", name, err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+func TestLANDiscoveryFindsPeers(t *testing.T) {
+	group := testLANGroup()
+	alice := newLANNode(t, "alice")
+	bob := newLANNode(t, "bob")
+	startLAN(t, alice, group)
+	startLAN(t, bob, group)
+
+	// Multicast can be accepted but silently dropped; skip rather than
+	// fail if nothing arrives at all
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		_, errA := alice.Peer(bob.ID())
+		_, errB := bob.Peer(alice.ID())
+		if errA == nil && errB == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := alice.Peer(bob.ID()); err != nil {
+		if _, err := bob.Peer(alice.ID()); err != nil {
+			t.Skip("Multicast datagrams are not delivered on this host")
+		}
+	}
+
+	for _, pair := range [][2]*Node{{alice, bob}, {bob, alice}} {
+		peer, err := pair[0].Peer(pair[1].ID())
+		if err != nil {
+			t.Fatalf("%s did not discover %s", pair[0].UserID(), pair[1].UserID())
+		}
+		if peer.DiscoveredVia != models.DiscoveredLAN {
+			t.Errorf("DiscoveredVia = %q; want %q", peer.DiscoveredVia, models.DiscoveredLAN)
+		}
+		if pair[0].KnownPeers().FindByID(pair[1].ID()) == nil {
+			t.Errorf("%s is missing from the known peer list", pair[1].UserID())
+		}
+	}
+
+	// The announced address is good enough to connect to
+	if _, err := alice.Ping(bob.ID()); err != nil {
+		t.Errorf("Ping to a discovered peer failed: %v", err)
+	}
+}
+
+func TestLANDiscoveryRejectsNonMulticastGroup(t *testing.T) {
+	node := newTestNode(t, "lan-bad")
+	if _, err := NewLANDiscovery(node, LANConfig{Group: "127.0.0.1:9977"}); err == nil {
+		t.Error("NewLANDiscovery should reject a unicast group address")
+	}
+}
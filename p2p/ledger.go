@@ -0,0 +1,90 @@
+// Package p2p - Transfer ledger reporting and receipts
+//
+// When a downloader has verified and written a chunk it signs a receipt
+// for it: a models.TransferRecord naming both peers, signed with the
+// downloader's identity key. The receipt goes into the downloader's own
+// ledger and is sent back to the peer that served the chunk, which checks
+// it and adds it to its ledger. A serving node never records uploads on
+// its own word, so the only upload credit it can show is what its
+// downloaders signed for.
+package p2p
+
+import (
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// Receipt message type
+const (
+	MsgReceipt MessageType = "receipt"
+)
+
+// LedgerFunc is told about every completed chunk transfer this node took
+// part in, with the receiver's receipt attached. The peer's user is only
+// named if the UserVerifier bound it to the peer; otherwise it is empty.
+type LedgerFunc func(record models.TransferRecord)
+
+// SetLedger sets the function completed chunk transfers are reported to
+func (t *Transfer) SetLedger(fn LedgerFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onTransfer = fn
+}
+
+// recordReceived signs a receipt for a verified chunk this node got from
+// a peer, reports it and sends it to the peer in the background. The
+// serving user is the verified user of the connection, never the one in
+// the address book, which is only what the peer or PEX claimed.
+func (t *Transfer) recordReceived(from models.PeerID, cid models.ContentID, index, n int) {
+	record := models.NewTransferRecord(cid, index, int64(n), from, t.node.ID())
+	record.ServerUser = t.node.connUser(from)
+	record.ReceiverUser = t.node.UserID()
+	if !record.IsValid() {
+		return
+	}
+	record.SignReceipt(t.node.Identity())
+
+	t.report(record)
+	go t.node.Request(from, MsgReceipt, record, nil)
+}
+
+// handleReceipt accepts a receipt for a chunk this node served. It must
+// come from the peer that received the chunk, name this node as the
+// server with its user (or none, if the receiver could not verify it),
+// name the connection's verified user (or none) as the receiver, and
+// carry that peer's valid signature.
+func (t *Transfer) handleReceipt(req *Request) (interface{}, error) {
+	var record models.TransferRecord
+	if err := req.Decode(&record); err != nil {
+		return nil, err
+	}
+
+	if !record.IsValid() {
+		return nil, errors.NewValidationError("receipt", "receipt does not describe a transfer")
+	}
+	if record.ServedBy != t.node.ID() || (record.ServerUser != "" && record.ServerUser != t.node.UserID()) {
+		return nil, errors.NewValidationError("receipt", "receipt is for a transfer served by someone else")
+	}
+	if record.ReceivedBy != req.From {
+		return nil, errors.NewValidationError("receipt", "receipt was not signed by the sending peer")
+	}
+	if record.ReceiverUser != req.FromUser {
+		return nil, errors.NewValidationError("receipt", "receipt names a receiving user the sending peer is not bound to")
+	}
+	if !record.VerifyReceipt() {
+		return nil, errors.ErrInvalidSignature
+	}
+
+	t.report(&record)
+	return nil, nil
+}
+
+// report passes a record to the ledger function, if one is set
+func (t *Transfer) report(record *models.TransferRecord) {
+	t.mu.Lock()
+	fn := t.onTransfer
+	t.mu.Unlock()
+	if fn != nil {
+		fn(*record)
+	}
+}
@@ -0,0 +1,220 @@
+// Package p2p - Unit tests for transfer ledger reporting
+package p2p
+
+import (
+	"sync"
+	"testing"
+
+	"p2p-library/models"
+)
+
+// ledgerLog collects the records a transfer reports
+type ledgerLog struct {
+	mu      sync.Mutex
+	records []models.TransferRecord
+}
+
+func (l *ledgerLog) record(r models.TransferRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, r)
+}
+
+// bytes totals the recorded bytes
+func (l *ledgerLog) bytes() (total int64, count int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range l.records {
+		total += r.Bytes
+	}
+	return total, len(l.records)
+}
+
+func TestTransfersAreReportedToBothLedgers(t *testing.T) {
+	alice := newTestTransfer(t, "alice")
+	bob := newTestTransfer(t, "bob")
+	register(t, bob.node, alice.node)
+	trustUsers(alice.node, bob.node)
+	trustUsers(bob.node, alice.node)
+
+	var served, received ledgerLog
+	alice.SetLedger(served.record)
+	bob.SetLedger(received.record)
+
+	data := testContent(3*models.ChunkSize + 99)
+	resource := models.NewResourceFromContent("lecture.pdf", data, "user-alice")
+	if err := alice.Publish(resource, data); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	if err := bob.Fetch(resource); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	if total, count := received.bytes(); total != int64(len(data)) || count != 4 {
+		t.Errorf("Bob's ledger: %d bytes in %d records; want %d in 4", total, count, len(data))
+	}
+	for _, r := range received.records {
+		if !r.VerifyReceipt() {
+			t.Errorf("Bob's record %s has no valid receipt", r.ID)
+		}
+		if r.ServedBy != alice.node.ID() || r.ReceivedBy != bob.node.ID() || r.ContentID != resource.ID {
+			t.Errorf("Bob's record %+v; want alice -> bob for %s", r, resource.ID)
+		}
+		if r.ServerUser != alice.node.UserID() || r.ReceiverUser != bob.node.UserID() {
+			t.Errorf("Record users = %s -> %s; want %s -> %s",
+				r.ServerUser, r.ReceiverUser, alice.node.UserID(), bob.node.UserID())
+		}
+	}
+
+	// Alice only learns of her uploads through Bob's receipts
+	waitFor(t, "alice's ledger", func() bool {
+		total, count := served.bytes()
+		return total == int64(len(data)) && count == 4
+	})
+	for _, r := range served.records {
+		if r.ServedBy != alice.node.ID() || r.ReceivedBy != bob.node.ID() || r.ReceiverUser != bob.node.UserID() {
+			t.Errorf("Alice's record %+v; want alice -> bob", r)
+		}
+		if !r.VerifyReceipt() {
+			t.Errorf("Alice's record %s has no valid receipt", r.ID)
+		}
+	}
+}
+
+func TestForgedReceiptsAreRejected(t *testing.T) {
+	alice := newTestTransfer(t, "alice")
+	bob := newTestNode(t, "bob")
+	mallory := newTestNode(t, "mallory")
+	register(t, mallory, alice.node)
+	trustUsers(alice.node, bob, mallory)
+
+	var served ledgerLog
+	alice.SetLedger(served.record)
+
+	valid := func(receiver *Node) *models.TransferRecord {
+		r := models.NewTransferRecord("cid-lecture", 0, models.ChunkSize, alice.node.ID(), receiver.ID())
+		r.ServerUser = alice.node.UserID()
+		r.ReceiverUser = receiver.UserID()
+		return r
+	}
+
+	// Mallory signs a receipt in Bob's name with her own key
+	inBobsName := valid(bob)
+	inBobsName.SignReceipt(mallory.Identity())
+
+	// Mallory presents a receipt Bob really signed
+	bobsOwn := valid(bob)
+	bobsOwn.SignReceipt(bob.Identity())
+
+	// Mallory's own receipt, inflated after signing
+	inflated := valid(mallory)
+	inflated.SignReceipt(mallory.Identity())
+	inflated.Bytes *= 10
+
+	// Mallory's receipt charging Bob's user for what she received
+	chargingBob := valid(mallory)
+	chargingBob.ReceiverUser = bob.UserID()
+	chargingBob.SignReceipt(mallory.Identity())
+
+	// Mallory's receipt charging nobody
+	chargingNobody := valid(mallory)
+	chargingNobody.ReceiverUser = ""
+	chargingNobody.SignReceipt(mallory.Identity())
+
+	// A receipt crediting some other server
+	elsewhere := valid(mallory)
+	elsewhere.ServedBy = bob.ID()
+	elsewhere.SignReceipt(mallory.Identity())
+
+	for name, r := range map[string]*models.TransferRecord{
+		"signed in bob's name":  inBobsName,
+		"relayed from bob":      bobsOwn,
+		"inflated":              inflated,
+		"for another server":    elsewhere,
+		"charging a third user": chargingBob,
+		"charging nobody":       chargingNobody,
+	} {
+		if err := mallory.Request(alice.node.ID(), MsgReceipt, r, nil); err == nil {
+			t.Errorf("Receipt %s was accepted", name)
+		}
+	}
+	if _, count := served.bytes(); count != 0 {
+		t.Errorf("Alice recorded %d forged receipts", count)
+	}
+
+	honest := valid(mallory)
+	honest.SignReceipt(mallory.Identity())
+	if err := mallory.Request(alice.node.ID(), MsgReceipt, honest, nil); err != nil {
+		t.Fatalf("Honest receipt rejected: %v", err)
+	}
+	if _, count := served.bytes(); count != 1 {
+		t.Errorf("Alice recorded %d receipts; want 1", count)
+	}
+}
+
+func TestReceiptsOnlyNameVerifiedServers(t *testing.T) {
+	// Mallory's handshake claims Alice's UserID, but Bob has Alice's user
+	// bound to Alice's own peer
+	alice := newTestNode(t, "alice")
+	mallory := newTestTransfer(t, "alice")
+	bob := newTestTransfer(t, "bob")
+	register(t, bob.node, mallory.node)
+	trustUsers(bob.node, alice)
+	trustUsers(mallory.node, bob.node)
+
+	var served, received ledgerLog
+	mallory.SetLedger(served.record)
+	bob.SetLedger(received.record)
+
+	data := testContent(models.ChunkSize)
+	resource := models.NewResourceFromContent("lecture.pdf", data, "user-alice")
+	mallory.Publish(resource, data)
+	if err := bob.Fetch(resource); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	if _, count := received.bytes(); count != 1 {
+		t.Fatalf("Bob recorded %d transfers; want 1", count)
+	}
+	if r := received.records[0]; r.ServedBy != mallory.node.ID() || r.ServerUser != "" {
+		t.Errorf("Bob's record credits %q on %s; want no user for Mallory's peer", r.ServerUser, r.ServedBy)
+	}
+
+	// Mallory still gets the receipt, crediting no user
+	waitFor(t, "mallory's ledger", func() bool {
+		_, count := served.bytes()
+		return count == 1
+	})
+}
+
+func TestConnectionCountsRealTraffic(t *testing.T) {
+	alice := newTestTransfer(t, "alice")
+	bob := newTestTransfer(t, "bob")
+	register(t, bob.node, alice.node)
+
+	data := testContent(2 * models.ChunkSize)
+	resource := models.NewResourceFromContent("lecture.pdf", data, "user-alice")
+	alice.Publish(resource, data)
+	if err := bob.Fetch(resource); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	conns := bob.node.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("Bob has %d connections; want 1", len(conns))
+	}
+	// Chunks travel base64-encoded inside JSON frames, so the wire carries
+	// more than the content itself
+	if conns[0].BytesReceived < int64(len(data)) {
+		t.Errorf("BytesReceived = %d; want at least %d", conns[0].BytesReceived, len(data))
+	}
+	if conns[0].BytesSent <= 0 || conns[0].BytesSent >= conns[0].BytesReceived {
+		t.Errorf("BytesSent = %d; want requests smaller than the %d bytes received",
+			conns[0].BytesSent, conns[0].BytesReceived)
+	}
+
+	waitFor(t, "alice's side of the connection", func() bool {
+		conns := alice.node.Connections()
+		return len(conns) == 1 && conns[0].BytesSent == bob.node.Connections()[0].BytesReceived
+	})
+}
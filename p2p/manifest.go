@@ -0,0 +1,208 @@
+// Package p2p - Chunk manifests and proofs
+//
+// Every chunk a node serves carries a Merkle proof from its resource's
+// manifest. The downloader checks the proof against the ContentID before
+// writing the chunk, so a peer sending bad data is caught on the first
+// corrupt chunk instead of after the whole file has been assembled. Such a
+// peer is dropped from the download and reported to the misbehavior
+// handler.
+package p2p
+
+import (
+	"encoding/json"
+	"os"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// manifestSuffix marks the saved manifest of a resource
+const manifestSuffix = ".manifest"
+
+// Manifest message types
+const (
+	MsgManifest MessageType = "manifest"
+)
+
+// ManifestRequest asks a peer for the chunk manifest of a resource
+type ManifestRequest struct {
+	ContentID models.ContentID `json:"content_id"`
+}
+
+// MisbehaviorFunc is called when a peer serves data that fails
+// verification. userID is empty if the peer's user is unknown or its
+// claim to the user doesn't pass the node's UserVerifier.
+type MisbehaviorFunc func(peerID models.PeerID, userID models.UserID, cid models.ContentID)
+
+// ============================================================================
+// MANIFEST FILES
+// ============================================================================
+
+// saveManifest writes a manifest next to the content it describes
+func (s *ContentStore) saveManifest(m *models.Manifest) error {
+	path, err := s.path(m.Root)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + manifestSuffix + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path+manifestSuffix)
+}
+
+// loadManifest reads and checks the saved manifest for cid
+func (s *ContentStore) loadManifest(cid models.ContentID) (*models.Manifest, error) {
+	path, err := s.path(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path + manifestSuffix)
+	if err != nil {
+		return nil, errors.NewNotFoundError("manifest", string(cid))
+	}
+
+	var m models.Manifest
+	if err := json.Unmarshal(data, &m); err != nil || m.Root != cid || !m.Valid() {
+		return nil, errors.NewOperationError("loadManifest", "corrupt manifest", err)
+	}
+	return &m, nil
+}
+
+// ============================================================================
+// MANIFEST LOOKUP
+// ============================================================================
+
+// manifest returns the manifest for cid from memory or disk
+func (t *Transfer) manifest(cid models.ContentID) (*models.Manifest, error) {
+	t.mu.Lock()
+	m, ok := t.manifests[cid]
+	t.mu.Unlock()
+	if ok {
+		return m, nil
+	}
+
+	m, err := t.content.loadManifest(cid)
+	if err != nil {
+		return nil, err
+	}
+	t.cacheManifest(m)
+	return m, nil
+}
+
+// storeManifest saves a valid manifest to disk and memory
+func (t *Transfer) storeManifest(m *models.Manifest) error {
+	if !m.Valid() {
+		return errors.ErrContentMismatch
+	}
+	if err := t.content.saveManifest(m); err != nil {
+		return err
+	}
+	t.cacheManifest(m)
+	return nil
+}
+
+// cacheManifest keeps a manifest in memory
+func (t *Transfer) cacheManifest(m *models.Manifest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.manifests[m.Root] = m
+}
+
+// ensureManifest makes sure the manifest for a download is stored locally
+// so its chunks can be served with proofs while the download runs. It
+// comes from the resource itself, the disk, or failing that one of the
+// peers.
+func (t *Transfer) ensureManifest(resource *models.Resource, peers []models.PeerID) {
+	if m := resource.Manifest; m != nil && m.Root == resource.ID && t.storeManifest(m) == nil {
+		return
+	}
+	if _, err := t.manifest(resource.ID); err == nil {
+		return
+	}
+
+	for _, peerID := range peers {
+		m, err := t.FetchManifest(peerID, resource.ID)
+		if err != nil {
+			continue
+		}
+		if t.storeManifest(m) == nil {
+			resource.Manifest = m
+			return
+		}
+	}
+}
+
+// handleManifest serves the manifest of a resource this node holds
+func (t *Transfer) handleManifest(req *Request) (interface{}, error) {
+	var mr ManifestRequest
+	if err := req.Decode(&mr); err != nil {
+		return nil, err
+	}
+	return t.manifest(mr.ContentID)
+}
+
+// FetchManifest requests a resource's manifest from a peer and checks
+// that it hashes to the ContentID
+func (t *Transfer) FetchManifest(peerID models.PeerID, cid models.ContentID) (*models.Manifest, error) {
+	var m models.Manifest
+	if err := t.node.Request(peerID, MsgManifest, ManifestRequest{ContentID: cid}, &m); err != nil {
+		return nil, err
+	}
+	if m.Root != cid || !m.Valid() {
+		return nil, errors.ErrContentMismatch
+	}
+	return &m, nil
+}
+
+// ============================================================================
+// PROOFS AND MISBEHAVIOR
+// ============================================================================
+
+// attachProof adds the manifest path for a chunk it is about to serve
+func (t *Transfer) attachProof(chunk *models.ResourceChunk) {
+	if m, err := t.manifest(chunk.ResourceID); err == nil {
+		chunk.Proof = m.Proof(chunk.ChunkIndex)
+	}
+}
+
+// verifyProof checks a received chunk against the resource's ContentID
+func verifyProof(resource *models.Resource, total int, chunk *models.ResourceChunk) error {
+	if !models.VerifyChunkProof(resource.ID, chunk.ChunkIndex, total, chunk.Data, chunk.Proof) {
+		return errors.ErrInvalidProof
+	}
+	return nil
+}
+
+// SetMisbehaviorHandler sets the function told about peers that serve
+// chunks failing verification
+func (t *Transfer) SetMisbehaviorHandler(fn MisbehaviorFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onMisbehavior = fn
+}
+
+// reportMisbehavior passes a peer that served bad data to the handler
+func (t *Transfer) reportMisbehavior(peerID models.PeerID, cid models.ContentID) {
+	t.mu.Lock()
+	fn := t.onMisbehavior
+	t.mu.Unlock()
+	if fn == nil {
+		return
+	}
+
+	// The address book's UserID may have been relayed by anyone, so only
+	// a user bound to the peer is penalized
+	var userID models.UserID
+	if peer, err := t.node.Peer(peerID); err == nil {
+		userID = t.node.verifiedUser(peerID, peer.UserID)
+	}
+	fn(peerID, userID, cid)
+}
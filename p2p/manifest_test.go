@@ -0,0 +1,144 @@
+// Package p2p - Unit tests for chunk manifests and proofs
+package p2p
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"p2p-library/models"
+)
+
+func TestManifestProofs(t *testing.T) {
+	for total := 1; total <= 9; total++ {
+		data := testContent(total*models.ChunkSize - 7)
+		manifest := models.NewManifest(data)
+		other := models.NewManifest(testContent(total * models.ChunkSize))
+
+		if !manifest.Valid() {
+			t.Fatalf("%d chunks: manifest is not valid", total)
+		}
+
+		for i := 0; i < total; i++ {
+			chunk, _ := readChunk(bytes.NewReader(data), manifest.Root, i, int64(len(data)))
+			proof := manifest.Proof(i)
+
+			if !models.VerifyChunkProof(manifest.Root, i, total, chunk.Data, proof) {
+				t.Errorf("%d chunks: proof for chunk %d rejected", total, i)
+			}
+			if models.VerifyChunkProof(manifest.Root, i, total, chunk.Data[1:], proof) {
+				t.Errorf("%d chunks: tampered chunk %d accepted", total, i)
+			}
+			if models.VerifyChunkProof(other.Root, i, total, chunk.Data, proof) {
+				t.Errorf("%d chunks: chunk %d accepted for another file", total, i)
+			}
+			if total > 1 && models.VerifyChunkProof(manifest.Root, (i+1)%total, total, chunk.Data, proof) {
+				t.Errorf("%d chunks: chunk %d accepted at the wrong index", total, i)
+			}
+		}
+	}
+}
+
+func TestBadPeerCaughtOnFirstCorruptChunk(t *testing.T) {
+	leecher := newTestTransfer(t, "leecher")
+	leecher.SetSwarmOptions(SwarmOptions{RequestsPerPeer: 1})
+
+	var (
+		mu       sync.Mutex
+		reported []models.UserID
+	)
+	leecher.SetMisbehaviorHandler(func(peerID models.PeerID, userID models.UserID, cid models.ContentID) {
+		mu.Lock()
+		defer mu.Unlock()
+		reported = append(reported, userID)
+	})
+
+	data := testContent(8 * models.ChunkSize)
+	resource := swarmResource(data)
+
+	// Mallory's chunks have valid checksums and proofs, but for a
+	// different file than the one the content ID names
+	forged := testContent(8*models.ChunkSize + 1)[1:]
+	mallory := fakeSeeder(t, "mallory", resource.ID, forged, chunkRange(0, 8), false)
+	good := fakeSeeder(t, "good", resource.ID, data, chunkRange(0, 8), false)
+	for _, n := range []*Node{mallory, good} {
+		register(t, leecher.node, n)
+		resource.AddPeer(n.ID())
+	}
+	trustUsers(leecher.node, mallory, good)
+	requested := countChunkRequests(mallory)
+
+	if err := leecher.Fetch(resource); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	got, _ := leecher.Content().Get(resource.ID)
+	if !bytes.Equal(got, data) {
+		t.Fatal("Downloaded content does not match the original")
+	}
+
+	if r := requested(); len(r) != 1 {
+		t.Errorf("Mallory was asked for chunks %v; want only the first", r)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reported) != 1 || reported[0] != mallory.UserID() {
+		t.Errorf("Reported users %v; want [%s]", reported, mallory.UserID())
+	}
+}
+
+func TestMisbehaviorOnlyNamesVerifiedUser(t *testing.T) {
+	leecher := newTestTransfer(t, "leecher")
+	var reported []models.UserID
+	leecher.SetMisbehaviorHandler(func(peerID models.PeerID, userID models.UserID, cid models.ContentID) {
+		reported = append(reported, userID)
+	})
+
+	// Mallory's address book entry names a user the leecher can't tie
+	// to Mallory's key, as gossip relayed by anyone might
+	mallory := newTestNode(t, "mallory")
+	register(t, leecher.node, mallory)
+	leecher.reportMisbehavior(mallory.ID(), "cid")
+
+	trustUsers(leecher.node, mallory)
+	leecher.reportMisbehavior(mallory.ID(), "cid")
+
+	if len(reported) != 2 || reported[0] != "" || reported[1] != mallory.UserID() {
+		t.Errorf("Reported users %q; want no user, then %s once verified", reported, mallory.UserID())
+	}
+}
+
+func TestDownloadFetchesMissingManifest(t *testing.T) {
+	seeder := newTestTransfer(t, "seeder")
+	leecher := newTestTransfer(t, "leecher")
+	register(t, leecher.node, seeder.node)
+
+	data := testContent(3 * models.ChunkSize)
+	resource := swarmResource(data)
+	seeder.Publish(resource, data)
+
+	// The leecher only knows the ID, as if it came from a search result
+	bare := *resource
+	bare.Manifest = nil
+	if err := leecher.Fetch(&bare); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	manifest, err := leecher.manifest(resource.ID)
+	if err != nil {
+		t.Fatalf("Manifest not stored: %v", err)
+	}
+	if manifest.Root != resource.ID || len(manifest.ChunkHashes) != 3 {
+		t.Errorf("Manifest = %s with %d chunks; want %s with 3", manifest.Root, len(manifest.ChunkHashes), resource.ID)
+	}
+
+	// The leecher can now serve chunks with proofs of its own
+	third := newTestTransfer(t, "third")
+	register(t, third.node, leecher.node)
+	chunk, err := third.FetchChunk(leecher.node.ID(), resource.ID, 2)
+	if err != nil {
+		t.Fatalf("FetchChunk failed: %v", err)
+	}
+	if verifyProof(resource, 3, chunk) != nil {
+		t.Error("Chunk served by the leecher has no valid proof")
+	}
+}
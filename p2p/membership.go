@@ -0,0 +1,126 @@
+// Package p2p - Gossip membership over peer connections
+//
+// The gossip package is transport independent. This file carries its
+// messages over the peer node's request/reply protocol and keeps the
+// node's address book in step with the group's view: members gossiped
+// alive are marked online with a fresh LastPingAt, and members declared
+// dead are marked offline.
+package p2p
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"p2p-library/models"
+	"p2p-library/p2p/gossip"
+)
+
+// Gossip message types
+const (
+	MsgGossip MessageType = "gossip"
+)
+
+// nodeGossipTransport delivers gossip messages over a Node's connections
+type nodeGossipTransport struct {
+	node *Node
+}
+
+// NewMembership creates a gossip member for node. From then on the node's
+// peer statuses follow the membership layer instead of individual
+// connections.
+func NewMembership(node *Node, cfg gossip.Config) *gossip.Gossip {
+	self := gossip.Member{
+		ID:     node.ID(),
+		UserID: node.UserID(),
+		Addr:   net.JoinHostPort("", strconv.Itoa(node.Port())),
+	}
+	g := gossip.New(self, cfg, &nodeGossipTransport{node: node})
+
+	node.mu.Lock()
+	node.liveness = true
+	node.mu.Unlock()
+
+	node.Handle(MsgGossip, func(req *Request) (interface{}, error) {
+		var msg gossip.Message
+		if err := req.Decode(&msg); err != nil {
+			return nil, err
+		}
+
+		// The handshake, not the message, says who the sender is
+		msg.From.ID = req.From
+		msg.From.UserID = req.FromUser
+		if peer, err := node.Peer(req.From); err == nil {
+			msg.From.Addr = net.JoinHostPort(peer.IPAddress, strconv.Itoa(peer.Port))
+		}
+		return g.HandleMessage(&msg), nil
+	})
+
+	g.OnUpdate(func(m gossip.Member) {
+		node.setLiveness(m.ID, m.UserID, m.Addr, m.State != gossip.StateDead, m.LastSeen)
+	})
+	return g
+}
+
+// Send implements gossip.Transport. Members the node hasn't met before are
+// added to its address book first.
+func (t *nodeGossipTransport) Send(to gossip.Member, msg *gossip.Message) (*gossip.Message, error) {
+	if err := t.node.registerAddr(to.ID, to.UserID, to.Addr, models.DiscoveredGossip); err != nil {
+		return nil, err
+	}
+
+	var reply gossip.Message
+	if err := t.node.Request(to.ID, MsgGossip, msg, &reply); err != nil {
+		return nil, err
+	}
+
+	// As for requests, the handshake says who answered
+	reply.From.ID = to.ID
+	reply.From.UserID = t.node.connUser(to.ID)
+	return &reply, nil
+}
+
+// MemberFor returns the gossip member record of a registered peer, for
+// use as a Join contact
+func (n *Node) MemberFor(peerID models.PeerID) (gossip.Member, error) {
+	peer, err := n.Peer(peerID)
+	if err != nil {
+		return gossip.Member{}, err
+	}
+	return gossip.Member{
+		ID:     peer.ID,
+		UserID: peer.UserID,
+		Addr:   net.JoinHostPort(peer.IPAddress, strconv.Itoa(peer.Port)),
+	}, nil
+}
+
+// setLiveness records what the membership layer knows about a peer
+func (n *Node) setLiveness(peerID models.PeerID, userID models.UserID, addr string, alive bool, lastSeen time.Time) {
+	if peerID == n.cfg.PeerID || n.registerAddr(peerID, userID, addr, models.DiscoveredGossip) != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	p, ok := n.peers[peerID]
+	if !ok {
+		return
+	}
+	if userID != "" {
+		p.UserID = userID
+	}
+	if !lastSeen.IsZero() && lastSeen.After(p.LastPingAt) {
+		p.LastPingAt = lastSeen
+	}
+	if alive {
+		n.remember(p)
+	}
+
+	switch {
+	case alive && p.Status != models.StatusOnline:
+		p.SetOnline()
+	case !alive:
+		p.SetOffline()
+	}
+}
@@ -0,0 +1,80 @@
+// Package p2p - Unit tests for gossip membership over peer connections
+package p2p
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"p2p-library/models"
+	"p2p-library/p2p/gossip"
+)
+
+func TestMembershipTracksPeerLiveness(t *testing.T) {
+	cfg := gossip.Config{
+		ProbeInterval:    20 * time.Millisecond,
+		ProbeTimeout:     200 * time.Millisecond,
+		SuspicionTimeout: 300 * time.Millisecond,
+	}
+
+	// Four nodes that each only know the first one
+	nodes := make([]*Node, 4)
+	groups := make([]*gossip.Gossip, 4)
+	for i := range nodes {
+		nodes[i] = newTestNode(t, fmt.Sprintf("swim-%d", i))
+		groups[i] = NewMembership(nodes[i], cfg)
+
+		if i > 0 {
+			register(t, nodes[i], nodes[0])
+			contact, _ := nodes[i].MemberFor(nodes[0].ID())
+			if err := groups[i].Join(contact); err != nil {
+				t.Fatalf("Join failed: %v", err)
+			}
+		}
+	}
+	for _, g := range groups {
+		g.Start()
+		defer g.Close()
+	}
+
+	victim := nodes[3]
+	waitFor(t, "everyone to learn of every peer", func() bool {
+		for _, n := range nodes[:3] {
+			p, err := n.Peer(victim.ID())
+			if err != nil || p.Status != models.StatusOnline || p.LastPingAt.IsZero() {
+				return false
+			}
+		}
+		return true
+	})
+
+	// Node 1 learned of the victim through gossip and was never told its
+	// address by hand; it still heard from it recently
+	if p, _ := nodes[1].Peer(victim.ID()); time.Since(p.LastPingAt) > time.Second {
+		t.Errorf("LastPingAt is stale: %v", p.LastPingAt)
+	}
+
+	groups[3].Close()
+	victim.Close()
+
+	waitFor(t, "the dead node to be marked offline", func() bool {
+		for _, n := range nodes[:3] {
+			if p, _ := n.Peer(victim.ID()); p.Status != models.StatusOffline {
+				return false
+			}
+		}
+		return true
+	})
+
+	// The survivors stay online
+	for _, n := range nodes[:3] {
+		for _, other := range nodes[:3] {
+			if n == other {
+				continue
+			}
+			if p, _ := n.Peer(other.ID()); p.Status != models.StatusOnline {
+				t.Errorf("%s sees %s as %s", n.ID(), other.ID(), p.Status)
+			}
+		}
+	}
+}
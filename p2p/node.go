@@ -0,0 +1,779 @@
+// Package p2p - Peer node
+//
+// Node is the concrete implementation of interfaces.PeerManager. It keeps
+// an address book of known peers, accepts and dials TCP connections, and
+// tracks one models.PeerConnection per connected peer.
+package p2p
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"p2p-library/errors"
+	"p2p-library/interfaces"
+	"p2p-library/models"
+)
+
+// Compile-time check that Node satisfies the PeerManager interface
+var _ interfaces.PeerManager = (*Node)(nil)
+
+// ============================================================================
+// CONFIGURATION
+// ============================================================================
+
+// Config holds the settings for a Node
+type Config struct {
+	// ListenAddr is the TCP address to listen on, e.g. ":9000".
+	// Use "127.0.0.1:0" to pick a free port (handy in tests).
+	ListenAddr string
+
+	// Identity announced to other peers during the handshake. The PeerID
+	// is derived from the Identity keypair, which is generated when nil;
+	// a PeerID set here must match it.
+	Identity *models.Identity
+	PeerID   models.PeerID
+	UserID   models.UserID
+
+	// Timeouts (zero values fall back to the defaults below)
+	DialTimeout      time.Duration
+	HandshakeTimeout time.Duration
+	RequestTimeout   time.Duration
+	WriteTimeout     time.Duration
+
+	// PeerListPath is where known peers are saved between runs. Leave it
+	// empty to keep them in memory only.
+	PeerListPath string
+
+	// MaxKnownPeers caps the known peer list; the least recently seen
+	// peers are forgotten first
+	MaxKnownPeers int
+
+	// PEXInterval is how often peers are asked for the peers they know
+	PEXInterval time.Duration
+}
+
+// Default timeouts
+const (
+	DefaultDialTimeout      = 5 * time.Second
+	DefaultHandshakeTimeout = 5 * time.Second
+	DefaultRequestTimeout   = 30 * time.Second
+	DefaultWriteTimeout     = 30 * time.Second
+	DefaultMaxKnownPeers    = 200
+	DefaultPEXInterval      = time.Minute
+)
+
+// Pause bounds between retries of a failing Accept
+const (
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+)
+
+// withDefaults fills in zero-valued settings
+func (c Config) withDefaults() Config {
+	if c.ListenAddr == "" {
+		c.ListenAddr = ":0"
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = DefaultDialTimeout
+	}
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = DefaultRequestTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = DefaultWriteTimeout
+	}
+	if c.MaxKnownPeers == 0 {
+		c.MaxKnownPeers = DefaultMaxKnownPeers
+	}
+	if c.PEXInterval == 0 {
+		c.PEXInterval = DefaultPEXInterval
+	}
+	return c
+}
+
+// ============================================================================
+// NODE
+// ============================================================================
+
+// Node is a single participant in the P2P network
+type Node struct {
+	cfg      Config
+	listener net.Listener
+
+	mu         sync.RWMutex
+	peers      map[models.PeerID]*models.Peer // address book
+	known      *models.PeerList               // persisted peers, capped
+	conns      map[models.PeerID]*peerConn    // live connections
+	handlers   map[MessageType]HandlerFunc
+	tls        *tls.Config  // session settings for our identity
+	liveness   bool         // peer status comes from gossip, not from connections
+	verifyUser UserVerifier // checks the UserIDs peers claim
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewNode creates a node; call Start to begin accepting connections
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.Identity == nil {
+		identity, err := models.NewIdentity()
+		if err != nil {
+			return nil, errors.NewOperationError("NewNode", "failed to generate identity", err)
+		}
+		cfg.Identity = identity
+	}
+	if cfg.PeerID == "" {
+		cfg.PeerID = cfg.Identity.PeerID()
+	}
+	if cfg.PeerID != cfg.Identity.PeerID() {
+		return nil, errors.NewValidationError("peer_id", "peer ID must be derived from the identity key")
+	}
+
+	session, err := sessionConfig(cfg.Identity)
+	if err != nil {
+		return nil, errors.NewOperationError("NewNode", "failed to create session certificate", err)
+	}
+
+	cfg = cfg.withDefaults()
+	n := &Node{
+		cfg:      cfg,
+		tls:      session,
+		peers:    make(map[models.PeerID]*models.Peer),
+		known:    models.NewPeerList(cfg.MaxKnownPeers),
+		conns:    make(map[models.PeerID]*peerConn),
+		handlers: make(map[MessageType]HandlerFunc),
+		closing:  make(chan struct{}),
+	}
+
+	n.Handle(MsgPing, func(req *Request) (interface{}, error) {
+		return Pong{PeerID: n.cfg.PeerID}, nil
+	})
+	n.Handle(MsgPEX, n.handlePEX)
+
+	return n, nil
+}
+
+// Start opens the listener and begins accepting connections
+func (n *Node) Start() error {
+	listener, err := net.Listen("tcp", n.cfg.ListenAddr)
+	if err != nil {
+		return errors.NewOperationError("Start", "failed to listen on "+n.cfg.ListenAddr, err)
+	}
+	n.listener = listener
+
+	if err := n.loadPeers(); err != nil {
+		listener.Close()
+		return err
+	}
+
+	n.wg.Add(2)
+	go n.acceptLoop()
+	go n.pexLoop()
+	return nil
+}
+
+// Close stops the listener and drops every connection
+func (n *Node) Close() error {
+	select {
+	case <-n.closing:
+		return nil
+	default:
+	}
+	close(n.closing)
+
+	if n.listener != nil {
+		n.listener.Close()
+	}
+
+	n.mu.RLock()
+	conns := make([]*peerConn, 0, len(n.conns))
+	for _, c := range n.conns {
+		conns = append(conns, c)
+	}
+	n.mu.RUnlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+
+	n.wg.Wait()
+	return n.SavePeers()
+}
+
+// ID returns this node's PeerID
+func (n *Node) ID() models.PeerID {
+	return n.cfg.PeerID
+}
+
+// Identity returns the keypair this node signs with
+func (n *Node) Identity() *models.Identity {
+	return n.cfg.Identity
+}
+
+// UserID returns the user this node belongs to
+func (n *Node) UserID() models.UserID {
+	return n.cfg.UserID
+}
+
+// Addr returns the address the node is listening on
+func (n *Node) Addr() net.Addr {
+	if n.listener == nil {
+		return nil
+	}
+	return n.listener.Addr()
+}
+
+// Port returns the TCP port the node is listening on
+func (n *Node) Port() int {
+	if addr, ok := n.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// Handle registers the handler for a message type
+func (n *Node) Handle(typ MessageType, h HandlerFunc) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.handlers[typ] = h
+}
+
+// handler looks up the handler for a message type
+func (n *Node) handler(typ MessageType) HandlerFunc {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.handlers[typ]
+}
+
+// ============================================================================
+// PEER MANAGER IMPLEMENTATION
+// ============================================================================
+
+// Register adds a peer to the address book (or refreshes its address)
+func (n *Node) Register(peer *models.Peer) error {
+	if peer == nil || peer.ID == "" {
+		return errors.NewValidationError("peer_id", "peer ID is required")
+	}
+	if peer.ID == n.cfg.PeerID {
+		return errors.NewValidationError("peer_id", "cannot register self")
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if existing, ok := n.peers[peer.ID]; ok {
+		existing.IPAddress = peer.IPAddress
+		existing.Port = peer.Port
+		if peer.UserID != "" {
+			existing.UserID = peer.UserID
+		}
+		n.remember(existing)
+		return nil
+	}
+
+	p := *peer
+	if _, connected := n.conns[peer.ID]; !connected {
+		p.Status = models.StatusOffline
+	}
+	if p.DiscoveredVia == "" {
+		p.DiscoveredVia = models.DiscoveredManual
+	}
+	n.peers[peer.ID] = &p
+	n.remember(&p)
+	return nil
+}
+
+// registerAddr adds a peer known by its "host:port" address to the
+// address book if it isn't there yet
+func (n *Node) registerAddr(peerID models.PeerID, userID models.UserID, addr string, via models.DiscoverySource) error {
+	if _, err := n.Peer(peerID); err == nil {
+		return nil
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.NewValidationError("addr", "invalid peer address "+addr)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return errors.NewValidationError("addr", "invalid peer port "+portStr)
+	}
+	peer := models.NewPeer(peerID, userID, host, port)
+	peer.DiscoveredVia = via
+	return n.Register(peer)
+}
+
+// Unregister disconnects and forgets a peer
+func (n *Node) Unregister(peerID models.PeerID) error {
+	n.mu.Lock()
+	_, known := n.peers[peerID]
+	conn := n.conns[peerID]
+	delete(n.peers, peerID)
+	n.known.Remove(peerID)
+	n.mu.Unlock()
+
+	if !known {
+		return errors.ErrPeerNotFound
+	}
+	if conn != nil {
+		conn.close()
+	}
+	return nil
+}
+
+// GetOnline returns copies of all peers that currently have a connection
+func (n *Node) GetOnline() ([]*models.Peer, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	online := make([]*models.Peer, 0, len(n.conns))
+	for _, p := range n.peers {
+		if p.Status == models.StatusOnline {
+			cp := *p
+			online = append(online, &cp)
+		}
+	}
+	return online, nil
+}
+
+// GetAll returns copies of every peer in the address book
+func (n *Node) GetAll() ([]*models.Peer, error) {
+	return n.Peers(), nil
+}
+
+// Connect dials a registered peer and performs the handshake.
+// Connecting to an already connected peer is a no-op.
+func (n *Node) Connect(peerID models.PeerID) error {
+	_, err := n.connFor(peerID)
+	return err
+}
+
+// Disconnect closes the connection to a peer but keeps it registered
+func (n *Node) Disconnect(peerID models.PeerID) error {
+	n.mu.RLock()
+	conn, ok := n.conns[peerID]
+	n.mu.RUnlock()
+
+	if !ok {
+		return errors.ErrPeerNotConnected
+	}
+	conn.close()
+	return nil
+}
+
+// Ping measures the round-trip time to a peer in milliseconds
+func (n *Node) Ping(peerID models.PeerID) (int64, error) {
+	rtt, err := n.PingRTT(peerID)
+	if err != nil {
+		return 0, err
+	}
+	return rtt.Milliseconds(), nil
+}
+
+// PingRTT measures the round-trip time to a peer at full resolution
+// and records it on the peer's entry in the address book
+func (n *Node) PingRTT(peerID models.PeerID) (time.Duration, error) {
+	conn, err := n.connFor(peerID)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	var pong Pong
+	if err := conn.request(MsgPing, nil, &pong, n.cfg.RequestTimeout); err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+
+	if pong.PeerID != peerID {
+		return 0, errors.ErrHandshakeFailed
+	}
+
+	n.mu.Lock()
+	if p, ok := n.peers[peerID]; ok {
+		p.UpdatePing(rtt.Milliseconds())
+	}
+	n.mu.Unlock()
+
+	return rtt, nil
+}
+
+// ============================================================================
+// QUERIES
+// ============================================================================
+
+// Peers returns copies of every peer in the address book
+func (n *Node) Peers() []*models.Peer {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	result := make([]*models.Peer, 0, len(n.peers))
+	for _, p := range n.peers {
+		cp := *p
+		result = append(result, &cp)
+	}
+	return result
+}
+
+// Peer returns a copy of a single address book entry
+func (n *Node) Peer(peerID models.PeerID) (*models.Peer, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	p, ok := n.peers[peerID]
+	if !ok {
+		return nil, errors.NewNotFoundError("peer", string(peerID))
+	}
+	cp := *p
+	return &cp, nil
+}
+
+// Connections returns a snapshot of every live connection
+func (n *Node) Connections() []models.PeerConnection {
+	n.mu.RLock()
+	conns := make([]*peerConn, 0, len(n.conns))
+	for _, c := range n.conns {
+		conns = append(conns, c)
+	}
+	n.mu.RUnlock()
+
+	result := make([]models.PeerConnection, 0, len(conns))
+	for _, c := range conns {
+		result = append(result, c.snapshot())
+	}
+	return result
+}
+
+// IsConnected reports whether there is a live connection to a peer
+func (n *Node) IsConnected(peerID models.PeerID) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	_, ok := n.conns[peerID]
+	return ok
+}
+
+// Request sends a request to a peer (connecting first if necessary)
+// and decodes the reply into resp
+func (n *Node) Request(peerID models.PeerID, typ MessageType, req, resp interface{}) error {
+	conn, err := n.connFor(peerID)
+	if err != nil {
+		return err
+	}
+	return conn.request(typ, req, resp, n.cfg.RequestTimeout)
+}
+
+// ============================================================================
+// CONNECTION MANAGEMENT
+// ============================================================================
+
+// connFor returns the live connection to a peer, dialing it if needed
+func (n *Node) connFor(peerID models.PeerID) (*peerConn, error) {
+	n.mu.RLock()
+	conn, connected := n.conns[peerID]
+	peer, known := n.peers[peerID]
+	var addr string
+	if known {
+		addr = net.JoinHostPort(peer.IPAddress, strconv.Itoa(peer.Port))
+	}
+	n.mu.RUnlock()
+
+	if connected {
+		return conn, nil
+	}
+	if !known {
+		return nil, errors.NewNotFoundError("peer", string(peerID))
+	}
+
+	return n.dial(addr, peerID)
+}
+
+// dial opens an outbound connection and performs the handshake.
+// If expected is non-empty the remote side must present that PeerID.
+func (n *Node) dial(addr string, expected models.PeerID) (*peerConn, error) {
+	select {
+	case <-n.closing:
+		return nil, errors.ErrNodeClosed
+	default:
+	}
+
+	raw, err := net.DialTimeout("tcp", addr, n.cfg.DialTimeout)
+	if err != nil {
+		return nil, errors.NewOperationError("Connect", "failed to dial "+addr, err)
+	}
+
+	conn, remote, err := n.handshake(raw, true)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	if expected != "" && remote.PeerID != expected {
+		conn.Close()
+		return nil, errors.NewOperationError("Connect", "unexpected peer "+string(remote.PeerID), errors.ErrHandshakeFailed)
+	}
+
+	return n.addConn(conn, remote, true)
+}
+
+// acceptLoop accepts inbound connections until the listener closes
+func (n *Node) acceptLoop() {
+	defer n.wg.Done()
+
+	// Accept errors other than a close (running out of file
+	// descriptors, say) are retried after a growing pause instead of
+	// spinning
+	var backoff time.Duration
+	for {
+		raw, err := n.listener.Accept()
+		if err != nil {
+			if backoff == 0 {
+				backoff = acceptBackoffMin
+			} else if backoff *= 2; backoff > acceptBackoffMax {
+				backoff = acceptBackoffMax
+			}
+			select {
+			case <-n.closing:
+				return
+			case <-time.After(backoff):
+				continue
+			}
+		}
+		backoff = 0
+
+		go func() {
+			conn, remote, err := n.handshake(raw, false)
+			if err != nil {
+				raw.Close()
+				return
+			}
+			n.addConn(conn, remote, false)
+		}()
+	}
+}
+
+// handshake opens an encrypted session over raw, exchanges Hello
+// messages inside it and then proves key ownership: each side signs the
+// nonce from the other's Hello with its identity key, which must also be
+// the key that set up the session. The dialing side speaks first. It
+// returns the secured connection to use from then on.
+func (n *Node) handshake(raw net.Conn, outbound bool) (net.Conn, Hello, error) {
+	conn, err := n.secureConn(raw, outbound)
+	if err != nil {
+		return nil, Hello{}, err
+	}
+	remote, err := n.exchangeHello(conn, outbound)
+	if err != nil {
+		return nil, Hello{}, err
+	}
+	return conn, remote, nil
+}
+
+// exchangeHello runs the Hello and Auth exchange over a secured session
+func (n *Node) exchangeHello(conn *tls.Conn, outbound bool) (Hello, error) {
+	conn.SetDeadline(time.Now().Add(n.cfg.HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce, err := newNonce()
+	if err != nil {
+		return Hello{}, errors.NewOperationError("Handshake", "failed to create nonce", err)
+	}
+	local := Hello{
+		Version:    ProtocolVersion,
+		PeerID:     n.cfg.PeerID,
+		UserID:     n.cfg.UserID,
+		ListenPort: n.Port(),
+		Nonce:      nonce,
+	}
+
+	send := func(typ MessageType, v interface{}) error {
+		payload, err := encodePayload(v)
+		if err != nil {
+			return err
+		}
+		if err := writeFrame(conn, &Message{Type: typ, Payload: payload}); err != nil {
+			return errors.NewOperationError("Handshake", "failed to send "+string(typ), errors.ErrHandshakeFailed)
+		}
+		return nil
+	}
+	sendHello := func() error { return send(MsgHello, local) }
+
+	if outbound {
+		if err := sendHello(); err != nil {
+			return Hello{}, err
+		}
+	}
+
+	msg, err := readFrame(conn)
+	if err != nil || msg.Type != MsgHello {
+		return Hello{}, errors.NewOperationError("Handshake", "no hello received", errors.ErrHandshakeFailed)
+	}
+	if msg.Error != "" {
+		return Hello{}, errors.NewOperationError("Handshake", msg.Error, errors.ErrHandshakeFailed)
+	}
+
+	req := &Request{Payload: msg.Payload}
+	var remote Hello
+	if err := req.Decode(&remote); err != nil {
+		return Hello{}, errors.NewOperationError("Handshake", "malformed hello", errors.ErrHandshakeFailed)
+	}
+
+	if remote.Version != ProtocolVersion {
+		if !outbound {
+			writeFrame(conn, &Message{Type: MsgHello, Error: errors.ErrVersionMismatch.Error()})
+		}
+		return Hello{}, errors.NewOperationError("Handshake", "remote speaks version "+strconv.Itoa(remote.Version), errors.ErrVersionMismatch)
+	}
+	if remote.PeerID == "" || remote.PeerID == n.cfg.PeerID {
+		return Hello{}, errors.NewOperationError("Handshake", "invalid remote peer ID", errors.ErrHandshakeFailed)
+	}
+	if len(remote.Nonce) != nonceSize {
+		return Hello{}, errors.NewOperationError("Handshake", "invalid remote nonce", errors.ErrHandshakeFailed)
+	}
+	if sessionPeer(conn) != remote.PeerID {
+		return Hello{}, errors.NewOperationError("Handshake", "session key does not match peer ID "+string(remote.PeerID), errors.ErrInvalidSignature)
+	}
+
+	sendAuth := func() error {
+		return send(MsgAuth, Auth{Signature: n.cfg.Identity.Sign(authBytes(remote.Nonce, local, remote.PeerID))})
+	}
+
+	// The dialer proves itself first; the listener answers once satisfied
+	if outbound {
+		if err := sendAuth(); err != nil {
+			return Hello{}, err
+		}
+	} else if err := sendHello(); err != nil {
+		return Hello{}, err
+	}
+
+	if err := n.verifyAuth(conn, nonce, remote); err != nil {
+		return Hello{}, err
+	}
+
+	if !outbound {
+		if err := sendAuth(); err != nil {
+			return Hello{}, err
+		}
+	}
+
+	return remote, nil
+}
+
+// verifyAuth reads the remote side's Auth and checks it signs our nonce
+// with the key its PeerID was derived from
+func (n *Node) verifyAuth(conn net.Conn, nonce []byte, remote Hello) error {
+	msg, err := readFrame(conn)
+	if err != nil || msg.Type != MsgAuth {
+		return errors.NewOperationError("Handshake", "no auth received", errors.ErrHandshakeFailed)
+	}
+
+	req := &Request{Payload: msg.Payload}
+	var auth Auth
+	if err := req.Decode(&auth); err != nil {
+		return errors.NewOperationError("Handshake", "malformed auth", errors.ErrHandshakeFailed)
+	}
+	if !models.VerifySignature(remote.PeerID, authBytes(nonce, remote, n.cfg.PeerID), auth.Signature) {
+		return errors.NewOperationError("Handshake", "remote does not own peer ID "+string(remote.PeerID), errors.ErrInvalidSignature)
+	}
+	return nil
+}
+
+// addConn records a handshaken connection and starts its read loop.
+//
+// If both sides dial each other at the same time we end up with two
+// connections. Both nodes keep the one initiated by the lower PeerID so
+// they agree on which connection survives.
+func (n *Node) addConn(raw net.Conn, remote Hello, outbound bool) (*peerConn, error) {
+	conn := newPeerConn(n, raw, remote)
+	conn.outbound = outbound
+
+	n.mu.Lock()
+	select {
+	case <-n.closing:
+		n.mu.Unlock()
+		raw.Close()
+		return nil, errors.ErrNodeClosed
+	default:
+	}
+
+	var replaced *peerConn
+	if existing, ok := n.conns[remote.PeerID]; ok {
+		if !n.prefer(conn, existing) {
+			n.mu.Unlock()
+			raw.Close()
+			return existing, nil
+		}
+		replaced = existing
+	}
+	n.conns[remote.PeerID] = conn
+
+	// Update (or create) the address book entry
+	peer, ok := n.peers[remote.PeerID]
+	if !ok {
+		peer = models.NewPeer(remote.PeerID, remote.UserID, "", remote.ListenPort)
+		peer.DiscoveredVia = models.DiscoveredInbound
+		if outbound {
+			peer.DiscoveredVia = models.DiscoveredBootstrap
+		}
+		n.peers[remote.PeerID] = peer
+	}
+	if host, _, err := net.SplitHostPort(raw.RemoteAddr().String()); err == nil {
+		peer.IPAddress = host
+	}
+	if remote.ListenPort != 0 {
+		peer.Port = remote.ListenPort
+	}
+	peer.UserID = remote.UserID
+	peer.SetOnline()
+	peer.LastPingAt = models.TimeNow()
+	n.remember(peer)
+
+	n.wg.Add(1)
+	n.mu.Unlock()
+
+	if replaced != nil {
+		replaced.close()
+	}
+
+	go func() {
+		defer n.wg.Done()
+		conn.readLoop()
+	}()
+
+	return conn, nil
+}
+
+// prefer reports whether candidate should replace existing
+func (n *Node) prefer(candidate, existing *peerConn) bool {
+	return n.initiator(candidate) < n.initiator(existing)
+}
+
+// initiator returns the PeerID of the side that dialed a connection
+func (n *Node) initiator(c *peerConn) models.PeerID {
+	if c.outbound {
+		return n.cfg.PeerID
+	}
+	return c.remote.PeerID
+}
+
+// connectionClosed removes a dead connection and marks the peer offline
+func (n *Node) connectionClosed(c *peerConn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conns[c.remote.PeerID] != c {
+		return // already replaced by a newer connection
+	}
+	delete(n.conns, c.remote.PeerID)
+
+	// With gossip membership a closed connection says nothing about
+	// whether the peer is still alive
+	if p, ok := n.peers[c.remote.PeerID]; ok && !n.liveness {
+		p.SetOffline()
+	}
+}
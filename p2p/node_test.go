@@ -0,0 +1,346 @@
+// Package p2p - Unit tests for Node
+package p2p
+
+import (
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// ============================================================================
+// TEST SETUP
+// ============================================================================
+
+// newTestNode starts a node on a free loopback port and stops it at cleanup
+func newTestNode(t *testing.T, name string) *Node {
+	t.Helper()
+
+	node, err := NewNode(Config{
+		ListenAddr:     "127.0.0.1:0",
+		UserID:         models.UserID("user-" + name),
+		RequestTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewNode(%s) failed: %v", name, err)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatalf("Start(%s) failed: %v", name, err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+// register adds target to node's address book
+func register(t *testing.T, node, target *Node) {
+	t.Helper()
+
+	peer := models.NewPeer(target.ID(), target.UserID(), "127.0.0.1", target.Port())
+	if err := node.Register(peer); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+}
+
+// trustUsers makes node accept the UserIDs the given peers claim, as a
+// store binding each of their users to their PeerID would
+func trustUsers(node *Node, peers ...*Node) {
+	bound := make(map[models.PeerID]models.UserID)
+	for _, peer := range peers {
+		bound[peer.ID()] = peer.UserID()
+	}
+	node.SetUserVerifier(func(peerID models.PeerID, userID models.UserID) bool {
+		return bound[peerID] == userID
+	})
+}
+
+// waitFor polls cond until it is true or the deadline passes
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// ============================================================================
+// TESTS
+// ============================================================================
+
+func TestConnectHandshake(t *testing.T) {
+	alice := newTestNode(t, "alice")
+	bob := newTestNode(t, "bob")
+
+	register(t, alice, bob)
+	if err := alice.Connect(bob.ID()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	// Bob learns Alice's identity from the handshake
+	waitFor(t, "bob to see alice", func() bool { return bob.IsConnected(alice.ID()) })
+
+	peer, err := bob.Peer(alice.ID())
+	if err != nil {
+		t.Fatalf("bob has no entry for alice: %v", err)
+	}
+	if peer.UserID != alice.UserID() {
+		t.Errorf("UserID = %s; want %s", peer.UserID, alice.UserID())
+	}
+	if peer.Port != alice.Port() {
+		t.Errorf("Port = %d; want %d", peer.Port, alice.Port())
+	}
+	if peer.Status != models.StatusOnline {
+		t.Errorf("Status = %s; want %s", peer.Status, models.StatusOnline)
+	}
+
+	conns := alice.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("Got %d connections; want 1", len(conns))
+	}
+	if conns[0].LocalPeer != alice.ID() || conns[0].RemotePeer != bob.ID() {
+		t.Errorf("Connection = %s -> %s; want %s -> %s",
+			conns[0].LocalPeer, conns[0].RemotePeer, alice.ID(), bob.ID())
+	}
+}
+
+func TestPingMeasuresLatency(t *testing.T) {
+	alice := newTestNode(t, "alice")
+	bob := newTestNode(t, "bob")
+	register(t, alice, bob)
+
+	rtt, err := alice.PingRTT(bob.ID())
+	if err != nil {
+		t.Fatalf("PingRTT failed: %v", err)
+	}
+	if rtt <= 0 {
+		t.Errorf("RTT = %v; want > 0", rtt)
+	}
+
+	latency, err := alice.Ping(bob.ID())
+	if err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if latency < 0 || latency > 1000 {
+		t.Errorf("Latency = %dms; want a loopback-sized value", latency)
+	}
+}
+
+func TestDuplicateRepliesDoNotStallTheConnection(t *testing.T) {
+	alice := newTestNode(t, "alice")
+	bob := newTestNode(t, "bob")
+	register(t, alice, bob)
+	if err := alice.Connect(bob.ID()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	waitFor(t, "bob to see alice", func() bool {
+		bob.mu.RLock()
+		defer bob.mu.RUnlock()
+		return bob.conns[alice.ID()] != nil
+	})
+
+	// A request of Alice's nobody is waiting on the reply to, answered
+	// three times by Bob
+	alice.mu.RLock()
+	toBob := alice.conns[bob.ID()]
+	alice.mu.RUnlock()
+	toBob.pendingMu.Lock()
+	toBob.pending[999] = make(chan *Message, 1)
+	toBob.pendingMu.Unlock()
+
+	bob.mu.RLock()
+	toAlice := bob.conns[alice.ID()]
+	bob.mu.RUnlock()
+	for i := 0; i < 3; i++ {
+		if err := toAlice.send(&Message{Type: MsgPing, ID: 999, Reply: true}); err != nil {
+			t.Fatalf("Sending reply %d failed: %v", i, err)
+		}
+	}
+
+	if _, err := alice.Ping(bob.ID()); err != nil {
+		t.Errorf("Ping after duplicate replies failed: %v", err)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	alice := newTestNode(t, "alice")
+	bob := newTestNode(t, "bob")
+	register(t, alice, bob)
+
+	if err := alice.Connect(bob.ID()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := alice.Disconnect(bob.ID()); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+
+	online, _ := alice.GetOnline()
+	if len(online) != 0 {
+		t.Errorf("Got %d online peers after disconnect; want 0", len(online))
+	}
+	waitFor(t, "bob to drop alice", func() bool { return !bob.IsConnected(alice.ID()) })
+
+	// The peer stays registered and can be reconnected
+	if err := alice.Connect(bob.ID()); err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	alice := newTestNode(t, "alice")
+	bob := newTestNode(t, "bob")
+	register(t, alice, bob)
+	alice.Connect(bob.ID())
+
+	if err := alice.Unregister(bob.ID()); err != nil {
+		t.Fatalf("Unregister failed: %v", err)
+	}
+	if _, err := alice.Peer(bob.ID()); !errors.IsNotFound(err) {
+		t.Errorf("Peer after Unregister: err = %v; want not found", err)
+	}
+	if err := alice.Unregister(bob.ID()); err != errors.ErrPeerNotFound {
+		t.Errorf("Second Unregister: err = %v; want %v", err, errors.ErrPeerNotFound)
+	}
+}
+
+func TestConnectUnknownPeer(t *testing.T) {
+	alice := newTestNode(t, "alice")
+
+	if err := alice.Connect("peer-nobody"); !errors.IsNotFound(err) {
+		t.Errorf("Connect to unknown peer: err = %v; want not found", err)
+	}
+}
+
+func TestHandshakeRejectsVersionMismatch(t *testing.T) {
+	alice := newTestNode(t, "alice")
+
+	identity, _ := models.NewIdentity()
+	session, _ := sessionConfig(identity)
+	raw, err := tls.Dial("tcp", alice.Addr().String(), session)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer raw.Close()
+
+	payload, _ := encodePayload(Hello{Version: ProtocolVersion + 1, PeerID: identity.PeerID()})
+	if err := writeFrame(raw, &Message{Type: MsgHello, Payload: payload}); err != nil {
+		t.Fatalf("writeFrame failed: %v", err)
+	}
+
+	raw.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply, err := readFrame(raw)
+	if err != nil {
+		t.Fatalf("readFrame failed: %v", err)
+	}
+	if reply.Error != errors.ErrVersionMismatch.Error() {
+		t.Errorf("Reply error = %q; want %q", reply.Error, errors.ErrVersionMismatch.Error())
+	}
+	if alice.IsConnected(identity.PeerID()) {
+		t.Error("Node accepted a peer with the wrong protocol version")
+	}
+}
+
+func TestHandshakeRejectsImpersonation(t *testing.T) {
+	alice := newTestNode(t, "alice")
+	bob := newTestNode(t, "bob")
+
+	// Mallory announces Alice's PeerID but holds a different key
+	mallory := newTestNode(t, "mallory")
+	mallory.cfg.PeerID = alice.ID()
+
+	_, err := mallory.dial(bob.Addr().String(), "")
+	if !errors.Is(err, errors.ErrInvalidSignature) && !errors.Is(err, errors.ErrHandshakeFailed) {
+		t.Errorf("Impersonating dial: err = %v; want handshake failure", err)
+	}
+	if bob.IsConnected(alice.ID()) {
+		t.Error("Bob accepted a connection from someone posing as Alice")
+	}
+}
+
+func TestNewNodeRequiresKeyDerivedPeerID(t *testing.T) {
+	if _, err := NewNode(Config{PeerID: "peer-alice-001"}); !errors.IsValidationError(err) {
+		t.Errorf("NewNode with a made-up PeerID: err = %v; want validation error", err)
+	}
+
+	identity, _ := models.NewIdentity()
+	node, err := NewNode(Config{Identity: identity})
+	if err != nil {
+		t.Fatalf("NewNode failed: %v", err)
+	}
+	if node.ID() != identity.PeerID() {
+		t.Errorf("ID = %s; want %s", node.ID(), identity.PeerID())
+	}
+}
+
+func TestLoadIdentityKeepsPeerID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+
+	first, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatalf("LoadIdentity failed: %v", err)
+	}
+	second, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatalf("Second LoadIdentity failed: %v", err)
+	}
+	if first.PeerID() != second.PeerID() {
+		t.Errorf("PeerID changed across loads: %s then %s", first.PeerID(), second.PeerID())
+	}
+}
+
+func TestMeshOfNodes(t *testing.T) {
+	const count = 5
+
+	nodes := make([]*Node, count)
+	for i := range nodes {
+		nodes[i] = newTestNode(t, fmt.Sprintf("n%d", i))
+	}
+
+	// Every node connects to every other node, some of them simultaneously
+	for i, from := range nodes {
+		for j, to := range nodes {
+			if i != j {
+				register(t, from, to)
+			}
+		}
+	}
+	errCh := make(chan error, count*count)
+	for i, from := range nodes {
+		for j, to := range nodes {
+			if i != j {
+				go func(from, to *Node) { errCh <- from.Connect(to.ID()) }(from, to)
+			}
+		}
+	}
+	for i := 0; i < count*(count-1); i++ {
+		if err := <-errCh; err != nil {
+			t.Errorf("Connect failed: %v", err)
+		}
+	}
+
+	for _, node := range nodes {
+		node := node
+		waitFor(t, string(node.ID())+" to settle", func() bool {
+			online, _ := node.GetOnline()
+			return len(online) == count-1 && len(node.Connections()) == count-1
+		})
+	}
+
+	for _, from := range nodes {
+		for _, to := range nodes {
+			if from == to {
+				continue
+			}
+			if _, err := from.Ping(to.ID()); err != nil {
+				t.Errorf("Ping %s -> %s failed: %v", from.ID(), to.ID(), err)
+			}
+		}
+	}
+}
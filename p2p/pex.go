@@ -0,0 +1,261 @@
+// Package p2p - Bootstrapping and peer exchange
+//
+// A new node only needs the address of one member of the network. It
+// dials the bootstrap addresses it was given and then asks every peer it
+// is connected to for a sample of the peers they know (peer exchange, or
+// PEX). What it learns is kept in a capped models.PeerList that is saved
+// to disk, so a restarted node can rejoin without bootstrapping again.
+package p2p
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// Peer exchange message types
+const (
+	MsgPEX MessageType = "pex"
+)
+
+// pexMaxPeers bounds how many peers a single exchange hands out
+const pexMaxPeers = 20
+
+// PEXRequest asks a peer for some of the peers it knows
+type PEXRequest struct {
+	Max int `json:"max"`
+}
+
+// PeerAddr is a peer as shared during peer exchange
+type PeerAddr struct {
+	ID       models.PeerID `json:"id"`
+	UserID   models.UserID `json:"user_id"`
+	Addr     string        `json:"addr"`
+	LastSeen time.Time     `json:"last_seen"`
+}
+
+// PEXResponse lists known peers, most recently seen first
+type PEXResponse struct {
+	Peers []PeerAddr `json:"peers"`
+}
+
+// ============================================================================
+// BOOTSTRAP
+// ============================================================================
+
+// Bootstrap connects to the given "host:port" addresses and exchanges
+// peers with each one that answers. It fails only if none of them does.
+func (n *Node) Bootstrap(addrs ...string) error {
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	joined := 0
+	for _, addr := range addrs {
+		conn, err := n.dial(addr, "")
+		if err != nil {
+			continue
+		}
+		joined++
+		n.ExchangePeers(conn.remote.PeerID)
+	}
+	if joined == 0 {
+		return errors.NewOperationError("Bootstrap", "no bootstrap peer reachable", errors.ErrNoPeersAvailable)
+	}
+	return n.SavePeers()
+}
+
+// ============================================================================
+// PEER EXCHANGE
+// ============================================================================
+
+// ExchangePeers asks a peer for the peers it knows and adds them to the
+// address book. It returns how many of them were new.
+func (n *Node) ExchangePeers(peerID models.PeerID) (int, error) {
+	var resp PEXResponse
+	if err := n.Request(peerID, MsgPEX, PEXRequest{Max: pexMaxPeers}, &resp); err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for _, pa := range resp.Peers {
+		if n.learn(pa) {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// handlePEX shares the peers seen most recently, leaving out the asker
+func (n *Node) handlePEX(req *Request) (interface{}, error) {
+	var pr PEXRequest
+	if err := req.Decode(&pr); err != nil {
+		return nil, err
+	}
+	if pr.Max <= 0 || pr.Max > pexMaxPeers {
+		pr.Max = pexMaxPeers
+	}
+
+	n.mu.RLock()
+	recent := n.known.MostRecent(-1)
+	n.mu.RUnlock()
+
+	resp := PEXResponse{Peers: make([]PeerAddr, 0, pr.Max)}
+	for _, p := range recent {
+		if len(resp.Peers) == pr.Max {
+			break
+		}
+		if p.ID == req.From || p.IPAddress == "" || p.Port == 0 {
+			continue
+		}
+		resp.Peers = append(resp.Peers, PeerAddr{
+			ID:       p.ID,
+			UserID:   p.UserID,
+			Addr:     net.JoinHostPort(p.IPAddress, strconv.Itoa(p.Port)),
+			LastSeen: p.LastPingAt,
+		})
+	}
+	return resp, nil
+}
+
+// learn adds a peer heard of through peer exchange. It keeps the time the
+// sharing peer last saw it, so hearsay never looks fresher than it is.
+func (n *Node) learn(pa PeerAddr) bool {
+	if pa.ID == "" || pa.ID == n.cfg.PeerID {
+		return false
+	}
+	if _, err := n.Peer(pa.ID); err == nil {
+		return false
+	}
+
+	host, portStr, err := net.SplitHostPort(pa.Addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+
+	peer := models.NewPeer(pa.ID, pa.UserID, host, port)
+	peer.DiscoveredVia = models.DiscoveredPEX
+	if now := models.TimeNow(); pa.LastSeen.Before(now) {
+		peer.LastPingAt = pa.LastSeen
+	}
+	return n.Register(peer) == nil
+}
+
+// pexLoop exchanges peers with a random connected peer every PEXInterval
+func (n *Node) pexLoop() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.cfg.PEXInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.closing:
+			return
+		case <-ticker.C:
+			connected := n.Connections()
+			if len(connected) == 0 {
+				continue
+			}
+			peer := connected[rand.Intn(len(connected))].RemotePeer
+			if added, err := n.ExchangePeers(peer); err == nil && added > 0 {
+				n.SavePeers()
+			}
+		}
+	}
+}
+
+// ============================================================================
+// KNOWN PEERS
+// ============================================================================
+
+// remember records a peer in the known peer list. A peer pushed out of the
+// full list is dropped from the address book unless it is connected.
+// Callers hold n.mu.
+func (n *Node) remember(p *models.Peer) {
+	evicted := n.known.Add(*p)
+	if evicted == nil {
+		return
+	}
+	if _, connected := n.conns[evicted.ID]; !connected {
+		delete(n.peers, evicted.ID)
+	}
+}
+
+// KnownPeers returns a copy of the known peer list
+func (n *Node) KnownPeers() *models.PeerList {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	list := models.NewPeerList(n.known.Capacity)
+	list.Peers = append(list.Peers, n.known.Peers...)
+	return list
+}
+
+// SavePeers writes the known peer list to PeerListPath
+func (n *Node) SavePeers() error {
+	if n.cfg.PeerListPath == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(n.KnownPeers())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(n.cfg.PeerListPath), 0o755); err != nil {
+		return errors.NewOperationError("SavePeers", "failed to create directory", err)
+	}
+
+	tmp := n.cfg.PeerListPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return errors.NewOperationError("SavePeers", "failed to write peer list", err)
+	}
+	return os.Rename(tmp, n.cfg.PeerListPath)
+}
+
+// loadPeers reads the peer list saved by a previous run into the address
+// book. A missing file just means there is nothing to load.
+func (n *Node) loadPeers() error {
+	if n.cfg.PeerListPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(n.cfg.PeerListPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewOperationError("loadPeers", "failed to read peer list", err)
+	}
+
+	var saved models.PeerList
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return errors.NewOperationError("loadPeers", "corrupt peer list", err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, p := range saved.Peers {
+		if p.ID == "" || p.ID == n.cfg.PeerID {
+			continue
+		}
+		p.Status = models.StatusOffline
+		if _, ok := n.peers[p.ID]; !ok {
+			cp := p
+			n.peers[p.ID] = &cp
+		}
+		n.remember(&p)
+	}
+	return nil
+}
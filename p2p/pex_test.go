@@ -0,0 +1,135 @@
+// Package p2p - Unit tests for bootstrapping and peer exchange
+package p2p
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"p2p-library/models"
+)
+
+// addrOf returns the address a test node listens on
+func addrOf(n *Node) string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(n.Port()))
+}
+
+func TestBootstrapLearnsPeersThroughExchange(t *testing.T) {
+	hub := newTestNode(t, "pex-hub")
+	a := newTestNode(t, "pex-a")
+	b := newTestNode(t, "pex-b")
+
+	// a and b only know the hub's address, not even its PeerID
+	if err := a.Bootstrap(addrOf(hub)); err != nil {
+		t.Fatalf("Bootstrap(a) failed: %v", err)
+	}
+	if err := b.Bootstrap(addrOf(hub)); err != nil {
+		t.Fatalf("Bootstrap(b) failed: %v", err)
+	}
+
+	// a bootstrapped first; it learns of b on its next exchange
+	added, err := a.ExchangePeers(hub.ID())
+	if err != nil {
+		t.Fatalf("ExchangePeers failed: %v", err)
+	}
+	if added != 1 {
+		t.Errorf("ExchangePeers added %d peers; want 1", added)
+	}
+
+	if _, err := b.Peer(a.ID()); err != nil {
+		t.Fatalf("b did not learn of a from the hub: %v", err)
+	}
+	if _, err := b.Ping(a.ID()); err != nil {
+		t.Errorf("b cannot reach a at the exchanged address: %v", err)
+	}
+}
+
+func TestBootstrapFailsWithNoReachablePeer(t *testing.T) {
+	node := newTestNode(t, "pex-lonely")
+	if err := node.Bootstrap("127.0.0.1:1"); err == nil {
+		t.Error("Bootstrap should fail when no address answers")
+	}
+}
+
+func TestKnownPeersPersistAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	hub := newTestNode(t, "persist-hub")
+
+	identity, _ := models.NewIdentity()
+	cfg := Config{
+		ListenAddr:   "127.0.0.1:0",
+		Identity:     identity,
+		UserID:       "user-persist",
+		PeerListPath: path,
+	}
+	first, err := NewNode(cfg)
+	if err != nil {
+		t.Fatalf("NewNode failed: %v", err)
+	}
+	if err := first.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if err := first.Bootstrap(addrOf(hub)); err != nil {
+		t.Fatalf("Bootstrap failed: %v", err)
+	}
+	first.Close()
+	waitFor(t, "the hub to notice the restart", func() bool {
+		return !hub.IsConnected(identity.PeerID())
+	})
+
+	second, err := NewNode(cfg)
+	if err != nil {
+		t.Fatalf("NewNode failed: %v", err)
+	}
+	if err := second.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer second.Close()
+
+	// The restarted node can reach the hub without bootstrapping
+	if _, err := second.Ping(hub.ID()); err != nil {
+		t.Errorf("Ping after restart failed: %v", err)
+	}
+}
+
+func TestKnownPeersEvictLeastRecentlySeen(t *testing.T) {
+	var clock time.Time = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	restore := models.TimeNow
+	models.TimeNow = func() time.Time { return clock }
+	defer func() { models.TimeNow = restore }()
+
+	node, err := NewNode(Config{MaxKnownPeers: 3})
+	if err != nil {
+		t.Fatalf("NewNode failed: %v", err)
+	}
+
+	for _, id := range []models.PeerID{"p1", "p2", "p3"} {
+		clock = clock.Add(time.Minute)
+		node.Register(models.NewPeer(id, "", "127.0.0.1", 9000))
+	}
+
+	// p1 is heard from again, so p2 is now the stalest
+	clock = clock.Add(time.Minute)
+	node.setLiveness("p1", "", "127.0.0.1:9000", true, clock)
+
+	clock = clock.Add(time.Minute)
+	node.Register(models.NewPeer("p4", "", "127.0.0.1", 9000))
+
+	known := node.KnownPeers()
+	if known.Count() != 3 {
+		t.Fatalf("Known peers = %d; want the capacity of 3", known.Count())
+	}
+	if known.FindByID("p2") != nil {
+		t.Error("p2 should have been evicted as least recently seen")
+	}
+	if _, err := node.Peer("p2"); err == nil {
+		t.Error("Evicted peer should be dropped from the address book")
+	}
+	for _, id := range []models.PeerID{"p1", "p3", "p4"} {
+		if known.FindByID(id) == nil {
+			t.Errorf("%s should still be known", id)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Package p2p - Resumable downloads
+//
+// Every download keeps a small state file next to its ".part" file. The
+// state records the resource being fetched and a bitmap of the chunks that
+// have been verified and flushed to disk. If the transfer is interrupted,
+// the next attempt (or the next start of the node) only fetches the chunks
+// that are still missing.
+package p2p
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// stateSuffix marks the saved state of an unfinished download
+const stateSuffix = ".state"
+
+// downloadState is the on-disk record of an unfinished download
+type downloadState struct {
+	Resource  models.Resource `json:"resource"`
+	Bitfield  Bitfield        `json:"bitfield"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// ============================================================================
+// STATE FILES
+// ============================================================================
+
+// saveState atomically writes the download state for a resource
+func (s *ContentStore) saveState(state *downloadState) error {
+	path, err := s.path(state.Resource.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + stateSuffix + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path+stateSuffix)
+}
+
+// loadState reads the saved state for cid, if there is one
+func (s *ContentStore) loadState(cid models.ContentID) (*downloadState, error) {
+	path, err := s.path(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path + stateSuffix)
+	if err != nil {
+		return nil, errors.NewNotFoundError("download state", string(cid))
+	}
+
+	var state downloadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.NewOperationError("loadState", "corrupt download state", err)
+	}
+	return &state, nil
+}
+
+// deleteState removes the saved state for cid
+func (s *ContentStore) deleteState(cid models.ContentID) {
+	if path, err := s.path(cid); err == nil {
+		os.Remove(path + stateSuffix)
+	}
+}
+
+// pendingStates returns the state of every unfinished download on disk
+func (s *ContentStore) pendingStates() ([]*downloadState, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*"+stateSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]*downloadState, 0, len(matches))
+	for _, match := range matches {
+		cid := models.ContentID(strings.TrimSuffix(filepath.Base(match), stateSuffix))
+		state, err := s.loadState(cid)
+		if err != nil {
+			continue
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// ============================================================================
+// RESUMING
+// ============================================================================
+
+// restoreProgress marks the chunks recorded in a saved state as done.
+// A state that doesn't match the resource (different size or chunk count)
+// is discarded and the download starts from scratch.
+func (t *Transfer) restoreProgress(resource *models.Resource, progress *Progress) {
+	state, err := t.content.loadState(resource.ID)
+	if err != nil {
+		return
+	}
+	if state.Resource.Size != resource.Size || len(state.Bitfield) != len(progress.have) {
+		t.content.deleteState(resource.ID)
+		return
+	}
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	for i := 0; i < progress.total; i++ {
+		if state.Bitfield.Has(i) {
+			progress.have.Set(i)
+			progress.resumed++
+		}
+	}
+}
+
+// persistProgress flushes the partial file and then records the verified
+// chunks, so the bitmap never claims a chunk that isn't on disk
+func (t *Transfer) persistProgress(resource *models.Resource, progress *Progress, f *os.File) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return t.content.saveState(&downloadState{
+		Resource:  *resource,
+		Bitfield:  progress.bitfield(),
+		UpdatedAt: models.TimeNow(),
+	})
+}
+
+// ResumePending restarts every download that was left unfinished, for
+// example because the node was shut down or lost its connection
+func (t *Transfer) ResumePending() ([]*Progress, error) {
+	states, err := t.content.pendingStates()
+	if err != nil {
+		return nil, errors.NewOperationError("ResumePending", "failed to scan download state", err)
+	}
+
+	resumed := make([]*Progress, 0, len(states))
+	for _, state := range states {
+		resource := state.Resource
+		progress, err := t.Download(&resource)
+		if err != nil {
+			continue
+		}
+		resumed = append(resumed, progress)
+	}
+	return resumed, nil
+}
@@ -0,0 +1,123 @@
+// Package p2p - Unit tests for resumable downloads
+package p2p
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"testing"
+
+	"p2p-library/models"
+)
+
+// countChunkRequests wraps a node's chunk handler and records which
+// chunk indexes were requested from it
+func countChunkRequests(node *Node) func() []int {
+	var (
+		mu        sync.Mutex
+		requested []int
+	)
+
+	inner := node.handler(MsgChunkRequest)
+	node.Handle(MsgChunkRequest, func(req *Request) (interface{}, error) {
+		var cr ChunkRequest
+		req.Decode(&cr)
+
+		mu.Lock()
+		requested = append(requested, cr.Index)
+		mu.Unlock()
+
+		return inner(req)
+	})
+
+	return func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		sorted := append([]int(nil), requested...)
+		sort.Ints(sorted)
+		return sorted
+	}
+}
+
+func TestDownloadResumesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	data := testContent(6 * models.ChunkSize)
+	resource := swarmResource(data)
+
+	partial := fakeSeeder(t, "partial", resource.ID, data, chunkRange(0, 4), false)
+	full := fakeSeeder(t, "full", resource.ID, data, chunkRange(0, 6), false)
+	resource.AddPeer(partial.ID())
+	resource.AddPeer(full.ID())
+
+	// First attempt: only the partial seeder is reachable
+	content, _ := NewContentStore(dir)
+	first := NewTransfer(newTestNode(t, "leecher"), content)
+	register(t, first.node, partial)
+
+	if err := first.Fetch(resource); err == nil {
+		t.Fatal("First attempt succeeded although two chunks were unreachable")
+	}
+	state, err := content.loadState(resource.ID)
+	if err != nil {
+		t.Fatalf("No download state saved: %v", err)
+	}
+	if got := state.Bitfield.Count(6); got != 4 {
+		t.Errorf("Saved bitmap has %d chunks; want 4", got)
+	}
+	first.node.Close()
+
+	// The node restarts with the same content directory
+	content, _ = NewContentStore(dir)
+	second := NewTransfer(newTestNode(t, "leecher-restarted"), content)
+	register(t, second.node, full)
+	requested := countChunkRequests(full)
+
+	resumed, err := second.ResumePending()
+	if err != nil {
+		t.Fatalf("ResumePending failed: %v", err)
+	}
+	if len(resumed) != 1 {
+		t.Fatalf("Resumed %d downloads; want 1", len(resumed))
+	}
+	if err := resumed[0].Wait(); err != nil {
+		t.Fatalf("Resumed download failed: %v", err)
+	}
+
+	got, _ := content.Get(resource.ID)
+	if !bytes.Equal(got, data) {
+		t.Fatal("Resumed content does not match the original")
+	}
+
+	if r := requested(); len(r) != 2 || r[0] != 4 || r[1] != 5 {
+		t.Errorf("Requested chunks %v after resume; want [4 5]", r)
+	}
+	if report := resumed[0].Report(); report.Resumed != 4 {
+		t.Errorf("Resumed = %d; want 4", report.Resumed)
+	}
+	if _, err := content.loadState(resource.ID); err == nil {
+		t.Error("Download state left behind after completion")
+	}
+}
+
+func TestMismatchedStateIsDiscarded(t *testing.T) {
+	leecher := newTestTransfer(t, "leecher")
+	data := testContent(3 * models.ChunkSize)
+	resource := swarmResource(data)
+
+	// A stale state for a different file size must not be trusted
+	stale := *resource
+	stale.Size = 5 * models.ChunkSize
+	leecher.Content().saveState(&downloadState{Resource: stale, Bitfield: FullBitfield(5)})
+
+	seeder := fakeSeeder(t, "seeder", resource.ID, data, chunkRange(0, 3), false)
+	register(t, leecher.node, seeder)
+	resource.AddPeer(seeder.ID())
+	requested := countChunkRequests(seeder)
+
+	if err := leecher.Fetch(resource); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if r := requested(); len(r) != 3 {
+		t.Errorf("Requested chunks %v; want all 3", r)
+	}
+}
@@ -0,0 +1,48 @@
+// Package p2p - Seeding
+//
+// Every resource a node holds, whether it uploaded the content or
+// downloaded and verified it, is served to other peers and announced in
+// the DHT. The transfer keeps count of what it gives back: bytes served
+// and time spent seeding. The application collects both with
+// TakeSeedReport and credits them to the node's user as upload
+// contribution.
+package p2p
+
+import (
+	"time"
+
+	"p2p-library/models"
+)
+
+// SeedReport is what a node contributed as a seeder since the last report
+type SeedReport struct {
+	Resources   int           `json:"resources"`    // resources currently offered
+	BytesServed int64         `json:"bytes_served"` // chunk bytes sent to other peers
+	Seeded      time.Duration `json:"seeded"`       // time spent offering at least one resource
+}
+
+// recordServed counts bytes sent to another peer
+func (t *Transfer) recordServed(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.served += int64(n)
+}
+
+// TakeSeedReport returns the seeding done since the previous call and
+// starts a new period. Time only counts as seeding while the node holds
+// some content to offer.
+func (t *Transfer) TakeSeedReport() SeedReport {
+	cids, _ := t.content.List()
+	now := models.TimeNow()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	report := SeedReport{Resources: len(cids), BytesServed: t.served}
+	if len(cids) > 0 && !t.seedSince.IsZero() {
+		report.Seeded = now.Sub(t.seedSince)
+	}
+	t.served = 0
+	t.seedSince = now
+	return report
+}
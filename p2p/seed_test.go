@@ -0,0 +1,84 @@
+// Package p2p - Unit tests for seeding
+package p2p
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"p2p-library/models"
+)
+
+// listed reports whether peerID is among peers
+func listed(peers []models.PeerID, peerID models.PeerID) bool {
+	for _, p := range peers {
+		if p == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDownloadedContentIsSeeded(t *testing.T) {
+	alice := newTestTransfer(t, "alice")
+	bob := newTestTransfer(t, "bob")
+	carol := newTestTransfer(t, "carol")
+	register(t, bob.node, alice.node)
+	register(t, carol.node, bob.node)
+
+	data := testContent(2*models.ChunkSize + 77)
+	resource := models.NewResourceFromContent("lecture.pdf", data, "user-alice")
+	if err := alice.Publish(resource, data); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	if err := bob.Fetch(resource); err != nil {
+		t.Fatalf("Bob's Fetch failed: %v", err)
+	}
+	if !listed(resource.AvailableOn, bob.node.ID()) {
+		t.Fatalf("AvailableOn = %v; want bob listed after his download", resource.AvailableOn)
+	}
+	bob.TakeSeedReport()
+
+	// Carol only knows Bob, so everything she gets comes from his copy
+	fromBob := *resource
+	fromBob.AvailableOn = []models.PeerID{bob.node.ID()}
+	if err := carol.Fetch(&fromBob); err != nil {
+		t.Fatalf("Carol's Fetch from Bob failed: %v", err)
+	}
+	got, _ := carol.Content().Get(resource.ID)
+	if !bytes.Equal(got, data) {
+		t.Error("Content served by a seeding downloader does not match the original")
+	}
+
+	report := bob.TakeSeedReport()
+	if report.BytesServed != int64(len(data)) {
+		t.Errorf("BytesServed = %d; want %d", report.BytesServed, len(data))
+	}
+	if report.Resources != 1 {
+		t.Errorf("Resources = %d; want 1", report.Resources)
+	}
+	if next := bob.TakeSeedReport(); next.BytesServed != 0 {
+		t.Errorf("BytesServed after a report = %d; want 0", next.BytesServed)
+	}
+}
+
+func TestSeedTimeCountsOnlyWithContent(t *testing.T) {
+	clock := useChokeClock(t)
+	alice := newTestTransfer(t, "alice")
+	alice.TakeSeedReport()
+
+	clock.advance(time.Hour)
+	if report := alice.TakeSeedReport(); report.Seeded != 0 {
+		t.Errorf("Seeded = %v with nothing to offer; want 0", report.Seeded)
+	}
+
+	data := testContent(models.ChunkSize)
+	if err := alice.Publish(models.NewResourceFromContent("notes.pdf", data, "user-alice"), data); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	clock.advance(2 * time.Hour)
+	if report := alice.TakeSeedReport(); report.Seeded != 2*time.Hour {
+		t.Errorf("Seeded = %v; want 2h", report.Seeded)
+	}
+}
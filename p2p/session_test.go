@@ -0,0 +1,129 @@
+// Package p2p - Unit tests for encrypted sessions
+package p2p
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"p2p-library/models"
+)
+
+// tap is a TCP proxy that records every byte passing through it, like a
+// passive observer on the wire
+type tap struct {
+	listener net.Listener
+	target   string
+
+	mu       sync.Mutex
+	captured bytes.Buffer
+}
+
+// newTap starts a proxy forwarding to target
+func newTap(t *testing.T, target string) *tap {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	tp := &tap{listener: listener, target: target}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			in, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			out, err := net.Dial("tcp", target)
+			if err != nil {
+				in.Close()
+				continue
+			}
+			go tp.pipe(in, out)
+			go tp.pipe(out, in)
+		}
+	}()
+	return tp
+}
+
+// pipe copies src to dst, keeping a copy of everything
+func (tp *tap) pipe(dst, src net.Conn) {
+	defer dst.Close()
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			tp.mu.Lock()
+			tp.captured.Write(buf[:n])
+			tp.mu.Unlock()
+			dst.Write(buf[:n])
+		}
+		if err != nil {
+			if err != io.EOF {
+				src.Close()
+			}
+			return
+		}
+	}
+}
+
+// seen returns a copy of the captured traffic
+func (tp *tap) seen() []byte {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return append([]byte(nil), tp.captured.Bytes()...)
+}
+
+func TestObserverCannotReadChunkData(t *testing.T) {
+	seeder := newTestTransfer(t, "seeder")
+	leecher := newTestTransfer(t, "leecher")
+
+	data := testContent(models.ChunkSize)
+	resource := swarmResource(data)
+	if err := seeder.Publish(resource, data); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	// The leecher reaches the seeder only through the tap
+	wire := newTap(t, seeder.node.Addr().String())
+	_, port, _ := net.SplitHostPort(wire.listener.Addr().String())
+	register(t, leecher.node, seeder.node)
+	peer, _ := leecher.node.Peer(seeder.node.ID())
+	peer.Port, _ = strconv.Atoi(port)
+	leecher.node.Register(peer)
+
+	chunk, err := leecher.FetchChunk(seeder.node.ID(), resource.ID, 0)
+	if err != nil {
+		t.Fatalf("FetchChunk through the tap failed: %v", err)
+	}
+	if !bytes.Equal(chunk.Data, data) {
+		t.Fatal("Chunk fetched through the tap does not match")
+	}
+
+	captured := wire.seen()
+	if len(captured) < len(data) {
+		t.Fatalf("Tap saw %d bytes; the chunk did not pass through it", len(captured))
+	}
+
+	// Neither the raw bytes nor their JSON (base64) form may appear, nor
+	// any of the plaintext protocol
+	sample := data[1000:1064]
+	encoded := []byte(base64.StdEncoding.EncodeToString(data[999:1095]))
+	for what, needle := range map[string][]byte{
+		"raw chunk bytes":    sample,
+		"base64 chunk bytes": encoded[8:72],
+		"message type":       []byte(MsgChunkRequest),
+		"peer ID":            []byte(seeder.node.ID()),
+		"content ID":         []byte(resource.ID),
+	} {
+		if bytes.Contains(captured, needle) {
+			t.Errorf("Observer recovered the %s from the wire", what)
+		}
+	}
+}
@@ -0,0 +1,532 @@
+// Package p2p - Swarm downloads
+//
+// When a resource is available on several peers, different chunks are
+// fetched from different peers at the same time. Each peer first reports
+// which chunks it holds; the rarest chunks are requested first so that
+// scarce pieces spread through the network quickly. A chunk that fails
+// (timeout, bad checksum, wrong length) is retried on another peer. A peer
+// that chokes us is asked again after a short pause, without counting it
+// as a failure.
+package p2p
+
+import (
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// Have message type
+const (
+	MsgHave MessageType = "have"
+)
+
+// HaveRequest asks a peer which chunks of a resource it holds
+type HaveRequest struct {
+	ContentID models.ContentID `json:"content_id"`
+}
+
+// HaveResponse lists the chunks a peer holds as a bitfield
+type HaveResponse struct {
+	TotalChunks int      `json:"total_chunks"`
+	Bitfield    Bitfield `json:"bitfield"`
+}
+
+// ============================================================================
+// SWARM OPTIONS
+// ============================================================================
+
+// SwarmOptions tunes how a swarm download spreads requests across peers
+type SwarmOptions struct {
+	// RequestsPerPeer is how many chunk requests may be in flight to a
+	// single peer at once
+	RequestsPerPeer int
+
+	// MaxPeerFailures is how many failed chunks in a row a peer may return
+	// before the download stops asking it
+	MaxPeerFailures int
+
+	// ChokeBackoff is how long a worker pauses after the peer choked it
+	ChokeBackoff time.Duration
+
+	// ChokeWait is how long a peer may keep choking us before the download
+	// stops asking it
+	ChokeWait time.Duration
+}
+
+// DefaultSwarmOptions returns the settings used when none are given
+func DefaultSwarmOptions() SwarmOptions {
+	return SwarmOptions{
+		RequestsPerPeer: 4,
+		MaxPeerFailures: 3,
+		ChokeBackoff:    500 * time.Millisecond,
+		ChokeWait:       time.Minute,
+	}
+}
+
+// ============================================================================
+// PROGRESS
+// ============================================================================
+
+// Progress tracks a single download while it runs
+type Progress struct {
+	mu         sync.Mutex
+	contentID  models.ContentID
+	size       int64
+	total      int
+	have       Bitfield
+	servedBy   []models.PeerID
+	bytes      int64
+	resumed    int // chunks restored from a previous attempt
+	startedAt  time.Time
+	finishedAt time.Time
+	err        error
+	done       chan struct{}
+}
+
+// ProgressReport is a point-in-time view of a download
+type ProgressReport struct {
+	ContentID   models.ContentID `json:"content_id"`
+	Completed   int              `json:"completed_chunks"`
+	TotalChunks int              `json:"total_chunks"`
+	Resumed     int              `json:"resumed_chunks"`
+	ServedBy    []models.PeerID  `json:"served_by"` // peer that served each chunk ("" if pending or resumed)
+	BytesDone   int64            `json:"bytes_done"`
+	Throughput  float64          `json:"throughput"` // bytes per second
+	Done        bool             `json:"done"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// newProgress creates progress tracking for a resource
+func newProgress(resource *models.Resource, total int) *Progress {
+	return &Progress{
+		contentID: resource.ID,
+		size:      resource.Size,
+		total:     total,
+		have:      NewBitfield(total),
+		servedBy:  make([]models.PeerID, total),
+		startedAt: models.TimeNow(),
+		done:      make(chan struct{}),
+	}
+}
+
+// record marks a chunk as verified and stored
+func (p *Progress) record(index int, peerID models.PeerID, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.have.Set(index)
+	p.servedBy[index] = peerID
+	p.bytes += int64(n)
+}
+
+// has reports whether a chunk has been verified and stored
+func (p *Progress) has(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.have.Has(index)
+}
+
+// bitfield returns a copy of the verified chunk bitfield
+func (p *Progress) bitfield() Bitfield {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.have.Clone()
+}
+
+// finish records the outcome and wakes anyone waiting on the download
+func (p *Progress) finish(err error) {
+	p.mu.Lock()
+	p.err = err
+	p.finishedAt = models.TimeNow()
+	p.mu.Unlock()
+	close(p.done)
+}
+
+// Wait blocks until the download finishes and returns its error
+func (p *Progress) Wait() error {
+	<-p.done
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Report returns a snapshot of the download's progress
+func (p *Progress) Report() ProgressReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	end := models.TimeNow()
+	finished := !p.finishedAt.IsZero()
+	if finished {
+		end = p.finishedAt
+	}
+
+	report := ProgressReport{
+		ContentID:   p.contentID,
+		Completed:   p.have.Count(p.total),
+		TotalChunks: p.total,
+		Resumed:     p.resumed,
+		ServedBy:    append([]models.PeerID(nil), p.servedBy...),
+		BytesDone:   p.bytes,
+		Done:        finished,
+	}
+	if elapsed := end.Sub(p.startedAt).Seconds(); elapsed > 0 {
+		report.Throughput = float64(p.bytes) / elapsed
+	}
+	if p.err != nil {
+		report.Error = p.err.Error()
+	}
+	return report
+}
+
+// ============================================================================
+// SWARM SCHEDULER
+// ============================================================================
+
+// swarm schedules the chunks of one download across the available peers
+type swarm struct {
+	transfer *Transfer
+	resource *models.Resource
+	progress *Progress
+	file     *os.File
+	opts     SwarmOptions
+
+	// persistMu serialises writes of the on-disk download state
+	persistMu sync.Mutex
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	haves    map[models.PeerID]Bitfield
+	pending  map[int]bool
+	inflight map[int]models.PeerID
+	failed   map[int]map[models.PeerID]bool
+	strikes  map[models.PeerID]int
+	chokedAt map[models.PeerID]time.Time // when a peer started choking us
+	dead     map[models.PeerID]bool
+	done     int
+	rng      *rand.Rand
+}
+
+// newSwarm prepares a scheduler for the chunks not yet in progress
+func newSwarm(t *Transfer, resource *models.Resource, progress *Progress, file *os.File, haves map[models.PeerID]Bitfield) *swarm {
+	s := &swarm{
+		transfer: t,
+		resource: resource,
+		progress: progress,
+		file:     file,
+		opts:     t.swarmOptions(),
+		haves:    haves,
+		pending:  make(map[int]bool),
+		inflight: make(map[int]models.PeerID),
+		failed:   make(map[int]map[models.PeerID]bool),
+		strikes:  make(map[models.PeerID]int),
+		chokedAt: make(map[models.PeerID]time.Time),
+		dead:     make(map[models.PeerID]bool),
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	for i := 0; i < progress.total; i++ {
+		if progress.has(i) {
+			s.done++
+		} else {
+			s.pending[i] = true
+		}
+	}
+	return s
+}
+
+// run starts the workers and blocks until no more progress is possible
+func (s *swarm) run() error {
+	var wg sync.WaitGroup
+	for peerID := range s.haves {
+		for i := 0; i < s.opts.RequestsPerPeer; i++ {
+			wg.Add(1)
+			go func(peerID models.PeerID) {
+				defer wg.Done()
+				s.worker(peerID)
+			}(peerID)
+		}
+	}
+	wg.Wait()
+
+	if s.done < s.progress.total {
+		return errors.NewOperationError("Download", "no peer could serve the remaining chunks", errors.ErrTransferFailed)
+	}
+	return nil
+}
+
+// worker keeps requesting chunks from one peer until there is nothing
+// left that this peer can help with
+func (s *swarm) worker(peerID models.PeerID) {
+	for {
+		index, ok := s.next(peerID)
+		if !ok {
+			return
+		}
+
+		chunk, err := s.transfer.FetchChunk(peerID, s.resource.ID, index)
+		if err == nil && int64(len(chunk.Data)) != s.chunkLength(index) {
+			err = errors.NewOperationError("Download", "chunk has the wrong length", errors.ErrTransferFailed)
+		}
+		if err == nil {
+			err = verifyProof(s.resource, s.progress.total, chunk)
+		}
+
+		// A chunk that arrives but fails verification means the peer is
+		// serving bad data; it gets no second chance
+		if errors.Is(err, errors.ErrChecksumMismatch) || errors.Is(err, errors.ErrInvalidProof) {
+			s.ban(index, peerID)
+			s.transfer.reportMisbehavior(peerID, s.resource.ID)
+			continue
+		}
+
+		// A choked request is not the peer's fault; let another peer take
+		// the chunk and ask again once a slot may have opened
+		if errors.Is(err, errors.ErrChoked) {
+			if s.choked(index, peerID) {
+				time.Sleep(s.opts.ChokeBackoff)
+			}
+			continue
+		}
+
+		if err == nil {
+			_, err = s.file.WriteAt(chunk.Data, int64(index)*models.ChunkSize)
+		}
+		if err != nil {
+			s.fail(index, peerID)
+			continue
+		}
+		s.complete(index, peerID, len(chunk.Data))
+	}
+}
+
+// next picks the rarest pending chunk this peer can serve. It waits while
+// other workers hold chunks that might come back for retry, and returns
+// false once the peer can no longer contribute.
+func (s *swarm) next(peerID models.PeerID) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.done == s.progress.total || s.dead[peerID] {
+			return -1, false
+		}
+
+		if index := s.pickRarest(peerID); index >= 0 {
+			delete(s.pending, index)
+			s.inflight[index] = peerID
+			return index, true
+		}
+
+		if !s.mightServeInflight(peerID) {
+			return -1, false
+		}
+		s.cond.Wait()
+	}
+}
+
+// pickRarest returns the pending chunk held by the fewest live peers,
+// breaking ties at random so peers don't all chase the same chunk
+func (s *swarm) pickRarest(peerID models.PeerID) int {
+	best, bestCount, ties := -1, 0, 0
+
+	for index := range s.pending {
+		if !s.canServe(peerID, index) {
+			continue
+		}
+
+		count := s.availability(index)
+		switch {
+		case best < 0 || count < bestCount:
+			best, bestCount, ties = index, count, 1
+		case count == bestCount:
+			// Reservoir sampling keeps a uniform choice among equals
+			ties++
+			if s.rng.Intn(ties) == 0 {
+				best = index
+			}
+		}
+	}
+	return best
+}
+
+// availability counts the live peers holding a chunk
+func (s *swarm) availability(index int) int {
+	count := 0
+	for peerID, have := range s.haves {
+		if !s.dead[peerID] && have.Has(index) {
+			count++
+		}
+	}
+	return count
+}
+
+// canServe reports whether peerID holds a chunk and hasn't failed it
+func (s *swarm) canServe(peerID models.PeerID, index int) bool {
+	return s.haves[peerID].Has(index) && !s.failed[index][peerID]
+}
+
+// mightServeInflight reports whether a chunk currently assigned to another
+// worker could later be handed to this peer if that worker fails
+func (s *swarm) mightServeInflight(peerID models.PeerID) bool {
+	for index, owner := range s.inflight {
+		if owner != peerID && s.canServe(peerID, index) {
+			return true
+		}
+	}
+	return false
+}
+
+// complete records a successfully stored chunk and saves the bitmap so
+// the chunk survives an interruption
+func (s *swarm) complete(index int, peerID models.PeerID, n int) {
+	s.progress.record(index, peerID, n)
+	s.transfer.recordReceived(peerID, s.resource.ID, index, n)
+
+	// A failed save only costs a re-fetch after a restart
+	s.persistMu.Lock()
+	s.transfer.persistProgress(s.resource, s.progress, s.file)
+	s.persistMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.inflight, index)
+	s.strikes[peerID] = 0
+	delete(s.chokedAt, peerID)
+	s.done++
+	s.cond.Broadcast()
+}
+
+// fail puts a chunk back in the queue and remembers which peer failed it
+func (s *swarm) fail(index int, peerID models.PeerID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.inflight, index)
+	s.pending[index] = true
+
+	if s.failed[index] == nil {
+		s.failed[index] = make(map[models.PeerID]bool)
+	}
+	s.failed[index][peerID] = true
+
+	s.strikes[peerID]++
+	if s.strikes[peerID] >= s.opts.MaxPeerFailures {
+		s.dead[peerID] = true
+	}
+	s.cond.Broadcast()
+}
+
+// choked puts a chunk back in the queue without blaming the peer. It
+// returns false once the peer has choked us for longer than ChokeWait, and
+// drops it from the download.
+func (s *swarm) choked(index int, peerID models.PeerID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.inflight, index)
+	s.pending[index] = true
+	s.cond.Broadcast()
+
+	now := time.Now()
+	since, ok := s.chokedAt[peerID]
+	if !ok {
+		s.chokedAt[peerID] = now
+		return true
+	}
+	if now.Sub(since) > s.opts.ChokeWait {
+		s.dead[peerID] = true
+		return false
+	}
+	return true
+}
+
+// ban puts a chunk back in the queue and drops the peer that served it
+// from the rest of the download
+func (s *swarm) ban(index int, peerID models.PeerID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.inflight, index)
+	s.pending[index] = true
+	s.dead[peerID] = true
+	s.cond.Broadcast()
+}
+
+// chunkLength returns the expected size of a chunk
+func (s *swarm) chunkLength(index int) int64 {
+	remaining := s.resource.Size - int64(index)*models.ChunkSize
+	if remaining > models.ChunkSize {
+		return models.ChunkSize
+	}
+	return remaining
+}
+
+// ============================================================================
+// PEER AVAILABILITY
+// ============================================================================
+
+// queryHaves asks every candidate peer which chunks it holds. Peers that
+// don't answer, or report a different chunk count, are left out.
+func (t *Transfer) queryHaves(resource *models.Resource, peers []models.PeerID, total int) map[models.PeerID]Bitfield {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		haves = make(map[models.PeerID]Bitfield)
+	)
+
+	for _, peerID := range peers {
+		if peerID == t.node.ID() {
+			continue
+		}
+
+		wg.Add(1)
+		go func(peerID models.PeerID) {
+			defer wg.Done()
+
+			var resp HaveResponse
+			if err := t.node.Request(peerID, MsgHave, HaveRequest{ContentID: resource.ID}, &resp); err != nil {
+				return
+			}
+			if resp.TotalChunks != total || resp.Bitfield.Count(total) == 0 {
+				return
+			}
+
+			mu.Lock()
+			haves[peerID] = resp.Bitfield
+			mu.Unlock()
+		}(peerID)
+	}
+
+	wg.Wait()
+	return haves
+}
+
+// handleHave reports which chunks of a resource this node can serve
+func (t *Transfer) handleHave(req *Request) (interface{}, error) {
+	var hr HaveRequest
+	if err := req.Decode(&hr); err != nil {
+		return nil, err
+	}
+
+	if t.content.Has(hr.ContentID) {
+		size, err := t.content.Size(hr.ContentID)
+		if err != nil {
+			return nil, err
+		}
+		total := models.ChunkCountFor(size)
+		return HaveResponse{TotalChunks: total, Bitfield: FullBitfield(total)}, nil
+	}
+
+	if p := t.activeDownload(hr.ContentID); p != nil {
+		return HaveResponse{TotalChunks: p.total, Bitfield: p.bitfield()}, nil
+	}
+
+	return nil, errors.NewNotFoundError("content", string(hr.ContentID))
+}
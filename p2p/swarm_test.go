@@ -0,0 +1,262 @@
+// Package p2p - Unit tests for swarm downloads
+package p2p
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// fakeSeeder starts a node that serves only the listed chunks of data.
+// When corrupt is set every chunk it serves has a bad checksum.
+func fakeSeeder(t *testing.T, name string, cid models.ContentID, data []byte, chunks []int, corrupt bool) *Node {
+	t.Helper()
+
+	node := newTestNode(t, name)
+	total := models.ChunkCountFor(int64(len(data)))
+	manifest := models.NewManifest(data)
+
+	have := NewBitfield(total)
+	for _, i := range chunks {
+		have.Set(i)
+	}
+
+	node.Handle(MsgHave, func(req *Request) (interface{}, error) {
+		return HaveResponse{TotalChunks: total, Bitfield: have}, nil
+	})
+	node.Handle(MsgChunkRequest, func(req *Request) (interface{}, error) {
+		var cr ChunkRequest
+		if err := req.Decode(&cr); err != nil {
+			return nil, err
+		}
+		if cr.ContentID != cid || !have.Has(cr.Index) {
+			return nil, errors.NewNotFoundError("chunk", string(cr.ContentID))
+		}
+
+		chunk, err := readChunk(bytes.NewReader(data), cid, cr.Index, int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		chunk.Proof = manifest.Proof(cr.Index)
+		if corrupt {
+			chunk.Data = append([]byte(nil), chunk.Data...)
+			chunk.Data[0] ^= 0xff
+		}
+		return chunk, nil
+	})
+	return node
+}
+
+// chunkRange returns the indexes [from, to)
+func chunkRange(from, to int) []int {
+	r := make([]int, 0, to-from)
+	for i := from; i < to; i++ {
+		r = append(r, i)
+	}
+	return r
+}
+
+// swarmResource builds a resource for data listed on the given nodes
+func swarmResource(data []byte, nodes ...*Node) *models.Resource {
+	resource := models.NewResourceFromContent("lecture.pdf", data, "user-alice")
+	for _, n := range nodes {
+		resource.AddPeer(n.ID())
+	}
+	return resource
+}
+
+func TestSwarmSplitsChunksAcrossPeers(t *testing.T) {
+	leecher := newTestTransfer(t, "leecher")
+
+	data := testContent(8*models.ChunkSize + 100)
+	resource := swarmResource(data)
+
+	// Neither seeder has the whole file, so both must be used
+	first := fakeSeeder(t, "first", resource.ID, data, chunkRange(0, 5), false)
+	second := fakeSeeder(t, "second", resource.ID, data, chunkRange(4, 9), false)
+	for _, n := range []*Node{first, second} {
+		register(t, leecher.node, n)
+		resource.AddPeer(n.ID())
+	}
+
+	progress, err := leecher.Download(resource)
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if err := progress.Wait(); err != nil {
+		t.Fatalf("Swarm download failed: %v", err)
+	}
+
+	got, _ := leecher.Content().Get(resource.ID)
+	if !bytes.Equal(got, data) {
+		t.Fatal("Downloaded content does not match the original")
+	}
+
+	report := progress.Report()
+	if !report.Done || report.Completed != 9 || report.TotalChunks != 9 {
+		t.Errorf("Report = %d/%d done=%v; want 9/9 done", report.Completed, report.TotalChunks, report.Done)
+	}
+	if report.BytesDone != int64(len(data)) {
+		t.Errorf("BytesDone = %d; want %d", report.BytesDone, len(data))
+	}
+	if report.Throughput <= 0 {
+		t.Errorf("Throughput = %f; want > 0", report.Throughput)
+	}
+
+	for i, peer := range report.ServedBy {
+		switch {
+		case i < 4 && peer != first.ID():
+			t.Errorf("Chunk %d served by %s; only %s has it", i, peer, first.ID())
+		case i > 4 && peer != second.ID():
+			t.Errorf("Chunk %d served by %s; only %s has it", i, peer, second.ID())
+		}
+	}
+}
+
+func TestSwarmRetriesFailedChunkOnAnotherPeer(t *testing.T) {
+	leecher := newTestTransfer(t, "leecher")
+	leecher.SetSwarmOptions(SwarmOptions{RequestsPerPeer: 2, MaxPeerFailures: 100})
+
+	data := testContent(6 * models.ChunkSize)
+	resource := swarmResource(data)
+
+	bad := fakeSeeder(t, "bad", resource.ID, data, chunkRange(0, 6), true)
+	good := fakeSeeder(t, "good", resource.ID, data, chunkRange(0, 6), false)
+	for _, n := range []*Node{bad, good} {
+		register(t, leecher.node, n)
+		resource.AddPeer(n.ID())
+	}
+
+	if err := leecher.Fetch(resource); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	got, _ := leecher.Content().Get(resource.ID)
+	if !bytes.Equal(got, data) {
+		t.Fatal("Downloaded content does not match the original")
+	}
+}
+
+func TestSwarmFailsWhenChunkUnavailable(t *testing.T) {
+	leecher := newTestTransfer(t, "leecher")
+
+	data := testContent(4 * models.ChunkSize)
+	resource := swarmResource(data)
+
+	// Nobody has chunk 3
+	partial := fakeSeeder(t, "partial", resource.ID, data, chunkRange(0, 3), false)
+	register(t, leecher.node, partial)
+	resource.AddPeer(partial.ID())
+
+	if err := leecher.Fetch(resource); err == nil {
+		t.Fatal("Fetch succeeded although a chunk is missing everywhere")
+	}
+	if leecher.Content().Has(resource.ID) {
+		t.Error("Incomplete content was committed")
+	}
+}
+
+func TestPickRarestFirst(t *testing.T) {
+	leecher := newTestTransfer(t, "leecher")
+
+	resource := models.NewResource("rare.pdf", 4*models.ChunkSize, "user-alice")
+	progress := newProgress(resource, 4)
+
+	// Chunk 3 is held by one peer, chunk 2 by two, chunks 0-1 by three
+	haves := map[models.PeerID]Bitfield{
+		"peer-a": FullBitfield(4),
+		"peer-b": FullBitfield(3),
+		"peer-c": FullBitfield(2),
+	}
+	s := newSwarm(leecher, resource, progress, nil, haves)
+
+	if index, _ := s.next("peer-a"); index != 3 {
+		t.Errorf("First pick = %d; want rarest chunk 3", index)
+	}
+	if index, _ := s.next("peer-a"); index != 2 {
+		t.Errorf("Second pick = %d; want chunk 2", index)
+	}
+	if index, _ := s.next("peer-a"); index != 0 && index != 1 {
+		t.Errorf("Third pick = %d; want chunk 0 or 1", index)
+	}
+}
+
+func TestLeechersServeEachOtherMidDownload(t *testing.T) {
+	seeder := newTestTransfer(t, "seeder")
+	leecher := newTestTransfer(t, "leecher")
+	register(t, leecher.node, seeder.node)
+
+	data := testContent(3 * models.ChunkSize)
+	resource := swarmResource(data)
+	if err := seeder.Publish(resource, data); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	// A download in progress advertises exactly the chunks it verified
+	progress := newProgress(resource, 3)
+	f, err := leecher.Content().openPartial(resource.ID)
+	if err != nil {
+		t.Fatalf("openPartial failed: %v", err)
+	}
+	defer f.Close()
+	chunk, _ := seeder.Content().ReadChunk(resource.ID, 1)
+	f.WriteAt(chunk.Data, models.ChunkSize)
+	progress.record(1, seeder.node.ID(), len(chunk.Data))
+
+	leecher.mu.Lock()
+	leecher.active[resource.ID] = progress
+	leecher.mu.Unlock()
+
+	other := newTestTransfer(t, "other")
+	register(t, other.node, leecher.node)
+
+	var resp HaveResponse
+	if err := other.node.Request(leecher.node.ID(), MsgHave, HaveRequest{ContentID: resource.ID}, &resp); err != nil {
+		t.Fatalf("Have request failed: %v", err)
+	}
+	if resp.Bitfield.Has(0) || !resp.Bitfield.Has(1) || resp.Bitfield.Has(2) {
+		t.Errorf("Have bitfield = %08b; want only chunk 1", resp.Bitfield)
+	}
+
+	got, err := other.FetchChunk(leecher.node.ID(), resource.ID, 1)
+	if err != nil {
+		t.Fatalf("FetchChunk from leecher failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, chunk.Data) {
+		t.Error("Partial chunk data does not match")
+	}
+}
+
+func TestConcurrentDownloadsShareProgress(t *testing.T) {
+	seeder := newTestTransfer(t, "seeder")
+	leecher := newTestTransfer(t, "leecher")
+	register(t, leecher.node, seeder.node)
+
+	data := testContent(2 * models.ChunkSize)
+	resource := swarmResource(data)
+	seeder.Publish(resource, data)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		// Each caller has its own copy, as one read from a store would be
+		own := *resource
+		own.AvailableOn = append([]models.PeerID(nil), resource.AvailableOn...)
+		go func() {
+			defer wg.Done()
+			errs <- leecher.Fetch(&own)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Fetch failed: %v", err)
+		}
+	}
+}
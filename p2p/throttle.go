@@ -0,0 +1,168 @@
+// Package p2p - Reputation-based bandwidth throttling
+//
+// The serving side of a transfer limits how fast it sends chunks to each
+// connection with a token bucket. The bucket's rate is a configured base
+// bandwidth times the requesting user's throttle multiplier (1.0 for
+// Contributors, 0.7 for Neutral users, 0.3 for Leechers), so being a
+// Leecher really does mean slower downloads.
+package p2p
+
+import (
+	"sync"
+	"time"
+
+	"p2p-library/models"
+)
+
+// ============================================================================
+// TOKEN BUCKET
+// ============================================================================
+
+// TokenBucket is a rate limiter measured in bytes. Tokens refill at a
+// steady rate up to the burst size; sending n bytes spends n tokens and
+// waits if the bucket runs into debt.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// now and sleep are swapped out in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewTokenBucket creates a full bucket with the given rate and burst size
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	b := &TokenBucket{
+		rate:  rate,
+		burst: float64(burst),
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+	b.tokens = b.burst
+	b.last = b.now()
+	return b
+}
+
+// Rate returns the current refill rate in bytes per second
+func (b *TokenBucket) Rate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// SetRate changes the refill rate. Tokens earned at the old rate are kept.
+func (b *TokenBucket) SetRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	b.rate = rate
+}
+
+// Wait blocks until n bytes may be sent
+func (b *TokenBucket) Wait(n int) {
+	b.mu.Lock()
+	b.refill()
+	b.tokens -= float64(n)
+
+	var delay time.Duration
+	if b.tokens < 0 && b.rate > 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay > 0 {
+		b.sleep(delay)
+	}
+}
+
+// refill adds the tokens earned since the last update (mu must be held)
+func (b *TokenBucket) refill() {
+	now := b.now()
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// ============================================================================
+// THROTTLE POLICY
+// ============================================================================
+
+// ThrottleConfig enables reputation-based limits on served chunks
+type ThrottleConfig struct {
+	// BaseRate is the send rate in bytes per second for a multiplier of
+	// 1.0. Zero or less disables throttling.
+	BaseRate int64
+
+	// Burst is how many bytes may be sent without waiting (defaults to 64KB)
+	Burst int
+
+	// Multiplier returns the requesting user's current throttle
+	// multiplier. It is consulted for every slice of data sent, so a change
+	// in classification takes effect immediately.
+	Multiplier func(userID models.UserID) float64
+}
+
+// DefaultThrottleBurst is the burst size used when none is configured
+const DefaultThrottleBurst = 64 << 10
+
+// SetThrottle enables (or, with a zero BaseRate, disables) throttling
+func (t *Transfer) SetThrottle(cfg ThrottleConfig) {
+	if cfg.Burst <= 0 {
+		cfg.Burst = DefaultThrottleBurst
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.throttle = cfg
+}
+
+// throttleConfig returns the current throttle settings
+func (t *Transfer) throttleConfig() ThrottleConfig {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.throttle
+}
+
+// sendRate returns the allowed send rate for a user in bytes per second
+func (cfg ThrottleConfig) sendRate(userID models.UserID) float64 {
+	multiplier := 1.0
+	if cfg.Multiplier != nil {
+		multiplier = cfg.Multiplier(userID)
+	}
+	return float64(cfg.BaseRate) * multiplier
+}
+
+// throttleSend waits until n bytes may be sent on the request's connection.
+// The wait is split into burst-sized slices and the rate is refreshed
+// before each one.
+func (t *Transfer) throttleSend(req *Request, n int) {
+	cfg := t.throttleConfig()
+	if cfg.BaseRate <= 0 || req.conn == nil {
+		return
+	}
+
+	bucket := req.conn.sendLimiter(func() *TokenBucket {
+		return NewTokenBucket(cfg.sendRate(req.FromUser), cfg.Burst)
+	})
+
+	for remaining := n; remaining > 0; remaining -= cfg.Burst {
+		bucket.SetRate(cfg.sendRate(req.FromUser))
+
+		slice := remaining
+		if slice > cfg.Burst {
+			slice = cfg.Burst
+		}
+		bucket.Wait(slice)
+	}
+}
@@ -0,0 +1,206 @@
+// Package p2p - Unit tests for bandwidth throttling
+package p2p
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"p2p-library/models"
+	"p2p-library/services"
+)
+
+// fakeClock drives a TokenBucket without real sleeping
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.slept += d
+	c.now = c.now.Add(d)
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	bucket := NewTokenBucket(1000, 100)
+	bucket.now, bucket.sleep, bucket.last = clock.Now, clock.Sleep, clock.now
+
+	// The initial burst is free
+	bucket.Wait(100)
+	if clock.slept != 0 {
+		t.Errorf("Slept %v for the burst; want 0", clock.slept)
+	}
+
+	// 500 more bytes at 1000 B/s takes half a second
+	bucket.Wait(500)
+	if clock.slept != 500*time.Millisecond {
+		t.Errorf("Slept %v; want 500ms", clock.slept)
+	}
+
+	// Halving the rate doubles the wait
+	bucket.SetRate(500)
+	clock.slept = 0
+	bucket.Wait(250)
+	if clock.slept != 500*time.Millisecond {
+		t.Errorf("Slept %v after SetRate; want 500ms", clock.slept)
+	}
+}
+
+// classMultiplier maps test users to classifications
+type classMultiplier struct {
+	mu      sync.Mutex
+	classes map[models.UserID]models.UserClassification
+}
+
+func (c *classMultiplier) set(userID models.UserID, class models.UserClassification) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.classes[userID] = class
+}
+
+func (c *classMultiplier) Multiplier(userID models.UserID) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return services.GetThrottleMultiplier(c.classes[userID])
+}
+
+// timeFetch downloads chunks from a seeder and returns the elapsed time
+func timeFetch(t *testing.T, leecher *Transfer, seeder *Node, cid models.ContentID, chunks ...int) time.Duration {
+	t.Helper()
+
+	start := time.Now()
+	for _, i := range chunks {
+		if _, err := leecher.FetchChunk(seeder.ID(), cid, i); err != nil {
+			t.Fatalf("FetchChunk(%d) failed: %v", i, err)
+		}
+	}
+	return time.Since(start)
+}
+
+func TestThrottleByClassification(t *testing.T) {
+	const (
+		baseRate = 1 << 20 // 1MB/s for a Contributor
+		burst    = 64 << 10
+		sample   = 512 << 10
+	)
+
+	classes := &classMultiplier{classes: make(map[models.UserID]models.UserClassification)}
+	seeder := newTestTransfer(t, "seeder")
+	seeder.SetThrottle(ThrottleConfig{BaseRate: baseRate, Burst: burst, Multiplier: classes.Multiplier})
+
+	// Only the short final chunk is fetched, keeping the test quick
+	data := testContent(models.ChunkSize + sample)
+	resource := swarmResource(data)
+	seeder.Publish(resource, data)
+
+	tests := []struct {
+		name  string
+		class models.UserClassification
+	}{
+		{"contributor", models.ClassContributor},
+		{"neutral", models.ClassNeutral},
+		{"leecher", models.ClassLeecher},
+	}
+
+	var previous float64
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leecher := newTestTransfer(t, tt.name)
+			classes.set(leecher.node.UserID(), tt.class)
+			trustUsers(seeder.node, leecher.node)
+			register(t, leecher.node, seeder.node)
+			leecher.node.Connect(seeder.node.ID())
+
+			elapsed := timeFetch(t, leecher, seeder.node, resource.ID, 1)
+			measured := float64(sample-burst) / elapsed.Seconds()
+			expected := baseRate * services.GetThrottleMultiplier(tt.class)
+
+			// Protocol overhead can only slow us down, so the upper bound
+			// is tight and the lower one leaves room for a busy machine
+			if measured > expected*1.1 || measured < expected*0.4 {
+				t.Errorf("Throughput = %.0f B/s; want about %.0f B/s", measured, expected)
+			}
+			if previous > 0 && measured >= previous {
+				t.Errorf("Throughput = %.0f B/s; want less than the better class's %.0f B/s", measured, previous)
+			}
+			previous = measured
+		})
+	}
+}
+
+func TestThrottleFollowsClassificationChange(t *testing.T) {
+	classes := &classMultiplier{classes: make(map[models.UserID]models.UserClassification)}
+	seeder := newTestTransfer(t, "seeder")
+	seeder.SetThrottle(ThrottleConfig{BaseRate: 1 << 20, Multiplier: classes.Multiplier})
+
+	// The short final chunk keeps the test quick at a low base rate
+	data := testContent(models.ChunkSize + 256<<10)
+	resource := swarmResource(data)
+	seeder.Publish(resource, data)
+
+	leecher := newTestTransfer(t, "student")
+	trustUsers(seeder.node, leecher.node)
+	register(t, leecher.node, seeder.node)
+	leecher.node.Connect(seeder.node.ID())
+
+	classes.set(leecher.node.UserID(), models.ClassLeecher)
+	slow := timeFetch(t, leecher, seeder.node, resource.ID, 1)
+
+	// The user earns Contributor status; the same connection speeds up
+	classes.set(leecher.node.UserID(), models.ClassContributor)
+	fast := timeFetch(t, leecher, seeder.node, resource.ID, 1)
+
+	if fast*3/2 > slow {
+		t.Errorf("Contributor fetch took %v vs %v as Leecher; want clearly faster", fast, slow)
+	}
+}
+
+func TestThrottleIgnoresUnverifiedUser(t *testing.T) {
+	classes := &classMultiplier{classes: make(map[models.UserID]models.UserClassification)}
+	seeder := newTestTransfer(t, "seeder")
+	// Unverified users get half a contributor's rate. A low base rate
+	// keeps per-request overhead from hiding that gap under -race.
+	seeder.SetThrottle(ThrottleConfig{BaseRate: 1 << 19, Multiplier: classes.Multiplier})
+
+	data := testContent(models.ChunkSize + 256<<10)
+	resource := swarmResource(data)
+	seeder.Publish(resource, data)
+
+	// The impostor's handshake claims the contributor's UserID, but the
+	// seeder has that user bound to the contributor's own peer
+	contributor := newTestNode(t, "contributor")
+	impostor := newTestTransfer(t, "contributor")
+	classes.set(contributor.UserID(), models.ClassContributor)
+	trustUsers(seeder.node, contributor)
+	register(t, impostor.node, seeder.node)
+	impostor.node.Connect(seeder.node.ID())
+	slow := timeFetch(t, impostor, seeder.node, resource.ID, 1)
+
+	honest := newTestTransfer(t, "honest")
+	classes.set(honest.node.UserID(), models.ClassContributor)
+	trustUsers(seeder.node, contributor, honest.node)
+	register(t, honest.node, seeder.node)
+	honest.node.Connect(seeder.node.ID())
+	fast := timeFetch(t, honest, seeder.node, resource.ID, 1)
+
+	if fast*3/2 > slow {
+		t.Errorf("Impostor fetch took %v vs %v for a verified contributor; want clearly slower", slow, fast)
+	}
+}
+
+func TestNoThrottleByDefault(t *testing.T) {
+	seeder := newTestTransfer(t, "seeder")
+	leecher := newTestTransfer(t, "leecher")
+	register(t, leecher.node, seeder.node)
+
+	data := testContent(models.ChunkSize)
+	resource := swarmResource(data)
+	seeder.Publish(resource, data)
+
+	if elapsed := timeFetch(t, leecher, seeder.node, resource.ID, 0); elapsed > 2*time.Second {
+		t.Errorf("Unthrottled fetch took %v", elapsed)
+	}
+}
@@ -0,0 +1,306 @@
+// Package p2p - Chunked content transfer
+//
+// A downloader asks a peer for chunk N of a ContentID and receives a
+// models.ResourceChunk carrying the chunk bytes, their checksum and a
+// proof from the resource's manifest. Both are verified before the chunk
+// is written to disk.
+package p2p
+
+import (
+	"sync"
+	"time"
+
+	"p2p-library/errors"
+	"p2p-library/interfaces"
+	"p2p-library/models"
+	"p2p-library/p2p/dht"
+)
+
+// Compile-time check that Transfer satisfies the ContentTransfer interface
+var _ interfaces.ContentTransfer = (*Transfer)(nil)
+
+// Chunk transfer message types
+const (
+	MsgChunkRequest MessageType = "chunk_request"
+)
+
+// ChunkRequest asks a peer for one chunk of a resource
+type ChunkRequest struct {
+	ContentID models.ContentID `json:"content_id"`
+	Index     int              `json:"index"`
+}
+
+// ============================================================================
+// TRANSFER
+// ============================================================================
+
+// Transfer serves local content to peers and downloads content from them
+type Transfer struct {
+	node    *Node
+	content *ContentStore
+
+	mu            sync.Mutex
+	opts          SwarmOptions
+	throttle      ThrottleConfig
+	active        map[models.ContentID]*Progress // downloads in progress
+	manifests     map[models.ContentID]*models.Manifest
+	onMisbehavior MisbehaviorFunc
+	onTransfer    LedgerFunc
+	locator       *dht.DHT  // optional: announces content and finds providers
+	chokes        *Choker   // optional: limits how many peers are served at once
+	served        int64     // bytes served since the last seed report
+	seedSince     time.Time // start of the current seed report period
+}
+
+// NewTransfer creates a Transfer and registers its handlers on the node
+func NewTransfer(node *Node, content *ContentStore) *Transfer {
+	t := &Transfer{
+		node:      node,
+		content:   content,
+		opts:      DefaultSwarmOptions(),
+		active:    make(map[models.ContentID]*Progress),
+		manifests: make(map[models.ContentID]*models.Manifest),
+		seedSince: models.TimeNow(),
+	}
+	node.Handle(MsgChunkRequest, t.handleChunkRequest)
+	node.Handle(MsgHave, t.handleHave)
+	node.Handle(MsgManifest, t.handleManifest)
+	node.Handle(MsgReceipt, t.handleReceipt)
+	return t
+}
+
+// SetSwarmOptions changes how future downloads spread requests across peers
+func (t *Transfer) SetSwarmOptions(opts SwarmOptions) {
+	defaults := DefaultSwarmOptions()
+	if opts.RequestsPerPeer <= 0 {
+		opts.RequestsPerPeer = defaults.RequestsPerPeer
+	}
+	if opts.MaxPeerFailures <= 0 {
+		opts.MaxPeerFailures = defaults.MaxPeerFailures
+	}
+	if opts.ChokeBackoff <= 0 {
+		opts.ChokeBackoff = defaults.ChokeBackoff
+	}
+	if opts.ChokeWait <= 0 {
+		opts.ChokeWait = defaults.ChokeWait
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.opts = opts
+}
+
+// swarmOptions returns the current swarm settings
+func (t *Transfer) swarmOptions() SwarmOptions {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.opts
+}
+
+// Progress returns the progress of an active download
+func (t *Transfer) Progress(cid models.ContentID) (*Progress, error) {
+	if p := t.activeDownload(cid); p != nil {
+		return p, nil
+	}
+	return nil, errors.NewNotFoundError("download", string(cid))
+}
+
+// activeDownload returns the in-progress download for cid, if any
+func (t *Transfer) activeDownload(cid models.ContentID) *Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active[cid]
+}
+
+// Content returns the local content store
+func (t *Transfer) Content() *ContentStore {
+	return t.content
+}
+
+// handleChunkRequest serves a chunk from the local content store, or a
+// verified chunk of a download that is still in progress, together with
+// its manifest proof. Peers without an upload slot are turned away with
+// errors.ErrChoked. The reply is held back as long as the requester's
+// bandwidth allowance requires.
+func (t *Transfer) handleChunkRequest(req *Request) (interface{}, error) {
+	var cr ChunkRequest
+	if err := req.Decode(&cr); err != nil {
+		return nil, err
+	}
+	if c := t.choker(); c != nil && !c.Allow(req.From, req.FromUser) {
+		return nil, errors.ErrChoked
+	}
+
+	chunk, err := t.readChunk(cr)
+	if err != nil {
+		return nil, err
+	}
+	t.attachProof(chunk)
+
+	t.throttleSend(req, len(chunk.Data))
+	t.recordServed(len(chunk.Data))
+	return chunk, nil
+}
+
+// readChunk reads a complete or partial chunk from local storage
+func (t *Transfer) readChunk(cr ChunkRequest) (*models.ResourceChunk, error) {
+	if t.content.Has(cr.ContentID) {
+		return t.content.ReadChunk(cr.ContentID, cr.Index)
+	}
+	if p := t.activeDownload(cr.ContentID); p != nil && p.has(cr.Index) {
+		return t.content.readPartialChunk(cr.ContentID, cr.Index, p.size)
+	}
+	return nil, errors.NewNotFoundError("chunk", string(cr.ContentID))
+}
+
+// FetchChunk requests one chunk from a peer and verifies it
+func (t *Transfer) FetchChunk(peerID models.PeerID, cid models.ContentID, index int) (*models.ResourceChunk, error) {
+	var chunk models.ResourceChunk
+	req := ChunkRequest{ContentID: cid, Index: index}
+	if err := t.node.Request(peerID, MsgChunkRequest, req, &chunk); err != nil {
+		return nil, err
+	}
+
+	if chunk.ResourceID != cid || chunk.ChunkIndex != index {
+		return nil, errors.NewOperationError("FetchChunk", "peer returned the wrong chunk", errors.ErrTransferFailed)
+	}
+	if !chunk.Verify() {
+		return nil, errors.ErrChecksumMismatch
+	}
+	if c := t.choker(); c != nil {
+		c.Received(peerID, len(chunk.Data))
+	}
+	return &chunk, nil
+}
+
+// ============================================================================
+// CONTENT TRANSFER IMPLEMENTATION
+// ============================================================================
+
+// Publish stores a resource's content locally and makes this node a source
+// for it. The resource's ID must be the content ID of data; its Size,
+// ChunkCount and Manifest are set from the real data.
+func (t *Transfer) Publish(resource *models.Resource, data []byte) error {
+	if !models.VerifyContent(resource.ID, data) {
+		return errors.NewOperationError("Publish", "resource ID is not the content ID of the data", errors.ErrContentMismatch)
+	}
+	if err := t.content.Put(resource.ID, data); err != nil {
+		return err
+	}
+	if resource.Manifest == nil || resource.Manifest.Root != resource.ID {
+		resource.Manifest = models.NewManifest(data)
+	}
+	if err := t.storeManifest(resource.Manifest); err != nil {
+		return err
+	}
+	t.announce(resource.ID)
+
+	resource.Size = int64(len(data))
+	resource.ChunkCount = models.ChunkCountFor(resource.Size)
+	resource.AddPeer(t.node.ID())
+	return nil
+}
+
+// Fetch downloads a resource's content from the peers in AvailableOn.
+// Content that is already stored locally is not fetched again. Once the
+// content is verified this node seeds it and is added to AvailableOn.
+func (t *Transfer) Fetch(resource *models.Resource) error {
+	progress, err := t.Download(resource)
+	if err != nil {
+		return err
+	}
+	if err := progress.Wait(); err != nil {
+		return err
+	}
+	resource.AddPeer(t.node.ID())
+	return nil
+}
+
+// Download starts a swarm download of a resource and returns its progress
+// immediately. If the resource is already being downloaded the existing
+// progress is returned.
+func (t *Transfer) Download(resource *models.Resource) (*Progress, error) {
+	total := resource.ChunkCount
+	if total == 0 {
+		total = models.ChunkCountFor(resource.Size)
+	}
+
+	t.mu.Lock()
+	if p, ok := t.active[resource.ID]; ok {
+		t.mu.Unlock()
+		return p, nil
+	}
+	progress := newProgress(resource, total)
+	if t.content.Has(resource.ID) {
+		t.mu.Unlock()
+		for i := 0; i < total; i++ {
+			progress.record(i, t.node.ID(), 0)
+		}
+		progress.finish(nil)
+		return progress, nil
+	}
+	t.restoreProgress(resource, progress)
+	t.active[resource.ID] = progress
+	t.mu.Unlock()
+
+	go func() {
+		err := t.runSwarm(resource, progress)
+
+		t.mu.Lock()
+		delete(t.active, resource.ID)
+		t.mu.Unlock()
+
+		progress.finish(err)
+	}()
+
+	return progress, nil
+}
+
+// runSwarm fetches every missing chunk and commits the finished file.
+// On failure the partial file and its state are kept for a later resume.
+func (t *Transfer) runSwarm(resource *models.Resource, progress *Progress) error {
+	f, err := t.content.openPartial(resource.ID)
+	if err != nil {
+		return errors.NewOperationError("Download", "failed to open partial file", err)
+	}
+	defer f.Close()
+
+	if err := t.persistProgress(resource, progress, f); err != nil {
+		return errors.NewOperationError("Download", "failed to save download state", err)
+	}
+
+	if progress.bitfield().Count(progress.total) < progress.total {
+		haves := t.queryHaves(resource, t.candidatePeers(resource), progress.total)
+		if len(haves) == 0 {
+			return errors.NewOperationError("Download", "no peer holds the resource", errors.ErrNoPeersAvailable)
+		}
+
+		peers := make([]models.PeerID, 0, len(haves))
+		for peerID := range haves {
+			peers = append(peers, peerID)
+		}
+		t.ensureManifest(resource, peers)
+		if err := newSwarm(t, resource, progress, f, haves).run(); err != nil {
+			return err
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	// Every chunk passed its checksum; the whole file must also hash to
+	// the content ID, otherwise the peers agreed on the wrong bytes
+	if err := t.content.verifyPartial(resource.ID, resource.Size); err != nil {
+		t.content.Delete(resource.ID)
+		return errors.NewOperationError("Download", "downloaded content failed verification", err)
+	}
+	if err := t.content.commitPartial(resource.ID, resource.Size); err != nil {
+		return err
+	}
+	t.content.deleteState(resource.ID)
+
+	// The verified copy is served like any other; tell the network
+	t.announce(resource.ID)
+	return nil
+}
@@ -0,0 +1,170 @@
+// Package p2p - Unit tests for chunked content transfer
+package p2p
+
+import (
+	"bytes"
+	"testing"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// newTestTransfer starts a node with a content store in a temp directory
+func newTestTransfer(t *testing.T, name string) *Transfer {
+	t.Helper()
+
+	content, err := NewContentStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewContentStore failed: %v", err)
+	}
+	return NewTransfer(newTestNode(t, name), content)
+}
+
+// testContent returns size bytes of deterministic, non-repeating data
+func testContent(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+func TestChunkCountFor(t *testing.T) {
+	tests := []struct {
+		size     int64
+		expected int
+	}{
+		{0, 0},
+		{1, 1},
+		{models.ChunkSize, 1},
+		{models.ChunkSize + 1, 2},
+		{models.MaxFileSize, models.MaxFileSize / models.ChunkSize},
+	}
+
+	for _, tt := range tests {
+		if got := models.ChunkCountFor(tt.size); got != tt.expected {
+			t.Errorf("ChunkCountFor(%d) = %d; want %d", tt.size, got, tt.expected)
+		}
+	}
+}
+
+func TestFetchMovesBytesBetweenNodes(t *testing.T) {
+	alice := newTestTransfer(t, "alice")
+	bob := newTestTransfer(t, "bob")
+	register(t, bob.node, alice.node)
+
+	data := testContent(3*models.ChunkSize + 1234)
+	resource := models.NewResourceFromContent("lecture.pdf", data, "user-alice")
+	if err := alice.Publish(resource, data); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	if resource.ChunkCount != 4 {
+		t.Errorf("ChunkCount = %d; want 4", resource.ChunkCount)
+	}
+	if resource.Size != int64(len(data)) {
+		t.Errorf("Size = %d; want %d", resource.Size, len(data))
+	}
+
+	if err := bob.Fetch(resource); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	got, err := bob.Content().Get(resource.ID)
+	if err != nil {
+		t.Fatalf("Content missing after Fetch: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Downloaded content does not match the original")
+	}
+}
+
+func TestFetchChunkRejectsBadChecksum(t *testing.T) {
+	bob := newTestTransfer(t, "bob")
+	mallory := newTestNode(t, "mallory")
+	register(t, bob.node, mallory)
+
+	// Mallory serves chunks whose data doesn't match the checksum
+	mallory.Handle(MsgChunkRequest, func(req *Request) (interface{}, error) {
+		var cr ChunkRequest
+		req.Decode(&cr)
+		return &models.ResourceChunk{
+			ResourceID: cr.ContentID,
+			ChunkIndex: cr.Index,
+			Data:       []byte("tampered"),
+			Checksum:   models.ChecksumChunk([]byte("original")),
+		}, nil
+	})
+
+	_, err := bob.FetchChunk(mallory.ID(), "abc123", 0)
+	if err != errors.ErrChecksumMismatch {
+		t.Errorf("FetchChunk err = %v; want %v", err, errors.ErrChecksumMismatch)
+	}
+}
+
+func TestContentIDIsDerivedFromBytes(t *testing.T) {
+	data := testContent(2*models.ChunkSize + 99)
+	a := models.NewResourceFromContent("lecture.pdf", data, "user-alice")
+	b := models.NewResourceFromContent("copy of lecture.pdf", data, "user-bob")
+	if a.ID != b.ID {
+		t.Errorf("Identical bytes got IDs %s and %s", a.ID, b.ID)
+	}
+
+	// Swapping two chunks keeps every chunk hash but changes the tree
+	swapped := append(append([]byte(nil), data[models.ChunkSize:2*models.ChunkSize]...), data[:models.ChunkSize]...)
+	swapped = append(swapped, data[2*models.ChunkSize:]...)
+	if models.ComputeContentID(swapped) == a.ID {
+		t.Error("Reordered chunks produced the same ID")
+	}
+	if !models.VerifyContent(a.ID, data) || models.VerifyContent(a.ID, swapped) {
+		t.Error("VerifyContent gave the wrong answer")
+	}
+}
+
+func TestPublishRejectsWrongContentID(t *testing.T) {
+	alice := newTestTransfer(t, "alice")
+
+	resource := models.NewResource("lecture.pdf", 1, "user-alice")
+	if err := alice.Publish(resource, testContent(100)); err == nil {
+		t.Fatal("Publish accepted data that doesn't match the resource ID")
+	}
+	if alice.Content().Has(resource.ID) {
+		t.Error("Mismatched content was stored")
+	}
+}
+
+func TestFetchFallsBackToNextPeer(t *testing.T) {
+	alice := newTestTransfer(t, "alice")
+	bob := newTestTransfer(t, "bob")
+	empty := newTestTransfer(t, "empty")
+	register(t, bob.node, empty.node)
+	register(t, bob.node, alice.node)
+
+	data := testContent(models.ChunkSize + 10)
+	resource := models.NewResourceFromContent("notes.pdf", data, "user-alice")
+	if err := alice.Publish(resource, data); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	// The first listed peer doesn't actually have the content
+	resource.AvailableOn = []models.PeerID{empty.node.ID(), alice.node.ID()}
+
+	if err := bob.Fetch(resource); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if !bob.Content().Has(resource.ID) {
+		t.Error("Content not stored after fallback")
+	}
+}
+
+func TestFetchWithoutPeersFails(t *testing.T) {
+	bob := newTestTransfer(t, "bob")
+
+	resource := models.NewResource("orphan.pdf", 2048, "user-nobody")
+	if err := bob.Fetch(resource); err == nil {
+		t.Fatal("Fetch succeeded with no peers")
+	}
+	if bob.Content().Has(resource.ID) {
+		t.Error("Partial content was committed")
+	}
+}
@@ -0,0 +1,126 @@
+// Package p2p implements the peer-to-peer networking layer of the library.
+//
+// Nodes talk to each other over TCP using length-prefixed JSON frames.
+// Every connection starts with a versioned handshake in which both sides
+// exchange their PeerID and UserID, after which either side can send
+// requests and receive replies over the same connection.
+package p2p
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"p2p-library/models"
+)
+
+// ============================================================================
+// PROTOCOL CONSTANTS
+// ============================================================================
+
+// ProtocolVersion is the wire protocol version spoken by this node.
+// Peers announcing a different version are rejected during the handshake.
+const ProtocolVersion = 2
+
+// maxFrameSize bounds a single frame on the wire. A JSON-encoded chunk is
+// base64 inflated, so this leaves headroom above models.ChunkSize.
+const maxFrameSize = 4 * models.ChunkSize
+
+// MessageType identifies the kind of message carried in a frame
+type MessageType string
+
+// Built-in message types
+const (
+	MsgHello MessageType = "hello"
+	MsgAuth  MessageType = "auth"
+	MsgPing  MessageType = "ping"
+)
+
+// ============================================================================
+// MESSAGES
+// ============================================================================
+
+// Message is the envelope for everything sent between peers.
+// Requests carry a non-zero ID; replies echo it back with Reply set.
+type Message struct {
+	Type    MessageType     `json:"type"`
+	ID      uint64          `json:"id"`
+	Reply   bool            `json:"reply,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Hello is exchanged by both sides when a connection is opened. Nonce is
+// a fresh challenge the other side must sign to prove it owns its PeerID.
+type Hello struct {
+	Version    int           `json:"version"`
+	PeerID     models.PeerID `json:"peer_id"`
+	UserID     models.UserID `json:"user_id"`
+	ListenPort int           `json:"listen_port"`
+	Nonce      []byte        `json:"nonce"`
+}
+
+// Auth answers the other side's Hello nonce
+type Auth struct {
+	Signature []byte `json:"signature"`
+}
+
+// Pong is the reply to a ping request
+type Pong struct {
+	PeerID models.PeerID `json:"peer_id"`
+}
+
+// ============================================================================
+// FRAMING
+// ============================================================================
+
+// writeFrame encodes msg as JSON and writes it with a 4-byte length prefix
+func writeFrame(w io.Writer, msg *Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(body) > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds limit of %d", len(body), maxFrameSize)
+	}
+
+	buf := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(body)))
+	copy(buf[4:], body)
+
+	_, err = w.Write(buf)
+	return err
+}
+
+// readFrame reads one length-prefixed frame and decodes it
+func readFrame(r io.Reader) (*Message, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds limit of %d", size, maxFrameSize)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	var msg Message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// encodePayload marshals v into a message payload
+func encodePayload(v interface{}) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
@@ -15,8 +15,8 @@ import (
 	"strings"
 
 	"p2p-library/errors"
+	"p2p-library/interfaces"
 	"p2p-library/models"
-	"p2p-library/store"
 )
 
 // ============================================================================
@@ -25,18 +25,37 @@ import (
 
 // LibraryService handles resource management operations
 type LibraryService struct {
-	store       *store.MemoryStore
+	db          interfaces.StorageBackend // runs multi-step changes as transactions
+	resources   interfaces.ResourceStorage
+	ratings     interfaces.RatingStorage
 	userService *UserService
+	transfer    interfaces.ContentTransfer // optional: moves content between peers
+	identity    *models.Identity           // optional: signs uploads and ratings
 }
 
-// NewLibraryService creates a new LibraryService
-func NewLibraryService(store *store.MemoryStore, userService *UserService) *LibraryService {
+// NewLibraryService creates a new LibraryService on a storage backend.
+// userService must use the same backend's users.
+func NewLibraryService(db interfaces.StorageBackend, userService *UserService) *LibraryService {
 	return &LibraryService{
-		store:       store,
+		db:          db,
+		resources:   db.Resources(),
+		ratings:     db.Ratings(),
 		userService: userService,
 	}
 }
 
+// SetTransfer attaches the content transfer used to move file bytes.
+// Without one, uploads and downloads only touch metadata.
+func (s *LibraryService) SetTransfer(transfer interfaces.ContentTransfer) {
+	s.transfer = transfer
+}
+
+// SetIdentity sets the keypair this node signs uploads and ratings with.
+// Without one, records are stored unsigned.
+func (s *LibraryService) SetIdentity(identity *models.Identity) {
+	s.identity = identity
+}
+
 // ============================================================================
 // RESOURCE OPERATIONS
 // ============================================================================
@@ -48,47 +67,194 @@ func (s *LibraryService) Upload(resource *models.Resource) error {
 		return err
 	}
 	
-	// Store the resource
-	if err := s.store.Store(resource); err != nil {
-		return errors.NewOperationError("Upload", "failed to store resource", err)
+	// Keep signatures made elsewhere; vouch for our own uploads
+	if resource.IsSigned() {
+		if !resource.VerifySignature() {
+			return errors.NewOperationError("Upload", "resource signature is invalid", errors.ErrInvalidSignature)
+		}
+	} else if s.identity != nil {
+		resource.Sign(s.identity)
 	}
 	
-	// Update uploader's stats
-	if err := s.userService.RecordUpload(resource.UploadedBy); err != nil {
-		// Log error but don't fail the upload
-		_ = err
+	// Store the resource and credit the uploader together, so a failed
+	// step leaves neither
+	return s.db.RunInTx(func(tx interfaces.Tx) error {
+		if err := tx.Resources().Store(resource); err != nil {
+			return errors.NewOperationError("Upload", "failed to store resource", err)
+		}
+		if err := userServiceIn(tx).RecordUpload(resource.UploadedBy); err != nil {
+			return errors.NewOperationError("Upload", "failed to record upload", err)
+		}
+		return nil
+	})
+}
+
+// UpdateResource saves changes to a resource's details. resource must
+// carry the Version it was read at: if the stored resource was changed
+// since, nothing is saved and a ConflictError is returned.
+func (s *LibraryService) UpdateResource(resource *models.Resource) error {
+	if err := validateResource(resource); err != nil {
+		return err
 	}
 	
+	resource.UpdatedAt = models.TimeNow()
+	if err := s.resources.Update(resource); err != nil {
+		return errors.NewOperationError("UpdateResource", "failed to update resource", err)
+	}
 	return nil
 }
 
-// Download retrieves a resource and updates statistics
+// UploadContent publishes a resource's file content and then adds it to
+// the library. The resource's ID is computed from the data, and Size and
+// ChunkCount are taken from it too. If the same bytes were uploaded
+// before, the existing resource is returned instead. Either way
+// AvailableOn lists the peers the transfer published the content on, not
+// the peer recorded for the uploader, which may not hold it.
+func (s *LibraryService) UploadContent(resource *models.Resource, data []byte) (*models.Resource, error) {
+	if s.transfer == nil {
+		return nil, errors.NewOperationError("UploadContent", "no content transfer configured", nil)
+	}
+	
+	resource.ID = models.ComputeContentID(data)
+	resource.Size = int64(len(data))
+	if err := validateResource(resource); err != nil {
+		return nil, err
+	}
+	
+	// Identical content dedupes onto the resource already in the library
+	if existing, err := s.resources.Get(resource.ID); err == nil {
+		if err := s.transfer.Publish(existing, data); err != nil {
+			return nil, errors.NewOperationError("UploadContent", "failed to publish content", err)
+		}
+		published := existing
+		err := s.resources.UpdateResource(existing.ID, func(r *models.Resource) error {
+			r.ChunkCount = published.ChunkCount
+			r.Manifest = published.Manifest
+			addPeers(r, published.AvailableOn)
+			existing = r
+			return nil
+		})
+		if err != nil {
+			return nil, errors.NewOperationError("UploadContent", "failed to update resource", err)
+		}
+		return existing, nil
+	}
+	
+	if err := s.transfer.Publish(resource, data); err != nil {
+		return nil, errors.NewOperationError("UploadContent", "failed to publish content", err)
+	}
+	
+	if err := s.Upload(resource); err != nil {
+		return nil, err
+	}
+	return resource, nil
+}
+
+// addPeers lists more sources of a resource, skipping empty peer IDs
+func addPeers(resource *models.Resource, peers []models.PeerID) {
+	for _, p := range peers {
+		if p != "" {
+			resource.AddPeer(p)
+		}
+	}
+}
+
+// Download retrieves a resource and updates statistics.
+// When a content transfer is configured the file bytes are fetched from
+// the peers listed in AvailableOn before the download is counted, and the
+// peers the transfer reports holding it, this node among them, are listed
+// as sources once the content verified.
+// The resource's count and the downloader's stats change together; an
+// unknown downloader fails the download.
 func (s *LibraryService) Download(resourceID models.ContentID, userID models.UserID) (*models.Resource, error) {
-	resource, err := s.store.Get(resourceID)
+	resource, err := s.resources.Get(resourceID)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Fetch adds the peers that now hold the content to our copy
+	var sources []models.PeerID
+	if s.transfer != nil {
+		if err := s.transfer.Fetch(resource); err != nil {
+			return nil, errors.NewOperationError("Download", "failed to transfer content", err)
+		}
+		sources = resource.AvailableOn
+	}
+	
+	// Count the download on the resource and the downloader together
+	err = s.db.RunInTx(func(tx interfaces.Tx) error {
+		err := tx.Resources().UpdateResource(resourceID, func(r *models.Resource) error {
+			r.DownloadCount++
+			addPeers(r, sources)
+			resource = r
+			return nil
+		})
+		if err != nil {
+			return errors.NewOperationError("Download", "failed to update resource", err)
+		}
+		return userServiceIn(tx).RecordDownload(userID)
+	})
 	if err != nil {
 		return nil, err
 	}
 	
-	// Update download count
-	resource.DownloadCount++
+	return resource, nil
+}
+
+// Rate records a user's rating of a resource. A rating that arrives
+// signed must carry a valid signature; an unsigned one is signed by this
+// node. Each user can rate a resource once.
+func (s *LibraryService) Rate(rating *models.ResourceRating) (*models.Resource, error) {
+	if !rating.IsValid() {
+		return nil, errors.ErrInvalidRating
+	}
+	
+	if _, err := s.resources.Get(rating.ResourceID); err != nil {
+		return nil, err
+	}
 	
-	// Update downloader's stats
-	if err := s.userService.RecordDownload(userID); err != nil {
-		// Log error but don't fail the download
-		_ = err
+	if rating.IsSigned() {
+		if !rating.VerifySignature() {
+			return nil, errors.NewOperationError("Rate", "rating signature is invalid", errors.ErrInvalidSignature)
+		}
+	} else if s.identity != nil {
+		rating.Sign(s.identity)
 	}
 	
+	// The rating and the resource's totals are stored together
+	var resource *models.Resource
+	err := s.db.RunInTx(func(tx interfaces.Tx) error {
+		if err := tx.Ratings().Create(rating); err != nil {
+			// A user's rating of a resource has a fixed ID
+			if errors.Is(err, errors.ErrAlreadyExists) {
+				return errors.ErrAlreadyRated
+			}
+			return errors.NewOperationError("Rate", "failed to store rating", err)
+		}
+		err := tx.Resources().UpdateResource(rating.ResourceID, func(r *models.Resource) error {
+			r.AddRating(rating.Rating)
+			resource = r
+			return nil
+		})
+		if err != nil {
+			return errors.NewOperationError("Rate", "failed to update resource", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return resource, nil
 }
 
 // GetResource retrieves a resource by ID
 func (s *LibraryService) GetResource(resourceID models.ContentID) (*models.Resource, error) {
-	return s.store.Get(resourceID)
+	return s.resources.Get(resourceID)
 }
 
 // GetUserLibrary returns all resources uploaded by a user
 func (s *LibraryService) GetUserLibrary(userID models.UserID) ([]*models.Resource, error) {
-	return s.store.GetByUser(userID)
+	return s.resources.GetByUser(userID)
 }
 
 // ============================================================================
@@ -98,7 +264,7 @@ func (s *LibraryService) GetUserLibrary(userID models.UserID) ([]*models.Resourc
 // GetPopular returns the most popular resources
 // Demonstrates: slice sorting and limiting with loops
 func (s *LibraryService) GetPopular(limit int) ([]*models.Resource, error) {
-	all, err := s.store.GetAll()
+	all, err := s.resources.GetAll()
 	if err != nil {
 		return nil, err
 	}
@@ -121,7 +287,7 @@ func (s *LibraryService) GetPopular(limit int) ([]*models.Resource, error) {
 // GetRecent returns recently added resources
 // Demonstrates: range loop with index
 func (s *LibraryService) GetRecent(limit int) ([]*models.Resource, error) {
-	all, err := s.store.GetAll()
+	all, err := s.resources.GetAll()
 	if err != nil {
 		return nil, err
 	}
@@ -142,7 +308,7 @@ func (s *LibraryService) GetRecent(limit int) ([]*models.Resource, error) {
 
 // GetTopRated returns highest rated resources
 func (s *LibraryService) GetTopRated(limit int) ([]*models.Resource, error) {
-	all, err := s.store.GetAll()
+	all, err := s.resources.GetAll()
 	if err != nil {
 		return nil, err
 	}
@@ -170,31 +336,15 @@ func (s *LibraryService) GetTopRated(limit int) ([]*models.Resource, error) {
 }
 
 // FilterBySubject returns resources in a specific subject
-// Demonstrates: range loop with filtering
+// The storage layer looks the subject up in its index
 func (s *LibraryService) FilterBySubject(subject string) ([]*models.Resource, error) {
-	all, err := s.store.GetAll()
-	if err != nil {
-		return nil, err
-	}
-	
-	// GO CONCEPT 3: Building new slice with filtered elements
-	filtered := make([]*models.Resource, 0)
-	
-	// GO CONCEPT 2: Range loop - value only (ignoring index with _)
-	for _, resource := range all {
-		// GO CONCEPT 2: Control flow - if statement
-		if strings.EqualFold(resource.Subject, subject) {
-			filtered = append(filtered, resource)
-		}
-	}
-	
-	return filtered, nil
+	return s.resources.GetBySubject(subject)
 }
 
 // FilterByType returns resources of a specific type
 // Demonstrates: switch statement
 func (s *LibraryService) FilterByType(resourceType models.ResourceType) ([]*models.Resource, error) {
-	all, err := s.store.GetAll()
+	all, err := s.resources.GetAll()
 	if err != nil {
 		return nil, err
 	}
@@ -234,7 +384,7 @@ func (s *LibraryService) FilterByType(resourceType models.ResourceType) ([]*mode
 // FilterByRating returns resources above a minimum rating
 // Demonstrates: comparison operators in loops
 func (s *LibraryService) FilterByRating(minRating float64) ([]*models.Resource, error) {
-	all, err := s.store.GetAll()
+	all, err := s.resources.GetAll()
 	if err != nil {
 		return nil, err
 	}
@@ -257,7 +407,7 @@ func (s *LibraryService) FilterByRating(minRating float64) ([]*models.Resource,
 // SearchWithFilters performs filtered search
 // Demonstrates: multiple control flow constructs
 func (s *LibraryService) SearchWithFilters(query string, subject string, minRating float64, resourceType models.ResourceType) ([]*models.Resource, error) {
-	all, err := s.store.GetAll()
+	all, err := s.resources.GetAll()
 	if err != nil {
 		return nil, err
 	}
@@ -344,7 +494,7 @@ func validateResource(resource *models.Resource) error {
 
 // GetStatistics returns library statistics
 func (s *LibraryService) GetStatistics() (*LibraryStats, error) {
-	all, err := s.store.GetAll()
+	all, err := s.resources.GetAll()
 	if err != nil {
 		return nil, err
 	}
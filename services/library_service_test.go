@@ -2,162 +2,557 @@
 package services
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	
+	"p2p-library/errors"
+	"p2p-library/interfaces"
 	"p2p-library/models"
-	"p2p-library/store"
 )
 
-func setupLibraryTest() (*LibraryService, *UserService, *store.MemoryStore) {
-	memStore := store.NewMemoryStore()
-	userService := NewUserService(memStore)
-	libraryService := NewLibraryService(memStore, userService)
-	return libraryService, userService, memStore
+func setupLibraryTest(db interfaces.StorageBackend) (*LibraryService, *UserService, interfaces.ResourceStorage) {
+	userService := NewUserService(db)
+	libraryService := NewLibraryService(db, userService)
+	return libraryService, userService, db.Resources()
 }
 
 func TestUploadResource(t *testing.T) {
-	libService, userService, _ := setupLibraryTest()
-	
-	// Create a user
-	user, _ := userService.CreateUser("uploader", "up@test.com", "pass")
-	
-	// Create resource
-	resource := models.NewResource("test.pdf", 1024*1024, user.ID)
-	resource.Title = "Test Document"
-	resource.Subject = "Computer Science"
-	
-	err := libService.Upload(resource)
-	if err != nil {
-		t.Fatalf("Upload failed: %v", err)
-	}
-	
-	// Verify resource stored
-	got, err := libService.GetResource(resource.ID)
-	if err != nil {
-		t.Fatalf("GetResource failed: %v", err)
-	}
-	
-	if got.Title != "Test Document" {
-		t.Errorf("Title = %s; want Test Document", got.Title)
-	}
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		libService, userService, _ := setupLibraryTest(db)
+		
+		// Create a user
+		user, _ := userService.CreateUser("uploader", "up@test.com", "pass")
+		
+		// Create resource
+		resource := models.NewResource("test.pdf", 1024*1024, user.ID)
+		resource.Title = "Test Document"
+		resource.Subject = "Computer Science"
+		
+		err := libService.Upload(resource)
+		if err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+		
+		// Verify resource stored
+		got, err := libService.GetResource(resource.ID)
+		if err != nil {
+			t.Fatalf("GetResource failed: %v", err)
+		}
+		
+		if got.Title != "Test Document" {
+			t.Errorf("Title = %s; want Test Document", got.Title)
+		}
+	})
 }
 
 func TestDownloadResource(t *testing.T) {
-	libService, userService, _ := setupLibraryTest()
-	
-	uploader, _ := userService.CreateUser("uploader", "up@test.com", "pass")
-	downloader, _ := userService.CreateUser("downloader", "down@test.com", "pass")
-	
-	resource := models.NewResource("test.pdf", 1024, uploader.ID)
-	libService.Upload(resource)
-	
-	// Download
-	downloaded, err := libService.Download(resource.ID, downloader.ID)
-	if err != nil {
-		t.Fatalf("Download failed: %v", err)
-	}
-	
-	if downloaded.DownloadCount != 1 {
-		t.Errorf("DownloadCount = %d; want 1", downloaded.DownloadCount)
-	}
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		libService, userService, _ := setupLibraryTest(db)
+		
+		uploader, _ := userService.CreateUser("uploader", "up@test.com", "pass")
+		downloader, _ := userService.CreateUser("downloader", "down@test.com", "pass")
+		
+		resource := models.NewResource("test.pdf", 1024, uploader.ID)
+		libService.Upload(resource)
+		
+		// Download
+		downloaded, err := libService.Download(resource.ID, downloader.ID)
+		if err != nil {
+			t.Fatalf("Download failed: %v", err)
+		}
+		
+		if downloaded.DownloadCount != 1 {
+			t.Errorf("DownloadCount = %d; want 1", downloaded.DownloadCount)
+		}
+	})
 }
 
 func TestGetPopular(t *testing.T) {
-	libService, userService, _ := setupLibraryTest()
-	
-	user, _ := userService.CreateUser("user", "u@test.com", "pass")
-	
-	// Create resources
-	r1 := models.NewResource("pop1.pdf", 1024, user.ID)
-	r2 := models.NewResource("pop2.pdf", 1024, user.ID)
-	r3 := models.NewResource("pop3.pdf", 1024, user.ID)
-	
-	libService.Upload(r1)
-	libService.Upload(r2)
-	libService.Upload(r3)
-	
-	// Download r2 multiple times
-	for i := 0; i < 5; i++ {
-		libService.Download(r2.ID, user.ID)
-	}
-	// Download r1 once
-	libService.Download(r1.ID, user.ID)
-	
-	popular, err := libService.GetPopular(2)
-	if err != nil {
-		t.Fatalf("GetPopular failed: %v", err)
-	}
-	
-	if len(popular) != 2 {
-		t.Errorf("Got %d results; want 2", len(popular))
-	}
-	
-	// r2 should be first (most downloads)
-	if popular[0].ID != r2.ID {
-		t.Error("Most popular resource not first")
-	}
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		libService, userService, _ := setupLibraryTest(db)
+		
+		user, _ := userService.CreateUser("user", "u@test.com", "pass")
+		
+		// Create resources
+		r1 := models.NewResource("pop1.pdf", 1024, user.ID)
+		r2 := models.NewResource("pop2.pdf", 1024, user.ID)
+		r3 := models.NewResource("pop3.pdf", 1024, user.ID)
+		
+		libService.Upload(r1)
+		libService.Upload(r2)
+		libService.Upload(r3)
+		
+		// Download r2 multiple times
+		for i := 0; i < 5; i++ {
+			libService.Download(r2.ID, user.ID)
+		}
+		// Download r1 once
+		libService.Download(r1.ID, user.ID)
+		
+		popular, err := libService.GetPopular(2)
+		if err != nil {
+			t.Fatalf("GetPopular failed: %v", err)
+		}
+		
+		if len(popular) != 2 {
+			t.Errorf("Got %d results; want 2", len(popular))
+		}
+		
+		// r2 should be first (most downloads)
+		if popular[0].ID != r2.ID {
+			t.Error("Most popular resource not first")
+		}
+	})
 }
 
 func TestFilterBySubject(t *testing.T) {
-	libService, userService, _ := setupLibraryTest()
-	
-	user, _ := userService.CreateUser("user", "u@test.com", "pass")
-	
-	r1 := models.NewResource("math.pdf", 1024, user.ID)
-	r1.Subject = "Mathematics"
-	
-	r2 := models.NewResource("cs.pdf", 1024, user.ID)
-	r2.Subject = "Computer Science"
-	
-	r3 := models.NewResource("math2.pdf", 1024, user.ID)
-	r3.Subject = "Mathematics"
-	
-	libService.Upload(r1)
-	libService.Upload(r2)
-	libService.Upload(r3)
-	
-	mathResources, err := libService.FilterBySubject("Mathematics")
-	if err != nil {
-		t.Fatalf("FilterBySubject failed: %v", err)
-	}
-	
-	if len(mathResources) != 2 {
-		t.Errorf("Got %d resources; want 2", len(mathResources))
-	}
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		libService, userService, _ := setupLibraryTest(db)
+		
+		user, _ := userService.CreateUser("user", "u@test.com", "pass")
+		
+		r1 := models.NewResource("math.pdf", 1024, user.ID)
+		r1.Subject = "Mathematics"
+		
+		r2 := models.NewResource("cs.pdf", 1024, user.ID)
+		r2.Subject = "Computer Science"
+		
+		r3 := models.NewResource("math2.pdf", 1024, user.ID)
+		r3.Subject = "Mathematics"
+		
+		libService.Upload(r1)
+		libService.Upload(r2)
+		libService.Upload(r3)
+		
+		mathResources, err := libService.FilterBySubject("Mathematics")
+		if err != nil {
+			t.Fatalf("FilterBySubject failed: %v", err)
+		}
+		
+		if len(mathResources) != 2 {
+			t.Errorf("Got %d resources; want 2", len(mathResources))
+		}
+	})
 }
 
 func TestSearchWithFilters(t *testing.T) {
-	libService, userService, _ := setupLibraryTest()
-	
-	user, _ := userService.CreateUser("user", "u@test.com", "pass")
-	
-	r1 := models.NewResource("golang.pdf", 1024, user.ID)
-	r1.Title = "Go Programming"
-	r1.Subject = "Computer Science"
-	
-	r2 := models.NewResource("python.pdf", 1024, user.ID)
-	r2.Title = "Python Basics"
-	r2.Subject = "Computer Science"
-	
-	r3 := models.NewResource("calculus.pdf", 1024, user.ID)
-	r3.Title = "Calculus Fundamentals"
-	r3.Subject = "Mathematics"
-	
-	libService.Upload(r1)
-	libService.Upload(r2)
-	libService.Upload(r3)
-	
-	// Search for "go" in CS
-	results, err := libService.SearchWithFilters("go", "Computer Science", 0, "")
-	if err != nil {
-		t.Fatalf("Search failed: %v", err)
-	}
-	
-	if len(results) != 1 {
-		t.Errorf("Got %d results; want 1", len(results))
-	}
-	
-	if len(results) > 0 && results[0].ID != r1.ID {
-		t.Error("Wrong resource returned")
-	}
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		libService, userService, _ := setupLibraryTest(db)
+		
+		user, _ := userService.CreateUser("user", "u@test.com", "pass")
+		
+		r1 := models.NewResource("golang.pdf", 1024, user.ID)
+		r1.Title = "Go Programming"
+		r1.Subject = "Computer Science"
+		
+		r2 := models.NewResource("python.pdf", 1024, user.ID)
+		r2.Title = "Python Basics"
+		r2.Subject = "Computer Science"
+		
+		r3 := models.NewResource("calculus.pdf", 1024, user.ID)
+		r3.Title = "Calculus Fundamentals"
+		r3.Subject = "Mathematics"
+		
+		libService.Upload(r1)
+		libService.Upload(r2)
+		libService.Upload(r3)
+		
+		// Search for "go" in CS
+		results, err := libService.SearchWithFilters("go", "Computer Science", 0, "")
+		if err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		
+		if len(results) != 1 {
+			t.Errorf("Got %d results; want 1", len(results))
+		}
+		
+		if len(results) > 0 && results[0].ID != r1.ID {
+			t.Error("Wrong resource returned")
+		}
+	})
+}
+
+// fakeTransfer records calls instead of moving bytes between peers. Like
+// the real transfer it lists its node as a source of what it publishes
+// and fetches.
+type fakeTransfer struct {
+	node      models.PeerID
+	published map[models.ContentID][]byte
+	fetched   []models.ContentID
+}
+
+func newFakeTransfer() *fakeTransfer {
+	return &fakeTransfer{node: "peer-node", published: make(map[models.ContentID][]byte)}
+}
+
+func (f *fakeTransfer) Publish(resource *models.Resource, data []byte) error {
+	f.published[resource.ID] = data
+	resource.ChunkCount = models.ChunkCountFor(int64(len(data)))
+	resource.AddPeer(f.node)
+	return nil
+}
+
+func (f *fakeTransfer) Fetch(resource *models.Resource) error {
+	f.fetched = append(f.fetched, resource.ID)
+	resource.AddPeer(f.node)
+	return nil
+}
+
+func TestUploadContentAndDownload(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		libService, userService, _ := setupLibraryTest(db)
+		transfer := newFakeTransfer()
+		libService.SetTransfer(transfer)
+		
+		uploader, _ := userService.CreateUser("uploader", "up@test.com", "pass")
+		downloader, _ := userService.CreateUser("downloader", "down@test.com", "pass")
+		
+		data := make([]byte, 2*models.ChunkSize+1)
+		resource, err := libService.UploadContent(models.NewResource("lecture.pdf", 1, uploader.ID), data)
+		if err != nil {
+			t.Fatalf("UploadContent failed: %v", err)
+		}
+		
+		if resource.Size != int64(len(data)) {
+			t.Errorf("Size = %d; want %d", resource.Size, len(data))
+		}
+		if resource.ChunkCount != 3 {
+			t.Errorf("ChunkCount = %d; want 3", resource.ChunkCount)
+		}
+		
+		if _, err := libService.Download(resource.ID, downloader.ID); err != nil {
+			t.Fatalf("Download failed: %v", err)
+		}
+		if len(transfer.fetched) != 1 || transfer.fetched[0] != resource.ID {
+			t.Errorf("Fetched = %v; want [%s]", transfer.fetched, resource.ID)
+		}
+	})
+}
+
+func TestUploadContentDedupesIdenticalFiles(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		libService, userService, _ := setupLibraryTest(db)
+		libService.SetTransfer(newFakeTransfer())
+		
+		alice, _ := userService.CreateUser("alice", "alice@test.com", "pass")
+		bob, _ := userService.CreateUser("bob", "bob@test.com", "pass")
+		alice.PeerID = "peer-alice"
+		bob.PeerID = "peer-bob"
+		userService.UpdateUser(alice)
+		userService.UpdateUser(bob)
+		
+		data := []byte("the same lecture notes")
+		first, err := libService.UploadContent(models.NewResource("notes.pdf", 1, alice.ID), data)
+		if err != nil {
+			t.Fatalf("First upload failed: %v", err)
+		}
+		second, err := libService.UploadContent(models.NewResource("notes-copy.pdf", 1, bob.ID), data)
+		if err != nil {
+			t.Fatalf("Second upload failed: %v", err)
+		}
+		
+		if second.ID != first.ID || second.Filename != "notes.pdf" {
+			t.Errorf("Second upload got %s (%s); want the existing resource %s", second.ID, second.Filename, first.ID)
+		}
+		if first.ID != models.ComputeContentID(data) {
+			t.Errorf("ID = %s; want the content ID of the data", first.ID)
+		}
+		
+		all, _ := libService.GetRecent(10)
+		if len(all) != 1 {
+			t.Errorf("Library has %d resources; want 1", len(all))
+		}
+		
+		// Only the node the content was published on holds it, not the
+		// peers recorded for the uploaders
+		stored, _ := libService.GetResource(first.ID)
+		peers := stored.AvailableOn
+		if len(peers) != 1 || peers[0] != "peer-node" {
+			t.Errorf("AvailableOn = %v; want [peer-node]", peers)
+		}
+		
+		// Only the first upload counts towards the uploader's stats
+		bob, _ = userService.GetUser(bob.ID)
+		if bob.TotalUploads != 0 {
+			t.Errorf("Bob's TotalUploads = %d; want 0", bob.TotalUploads)
+		}
+	})
+}
+
+func TestUploadIsSignedByNodeIdentity(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		libService, userService, _ := setupLibraryTest(db)
+		identity, _ := models.NewIdentity()
+		libService.SetIdentity(identity)
+
+		user, _ := userService.CreateUser("signer", "sign@test.com", "pass")
+		resource := models.NewResource("signed.pdf", 1024, user.ID)
+		if err := libService.Upload(resource); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+
+		if resource.SignedBy != identity.PeerID() || !resource.VerifySignature() {
+			t.Errorf("Upload should be signed by %s", identity.PeerID())
+		}
+
+		// Changing who uploaded it breaks the signature
+		resource.UploadedBy = "someone-else"
+		if resource.VerifySignature() {
+			t.Error("Signature should not cover a different uploader")
+		}
+	})
+}
+
+func TestUploadRejectsForgedSignature(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		libService, userService, _ := setupLibraryTest(db)
+		alice, _ := models.NewIdentity()
+		mallory, _ := models.NewIdentity()
+
+		user, _ := userService.CreateUser("victim", "victim@test.com", "pass")
+		resource := models.NewResource("forged.pdf", 1024, user.ID)
+
+		// Mallory signs but claims the upload came from Alice's peer
+		resource.Sign(mallory)
+		resource.SignedBy = alice.PeerID()
+
+		err := libService.Upload(resource)
+		if !errors.Is(err, errors.ErrInvalidSignature) {
+			t.Fatalf("Upload error = %v; want ErrInvalidSignature", err)
+		}
+		if _, err := libService.GetResource(resource.ID); err == nil {
+			t.Error("Forged resource should not be stored")
+		}
+	})
+}
+
+func TestRateSignsAndVerifiesRatings(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		libService, userService, _ := setupLibraryTest(db)
+		identity, _ := models.NewIdentity()
+		libService.SetIdentity(identity)
+
+		user, _ := userService.CreateUser("rater", "rate@test.com", "pass")
+		resource := models.NewResource("rated.pdf", 1024, user.ID)
+		libService.Upload(resource)
+
+		rating := models.NewResourceRating(resource.ID, user.ID, 4, "useful")
+		updated, err := libService.Rate(rating)
+		if err != nil {
+			t.Fatalf("Rate failed: %v", err)
+		}
+		if updated.TotalRatings != 1 || updated.AverageRating != 4 {
+			t.Errorf("Resource ratings = %d avg %.1f; want 1 avg 4", updated.TotalRatings, updated.AverageRating)
+		}
+		if !rating.VerifySignature() {
+			t.Error("Rating should be signed by the node")
+		}
+
+		// A rating whose score was changed after signing is rejected
+		other, _ := userService.CreateUser("other", "other@test.com", "pass")
+		tampered := models.NewResourceRating(resource.ID, other.ID, 1, "")
+		tampered.Sign(identity)
+		tampered.Rating = 5
+		if _, err := libService.Rate(tampered); !errors.Is(err, errors.ErrInvalidSignature) {
+			t.Errorf("Rate(tampered) error = %v; want ErrInvalidSignature", err)
+		}
+
+		// Each user rates once
+		if _, err := libService.Rate(models.NewResourceRating(resource.ID, user.ID, 5, "")); err == nil {
+			t.Error("A second rating by the same user should be rejected")
+		}
+	})
+}
+
+func TestDownloadListsThisNodeAsSource(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		libService, userService, store := setupLibraryTest(db)
+		libService.SetTransfer(newFakeTransfer())
+		
+		uploader, _ := userService.CreateUser("uploader", "up@test.com", "pass")
+		downloader, _ := userService.CreateUser("downloader", "down@test.com", "pass")
+		downloader.PeerID = "peer-downloader"
+		userService.UpdateUser(downloader)
+		
+		// The content is on another peer so far
+		resource := models.NewResource("notes.pdf", 1024, uploader.ID)
+		resource.AddPeer("peer-seeder")
+		if err := libService.Upload(resource); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+		if _, err := libService.Download(resource.ID, downloader.ID); err != nil {
+			t.Fatalf("Download failed: %v", err)
+		}
+		
+		// The node that fetched it is a source now; the peer recorded for
+		// the downloading user never got the bytes
+		stored, _ := store.Get(resource.ID)
+		peers := stored.AvailableOn
+		if len(peers) != 2 || peers[0] != "peer-seeder" || peers[1] != "peer-node" {
+			t.Errorf("AvailableOn = %v; want [peer-seeder peer-node]", peers)
+		}
+		if stored.DownloadCount != 1 {
+			t.Errorf("DownloadCount = %d; want 1", stored.DownloadCount)
+		}
+	})
+}
+
+func TestConcurrentDownloadsAndRatings(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		libService, userService, _ := setupLibraryTest(db)
+		
+		uploader, _ := userService.CreateUser("uploader", "up@test.com", "pass")
+		resource := models.NewResource("popular.pdf", 1024, uploader.ID)
+		resource.Tags = []string{"exam"}
+		libService.Upload(resource)
+		
+		const readers, downloadsEach = 20, 5
+		var users []*models.User
+		for i := 0; i < readers; i++ {
+			user, _ := userService.CreateUser(fmt.Sprintf("reader-%d", i), fmt.Sprintf("r%d@test.com", i), "pass")
+			users = append(users, user)
+		}
+		
+		// Every goroutine works on its own copy, so mutating what the
+		// service returns must not race with the other writers
+		var wg sync.WaitGroup
+		for _, user := range users {
+			wg.Add(1)
+			go func(user *models.User) {
+				defer wg.Done()
+				for i := 0; i < downloadsEach; i++ {
+					got, err := libService.Download(resource.ID, user.ID)
+					if err != nil {
+						t.Errorf("Download failed: %v", err)
+						return
+					}
+					got.Tags = append(got.Tags, "seen")
+				}
+				rated, err := libService.Rate(models.NewResourceRating(resource.ID, user.ID, 4, ""))
+				if err != nil {
+					t.Errorf("Rate failed: %v", err)
+					return
+				}
+				rated.Title = "changed locally"
+			}(user)
+		}
+		wg.Wait()
+		
+		got, _ := libService.GetResource(resource.ID)
+		if got.DownloadCount != readers*downloadsEach {
+			t.Errorf("DownloadCount = %d; want %d", got.DownloadCount, readers*downloadsEach)
+		}
+		if got.TotalRatings != readers || got.AverageRating != 4 {
+			t.Errorf("Ratings = %d avg %.1f; want %d avg 4", got.TotalRatings, got.AverageRating, readers)
+		}
+		if len(got.Tags) != 1 || got.Title != "" {
+			t.Errorf("Stored resource = tags %v title %q; want local changes kept out of the store", got.Tags, got.Title)
+		}
+		for _, user := range users {
+			if stored, _ := userService.GetUser(user.ID); stored.TotalDownloads != downloadsEach {
+				t.Errorf("%s has %d downloads; want %d", user.Username, stored.TotalDownloads, downloadsEach)
+			}
+		}
+	})
+}
+
+func TestUpdateResourceRejectsStaleVersion(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		libService, userService, _ := setupLibraryTest(db)
+		
+		user, _ := userService.CreateUser("editor", "edit@test.com", "pass")
+		libService.Upload(models.NewResource("notes.pdf", 1024, user.ID))
+		resources, _ := libService.GetUserLibrary(user.ID)
+		
+		edit := resources[0]
+		edit.Title = "Lecture notes"
+		if _, err := libService.Download(edit.ID, user.ID); err != nil {
+			t.Fatalf("Download failed: %v", err)
+		}
+		
+		// The download was stored after edit was read
+		if err := libService.UpdateResource(edit); !errors.IsConflict(err) {
+			t.Fatalf("UpdateResource error = %v; want a ConflictError", err)
+		}
+		
+		fresh, _ := libService.GetResource(edit.ID)
+		fresh.Title = "Lecture notes"
+		if err := libService.UpdateResource(fresh); err != nil {
+			t.Fatalf("UpdateResource of a fresh copy failed: %v", err)
+		}
+		stored, _ := libService.GetResource(edit.ID)
+		if stored.Title != "Lecture notes" || stored.DownloadCount != 1 || stored.Version != fresh.Version {
+			t.Errorf("Stored resource = %q, %d downloads, version %d; want the edit, the download and version %d",
+				stored.Title, stored.DownloadCount, stored.Version, fresh.Version)
+		}
+	})
+}
+
+// failingUpdates is a backend whose transactions cannot update resources
+type failingUpdates struct{ interfaces.StorageBackend }
+
+func (b failingUpdates) RunInTx(fn func(tx interfaces.Tx) error) error {
+	return b.StorageBackend.RunInTx(func(tx interfaces.Tx) error {
+		return fn(failingTx{tx})
+	})
+}
+
+type failingTx struct{ interfaces.Tx }
+
+func (tx failingTx) Resources() interfaces.ResourceStorage {
+	return failingResources{tx.Tx.Resources()}
+}
+
+type failingResources struct{ interfaces.ResourceStorage }
+
+func (failingResources) UpdateResource(models.ContentID, func(*models.Resource) error) error {
+	return errors.NewOperationError("UpdateResource", "simulated failure", nil)
+}
+
+func TestUploadAndDownloadAreAtomic(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		libService, userService, store := setupLibraryTest(db)
+		
+		// Crediting an unknown uploader fails, so nothing is stored
+		orphan := models.NewResource("orphan.pdf", 1024, "user-missing")
+		if err := libService.Upload(orphan); err == nil {
+			t.Fatal("Upload by an unknown user succeeded")
+		}
+		if _, err := store.Get(orphan.ID); err == nil {
+			t.Error("Resource of the failed upload was stored")
+		}
+		
+		// Counting a download for an unknown user fails, so the count stays
+		user, _ := userService.CreateUser("uploader", "up@test.com", "pass")
+		notes := models.NewResource("notes.pdf", 1024, user.ID)
+		libService.Upload(notes)
+		if _, err := libService.Download(notes.ID, "user-missing"); !errors.IsNotFound(err) {
+			t.Errorf("Download by an unknown user error = %v; want NotFound", err)
+		}
+		if stored, _ := store.Get(notes.ID); stored.DownloadCount != 0 {
+			t.Errorf("DownloadCount = %d after the failed download; want 0", stored.DownloadCount)
+		}
+	})
+}
+
+func TestRateIsAtomic(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		userService := NewUserService(db)
+		libService := NewLibraryService(failingUpdates{db}, userService)
+		
+		user, _ := userService.CreateUser("rater", "rate@test.com", "pass")
+		resource := models.NewResource("rated.pdf", 1024, user.ID)
+		if err := libService.Upload(resource); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+		
+		if _, err := libService.Rate(models.NewResourceRating(resource.ID, user.ID, 4, "")); err == nil {
+			t.Fatal("Rate succeeded although the resource could not be updated")
+		}
+		if ratings, _ := db.Ratings().GetByResource(resource.ID); len(ratings) != 0 {
+			t.Errorf("%d ratings stored by the failed Rate; want 0", len(ratings))
+		}
+	})
 }
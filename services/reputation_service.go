@@ -9,9 +9,11 @@
 package services
 
 import (
+	"time"
+	
 	"p2p-library/errors"
+	"p2p-library/interfaces"
 	"p2p-library/models"
-	"p2p-library/store"
 )
 
 // ============================================================================
@@ -20,25 +22,42 @@ import (
 
 // ReputationService handles reputation-related operations
 type ReputationService struct {
-	store *store.MemoryStore
+	db        interfaces.StorageBackend
+	users     interfaces.UserStorage
+	transfers interfaces.TransferStorage
 }
 
-// NewReputationService creates a new ReputationService
-func NewReputationService(store *store.MemoryStore) *ReputationService {
-	return &ReputationService{store: store}
+// NewReputationService creates a new ReputationService. The backend
+// is needed so ledger entries and the credit they give are stored in
+// one transaction.
+func NewReputationService(db interfaces.StorageBackend) *ReputationService {
+	return &ReputationService{db: db, users: db.Users(), transfers: db.Transfers()}
 }
 
 // ============================================================================
 // GO CONCEPT 2: CONTROL FLOW - REPUTATION CALCULATION
 // ============================================================================
 
-// CalculateReputation computes a user's reputation score
-// Formula: (Uploads × 2) - Downloads + (AvgRating × 10)
-// This is a pure function demonstrating calculation logic
-func CalculateReputation(uploads, downloads int, avgRating float64) int {
+// ReputationFactors are the inputs to the reputation formula. Byte
+// totals come from the transfer ledger, so how much a user moves counts
+// as well as how many files.
+type ReputationFactors struct {
+	Uploads       int
+	Downloads     int
+	BytesServed   int64
+	BytesReceived int64
+	AverageRating float64
+}
+
+// Score applies the reputation formula
+// Formula: (Uploads + BytesServed/10MB) × 2 - (Downloads + BytesReceived/10MB) + (AvgRating × 10)
+func (f ReputationFactors) Score() int {
+	uploads := f.Uploads + int(f.BytesServed/models.BytesPerUpload)
+	downloads := f.Downloads + int(f.BytesReceived/models.BytesPerUpload)
+	
 	uploadScore := uploads * models.UploadWeight      // Uploads count double
 	downloadPenalty := downloads * models.DownloadWeight // Downloads subtract
-	ratingBonus := int(avgRating * float64(models.RatingWeight)) // Rating bonus
+	ratingBonus := int(f.AverageRating * float64(models.RatingWeight)) // Rating bonus
 	
 	score := uploadScore - downloadPenalty + ratingBonus
 	
@@ -50,6 +69,17 @@ func CalculateReputation(uploads, downloads int, avgRating float64) int {
 	return score
 }
 
+// CalculateReputation computes a reputation score from counts alone
+// Formula: (Uploads × 2) - Downloads + (AvgRating × 10)
+// This is a pure function demonstrating calculation logic
+func CalculateReputation(uploads, downloads int, avgRating float64) int {
+	return ReputationFactors{
+		Uploads:       uploads,
+		Downloads:     downloads,
+		AverageRating: avgRating,
+	}.Score()
+}
+
 // GetClassification returns the classification for a score
 // GO CONCEPT 2: Switch statement for classification
 func GetClassificationForScore(score int) models.UserClassification {
@@ -85,40 +115,49 @@ func GetThrottleMultiplier(classification models.UserClassification) float64 {
 
 // Calculate computes and returns the reputation score for a user
 func (s *ReputationService) Calculate(userID models.UserID) (models.ReputationScore, error) {
-	user, err := s.store.GetUser(userID)
+	user, err := s.users.Get(userID)
 	if err != nil {
 		return 0, err
 	}
 	
-	score := CalculateReputation(
-		user.TotalUploads,
-		user.TotalDownloads,
-		user.AverageRating,
-	)
+	return models.ReputationScore(userScore(user)), nil
+}
+
+// userScore computes a user's reputation including penalties for
+// serving chunks that failed verification
+func userScore(user *models.User) int {
+	score := ReputationFactors{
+		Uploads:       user.TotalUploads + user.SeedCredit(),
+		Downloads:     user.TotalDownloads,
+		BytesServed:   user.BytesServed,
+		BytesReceived: user.BytesReceived,
+		AverageRating: user.AverageRating,
+	}.Score()
 	
-	return models.ReputationScore(score), nil
+	score -= user.BadChunks * models.MisbehaviorWeight
+	if score < models.LowReputation {
+		return models.LowReputation
+	}
+	return score
 }
 
 // RecalculateAll recalculates reputation for all users
 // GO CONCEPT 2: Loop through all users
 func (s *ReputationService) RecalculateAll() error {
-	users, err := s.store.GetAllUsers()
+	users, err := s.users.GetAll()
 	if err != nil {
 		return err
 	}
 	
 	// GO CONCEPT 2: Range loop
 	for _, user := range users {
-		score := CalculateReputation(
-			user.TotalUploads,
-			user.TotalDownloads,
-			user.AverageRating,
-		)
-		
-		user.Reputation = models.ReputationScore(score)
-		user.Classification = GetClassificationForScore(score)
-		
-		if err := s.store.UpdateUser(user); err != nil {
+		err := s.users.UpdateUser(user.ID, func(user *models.User) error {
+			score := userScore(user)
+			user.Reputation = models.ReputationScore(score)
+			user.Classification = GetClassificationForScore(score)
+			return nil
+		})
+		if err != nil {
 			// Continue with next user even if one fails
 			continue
 		}
@@ -127,9 +166,143 @@ func (s *ReputationService) RecalculateAll() error {
 	return nil
 }
 
+// RecordMisbehavior penalizes a user whose peer served a chunk that
+// failed verification and updates their classification immediately
+func (s *ReputationService) RecordMisbehavior(userID models.UserID) error {
+	return s.users.UpdateUser(userID, func(user *models.User) error {
+		user.BadChunks++
+		UpdateReputationByPointer(user, -models.MisbehaviorWeight)
+		return nil
+	})
+}
+
+// RecordSeeding credits a user for the time their peer spent seeding.
+// Every SeedHoursPerUpload hours seeded are worth one upload.
+func (s *ReputationService) RecordSeeding(userID models.UserID, seeded time.Duration) error {
+	if seeded < 0 {
+		return errors.NewValidationError("seeded", "seeding time cannot be negative")
+	}
+	
+	return s.adjust(userID, func(user *models.User) {
+		user.SeedingSeconds += int64(seeded / time.Second)
+	})
+}
+
+// ValidateReceipt checks that a transfer record is backed by a receipt
+// that can be credited: signed by the receiving peer, not crediting the
+// signer's own user, naming only users bound to the peers that moved the
+// bytes, and not seen before
+func (s *ReputationService) ValidateReceipt(record *models.TransferRecord) error {
+	if !record.IsValid() {
+		return errors.NewValidationError("transfer", "transfer must move bytes between two peers")
+	}
+	if !record.HasReceipt() {
+		return errors.NewOperationError("ValidateReceipt", "transfer has no receipt", errors.ErrInvalidReceipt)
+	}
+	if record.ServerUser != "" && record.ServerUser == record.ReceiverUser {
+		return errors.NewOperationError("ValidateReceipt", "receiver signed for its own user", errors.ErrSelfReceipt)
+	}
+	if !record.VerifyReceipt() {
+		return errors.NewOperationError("ValidateReceipt", "receipt is not signed by the receiving peer", errors.ErrInvalidSignature)
+	}
+	if err := s.checkBound(record.ServerUser, record.ServedBy); err != nil {
+		return err
+	}
+	if err := s.checkBound(record.ReceiverUser, record.ReceivedBy); err != nil {
+		return err
+	}
+	
+	if s.transfers.Has(record.ID) {
+		return errors.NewOperationError("ValidateReceipt", "receipt "+record.ID+" was already credited", errors.ErrReceiptReplayed)
+	}
+	return nil
+}
+
+// RecordTransfer adds a completed chunk transfer to the ledger and moves
+// both users' reputation by what the bytes are worth, all in one
+// transaction: if either user can't be credited, the transfer isn't
+// recorded either. Only transfers with a valid receipt are recorded.
+// Peers without a known user are kept in the ledger but credit nobody.
+func (s *ReputationService) RecordTransfer(record *models.TransferRecord) error {
+	if err := s.ValidateReceipt(record); err != nil {
+		return err
+	}
+	
+	return s.db.RunInTx(func(tx interfaces.Tx) error {
+		if err := tx.Transfers().Add(record); err != nil {
+			if errors.Is(err, errors.ErrAlreadyExists) {
+				return errors.NewOperationError("RecordTransfer", "receipt was already credited", errors.ErrReceiptReplayed)
+			}
+			return errors.NewOperationError("RecordTransfer", "failed to store transfer", err)
+		}
+		
+		inTx := &ReputationService{users: tx.Users(), transfers: tx.Transfers()}
+		if err := inTx.credit(record.ServerUser, func(user *models.User) {
+			user.BytesServed += record.Bytes
+		}); err != nil {
+			return errors.NewOperationError("RecordTransfer", "failed to credit the serving user", err)
+		}
+		if err := inTx.credit(record.ReceiverUser, func(user *models.User) {
+			user.BytesReceived += record.Bytes
+		}); err != nil {
+			return errors.NewOperationError("RecordTransfer", "failed to charge the receiving user", err)
+		}
+		return nil
+	})
+}
+
+// credit adjusts a transfer party's statistics. Parties with no user, or
+// a user this library doesn't know, are skipped.
+func (s *ReputationService) credit(userID models.UserID, change func(user *models.User)) error {
+	if userID == "" {
+		return nil
+	}
+	if err := s.adjust(userID, change); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// checkBound refuses a user named in a transfer unless the user's record
+// binds it to the peer the transfer names. Empty and unknown users pass:
+// credit skips them.
+func (s *ReputationService) checkBound(userID models.UserID, peerID models.PeerID) error {
+	if userID == "" {
+		return nil
+	}
+	user, err := s.users.Get(userID)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.PeerID != peerID {
+		return errors.NewOperationError("ValidateReceipt",
+			"user "+string(userID)+" is not bound to peer "+string(peerID), errors.ErrUnboundUser)
+	}
+	return nil
+}
+
+// GetTransfers returns the ledger entries a user served or received
+func (s *ReputationService) GetTransfers(userID models.UserID) ([]*models.TransferRecord, error) {
+	return s.transfers.GetByUser(userID)
+}
+
+// adjust applies a change to a user's statistics and moves their
+// reputation by the difference it makes to their score
+func (s *ReputationService) adjust(userID models.UserID, change func(user *models.User)) error {
+	return s.users.UpdateUser(userID, func(user *models.User) error {
+		before := userScore(user)
+		change(user)
+		UpdateReputationByPointer(user, userScore(user)-before)
+		return nil
+	})
+}
+
 // GetUserReputation returns reputation info for a user
 func (s *ReputationService) GetUserReputation(userID models.UserID) (*ReputationInfo, error) {
-	user, err := s.store.GetUser(userID)
+	user, err := s.users.Get(userID)
 	if err != nil {
 		return nil, err
 	}
@@ -141,6 +314,9 @@ func (s *ReputationService) GetUserReputation(userID models.UserID) (*Reputation
 		Uploads:        user.TotalUploads,
 		Downloads:      user.TotalDownloads,
 		AverageRating:  user.AverageRating,
+		BytesServed:    user.BytesServed,
+		BytesReceived:  user.BytesReceived,
+		SeedingSeconds: user.SeedingSeconds,
 		Throttle:       GetThrottleMultiplier(user.Classification),
 	}, nil
 }
@@ -148,7 +324,7 @@ func (s *ReputationService) GetUserReputation(userID models.UserID) (*Reputation
 // CheckAccessAllowed checks if user has sufficient reputation for an action
 // GO CONCEPT 2: Control flow with error handling
 func (s *ReputationService) CheckAccessAllowed(userID models.UserID, requiredScore int) error {
-	user, err := s.store.GetUser(userID)
+	user, err := s.users.Get(userID)
 	if err != nil {
 		return err
 	}
@@ -168,7 +344,7 @@ func (s *ReputationService) CheckAccessAllowed(userID models.UserID, requiredSco
 
 // GetThrottleSpeed returns download speed for a user
 func (s *ReputationService) GetThrottleSpeed(userID models.UserID) (float64, error) {
-	user, err := s.store.GetUser(userID)
+	user, err := s.users.Get(userID)
 	if err != nil {
 		return 0, err
 	}
@@ -182,7 +358,7 @@ func (s *ReputationService) GetThrottleSpeed(userID models.UserID) (float64, err
 
 // GetNetworkStats returns network-wide reputation statistics
 func (s *ReputationService) GetNetworkStats() (*NetworkStats, error) {
-	users, err := s.store.GetAllUsers()
+	users, err := s.users.GetAll()
 	if err != nil {
 		return nil, err
 	}
@@ -231,6 +407,9 @@ type ReputationInfo struct {
 	Uploads        int                       `json:"uploads"`
 	Downloads      int                       `json:"downloads"`
 	AverageRating  float64                   `json:"average_rating"`
+	BytesServed    int64                     `json:"bytes_served"`
+	BytesReceived  int64                     `json:"bytes_received"`
+	SeedingSeconds int64                     `json:"seeding_seconds"`
 	Throttle       float64                   `json:"throttle"`
 }
 
@@ -3,16 +3,42 @@ package services
 
 import (
 	"testing"
+	"time"
 	
+	"p2p-library/errors"
+	"p2p-library/interfaces"
 	"p2p-library/models"
-	"p2p-library/store"
 )
 
-func setupReputationTest() (*ReputationService, *UserService, *store.MemoryStore) {
-	memStore := store.NewMemoryStore()
-	userService := NewUserService(memStore)
-	repService := NewReputationService(memStore)
-	return repService, userService, memStore
+func setupReputationTest(db interfaces.StorageBackend) (*ReputationService, *UserService, interfaces.TransferStorage) {
+	userService := NewUserService(db)
+	repService := NewReputationService(db)
+	return repService, userService, db.Transfers()
+}
+
+// receipt returns a transfer of one chunk from server to the holder of
+// receiverKey, signed by receiverKey
+func receipt(receiverKey *models.Identity, server models.PeerID, serverUser, receiverUser models.UserID, index int, bytes int64) *models.TransferRecord {
+	record := models.NewTransferRecord("cid-lecture", index, bytes, server, receiverKey.PeerID())
+	record.ServerUser = serverUser
+	record.ReceiverUser = receiverUser
+	record.SignReceipt(receiverKey)
+	return record
+}
+
+// boundUser creates a user bound to peerID, as the user's own node does
+func boundUser(t *testing.T, userService *UserService, name string, peerID models.PeerID) *models.User {
+	t.Helper()
+	
+	user, err := userService.CreateUser(name, name+"@test.com", "pass")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if err := userService.BindPeer(user.ID, peerID); err != nil {
+		t.Fatalf("BindPeer failed: %v", err)
+	}
+	user.PeerID = peerID
+	return user
 }
 
 func TestGetClassificationForScore(t *testing.T) {
@@ -58,88 +84,354 @@ func TestGetThrottleMultiplier(t *testing.T) {
 }
 
 func TestCalculateUserReputation(t *testing.T) {
-	repService, userService, _ := setupReputationTest()
-	
-	user, _ := userService.CreateUser("user", "u@test.com", "pass")
-	
-	// Initial reputation
-	score, err := repService.Calculate(user.ID)
-	if err != nil {
-		t.Fatalf("Calculate failed: %v", err)
-	}
-	
-	if score != 0 {
-		t.Errorf("Initial score = %d; want 0", score)
-	}
-	
-	// Add uploads
-	for i := 0; i < 5; i++ {
-		userService.RecordUpload(user.ID)
-	}
-	
-	score, _ = repService.Calculate(user.ID)
-	if score <= 0 {
-		t.Errorf("Score after uploads should be positive: %d", score)
-	}
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		repService, userService, _ := setupReputationTest(db)
+		
+		user, _ := userService.CreateUser("user", "u@test.com", "pass")
+		
+		// Initial reputation
+		score, err := repService.Calculate(user.ID)
+		if err != nil {
+			t.Fatalf("Calculate failed: %v", err)
+		}
+		
+		if score != 0 {
+			t.Errorf("Initial score = %d; want 0", score)
+		}
+		
+		// Add uploads
+		for i := 0; i < 5; i++ {
+			userService.RecordUpload(user.ID)
+		}
+		
+		score, _ = repService.Calculate(user.ID)
+		if score <= 0 {
+			t.Errorf("Score after uploads should be positive: %d", score)
+		}
+	})
 }
 
 func TestGetUserReputation(t *testing.T) {
-	repService, userService, _ := setupReputationTest()
-	
-	user, _ := userService.CreateUser("user", "u@test.com", "pass")
-	
-	// Add activity
-	for i := 0; i < 30; i++ {
-		userService.RecordUpload(user.ID)
-	}
-	
-	info, err := repService.GetUserReputation(user.ID)
-	if err != nil {
-		t.Fatalf("GetUserReputation failed: %v", err)
-	}
-	
-	if info.Uploads != 30 {
-		t.Errorf("Uploads = %d; want 30", info.Uploads)
-	}
-	
-	if info.Classification != models.ClassContributor {
-		t.Errorf("Classification = %s; want Contributor", info.Classification)
-	}
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		repService, userService, _ := setupReputationTest(db)
+		
+		user, _ := userService.CreateUser("user", "u@test.com", "pass")
+		
+		// Add activity
+		for i := 0; i < 30; i++ {
+			userService.RecordUpload(user.ID)
+		}
+		
+		info, err := repService.GetUserReputation(user.ID)
+		if err != nil {
+			t.Fatalf("GetUserReputation failed: %v", err)
+		}
+		
+		if info.Uploads != 30 {
+			t.Errorf("Uploads = %d; want 30", info.Uploads)
+		}
+		
+		if info.Classification != models.ClassContributor {
+			t.Errorf("Classification = %s; want Contributor", info.Classification)
+		}
+	})
+}
+
+func TestRecordMisbehavior(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		repService, userService, _ := setupReputationTest(db)
+		
+		user, _ := userService.CreateUser("user", "u@test.com", "pass")
+		for i := 0; i < 30; i++ {
+			userService.RecordUpload(user.ID)
+		}
+		
+		// Two bad chunks take a Contributor (score 60) down to Neutral
+		for i := 0; i < 2; i++ {
+			if err := repService.RecordMisbehavior(user.ID); err != nil {
+				t.Fatalf("RecordMisbehavior failed: %v", err)
+			}
+		}
+		
+		info, _ := repService.GetUserReputation(user.ID)
+		if info.Score != 40 {
+			t.Errorf("Score = %d; want 40", info.Score)
+		}
+		if info.Classification != models.ClassNeutral {
+			t.Errorf("Classification = %s; want Neutral", info.Classification)
+		}
+		
+		// The penalty survives a full recalculation
+		repService.RecalculateAll()
+		if score, _ := repService.Calculate(user.ID); score != 40 {
+			t.Errorf("Score after RecalculateAll = %d; want 40", score)
+		}
+	})
+}
+
+func TestRecordSeedingCountsAsUploads(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		repService, userService, _ := setupReputationTest(db)
+		
+		user, _ := userService.CreateUser("seeder", "s@test.com", "pass")
+		
+		// Two days of seeding are worth two uploads
+		if err := repService.RecordSeeding(user.ID, 36*time.Hour); err != nil {
+			t.Fatalf("RecordSeeding failed: %v", err)
+		}
+		if err := repService.RecordSeeding(user.ID, 12*time.Hour); err != nil {
+			t.Fatalf("RecordSeeding failed: %v", err)
+		}
+		
+		info, _ := repService.GetUserReputation(user.ID)
+		if info.SeedingSeconds != 48*3600 {
+			t.Errorf("SeedingSeconds = %d; want %d", info.SeedingSeconds, 48*3600)
+		}
+		want := models.ReputationScore(2 * models.UploadWeight)
+		if info.Score != want {
+			t.Errorf("Score = %d; want %d", info.Score, want)
+		}
+		
+		// A full recalculation arrives at the same score
+		if score, _ := repService.Calculate(user.ID); score != want {
+			t.Errorf("Calculate = %d; want %d", score, want)
+		}
+		
+		if err := repService.RecordSeeding(user.ID, -time.Hour); !errors.IsValidationError(err) {
+			t.Errorf("Negative seeding: err = %v; want validation error", err)
+		}
+	})
+}
+
+func TestRecordTransferCreditsBothSides(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		repService, userService, transfers := setupReputationTest(db)
+		
+		receiverKey, _ := models.NewIdentity()
+		server := boundUser(t, userService, "server", "peer-server")
+		receiver := boundUser(t, userService, "receiver", receiverKey.PeerID())
+		
+		// 25 chunks of 1MB: 2 units of 10MB served and received
+		for i := 0; i < 25; i++ {
+			record := receipt(receiverKey, "peer-server", server.ID, receiver.ID, i, models.ChunkSize)
+			if err := repService.RecordTransfer(record); err != nil {
+				t.Fatalf("RecordTransfer failed: %v", err)
+			}
+		}
+		
+		serverInfo, _ := repService.GetUserReputation(server.ID)
+		if serverInfo.BytesServed != 25*models.ChunkSize {
+			t.Errorf("BytesServed = %d; want %d", serverInfo.BytesServed, 25*models.ChunkSize)
+		}
+		if serverInfo.Score != 2*models.UploadWeight {
+			t.Errorf("Server score = %d; want %d", serverInfo.Score, 2*models.UploadWeight)
+		}
+		receiverInfo, _ := repService.GetUserReputation(receiver.ID)
+		if receiverInfo.BytesReceived != 25*models.ChunkSize {
+			t.Errorf("BytesReceived = %d; want %d", receiverInfo.BytesReceived, 25*models.ChunkSize)
+		}
+		if receiverInfo.Score != -2*models.DownloadWeight {
+			t.Errorf("Receiver score = %d; want %d", receiverInfo.Score, -2*models.DownloadWeight)
+		}
+		
+		ledger, _ := repService.GetTransfers(server.ID)
+		if len(ledger) != 25 || ledger[0].ChunkIndex != 0 || ledger[24].ChunkIndex != 24 {
+			t.Errorf("Ledger has %d entries; want 25 in order", len(ledger))
+		}
+		
+		all, _ := transfers.GetAll()
+		if len(all) != 25 {
+			t.Errorf("Store has %d transfers; want 25", len(all))
+		}
+	})
+}
+
+func TestRecordTransferRejectsBadReceipts(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		repService, userService, _ := setupReputationTest(db)
+		
+		receiverKey, _ := models.NewIdentity()
+		serverKey, _ := models.NewIdentity()
+		server := boundUser(t, userService, "server", serverKey.PeerID())
+		receiver := boundUser(t, userService, "receiver", receiverKey.PeerID())
+		third := boundUser(t, userService, "third", "peer-third")
+		
+		good := receipt(receiverKey, serverKey.PeerID(), server.ID, receiver.ID, 0, models.ChunkSize)
+		if err := repService.RecordTransfer(good); err != nil {
+			t.Fatalf("RecordTransfer with a valid receipt failed: %v", err)
+		}
+		
+		unsigned := models.NewTransferRecord("cid-lecture", 1, models.ChunkSize, serverKey.PeerID(), receiverKey.PeerID())
+		unsigned.ServerUser = server.ID
+		
+		// The server signs in the receiver's name
+		forged := models.NewTransferRecord("cid-lecture", 2, models.ChunkSize, serverKey.PeerID(), receiverKey.PeerID())
+		forged.ServerUser = server.ID
+		forged.SignReceipt(serverKey)
+		
+		// A valid receipt inflated after signing
+		inflated := receipt(receiverKey, serverKey.PeerID(), server.ID, receiver.ID, 3, models.ChunkSize)
+		inflated.Bytes *= 100
+		
+		// The server's own key plays the receiver for its own user
+		selfSigned := receipt(serverKey, "peer-other", server.ID, server.ID, 4, models.ChunkSize)
+		
+		// The receiver charges a third user for what it received
+		chargingThird := receipt(receiverKey, serverKey.PeerID(), server.ID, third.ID, 6, models.ChunkSize)
+		
+		// Another peer serves the chunk and claims the server's user
+		claimingServer := receipt(receiverKey, "peer-third", server.ID, receiver.ID, 7, models.ChunkSize)
+		
+		// A transfer from a peer to itself
+		toItself := receipt(serverKey, serverKey.PeerID(), server.ID, receiver.ID, 5, models.ChunkSize)
+		
+		replayed := *good
+		
+		tests := []struct {
+			name   string
+			record *models.TransferRecord
+			want   error
+		}{
+			{"unsigned", unsigned, errors.ErrInvalidReceipt},
+			{"forged", forged, errors.ErrInvalidSignature},
+			{"inflated", inflated, errors.ErrInvalidSignature},
+			{"self-signed", selfSigned, errors.ErrSelfReceipt},
+			{"replayed", &replayed, errors.ErrReceiptReplayed},
+			{"charging a third user", chargingThird, errors.ErrUnboundUser},
+			{"claiming the server's user", claimingServer, errors.ErrUnboundUser},
+		}
+		for _, tt := range tests {
+			if err := repService.RecordTransfer(tt.record); !errors.Is(err, tt.want) {
+				t.Errorf("%s receipt: err = %v; want %v", tt.name, err, tt.want)
+			}
+		}
+		if err := repService.RecordTransfer(toItself); !errors.IsValidationError(err) {
+			t.Errorf("Transfer to itself: err = %v; want validation error", err)
+		}
+		
+		// Only the one valid receipt was credited
+		info, _ := repService.GetUserReputation(server.ID)
+		if info.BytesServed != models.ChunkSize {
+			t.Errorf("BytesServed = %d; want %d", info.BytesServed, models.ChunkSize)
+		}
+	})
+}
+
+// failingCredits is a backend whose transactions can't update users
+type failingCredits struct{ interfaces.StorageBackend }
+
+type failingCreditsTx struct{ interfaces.Tx }
+
+type failingUsers struct{ interfaces.UserStorage }
+
+func (b failingCredits) RunInTx(fn func(tx interfaces.Tx) error) error {
+	return b.StorageBackend.RunInTx(func(tx interfaces.Tx) error { return fn(failingCreditsTx{tx}) })
+}
+
+func (tx failingCreditsTx) Users() interfaces.UserStorage { return failingUsers{tx.Tx.Users()} }
+
+func (u failingUsers) UpdateUser(id models.UserID, change func(*models.User) error) error {
+	return errors.ErrInvalidInput
+}
+
+func TestRecordTransferIsAllOrNothing(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		repService := NewReputationService(failingCredits{db})
+		userService := NewUserService(db)
+		
+		receiverKey, _ := models.NewIdentity()
+		server := boundUser(t, userService, "server", "peer-server")
+		receiver := boundUser(t, userService, "receiver", receiverKey.PeerID())
+		
+		record := receipt(receiverKey, "peer-server", server.ID, receiver.ID, 0, models.ChunkSize)
+		if err := repService.RecordTransfer(record); !errors.Is(err, errors.ErrInvalidInput) {
+			t.Fatalf("RecordTransfer error = %v; want the failed credit", err)
+		}
+		if db.Transfers().Has(record.ID) {
+			t.Error("The ledger kept a transfer nobody was credited for")
+		}
+	})
+}
+
+func TestRecordTransferSkipsUnknownUsers(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		repService, userService, transfers := setupReputationTest(db)
+		
+		server := boundUser(t, userService, "server", "peer-server")
+		receiverKey, _ := models.NewIdentity()
+		
+		record := receipt(receiverKey, "peer-server", server.ID, "user-elsewhere", 0, models.ChunkSize)
+		if err := repService.RecordTransfer(record); err != nil {
+			t.Fatalf("RecordTransfer failed: %v", err)
+		}
+		if !transfers.Has(record.ID) {
+			t.Error("Transfer to a user of another library was not recorded")
+		}
+		if info, _ := repService.GetUserReputation(server.ID); info.BytesServed != models.ChunkSize {
+			t.Errorf("BytesServed = %d; want %d", info.BytesServed, models.ChunkSize)
+		}
+	})
+}
+
+func TestBytesServedOutweighFileCount(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		repService, userService, _ := setupReputationTest(db)
+		
+		// Fifty tiny uploads against 2GB seeded to others
+		tiny, _ := userService.CreateUser("tiny", "tiny@test.com", "pass")
+		for i := 0; i < 50; i++ {
+			userService.RecordUpload(tiny.ID)
+		}
+		seeder := boundUser(t, userService, "seeder", "peer-seeder")
+		otherKey, _ := models.NewIdentity()
+		record := receipt(otherKey, "peer-seeder", seeder.ID, "", 0, 2<<30)
+		if err := repService.RecordTransfer(record); err != nil {
+			t.Fatalf("RecordTransfer failed: %v", err)
+		}
+		
+		tinyScore, _ := repService.Calculate(tiny.ID)
+		seederScore, _ := repService.Calculate(seeder.ID)
+		if seederScore <= tinyScore {
+			t.Errorf("Seeder score %d <= tiny uploader score %d; bytes should count", seederScore, tinyScore)
+		}
+	})
 }
 
 func TestNetworkStats(t *testing.T) {
-	repService, userService, _ := setupReputationTest()
-	
-	// Create users with different activities
-	u1, _ := userService.CreateUser("contrib", "c@test.com", "pass")
-	u2, _ := userService.CreateUser("neutral", "n@test.com", "pass")
-	u3, _ := userService.CreateUser("leech", "l@test.com", "pass")
-	
-	// Make u1 a contributor
-	for i := 0; i < 30; i++ {
-		userService.RecordUpload(u1.ID)
-	}
-	
-	// u2 stays neutral
-	for i := 0; i < 10; i++ {
-		userService.RecordUpload(u2.ID)
-	}
-	
-	// Make u3 a leecher
-	for i := 0; i < 50; i++ {
-		userService.RecordDownload(u3.ID)
-	}
-	
-	stats, err := repService.GetNetworkStats()
-	if err != nil {
-		t.Fatalf("GetNetworkStats failed: %v", err)
-	}
-	
-	if stats.TotalUsers != 3 {
-		t.Errorf("TotalUsers = %d; want 3", stats.TotalUsers)
-	}
-	
-	if stats.Contributors < 1 {
-		t.Error("Should have at least 1 contributor")
-	}
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		repService, userService, _ := setupReputationTest(db)
+		
+		// Create users with different activities
+		u1, _ := userService.CreateUser("contrib", "c@test.com", "pass")
+		u2, _ := userService.CreateUser("neutral", "n@test.com", "pass")
+		u3, _ := userService.CreateUser("leech", "l@test.com", "pass")
+		
+		// Make u1 a contributor
+		for i := 0; i < 30; i++ {
+			userService.RecordUpload(u1.ID)
+		}
+		
+		// u2 stays neutral
+		for i := 0; i < 10; i++ {
+			userService.RecordUpload(u2.ID)
+		}
+		
+		// Make u3 a leecher
+		for i := 0; i < 50; i++ {
+			userService.RecordDownload(u3.ID)
+		}
+		
+		stats, err := repService.GetNetworkStats()
+		if err != nil {
+			t.Fatalf("GetNetworkStats failed: %v", err)
+		}
+		
+		if stats.TotalUsers != 3 {
+			t.Errorf("TotalUsers = %d; want 3", stats.TotalUsers)
+		}
+		
+		if stats.Contributors < 1 {
+			t.Error("Should have at least 1 contributor")
+		}
+	})
 }
@@ -4,16 +4,16 @@ package services
 import (
 	"sort"
 	"strings"
+	"p2p-library/interfaces"
 	"p2p-library/models"
-	"p2p-library/store"
 )
 
 type SearchService struct {
-	store *store.MemoryStore
+	resources interfaces.ResourceStorage
 }
 
-func NewSearchService(store *store.MemoryStore) *SearchService {
-	return &SearchService{store: store}
+func NewSearchService(resources interfaces.ResourceStorage) *SearchService {
+	return &SearchService{resources: resources}
 }
 
 type SearchFilters struct {
@@ -28,7 +28,7 @@ type SearchFilters struct {
 }
 
 func (s *SearchService) Search(query string, filters SearchFilters) (*models.SearchResults, error) {
-	all, err := s.store.GetAll()
+	all, err := s.resources.GetAll()
 	if err != nil {
 		return nil, err
 	}
@@ -65,38 +65,15 @@ func (s *SearchService) Search(query string, filters SearchFilters) (*models.Sea
 }
 
 func (s *SearchService) SearchBySubject(subject string) ([]*models.Resource, error) {
-	all, err := s.store.GetAll()
-	if err != nil {
-		return nil, err
-	}
-	results := make([]*models.Resource, 0)
-	for _, r := range all {
-		if strings.EqualFold(r.Subject, subject) {
-			results = append(results, r)
-		}
-	}
-	return results, nil
+	return s.resources.GetBySubject(subject)
 }
 
 func (s *SearchService) SearchByTag(tag string) ([]*models.Resource, error) {
-	all, err := s.store.GetAll()
-	if err != nil {
-		return nil, err
-	}
-	results := make([]*models.Resource, 0)
-	for _, r := range all {
-		for _, t := range r.Tags {
-			if strings.EqualFold(t, tag) {
-				results = append(results, r)
-				break
-			}
-		}
-	}
-	return results, nil
+	return s.resources.GetByTag(tag)
 }
 
 func (s *SearchService) GetSuggestions(partial string) ([]string, error) {
-	all, err := s.store.GetAll()
+	all, err := s.resources.GetAll()
 	if err != nil {
 		return nil, err
 	}
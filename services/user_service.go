@@ -9,11 +9,14 @@
 package services
 
 import (
+	"net/mail"
+	"strings"
+
 	"github.com/google/uuid"
 	
 	"p2p-library/errors"
+	"p2p-library/interfaces"
 	"p2p-library/models"
-	"p2p-library/store"
 )
 
 // ============================================================================
@@ -22,12 +25,42 @@ import (
 
 // UserService handles user-related operations
 type UserService struct {
-	store *store.MemoryStore
+	db    interfaces.StorageBackend // nil for a service inside a transaction
+	users interfaces.UserStorage
+}
+
+// NewUserService creates a new UserService on a storage backend
+func NewUserService(db interfaces.StorageBackend) *UserService {
+	return &UserService{db: db, users: db.Users()}
 }
 
-// NewUserService creates a new UserService
-func NewUserService(store *store.MemoryStore) *UserService {
-	return &UserService{store: store}
+// userServiceIn returns a UserService on the users of a transaction, so
+// its changes commit or roll back with the rest of the transaction
+func userServiceIn(tx interfaces.Tx) *UserService {
+	return &UserService{users: tx.Users()}
+}
+
+// inTx runs fn on the users of one transaction. A service already inside
+// a transaction runs fn on its users directly.
+func (s *UserService) inTx(fn func(users interfaces.UserStorage) error) error {
+	if s.db == nil {
+		return fn(s.users)
+	}
+	return s.db.RunInTx(func(tx interfaces.Tx) error {
+		return fn(tx.Users())
+	})
+}
+
+// checkEmailFree returns ErrEmailTaken if a user other than id has email
+func checkEmailFree(users interfaces.UserStorage, email string, id models.UserID) error {
+	other, err := users.GetByEmail(email)
+	if err == nil && other.ID != id {
+		return errors.ErrEmailTaken
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
 }
 
 // ============================================================================
@@ -56,7 +89,8 @@ func UpdateReputationByPointer(user *models.User, delta int) {
 // USER OPERATIONS
 // ============================================================================
 
-// CreateUser creates a new user
+// CreateUser creates a new user. ErrEmailTaken is returned if another
+// user already has the email.
 func (s *UserService) CreateUser(username, email, password string) (*models.User, error) {
 	// Generate UUID for user ID
 	id := models.UserID(uuid.New().String())
@@ -65,9 +99,19 @@ func (s *UserService) CreateUser(username, email, password string) (*models.User
 	user := models.NewUser(id, username, email)
 	user.Password = password // In real app, this would be hashed
 	
-	// Store user
-	if err := s.store.Create(user); err != nil {
-		return nil, errors.NewOperationError("CreateUser", "failed to store user", err)
+	// Check the email and store the user in one transaction, so two
+	// users can't take the same email at once
+	err := s.inTx(func(users interfaces.UserStorage) error {
+		if err := checkEmailFree(users, email, id); err != nil {
+			return err
+		}
+		if err := users.Create(user); err != nil {
+			return errors.NewOperationError("CreateUser", "failed to store user", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	
 	return user, nil
@@ -75,7 +119,7 @@ func (s *UserService) CreateUser(username, email, password string) (*models.User
 
 // GetUser retrieves a user by ID
 func (s *UserService) GetUser(id models.UserID) (*models.User, error) {
-	user, err := s.store.GetUser(id)
+	user, err := s.users.Get(id)
 	if err != nil {
 		return nil, err
 	}
@@ -84,82 +128,128 @@ func (s *UserService) GetUser(id models.UserID) (*models.User, error) {
 
 // GetUserByEmail retrieves a user by email
 func (s *UserService) GetUserByEmail(email string) (*models.User, error) {
-	return s.store.GetByEmail(email)
+	return s.users.GetByEmail(email)
 }
 
 // UpdateUser updates user information
 // GO CONCEPT 7: Uses pointer to modify user in place
+// The store rejects the update with a ConflictError if the user was
+// changed since it was read, and sets the new Version on success
 func (s *UserService) UpdateUser(user *models.User) error {
 	user.UpdateActivity() // Updates LastActiveAt timestamp
-	return s.store.UpdateUser(user)
+	return s.users.Update(user)
+}
+
+// UpdateDetails changes a user's username and email and saves the user
+// like UpdateUser. Both are required, the email must be a plain address,
+// and ErrEmailTaken is returned if another user already has it.
+func (s *UserService) UpdateDetails(user *models.User, username, email string) error {
+	username = strings.TrimSpace(username)
+	email = strings.TrimSpace(email)
+	if username == "" {
+		return errors.NewValidationError("username", "username is required")
+	}
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return errors.NewValidationError("email", "email is not a valid address")
+	}
+
+	// Check the email and save in one transaction, so another user can't
+	// take the email between the two
+	return s.inTx(func(users interfaces.UserStorage) error {
+		if err := checkEmailFree(users, email, user.ID); err != nil {
+			return err
+		}
+		user.Username = username
+		user.Email = email
+		user.UpdateActivity()
+		return users.Update(user)
+	})
 }
 
 // RecordUpload records that a user uploaded a resource
 // Demonstrates modifying struct through pointer
 func (s *UserService) RecordUpload(userID models.UserID) error {
-	user, err := s.store.GetUser(userID)
-	if err != nil {
-		return err
-	}
-	
-	// Modify through pointer - changes persist
-	user.TotalUploads++
-	
-	// Update reputation using pointer method
-	delta := models.UploadWeight
-	UpdateReputationByPointer(user, delta)
-	
-	return s.store.UpdateUser(user)
+	return s.users.UpdateUser(userID, func(user *models.User) error {
+		// Modify through pointer - changes persist
+		user.TotalUploads++
+		
+		// Update reputation using pointer method
+		delta := models.UploadWeight
+		UpdateReputationByPointer(user, delta)
+		return nil
+	})
 }
 
 // RecordDownload records that a user downloaded a resource
 func (s *UserService) RecordDownload(userID models.UserID) error {
-	user, err := s.store.GetUser(userID)
-	if err != nil {
-		return err
-	}
-	
-	// Modify through pointer
-	user.TotalDownloads++
-	
-	// Downloads decrease reputation
-	delta := -models.DownloadWeight
-	UpdateReputationByPointer(user, delta)
-	
-	return s.store.UpdateUser(user)
+	return s.users.UpdateUser(userID, func(user *models.User) error {
+		// Modify through pointer
+		user.TotalDownloads++
+		
+		// Downloads decrease reputation
+		delta := -models.DownloadWeight
+		UpdateReputationByPointer(user, delta)
+		return nil
+	})
 }
 
 // UpdateRatingReceived updates user stats when they receive a rating
 func (s *UserService) UpdateRatingReceived(userID models.UserID, rating models.Rating) error {
-	user, err := s.store.GetUser(userID)
-	if err != nil {
-		return err
-	}
-	
-	// Recalculate average rating
-	totalRatings := float64(user.TotalUploads)
-	if totalRatings == 0 {
-		totalRatings = 1
-	}
-	currentSum := user.AverageRating * totalRatings
-	newSum := currentSum + float64(rating)
-	user.AverageRating = newSum / (totalRatings + 1)
-	
-	// Update reputation based on rating
-	delta := int(float64(rating) * float64(models.RatingWeight) / 5.0)
-	UpdateReputationByPointer(user, delta)
-	
-	return s.store.UpdateUser(user)
+	return s.users.UpdateUser(userID, func(user *models.User) error {
+		// Recalculate average rating
+		totalRatings := float64(user.TotalUploads)
+		if totalRatings == 0 {
+			totalRatings = 1
+		}
+		currentSum := user.AverageRating * totalRatings
+		newSum := currentSum + float64(rating)
+		user.AverageRating = newSum / (totalRatings + 1)
+		
+		// Update reputation based on rating
+		delta := int(float64(rating) * float64(models.RatingWeight) / 5.0)
+		UpdateReputationByPointer(user, delta)
+		return nil
+	})
+}
+
+// BindPeer records that a user runs the peer with the given PeerID.
+// Only the user's own node should do this: the binding is what makes
+// other peers' claims to be that user believable.
+func (s *UserService) BindPeer(userID models.UserID, peerID models.PeerID) error {
+	return s.users.UpdateUser(userID, func(user *models.User) error {
+		user.PeerID = peerID
+		return nil
+	})
+}
+
+// UpdatePeerStatus records the network status of a user's peer as
+// reported by the membership layer. An empty ipAddress keeps the old one.
+// It never rebinds a user: the update is refused unless the user is
+// already bound to peerID.
+func (s *UserService) UpdatePeerStatus(userID models.UserID, peerID models.PeerID, status models.PeerStatus, ipAddress string) error {
+	return s.users.UpdateUser(userID, func(user *models.User) error {
+		if user.PeerID != peerID {
+			return errors.NewValidationError("peer_id", "user is not bound to peer "+string(peerID))
+		}
+		user.Status = status
+		if ipAddress != "" {
+			user.IPAddress = ipAddress
+		}
+		if status == models.StatusOnline {
+			user.UpdateActivity()
+		}
+		return nil
+	})
 }
 
 // GetAllUsers returns all users
 func (s *UserService) GetAllUsers() ([]*models.User, error) {
-	return s.store.GetAllUsers()
+	return s.users.GetAll()
 }
 
 // GetLeaderboard returns top users by reputation
 func (s *UserService) GetLeaderboard(limit int) ([]*models.User, error) {
-	return s.store.GetLeaderboard(limit)
+	return s.users.GetLeaderboard(limit)
 }
 
 // ============================================================================
@@ -9,8 +9,13 @@
 package services
 
 import (
+	"fmt"
+	"path/filepath"
+	"sync"
 	"testing"
 
+	"p2p-library/errors"
+	"p2p-library/interfaces"
 	"p2p-library/models"
 	"p2p-library/store"
 )
@@ -19,10 +24,37 @@ import (
 // TEST SETUP
 // ============================================================================
 
-func setupUserTest() (*UserService, *store.MemoryStore) {
-	memStore := store.NewMemoryStore()
-	userService := NewUserService(memStore)
-	return userService, memStore
+// testBackends are the storage engines the service tests run against
+var testBackends = []struct {
+	name string
+	open func(t *testing.T) interfaces.StorageBackend
+}{
+	{"memory", func(t *testing.T) interfaces.StorageBackend {
+		return store.NewMemoryStore()
+	}},
+	{"bolt", func(t *testing.T) interfaces.StorageBackend {
+		db, err := store.OpenBoltStore(filepath.Join(t.TempDir(), "library.db"))
+		if err != nil {
+			t.Fatalf("OpenBoltStore failed: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}},
+}
+
+// eachBackend runs a test as a subtest on every storage backend
+func eachBackend(t *testing.T, test func(t *testing.T, db interfaces.StorageBackend)) {
+	for _, backend := range testBackends {
+		open := backend.open
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, open(t))
+		})
+	}
+}
+
+func setupUserTest(db interfaces.StorageBackend) (*UserService, interfaces.UserStorage) {
+	userService := NewUserService(db)
+	return userService, db.Users()
 }
 
 // ============================================================================
@@ -123,121 +155,286 @@ func TestUpdateReputationByPointer(t *testing.T) {
 // ============================================================================
 
 func TestCreateUser(t *testing.T) {
-	service, _ := setupUserTest()
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		service, _ := setupUserTest(db)
 
-	user, err := service.CreateUser("testuser", "test@example.com", "password123")
+		user, err := service.CreateUser("testuser", "test@example.com", "password123")
 
-	if err != nil {
-		t.Fatalf("CreateUser failed: %v", err)
-	}
+		if err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
 
-	if user.Username != "testuser" {
-		t.Errorf("Username = %s; want testuser", user.Username)
-	}
+		if user.Username != "testuser" {
+			t.Errorf("Username = %s; want testuser", user.Username)
+		}
 
-	if user.Email != "test@example.com" {
-		t.Errorf("Email = %s; want test@example.com", user.Email)
-	}
+		if user.Email != "test@example.com" {
+			t.Errorf("Email = %s; want test@example.com", user.Email)
+		}
 
-	if user.Classification != models.ClassNeutral {
-		t.Errorf("Classification = %s; want Neutral", user.Classification)
-	}
+		if user.Classification != models.ClassNeutral {
+			t.Errorf("Classification = %s; want Neutral", user.Classification)
+		}
+	})
 }
 
 func TestGetUser(t *testing.T) {
-	service, _ := setupUserTest()
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		service, _ := setupUserTest(db)
 
-	// Create a user first
-	created, _ := service.CreateUser("testuser", "test@example.com", "password")
+		// Create a user first
+		created, _ := service.CreateUser("testuser", "test@example.com", "password")
 
-	// Get the user
-	got, err := service.GetUser(created.ID)
+		// Get the user
+		got, err := service.GetUser(created.ID)
 
-	if err != nil {
-		t.Fatalf("GetUser failed: %v", err)
-	}
+		if err != nil {
+			t.Fatalf("GetUser failed: %v", err)
+		}
 
-	if got.ID != created.ID {
-		t.Errorf("ID mismatch: got %s, want %s", got.ID, created.ID)
-	}
+		if got.ID != created.ID {
+			t.Errorf("ID mismatch: got %s, want %s", got.ID, created.ID)
+		}
+	})
 }
 
 func TestRecordUpload(t *testing.T) {
-	service, _ := setupUserTest()
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		service, _ := setupUserTest(db)
 
-	user, _ := service.CreateUser("uploader", "up@test.com", "pass")
+		user, _ := service.CreateUser("uploader", "up@test.com", "pass")
 
-	err := service.RecordUpload(user.ID)
-	if err != nil {
-		t.Fatalf("RecordUpload failed: %v", err)
-	}
+		err := service.RecordUpload(user.ID)
+		if err != nil {
+			t.Fatalf("RecordUpload failed: %v", err)
+		}
 
-	updated, _ := service.GetUser(user.ID)
+		updated, _ := service.GetUser(user.ID)
 
-	if updated.TotalUploads != 1 {
-		t.Errorf("TotalUploads = %d; want 1", updated.TotalUploads)
-	}
+		if updated.TotalUploads != 1 {
+			t.Errorf("TotalUploads = %d; want 1", updated.TotalUploads)
+		}
 
-	if updated.Reputation <= 0 {
-		t.Errorf("Reputation should increase after upload: %d", updated.Reputation)
-	}
+		if updated.Reputation <= 0 {
+			t.Errorf("Reputation should increase after upload: %d", updated.Reputation)
+		}
+	})
+}
+
+func TestUpdatePeerStatus(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		service, _ := setupUserTest(db)
+
+		user, _ := service.CreateUser("gossiper", "gossip@test.com", "pass")
+
+		// Status only follows the peer the user is bound to
+		if err := service.UpdatePeerStatus(user.ID, "peer-gossiper", models.StatusOnline, "10.0.0.7"); !errors.IsValidationError(err) {
+			t.Errorf("Unbound UpdatePeerStatus error = %v; want a validation error", err)
+		}
+		if err := service.BindPeer(user.ID, "peer-gossiper"); err != nil {
+			t.Fatalf("BindPeer failed: %v", err)
+		}
+
+		if err := service.UpdatePeerStatus(user.ID, "peer-gossiper", models.StatusOnline, "10.0.0.7"); err != nil {
+			t.Fatalf("UpdatePeerStatus failed: %v", err)
+		}
+		updated, _ := service.GetUser(user.ID)
+		if updated.Status != models.StatusOnline || updated.PeerID != "peer-gossiper" || updated.IPAddress != "10.0.0.7" {
+			t.Errorf("After going online got status=%s peer=%s ip=%s", updated.Status, updated.PeerID, updated.IPAddress)
+		}
+
+		// Going offline keeps the last known address
+		if err := service.UpdatePeerStatus(user.ID, "peer-gossiper", models.StatusOffline, ""); err != nil {
+			t.Fatalf("UpdatePeerStatus failed: %v", err)
+		}
+		updated, _ = service.GetUser(user.ID)
+		if updated.Status != models.StatusOffline || updated.IPAddress != "10.0.0.7" {
+			t.Errorf("After going offline got status=%s ip=%s", updated.Status, updated.IPAddress)
+		}
+
+		// Another peer cannot take the user over
+		if err := service.UpdatePeerStatus(user.ID, "peer-impostor", models.StatusOnline, "10.0.0.66"); err == nil {
+			t.Error("UpdatePeerStatus accepted a peer the user is not bound to")
+		}
+		updated, _ = service.GetUser(user.ID)
+		if updated.PeerID != "peer-gossiper" || updated.IPAddress != "10.0.0.7" {
+			t.Errorf("Impostor changed the user to peer=%s ip=%s", updated.PeerID, updated.IPAddress)
+		}
+
+		if err := service.UpdatePeerStatus("missing", "peer-x", models.StatusOnline, ""); err == nil {
+			t.Error("UpdatePeerStatus should fail for an unknown user")
+		}
+	})
 }
 
 func TestRecordDownload(t *testing.T) {
-	service, _ := setupUserTest()
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		service, _ := setupUserTest(db)
 
-	// Create user with some uploads first
-	user, _ := service.CreateUser("downloader", "down@test.com", "pass")
-	service.RecordUpload(user.ID)
-	service.RecordUpload(user.ID)
+		// Create user with some uploads first
+		user, _ := service.CreateUser("downloader", "down@test.com", "pass")
+		service.RecordUpload(user.ID)
+		service.RecordUpload(user.ID)
 
-	initialUser, _ := service.GetUser(user.ID)
-	initialRep := initialUser.Reputation // capture value, not pointer
+		initialUser, _ := service.GetUser(user.ID)
+		initialRep := initialUser.Reputation // capture value, not pointer
 
-	err := service.RecordDownload(user.ID)
-	if err != nil {
-		t.Fatalf("RecordDownload failed: %v", err)
-	}
+		err := service.RecordDownload(user.ID)
+		if err != nil {
+			t.Fatalf("RecordDownload failed: %v", err)
+		}
 
-	updated, _ := service.GetUser(user.ID)
+		updated, _ := service.GetUser(user.ID)
 
-	if updated.TotalDownloads != 1 {
-		t.Errorf("TotalDownloads = %d; want 1", updated.TotalDownloads)
-	}
+		if updated.TotalDownloads != 1 {
+			t.Errorf("TotalDownloads = %d; want 1", updated.TotalDownloads)
+		}
 
-	if updated.Reputation >= initialRep {
-		t.Errorf("Reputation should decrease after download: was %d, now %d", initialRep, updated.Reputation)
-	}
+		if updated.Reputation >= initialRep {
+			t.Errorf("Reputation should decrease after download: was %d, now %d", initialRep, updated.Reputation)
+		}
+	})
 }
 
 func TestGetLeaderboard(t *testing.T) {
-	service, _ := setupUserTest()
-
-	// Create users with different reputations
-	u1, _ := service.CreateUser("user1", "u1@test.com", "pass")
-	u2, _ := service.CreateUser("user2", "u2@test.com", "pass")
-	u3, _ := service.CreateUser("user3", "u3@test.com", "pass")
-
-	// Give them different upload counts
-	for i := 0; i < 5; i++ {
-		service.RecordUpload(u1.ID)
-	}
-	for i := 0; i < 3; i++ {
-		service.RecordUpload(u2.ID)
-	}
-	service.RecordUpload(u3.ID)
-
-	leaders, err := service.GetLeaderboard(3)
-	if err != nil {
-		t.Fatalf("GetLeaderboard failed: %v", err)
-	}
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		service, _ := setupUserTest(db)
+
+		// Create users with different reputations
+		u1, _ := service.CreateUser("user1", "u1@test.com", "pass")
+		u2, _ := service.CreateUser("user2", "u2@test.com", "pass")
+		u3, _ := service.CreateUser("user3", "u3@test.com", "pass")
+
+		// Give them different upload counts
+		for i := 0; i < 5; i++ {
+			service.RecordUpload(u1.ID)
+		}
+		for i := 0; i < 3; i++ {
+			service.RecordUpload(u2.ID)
+		}
+		service.RecordUpload(u3.ID)
+
+		leaders, err := service.GetLeaderboard(3)
+		if err != nil {
+			t.Fatalf("GetLeaderboard failed: %v", err)
+		}
+
+		if len(leaders) != 3 {
+			t.Errorf("Leaderboard size = %d; want 3", len(leaders))
+		}
+
+		// Check order (highest first)
+		if leaders[0].TotalUploads < leaders[1].TotalUploads {
+			t.Error("Leaderboard not sorted correctly")
+		}
+	})
+}
 
-	if len(leaders) != 3 {
-		t.Errorf("Leaderboard size = %d; want 3", len(leaders))
-	}
+func TestUpdateUserRejectsStaleVersion(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		service, _ := setupUserTest(db)
+
+		user, _ := service.CreateUser("editor", "edit@test.com", "pass")
+		if user.Version != 1 {
+			t.Errorf("New user has version %d; want 1", user.Version)
+		}
+
+		// Two admins read the same version and both edit it
+		first, _ := service.GetUser(user.ID)
+		second, _ := service.GetUser(user.ID)
+		first.Email = "first@test.com"
+		if err := service.UpdateUser(first); err != nil {
+			t.Fatalf("First UpdateUser failed: %v", err)
+		}
+		if first.Version != 2 {
+			t.Errorf("Version after the first update = %d; want 2", first.Version)
+		}
+		second.Email = "second@test.com"
+		if err := service.UpdateUser(second); !errors.IsConflict(err) {
+			t.Errorf("Second UpdateUser error = %v; want a ConflictError", err)
+		}
+
+		// Atomic updates bump the version too, so an old copy goes stale
+		service.RecordUpload(user.ID)
+		first.Username = "renamed"
+		if err := service.UpdateUser(first); !errors.IsConflict(err) {
+			t.Errorf("UpdateUser after RecordUpload error = %v; want a ConflictError", err)
+		}
+
+		stored, _ := service.GetUser(user.ID)
+		if stored.Email != "first@test.com" || stored.Username != "editor" || stored.TotalUploads != 1 || stored.Version != 3 {
+			t.Errorf("Stored user = %s %s, %d uploads, version %d; want only the first edit and the upload",
+				stored.Username, stored.Email, stored.TotalUploads, stored.Version)
+		}
+	})
+}
 
-	// Check order (highest first)
-	if leaders[0].TotalUploads < leaders[1].TotalUploads {
-		t.Error("Leaderboard not sorted correctly")
-	}
+func TestEmailsStayUniqueUnderConcurrentWrites(t *testing.T) {
+	eachBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		service, users := setupUserTest(db)
+		const writers = 8
+
+		// Every writer creates a user with the same email
+		var wg sync.WaitGroup
+		errs := make(chan error, writers)
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := service.CreateUser(fmt.Sprintf("user%d", i), "same@test.com", "pass")
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		created := 0
+		for err := range errs {
+			switch {
+			case err == nil:
+				created++
+			case !errors.Is(err, errors.ErrEmailTaken):
+				t.Errorf("CreateUser error = %v; want ErrEmailTaken", err)
+			}
+		}
+		if created != 1 {
+			t.Errorf("%d users were created with the same email; want 1", created)
+		}
+
+		// Then existing users all change to one new email
+		var editors []*models.User
+		for i := 0; i < writers; i++ {
+			user, err := service.CreateUser(fmt.Sprintf("editor%d", i), fmt.Sprintf("e%d@test.com", i), "pass")
+			if err != nil {
+				t.Fatalf("CreateUser failed: %v", err)
+			}
+			editors = append(editors, user)
+		}
+		errs = make(chan error, writers)
+		for _, user := range editors {
+			wg.Add(1)
+			go func(user *models.User) {
+				defer wg.Done()
+				errs <- service.UpdateDetails(user, user.Username, "wanted@test.com")
+			}(user)
+		}
+		wg.Wait()
+		close(errs)
+		updated := 0
+		for err := range errs {
+			switch {
+			case err == nil:
+				updated++
+			case !errors.Is(err, errors.ErrEmailTaken):
+				t.Errorf("UpdateDetails error = %v; want ErrEmailTaken", err)
+			}
+		}
+		if updated != 1 {
+			t.Errorf("%d users took the same email; want 1", updated)
+		}
+
+		all, _ := users.GetAll()
+		if len(all) != 1+writers {
+			t.Errorf("Store has %d users; want %d", len(all), 1+writers)
+		}
+	})
 }
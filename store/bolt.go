@@ -0,0 +1,658 @@
+// Package store - Persistent storage on an embedded bbolt database
+//
+// BoltStore keeps users, resources, ratings and the transfer ledger in a
+// single bbolt file, so the library survives a restart. Each record is
+// stored as JSON under its ID in a bucket of its own; the transfer ledger
+// is keyed by an increasing sequence number so it reads back in the order
+// it was written, with a second bucket mapping record IDs to that key.
+// Lookups by email, uploader, subject, tag, rating resource and rating
+// user, and the leaderboard, go through index buckets (see bolt_index.go);
+// search and the transfer ledger still scan.
+//
+// Like MemoryStore, every read decodes a fresh copy. Changing a returned
+// value does nothing until it is passed back to Update, which checks its
+// version against the stored one, and UpdateResource and UpdateUser do
+// their read-modify-write in a single transaction.
+//
+// bbolt runs one write transaction at a time, but a change event can only
+// be published once its transaction has committed and released bbolt's
+// lock. BoltStore serializes its writes with a mutex of its own, held
+// until the events are out, so they are published in commit order.
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"p2p-library/errors"
+	"p2p-library/events"
+	"p2p-library/interfaces"
+	"p2p-library/models"
+)
+
+// Bucket names
+var (
+	bucketResources   = []byte("resources")
+	bucketUsers       = []byte("users")
+	bucketRatings     = []byte("ratings")
+	bucketTransfers   = []byte("transfers")
+	bucketTransferIDs = []byte("transfer_ids")
+)
+
+// BoltStore provides file-backed storage for all data types
+type BoltStore struct {
+	db      *bolt.DB
+	bus     *events.Bus
+	writeMu *sync.Mutex // held from the start of a write until its events are published
+
+	// Set on the view of the store a write transaction works on
+	tx      *bolt.Tx
+	pending []events.Event // published once tx commits
+}
+
+// OpenBoltStore opens the database at path, creating it if needed
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.NewOperationError("OpenBoltStore", "failed to open "+path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketResources, bucketUsers, bucketRatings, bucketTransfers, bucketTransferIDs} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		// A database from before the indexes gets them built once
+		var missing bool
+		for _, name := range indexBuckets {
+			if tx.Bucket(name) != nil {
+				continue
+			}
+			missing = true
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		if missing {
+			return buildIndexes(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.NewOperationError("OpenBoltStore", "failed to create buckets", err)
+	}
+
+	return &BoltStore{db: db, bus: events.NewBus(), writeMu: &sync.Mutex{}}, nil
+}
+
+// Resources returns the store as ResourceStorage
+func (b *BoltStore) Resources() interfaces.ResourceStorage { return boltResources{b} }
+
+// Users returns the store as UserStorage
+func (b *BoltStore) Users() interfaces.UserStorage { return boltUsers{b} }
+
+// Ratings returns the store as RatingStorage
+func (b *BoltStore) Ratings() interfaces.RatingStorage { return boltRatings{b} }
+
+// Transfers returns the store as TransferStorage
+func (b *BoltStore) Transfers() interfaces.TransferStorage { return boltTransfers{b} }
+
+// Events returns the bus the store publishes its changes on
+func (b *BoltStore) Events() *events.Bus { return b.bus }
+
+// RunInTx runs fn as one transaction over resources, users, ratings and
+// the transfer ledger, in a single bbolt write transaction: if fn returns an error, bbolt
+// discards all of its changes and publishes none of their events. fn
+// must only use tx.
+func (b *BoltStore) RunInTx(fn func(tx interfaces.Tx) error) error {
+	return b.update(func(w *BoltStore) error { return fn(w) })
+}
+
+// Close closes the database file
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+// update runs fn on a view of the store bound to a new write
+// transaction, or on this view if it already has one. Once a new
+// transaction commits, the events fn queued with emit are published.
+func (b *BoltStore) update(fn func(w *BoltStore) error) error {
+	if b.tx != nil {
+		return fn(b)
+	}
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
+	w := &BoltStore{db: b.db, bus: b.bus, writeMu: b.writeMu}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		w.tx = tx
+		return fn(w)
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range w.pending {
+		b.bus.Publish(e)
+	}
+	return nil
+}
+
+// view runs fn in a read transaction, or in the transaction the view
+// belongs to, so a transaction reads its own changes
+func (b *BoltStore) view(fn func(tx *bolt.Tx) error) error {
+	if b.tx != nil {
+		return fn(b.tx)
+	}
+	return b.db.View(fn)
+}
+
+// ============================================================================
+// RECORD HELPERS
+// ============================================================================
+
+// get decodes the value under key into v. It reports false if there is none.
+func (b *BoltStore) get(bucket []byte, key string, v interface{}) (bool, error) {
+	var found bool
+	err := b.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, v)
+	})
+	return found, err
+}
+
+// insert encodes v under a new key, returning exists if the key is taken.
+// Existing values are changed with modify, which sees the stored version.
+// event builds the change event once the value is in.
+func (b *BoltStore) insert(bucket []byte, key string, v interface{}, exists error, event func() events.Event) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.update(func(w *BoltStore) error {
+		bkt := w.tx.Bucket(bucket)
+		if bkt.Get([]byte(key)) != nil {
+			return exists
+		}
+		if err := reindex(w.tx, bucket, nil, data); err != nil {
+			return err
+		}
+		if err := bkt.Put([]byte(key), data); err != nil {
+			return err
+		}
+		w.emit(event)
+		return nil
+	})
+}
+
+// modify decodes the value under key into v, lets change alter it and
+// stores it again, all in one write transaction. notFound is returned if
+// there is no value; an error from change leaves the value as it was.
+// event builds the change event from v once it is stored.
+func (b *BoltStore) modify(bucket []byte, key string, v interface{}, notFound error, change func() error, event func() events.Event) error {
+	return b.update(func(w *BoltStore) error {
+		bkt := w.tx.Bucket(bucket)
+		old := bkt.Get([]byte(key))
+		if old == nil {
+			return notFound
+		}
+		if err := json.Unmarshal(old, v); err != nil {
+			return err
+		}
+		if err := change(); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if err := reindex(w.tx, bucket, old, data); err != nil {
+			return err
+		}
+		if err := bkt.Put([]byte(key), data); err != nil {
+			return err
+		}
+		w.emit(event)
+		return nil
+	})
+}
+
+// remove deletes key, returning notFound if it is not there
+func (b *BoltStore) remove(bucket []byte, key string, notFound error, event func() events.Event) error {
+	return b.update(func(w *BoltStore) error {
+		bkt := w.tx.Bucket(bucket)
+		old := bkt.Get([]byte(key))
+		if old == nil {
+			return notFound
+		}
+		if err := reindex(w.tx, bucket, old, nil); err != nil {
+			return err
+		}
+		if err := bkt.Delete([]byte(key)); err != nil {
+			return err
+		}
+		w.emit(event)
+		return nil
+	})
+}
+
+// each decodes every value in a bucket, in key order, and passes it to fn
+func (b *BoltStore) each(bucket []byte, decode func(data []byte) error) error {
+	return b.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(_, data []byte) error {
+			return decode(data)
+		})
+	})
+}
+
+// ============================================================================
+// RESOURCE STORAGE
+// ============================================================================
+
+// boltResources is the ResourceStorage view of a BoltStore
+type boltResources struct{ b *BoltStore }
+
+func (r boltResources) Store(resource *models.Resource) error {
+	resource.Version = 1
+	return r.b.insert(bucketResources, string(resource.ID), resource, errors.ErrAlreadyExists, func() events.Event {
+		return events.ResourceEvent(events.OpCreate, resource.ID, resource)
+	})
+}
+
+func (r boltResources) Get(id models.ContentID) (*models.Resource, error) {
+	var resource models.Resource
+	found, err := r.b.get(bucketResources, string(id), &resource)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.NewNotFoundError("resource", string(id))
+	}
+	return &resource, nil
+}
+
+func (r boltResources) Update(resource *models.Resource) error {
+	var stored models.Resource
+	err := r.b.modify(bucketResources, string(resource.ID), &stored, errors.ErrResourceNotFound, func() error {
+		if resource.Version != stored.Version {
+			return errors.NewConflictError("resource", string(resource.ID), resource.Version, stored.Version)
+		}
+		stored = *resource
+		stored.Version++
+		return nil
+	}, func() events.Event {
+		return events.ResourceEvent(events.OpUpdate, stored.ID, &stored)
+	})
+	if err == nil {
+		resource.Version = stored.Version
+	}
+	return err
+}
+
+func (r boltResources) UpdateResource(id models.ContentID, change func(*models.Resource) error) error {
+	var resource models.Resource
+	return r.b.modify(bucketResources, string(id), &resource, errors.NewNotFoundError("resource", string(id)),
+		func() error {
+			version := resource.Version
+			if err := change(&resource); err != nil {
+				return err
+			}
+			resource.Version = version + 1
+			return nil
+		}, func() events.Event {
+			return events.ResourceEvent(events.OpUpdate, id, &resource)
+		})
+}
+
+func (r boltResources) Delete(id models.ContentID) error {
+	return r.b.remove(bucketResources, string(id), errors.ErrResourceNotFound, func() events.Event {
+		return events.ResourceEvent(events.OpDelete, id, nil)
+	})
+}
+
+func (r boltResources) GetAll() ([]*models.Resource, error) {
+	return r.filter(func(*models.Resource) bool { return true })
+}
+
+func (r boltResources) Search(query string) ([]*models.Resource, error) {
+	query = strings.ToLower(query)
+	return r.filter(func(resource *models.Resource) bool { return matchesQuery(resource, query) })
+}
+
+func (r boltResources) GetByUser(userID models.UserID) ([]*models.Resource, error) {
+	return r.indexed(bucketResourceUploader, string(userID))
+}
+
+func (r boltResources) GetBySubject(subject string) ([]*models.Resource, error) {
+	return r.indexed(bucketResourceSubject, strings.ToLower(subject))
+}
+
+func (r boltResources) GetByTag(tag string) ([]*models.Resource, error) {
+	return r.indexed(bucketResourceTag, strings.ToLower(tag))
+}
+
+// indexed returns the resources filed under value in index
+func (r boltResources) indexed(index []byte, value string) ([]*models.Resource, error) {
+	result := make([]*models.Resource, 0)
+	err := r.b.lookup(bucketResources, index, value, func(data []byte) error {
+		var resource models.Resource
+		if err := json.Unmarshal(data, &resource); err != nil {
+			return err
+		}
+		result = append(result, &resource)
+		return nil
+	})
+	return result, err
+}
+
+// filter returns the resources keep accepts
+func (r boltResources) filter(keep func(*models.Resource) bool) ([]*models.Resource, error) {
+	result := make([]*models.Resource, 0)
+	err := r.b.each(bucketResources, func(data []byte) error {
+		var resource models.Resource
+		if err := json.Unmarshal(data, &resource); err != nil {
+			return err
+		}
+		if keep(&resource) {
+			result = append(result, &resource)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// ============================================================================
+// USER STORAGE
+// ============================================================================
+
+// storedUser adds the password, which models.User keeps out of JSON
+type storedUser struct {
+	*models.User
+	Password string `json:"password"`
+}
+
+// boltUsers is the UserStorage view of a BoltStore
+type boltUsers struct{ b *BoltStore }
+
+func (u boltUsers) Create(user *models.User) error {
+	user.Version = 1
+	return u.b.insert(bucketUsers, string(user.ID), storedUser{user, user.Password}, errors.ErrUserAlreadyExists,
+		func() events.Event {
+			return events.UserEvent(events.OpCreate, user.ID, user)
+		})
+}
+
+func (u boltUsers) Get(id models.UserID) (*models.User, error) {
+	stored := storedUser{User: &models.User{}}
+	found, err := u.b.get(bucketUsers, string(id), &stored)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.NewNotFoundError("user", string(id))
+	}
+	stored.User.Password = stored.Password
+	return stored.User, nil
+}
+
+func (u boltUsers) GetByEmail(email string) (*models.User, error) {
+	var found *models.User
+	err := u.b.lookup(bucketUsers, bucketUserEmail, email, func(data []byte) error {
+		if found == nil {
+			user, err := decodeUser(data)
+			found = user
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, errors.NewNotFoundError("user", email)
+	}
+	return found, nil
+}
+
+func (u boltUsers) Update(user *models.User) error {
+	stored := storedUser{User: &models.User{}}
+	err := u.b.modify(bucketUsers, string(user.ID), &stored, errors.ErrUserNotFound, func() error {
+		if user.Version != stored.User.Version {
+			return errors.NewConflictError("user", string(user.ID), user.Version, stored.User.Version)
+		}
+		updated := *user
+		updated.Version++
+		stored = storedUser{&updated, user.Password}
+		return nil
+	}, func() events.Event {
+		return events.UserEvent(events.OpUpdate, user.ID, stored.User)
+	})
+	if err == nil {
+		user.Version = stored.User.Version
+	}
+	return err
+}
+
+func (u boltUsers) UpdateUser(id models.UserID, change func(*models.User) error) error {
+	stored := storedUser{User: &models.User{}}
+	return u.b.modify(bucketUsers, string(id), &stored, errors.NewNotFoundError("user", string(id)),
+		func() error {
+			version := stored.User.Version
+			stored.User.Password = stored.Password
+			if err := change(stored.User); err != nil {
+				return err
+			}
+			stored.User.Version = version + 1
+			stored.Password = stored.User.Password
+			return nil
+		}, func() events.Event {
+			return events.UserEvent(events.OpUpdate, id, stored.User)
+		})
+}
+
+func (u boltUsers) Delete(id models.UserID) error {
+	return u.b.remove(bucketUsers, string(id), errors.ErrUserNotFound, func() events.Event {
+		return events.UserEvent(events.OpDelete, id, nil)
+	})
+}
+
+func (u boltUsers) GetAll() ([]*models.User, error) {
+	result := make([]*models.User, 0)
+	err := u.b.each(bucketUsers, func(data []byte) error {
+		user, err := decodeUser(data)
+		if err != nil {
+			return err
+		}
+		result = append(result, user)
+		return nil
+	})
+	return result, err
+}
+
+func (u boltUsers) GetLeaderboard(limit int) ([]*models.User, error) {
+	// The reputation index is already sorted, highest first
+	result := make([]*models.User, 0)
+	err := u.b.ranked(limit, func(data []byte) error {
+		user, err := decodeUser(data)
+		if err != nil {
+			return err
+		}
+		result = append(result, user)
+		return nil
+	})
+	return result, err
+}
+
+// decodeUser decodes a stored user with its password
+func decodeUser(data []byte) (*models.User, error) {
+	stored := storedUser{User: &models.User{}}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	stored.User.Password = stored.Password
+	return stored.User, nil
+}
+
+// ============================================================================
+// RATING STORAGE
+// ============================================================================
+
+// boltRatings is the RatingStorage view of a BoltStore
+type boltRatings struct{ b *BoltStore }
+
+func (r boltRatings) Create(rating *models.ResourceRating) error {
+	rating.Version = 1
+	return r.b.insert(bucketRatings, rating.ID, rating, errors.ErrAlreadyExists, func() events.Event {
+		return events.RatingEvent(events.OpCreate, rating.ID, rating)
+	})
+}
+
+func (r boltRatings) Get(id string) (*models.ResourceRating, error) {
+	var rating models.ResourceRating
+	found, err := r.b.get(bucketRatings, id, &rating)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.ErrRatingNotFound
+	}
+	return &rating, nil
+}
+
+func (r boltRatings) GetByResource(resourceID models.ContentID) ([]*models.ResourceRating, error) {
+	return r.indexed(bucketRatingsByResource, string(resourceID))
+}
+
+func (r boltRatings) GetByUser(userID models.UserID) ([]*models.ResourceRating, error) {
+	return r.indexed(bucketRatingsByUser, string(userID))
+}
+
+func (r boltRatings) GetAll() ([]*models.ResourceRating, error) {
+	result := make([]*models.ResourceRating, 0)
+	err := r.b.each(bucketRatings, func(data []byte) error {
+		var rating models.ResourceRating
+		if err := json.Unmarshal(data, &rating); err != nil {
+			return err
+		}
+		result = append(result, &rating)
+		return nil
+	})
+	return result, err
+}
+
+func (r boltRatings) Update(rating *models.ResourceRating) error {
+	var stored models.ResourceRating
+	err := r.b.modify(bucketRatings, rating.ID, &stored, errors.ErrRatingNotFound, func() error {
+		if rating.Version != stored.Version {
+			return errors.NewConflictError("rating", rating.ID, rating.Version, stored.Version)
+		}
+		stored = *rating
+		stored.Version++
+		return nil
+	}, func() events.Event {
+		return events.RatingEvent(events.OpUpdate, rating.ID, &stored)
+	})
+	if err == nil {
+		rating.Version = stored.Version
+	}
+	return err
+}
+
+func (r boltRatings) Delete(id string) error {
+	return r.b.remove(bucketRatings, id, errors.ErrRatingNotFound, func() events.Event {
+		return events.RatingEvent(events.OpDelete, id, nil)
+	})
+}
+
+// indexed returns the ratings filed under value in index
+func (r boltRatings) indexed(index []byte, value string) ([]*models.ResourceRating, error) {
+	result := make([]*models.ResourceRating, 0)
+	err := r.b.lookup(bucketRatings, index, value, func(data []byte) error {
+		var rating models.ResourceRating
+		if err := json.Unmarshal(data, &rating); err != nil {
+			return err
+		}
+		result = append(result, &rating)
+		return nil
+	})
+	return result, err
+}
+
+// ============================================================================
+// TRANSFER LEDGER STORAGE
+// ============================================================================
+
+// boltTransfers is the TransferStorage view of a BoltStore
+type boltTransfers struct{ b *BoltStore }
+
+func (t boltTransfers) Add(record *models.TransferRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return t.b.update(func(w *BoltStore) error {
+		ids := w.tx.Bucket(bucketTransferIDs)
+		if ids.Get([]byte(record.ID)) != nil {
+			return errors.ErrAlreadyExists
+		}
+
+		ledger := w.tx.Bucket(bucketTransfers)
+		seq, err := ledger.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+
+		if err := ledger.Put(key, data); err != nil {
+			return err
+		}
+		return ids.Put([]byte(record.ID), key)
+	})
+}
+
+func (t boltTransfers) Has(id string) bool {
+	var found bool
+	t.b.view(func(tx *bolt.Tx) error {
+		found = tx.Bucket(bucketTransferIDs).Get([]byte(id)) != nil
+		return nil
+	})
+	return found
+}
+
+func (t boltTransfers) GetAll() ([]*models.TransferRecord, error) {
+	return t.filter(func(*models.TransferRecord) bool { return true })
+}
+
+func (t boltTransfers) GetByUser(userID models.UserID) ([]*models.TransferRecord, error) {
+	return t.filter(func(record *models.TransferRecord) bool { return record.Involves(userID) })
+}
+
+// filter returns the ledger entries keep accepts, oldest first
+func (t boltTransfers) filter(keep func(*models.TransferRecord) bool) ([]*models.TransferRecord, error) {
+	result := make([]*models.TransferRecord, 0)
+	err := t.b.each(bucketTransfers, func(data []byte) error {
+		var record models.TransferRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		if keep(&record) {
+			result = append(result, &record)
+		}
+		return nil
+	})
+	return result, err
+}
@@ -0,0 +1,192 @@
+// Package store - Secondary indexes for BoltStore
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// ============================================================================
+// SECONDARY INDEXES
+// ============================================================================
+// Like MemoryStore, BoltStore indexes records by the fields it looks them
+// up by. Each index is a bucket of empty values keyed by the field value,
+// a zero byte and the record ID, so the records filed under a value are
+// one cursor seek away and come out in ID order. Every write goes through
+// reindex in the same bolt transaction as the record itself, so a
+// rolled-back write leaves no index entries behind.
+
+// Index bucket names
+var (
+	bucketUserEmail         = []byte("index_user_email")
+	bucketUserReputation    = []byte("index_user_reputation")
+	bucketResourceUploader  = []byte("index_resource_uploader")
+	bucketResourceSubject   = []byte("index_resource_subject")
+	bucketResourceTag       = []byte("index_resource_tag")
+	bucketRatingsByResource = []byte("index_rating_resource")
+	bucketRatingsByUser     = []byte("index_rating_user")
+)
+
+var indexBuckets = [][]byte{
+	bucketUserEmail, bucketUserReputation,
+	bucketResourceUploader, bucketResourceSubject, bucketResourceTag,
+	bucketRatingsByResource, bucketRatingsByUser,
+}
+
+// indexEntry is one key a record is filed under in an index bucket
+type indexEntry struct {
+	bucket []byte
+	key    []byte
+}
+
+// indexKey returns the key filing id under value. With an empty id it is
+// the prefix shared by every record filed under value.
+func indexKey(value, id string) []byte {
+	key := make([]byte, 0, len(value)+1+len(id))
+	key = append(key, value...)
+	key = append(key, 0)
+	return append(key, id...)
+}
+
+// rankKey returns the key of a user in the reputation index. Keys sort
+// highest reputation first and then by ID, the order of rank.before.
+func rankKey(reputation models.ReputationScore, id models.UserID) []byte {
+	key := make([]byte, 8, 8+len(id))
+	// Flipping the sign bit sorts negative scores below positive ones;
+	// inverting the rest puts the highest first
+	binary.BigEndian.PutUint64(key, ^(uint64(reputation) ^ 1<<63))
+	return append(key, id...)
+}
+
+// indexEntries returns the index entries of a record stored as data in
+// bucket. Transfer ledger records are not indexed.
+func indexEntries(bucket, data []byte) ([]indexEntry, error) {
+	switch {
+	case bytes.Equal(bucket, bucketResources):
+		var resource models.Resource
+		if err := json.Unmarshal(data, &resource); err != nil {
+			return nil, err
+		}
+		id := string(resource.ID)
+		entries := []indexEntry{
+			{bucketResourceUploader, indexKey(string(resource.UploadedBy), id)},
+			{bucketResourceSubject, indexKey(strings.ToLower(resource.Subject), id)},
+		}
+		for _, tag := range resource.Tags {
+			entries = append(entries, indexEntry{bucketResourceTag, indexKey(strings.ToLower(tag), id)})
+		}
+		return entries, nil
+
+	case bytes.Equal(bucket, bucketUsers):
+		var user models.User
+		if err := json.Unmarshal(data, &user); err != nil {
+			return nil, err
+		}
+		return []indexEntry{
+			{bucketUserEmail, indexKey(user.Email, string(user.ID))},
+			{bucketUserReputation, rankKey(user.Reputation, user.ID)},
+		}, nil
+
+	case bytes.Equal(bucket, bucketRatings):
+		var rating models.ResourceRating
+		if err := json.Unmarshal(data, &rating); err != nil {
+			return nil, err
+		}
+		return []indexEntry{
+			{bucketRatingsByResource, indexKey(string(rating.ResourceID), rating.ID)},
+			{bucketRatingsByUser, indexKey(string(rating.UserID), rating.ID)},
+		}, nil
+	}
+	return nil, nil
+}
+
+// reindex moves a record of bucket in the indexes from its old data to
+// its new data. old is nil for a new record and new is nil for a deleted
+// one. The old entries are removed first, so entries both versions share
+// are kept.
+func reindex(tx *bolt.Tx, bucket, old, new []byte) error {
+	if old != nil {
+		entries, err := indexEntries(bucket, old)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := tx.Bucket(e.bucket).Delete(e.key); err != nil {
+				return err
+			}
+		}
+	}
+	if new != nil {
+		entries, err := indexEntries(bucket, new)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := tx.Bucket(e.bucket).Put(e.key, []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buildIndexes files every record in the indexes. OpenBoltStore runs it
+// on a database written before the indexes existed.
+func buildIndexes(tx *bolt.Tx) error {
+	for _, bucket := range [][]byte{bucketResources, bucketUsers, bucketRatings} {
+		err := tx.Bucket(bucket).ForEach(func(_, data []byte) error {
+			return reindex(tx, bucket, nil, data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup decodes every record of bucket filed under value in index, in
+// ID order, and passes it to decode
+func (b *BoltStore) lookup(bucket, index []byte, value string, decode func(data []byte) error) error {
+	prefix := indexKey(value, "")
+	return b.view(func(tx *bolt.Tx) error {
+		records := tx.Bucket(bucket)
+		c := tx.Bucket(index).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			data := records.Get(k[len(prefix):])
+			if data == nil {
+				return errors.NewOperationError("lookup", "index "+string(index)+" lists missing record "+string(k[len(prefix):]), nil)
+			}
+			if err := decode(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ranked decodes the limit highest ranked users, best first, and passes
+// each to decode
+func (b *BoltStore) ranked(limit int, decode func(data []byte) error) error {
+	return b.view(func(tx *bolt.Tx) error {
+		users := tx.Bucket(bucketUsers)
+		c := tx.Bucket(bucketUserReputation).Cursor()
+		for k, _ := c.First(); k != nil && limit > 0; k, _ = c.Next() {
+			data := users.Get(k[8:])
+			if data == nil {
+				return errors.NewOperationError("ranked", "reputation index lists missing user "+string(k[8:]), nil)
+			}
+			if err := decode(data); err != nil {
+				return err
+			}
+			limit--
+		}
+		return nil
+	})
+}
@@ -0,0 +1,299 @@
+// Package store - Unit tests and benchmarks for the BoltStore indexes
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+
+	"p2p-library/interfaces"
+	"p2p-library/models"
+)
+
+// openTestBolt opens a fresh BoltStore that is closed with the test
+func openTestBolt(tb testing.TB, path string) *BoltStore {
+	tb.Helper()
+
+	b, err := OpenBoltStore(path)
+	if err != nil {
+		tb.Fatalf("OpenBoltStore failed: %v", err)
+	}
+	tb.Cleanup(func() { b.Close() })
+	return b
+}
+
+// boltLeaderboard returns the IDs on a BoltStore leaderboard in order
+func boltLeaderboard(t *testing.T, b *BoltStore, limit int) string {
+	t.Helper()
+
+	users, err := b.Users().GetLeaderboard(limit)
+	if err != nil {
+		t.Fatalf("GetLeaderboard failed: %v", err)
+	}
+	ids := make([]models.UserID, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+	return fmt.Sprint(ids)
+}
+
+// ============================================================================
+// TESTS
+// ============================================================================
+
+func TestBoltResourceIndexesFollowUpdateAndDelete(t *testing.T) {
+	b := openTestBolt(t, filepath.Join(t.TempDir(), "library.db"))
+	resources := b.Resources()
+
+	notes := models.NewResource("notes.pdf", 1024, "user-alice")
+	notes.Subject = "Mathematics"
+	notes.Tags = []string{"Exam", "algebra"}
+	slides := models.NewResource("slides.pdf", 2048, "user-alice")
+	slides.Subject = "Physics"
+	resources.Store(notes)
+	resources.Store(slides)
+
+	if got := resourceIDs(mustResources(resources.GetBySubject("mathematics"))); len(got) != 1 || !got[notes.ID] {
+		t.Errorf("GetBySubject(mathematics) = %v; want the notes, ignoring case", got)
+	}
+	if got := resourceIDs(mustResources(resources.GetByTag("EXAM"))); len(got) != 1 || !got[notes.ID] {
+		t.Errorf("GetByTag(EXAM) = %v; want the notes, ignoring case", got)
+	}
+	if got := mustResources(resources.GetByUser("user-alice")); len(got) != 2 {
+		t.Errorf("GetByUser(alice) returned %d resources; want 2", len(got))
+	}
+
+	resources.UpdateResource(notes.ID, func(r *models.Resource) error {
+		r.Subject = "Physics"
+		r.Tags = []string{"algebra"}
+		r.UploadedBy = "user-bob"
+		return nil
+	})
+	if got := mustResources(resources.GetBySubject("Mathematics")); len(got) != 0 {
+		t.Errorf("GetBySubject(Mathematics) returned %d resources after the update; want 0", len(got))
+	}
+	if got := mustResources(resources.GetBySubject("physics")); len(got) != 2 {
+		t.Errorf("GetBySubject(physics) returned %d resources; want 2", len(got))
+	}
+	if got := mustResources(resources.GetByTag("exam")); len(got) != 0 {
+		t.Errorf("GetByTag(exam) returned %d resources after the tag was dropped; want 0", len(got))
+	}
+	if got := mustResources(resources.GetByUser("user-bob")); len(got) != 1 || got[0].ID != notes.ID {
+		t.Errorf("GetByUser(bob) = %d resources; want the notes", len(got))
+	}
+
+	resources.Delete(slides.ID)
+	if got := mustResources(resources.GetByUser("user-alice")); len(got) != 0 {
+		t.Errorf("GetByUser(alice) returned %d resources after the delete; want 0", len(got))
+	}
+}
+
+func TestBoltRatingIndexesFollowUpdateAndDelete(t *testing.T) {
+	b := openTestBolt(t, filepath.Join(t.TempDir(), "library.db"))
+	ratings := b.Ratings()
+
+	first := models.NewResourceRating("cid-notes", "user-alice", 4, "")
+	second := models.NewResourceRating("cid-notes", "user-bob", 5, "")
+	ratings.Create(first)
+	ratings.Create(second)
+
+	first.ResourceID = "cid-slides"
+	if err := ratings.Update(first); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if got, _ := ratings.GetByResource("cid-notes"); len(got) != 1 || got[0].ID != second.ID {
+		t.Errorf("GetByResource(notes) = %d ratings after the update; want only Bob's", len(got))
+	}
+	if got, _ := ratings.GetByUser("user-alice"); len(got) != 1 || got[0].ResourceID != "cid-slides" {
+		t.Errorf("GetByUser(alice) = %d ratings; want her updated one", len(got))
+	}
+
+	ratings.Delete(second.ID)
+	if got, _ := ratings.GetByUser("user-bob"); len(got) != 0 {
+		t.Errorf("GetByUser(bob) returned %d ratings after the delete; want 0", len(got))
+	}
+}
+
+func TestBoltUserIndexesFollowUpdateAndDelete(t *testing.T) {
+	b := openTestBolt(t, filepath.Join(t.TempDir(), "library.db"))
+	users := b.Users()
+
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		user := models.NewUser(models.UserID("user-"+name), name, name+"@test.com")
+		user.Reputation = 10
+		users.Create(user)
+	}
+	if got := boltLeaderboard(t, b, 10); got != "[user-alice user-bob user-carol user-dave]" {
+		t.Errorf("Leaderboard = %s; want the tie broken by ID", got)
+	}
+
+	users.UpdateUser("user-carol", func(u *models.User) error {
+		u.Reputation = 90
+		u.Email = "carol@uni.edu"
+		return nil
+	})
+	users.UpdateUser("user-alice", func(u *models.User) error {
+		u.Reputation = -5
+		return nil
+	})
+	if got := boltLeaderboard(t, b, 10); got != "[user-carol user-bob user-dave user-alice]" {
+		t.Errorf("Leaderboard = %s; want Carol first and Alice's negative score last", got)
+	}
+	if _, err := users.GetByEmail("carol@test.com"); err == nil {
+		t.Error("GetByEmail still finds Carol by her old email")
+	}
+	if user, err := users.GetByEmail("carol@uni.edu"); err != nil || user.ID != "user-carol" {
+		t.Errorf("GetByEmail(carol@uni.edu) = %v, %v; want Carol", user, err)
+	}
+
+	users.Delete("user-carol")
+	if got := boltLeaderboard(t, b, 2); got != "[user-bob user-dave]" {
+		t.Errorf("Leaderboard = %s after the delete; want Carol gone", got)
+	}
+	if _, err := users.GetByEmail("carol@uni.edu"); err == nil {
+		t.Error("GetByEmail finds a deleted user")
+	}
+}
+
+func TestBoltIndexesRollBackWithTheirTx(t *testing.T) {
+	b := openTestBolt(t, filepath.Join(t.TempDir(), "library.db"))
+	b.Users().Create(models.NewUser("user-alice", "alice", "alice@test.com"))
+
+	notes := models.NewResource("notes.pdf", 1024, "user-alice")
+	b.RunInTx(func(tx interfaces.Tx) error {
+		tx.Resources().Store(notes)
+		tx.Users().UpdateUser("user-alice", func(u *models.User) error {
+			u.Email = "alice@uni.edu"
+			return nil
+		})
+		return fmt.Errorf("abort")
+	})
+
+	if got := mustResources(b.Resources().GetByUser("user-alice")); len(got) != 0 {
+		t.Errorf("GetByUser returned %d resources from a rolled-back tx", len(got))
+	}
+	if _, err := b.Users().GetByEmail("alice@test.com"); err != nil {
+		t.Errorf("GetByEmail lost the committed email: %v", err)
+	}
+	if _, err := b.Users().GetByEmail("alice@uni.edu"); err == nil {
+		t.Error("GetByEmail finds an email from a rolled-back tx")
+	}
+}
+
+func TestBoltIndexesAreBuiltForOlderDatabases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "library.db")
+	b, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("OpenBoltStore failed: %v", err)
+	}
+	b.Users().Create(models.NewUser("user-alice", "alice", "alice@test.com"))
+	notes := models.NewResource("notes.pdf", 1024, "user-alice")
+	notes.Tags = []string{"exam"}
+	b.Resources().Store(notes)
+	b.Ratings().Create(models.NewResourceRating(notes.ID, "user-alice", 4, ""))
+
+	// Drop the indexes, as a database written before them would be
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range indexBuckets {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Dropping the indexes failed: %v", err)
+	}
+	b.Close()
+
+	b = openTestBolt(t, path)
+	if _, err := b.Users().GetByEmail("alice@test.com"); err != nil {
+		t.Errorf("GetByEmail after reopening: %v", err)
+	}
+	if got := mustResources(b.Resources().GetByTag("exam")); len(got) != 1 {
+		t.Errorf("GetByTag returned %d resources after reopening; want 1", len(got))
+	}
+	if got, _ := b.Ratings().GetByResource(notes.ID); len(got) != 1 {
+		t.Errorf("GetByResource returned %d ratings after reopening; want 1", len(got))
+	}
+	if got := boltLeaderboard(t, b, 10); got != "[user-alice]" {
+		t.Errorf("Leaderboard = %s after reopening; want Alice", got)
+	}
+}
+
+// ============================================================================
+// BENCHMARKS
+// ============================================================================
+// The same lookups as the MemoryStore benchmarks. Bolt stores are filled
+// in one transaction, and kept smaller since every write goes to disk.
+
+var boltBenchmarkSizes = []int{1000, 5000, 25000}
+
+// populatedBolt returns a BoltStore with n users, each with one resource
+// and one rating
+func populatedBolt(b *testing.B, n int) *BoltStore {
+	store := openTestBolt(b, filepath.Join(b.TempDir(), "library.db"))
+	err := store.RunInTx(func(tx interfaces.Tx) error {
+		for i := 0; i < n; i++ {
+			user := models.NewUser(models.UserID(fmt.Sprintf("user-%d", i)), fmt.Sprintf("u%d", i), fmt.Sprintf("u%d@test.com", i))
+			user.Reputation = models.ReputationScore(i % 100)
+			if err := tx.Users().Create(user); err != nil {
+				return err
+			}
+
+			resource := models.NewResource(fmt.Sprintf("file-%d.pdf", i), int64(1024+i), user.ID)
+			resource.Subject = fmt.Sprintf("subject-%d", i%50)
+			resource.Tags = []string{fmt.Sprintf("tag-%d", i%200)}
+			if err := tx.Resources().Store(resource); err != nil {
+				return err
+			}
+
+			if err := tx.Ratings().Create(models.NewResourceRating(resource.ID, user.ID, 4, "")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatalf("Filling the store failed: %v", err)
+	}
+	return store
+}
+
+// benchmarkBoltLookup runs lookup against every bolt benchmark size
+func benchmarkBoltLookup(b *testing.B, lookup func(s *BoltStore, i int)) {
+	for _, n := range boltBenchmarkSizes {
+		s := populatedBolt(b, n)
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				lookup(s, i%n)
+			}
+		})
+	}
+}
+
+func BenchmarkBoltGetByEmail(b *testing.B) {
+	benchmarkBoltLookup(b, func(s *BoltStore, i int) {
+		s.Users().GetByEmail(fmt.Sprintf("u%d@test.com", i))
+	})
+}
+
+func BenchmarkBoltGetByUser(b *testing.B) {
+	benchmarkBoltLookup(b, func(s *BoltStore, i int) {
+		s.Resources().GetByUser(models.UserID(fmt.Sprintf("user-%d", i)))
+	})
+}
+
+func BenchmarkBoltGetRatingsByUser(b *testing.B) {
+	benchmarkBoltLookup(b, func(s *BoltStore, i int) {
+		s.Ratings().GetByUser(models.UserID(fmt.Sprintf("user-%d", i)))
+	})
+}
+
+func BenchmarkBoltGetLeaderboard(b *testing.B) {
+	benchmarkBoltLookup(b, func(s *BoltStore, i int) {
+		s.Users().GetLeaderboard(10)
+	})
+}
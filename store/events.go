@@ -0,0 +1,63 @@
+// Package store - Change events
+//
+// Both backends publish one event per committed write to resources, users
+// and ratings. MemoryStore publishes with its lock still held, so events
+// come out in the order the writes were applied; BoltStore serializes its
+// writes with a mutex of its own for the same reason. The transfer ledger
+// and Clear publish nothing.
+package store
+
+import (
+	"p2p-library/events"
+	"p2p-library/models"
+)
+
+// eventFor returns the event for a logged mutation, if it has one
+func eventFor(entry *walEntry) (events.Event, bool) {
+	switch entry.Op {
+	case opStoreResource:
+		return events.ResourceEvent(events.OpCreate, entry.Resource.ID, entry.Resource), true
+	case opUpdateResource:
+		return events.ResourceEvent(events.OpUpdate, entry.Resource.ID, entry.Resource), true
+	case opDeleteResource:
+		return events.ResourceEvent(events.OpDelete, models.ContentID(entry.ID), nil), true
+	case opCreateUser:
+		return events.UserEvent(events.OpCreate, entry.User.User.ID, entry.User.User), true
+	case opUpdateUser:
+		return events.UserEvent(events.OpUpdate, entry.User.User.ID, entry.User.User), true
+	case opDeleteUser:
+		return events.UserEvent(events.OpDelete, models.UserID(entry.ID), nil), true
+	case opCreateRating:
+		return events.RatingEvent(events.OpCreate, entry.Rating.ID, entry.Rating), true
+	case opUpdateRating:
+		return events.RatingEvent(events.OpUpdate, entry.Rating.ID, entry.Rating), true
+	case opDeleteRating:
+		return events.RatingEvent(events.OpDelete, entry.ID, nil), true
+	}
+	return events.Event{}, false
+}
+
+// publish sends the events for a committed entry, or for each entry of a
+// committed transaction (mu held)
+func (m *MemoryStore) publish(entry *walEntry) {
+	if !m.bus.HasSubscribers() {
+		return
+	}
+	if entry.Op == opBatch {
+		for i := range entry.Batch {
+			m.publish(&entry.Batch[i])
+		}
+		return
+	}
+	if e, ok := eventFor(entry); ok {
+		m.bus.Publish(e)
+	}
+}
+
+// emit queues the event for a write made through w. It is published
+// when w's bolt transaction commits, and dropped if it rolls back.
+func (w *BoltStore) emit(event func() events.Event) {
+	if w.bus.HasSubscribers() {
+		w.pending = append(w.pending, event())
+	}
+}
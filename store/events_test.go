@@ -0,0 +1,205 @@
+// Package store - Unit tests for change events
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"p2p-library/events"
+	"p2p-library/interfaces"
+	"p2p-library/models"
+)
+
+// eventBackends opens each backend fresh for a test
+var eventBackends = []struct {
+	name string
+	open func(t *testing.T) interfaces.StorageBackend
+}{
+	{"memory", func(t *testing.T) interfaces.StorageBackend { return NewMemoryStore() }},
+	{"wal", func(t *testing.T) interfaces.StorageBackend {
+		return openWALStore(t, t.TempDir(), WALConfig{NoSync: true})
+	}},
+	{"bolt", func(t *testing.T) interfaces.StorageBackend {
+		b, err := OpenBoltStore(filepath.Join(t.TempDir(), "library.db"))
+		if err != nil {
+			t.Fatalf("OpenBoltStore failed: %v", err)
+		}
+		return b
+	}},
+}
+
+func eachEventBackend(t *testing.T, test func(t *testing.T, db interfaces.StorageBackend)) {
+	for _, backend := range eventBackends {
+		open := backend.open
+		t.Run(backend.name, func(t *testing.T) {
+			db := open(t)
+			defer db.Close()
+			test(t, db)
+		})
+	}
+}
+
+// drain returns the events waiting on sub, as "entity op id"
+func drain(sub *events.Subscription) []string {
+	var got []string
+	for {
+		select {
+		case e := <-sub.Events():
+			got = append(got, fmt.Sprintf("%s %s %s", e.Entity, e.Op, e.ID))
+		default:
+			return got
+		}
+	}
+}
+
+func expectEvents(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Events = %q; want %q", got, want)
+	}
+}
+
+// ============================================================================
+// TESTS
+// ============================================================================
+
+func TestWritesPublishEventsInOrder(t *testing.T) {
+	eachEventBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		sub := db.Events().Subscribe(100)
+
+		alice := models.NewUser("user-alice", "alice", "alice@test.com")
+		db.Users().Create(alice)
+		notes := models.NewResource("notes.pdf", 1024, "user-alice")
+		db.Resources().Store(notes)
+		rating := models.NewResourceRating(notes.ID, "user-alice", 4, "")
+		db.Ratings().Create(rating)
+
+		notes.Title = "Notes"
+		db.Resources().Update(notes)
+		db.Resources().UpdateResource(notes.ID, func(r *models.Resource) error {
+			r.DownloadCount++
+			return nil
+		})
+		db.Users().UpdateUser("user-alice", func(u *models.User) error {
+			u.TotalUploads++
+			return nil
+		})
+		rating.Rating = 5
+		db.Ratings().Update(rating)
+
+		db.Ratings().Delete(rating.ID)
+		db.Resources().Delete(notes.ID)
+		db.Users().Delete("user-alice")
+
+		expectEvents(t, drain(sub),
+			"user create user-alice",
+			"resource create "+string(notes.ID),
+			"rating create "+rating.ID,
+			"resource update "+string(notes.ID),
+			"resource update "+string(notes.ID),
+			"user update user-alice",
+			"rating update "+rating.ID,
+			"rating delete "+rating.ID,
+			"resource delete "+string(notes.ID),
+			"user delete user-alice",
+		)
+	})
+}
+
+func TestEventsCarryTheStoredRecord(t *testing.T) {
+	eachEventBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		sub := db.Events().Subscribe(100)
+
+		alice := models.NewUser("user-alice", "alice", "alice@test.com")
+		alice.Password = "secret"
+		db.Users().Create(alice)
+		notes := models.NewResource("notes.pdf", 1024, "user-alice")
+		db.Resources().Store(notes)
+		db.Resources().UpdateResource(notes.ID, func(r *models.Resource) error {
+			r.DownloadCount = 7
+			return nil
+		})
+
+		if e := <-sub.Events(); e.User == nil || e.User.Email != "alice@test.com" || e.User.Password != "" {
+			t.Errorf("User event = %+v; want Alice without her password", e.User)
+		}
+		<-sub.Events()
+		if e := <-sub.Events(); e.Resource == nil || e.Resource.DownloadCount != 7 || e.Resource.Version != 2 {
+			t.Errorf("Resource event = %+v; want the updated resource at version 2", e.Resource)
+		}
+	})
+}
+
+func TestFailedWritesPublishNothing(t *testing.T) {
+	eachEventBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		alice := models.NewUser("user-alice", "alice", "alice@test.com")
+		db.Users().Create(alice)
+		sub := db.Events().Subscribe(100)
+
+		db.Users().Create(models.NewUser("user-alice", "alice", "alice@test.com"))
+		stale := *alice
+		stale.Version = 0
+		db.Users().Update(&stale)
+		db.Users().UpdateUser("user-alice", func(u *models.User) error {
+			return fmt.Errorf("refused")
+		})
+		db.Resources().Delete("missing")
+
+		expectEvents(t, drain(sub))
+	})
+}
+
+func TestTxPublishesOnlyOnCommit(t *testing.T) {
+	eachEventBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		db.Users().Create(models.NewUser("user-alice", "alice", "alice@test.com"))
+		sub := db.Events().Subscribe(100)
+
+		upload := func(resource *models.Resource, fail error) error {
+			return db.RunInTx(func(tx interfaces.Tx) error {
+				if err := tx.Resources().Store(resource); err != nil {
+					return err
+				}
+				err := tx.Users().UpdateUser(resource.UploadedBy, func(u *models.User) error {
+					u.TotalUploads++
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				// Nothing is published while the transaction runs
+				expectEvents(t, drain(sub))
+				return fail
+			})
+		}
+
+		upload(models.NewResource("failed.pdf", 1024, "user-alice"), fmt.Errorf("failed"))
+		expectEvents(t, drain(sub))
+
+		notes := models.NewResource("notes.pdf", 1024, "user-alice")
+		if err := upload(notes, nil); err != nil {
+			t.Fatalf("RunInTx failed: %v", err)
+		}
+		expectEvents(t, drain(sub),
+			"resource create "+string(notes.ID),
+			"user update user-alice",
+		)
+	})
+}
+
+func TestRecoveryPublishesNothing(t *testing.T) {
+	dir := t.TempDir()
+	m := openWALStore(t, dir, WALConfig{NoSync: true})
+	m.Create(models.NewUser("user-alice", "alice", "alice@test.com"))
+	crashed(m)
+
+	got := openWALStore(t, dir, WALConfig{})
+	defer got.Close()
+	sub := got.Events().Subscribe(100)
+	got.Create(models.NewUser("user-bob", "bob", "bob@test.com"))
+
+	// Replaying the log is not a change; the first event is Bob's
+	if e := <-sub.Events(); e.ID != "user-bob" || e.Seq != 1 {
+		t.Errorf("First event = %q seq %d; want user-bob seq 1", e.ID, e.Seq)
+	}
+}
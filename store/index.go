@@ -0,0 +1,209 @@
+// Package store - Secondary indexes for MemoryStore
+package store
+
+import (
+	"math/rand"
+	"strings"
+
+	"p2p-library/models"
+)
+
+// ============================================================================
+// SECONDARY INDEXES
+// ============================================================================
+// MemoryStore keeps its records in maps keyed by ID. Lookups by any other
+// field would have to scan every record, so the store also keeps these
+// indexes from a field's value to the IDs of the records that have it.
+// apply updates them together with the maps, so every write - logged or
+// replayed - keeps them in step: the old version of a record is removed
+// from the indexes before the new one is added.
+
+// index maps a key to the set of record IDs filed under it
+type index map[string]map[string]bool
+
+// add files id under key
+func (ix index) add(key, id string) {
+	ids, ok := ix[key]
+	if !ok {
+		ids = make(map[string]bool)
+		ix[key] = ids
+	}
+	ids[id] = true
+}
+
+// remove takes id out from under key, dropping the key once it is empty
+func (ix index) remove(key, id string) {
+	ids := ix[key]
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(ix, key)
+	}
+}
+
+// indexes holds every secondary index of a MemoryStore
+type indexes struct {
+	email             index // user email -> user IDs
+	uploader          index // uploader user ID -> resource IDs
+	subject           index // lowercase subject -> resource IDs
+	tag               index // lowercase tag -> resource IDs
+	ratingsByResource index // resource ID -> rating IDs
+	ratingsByUser     index // user ID -> rating IDs
+	reputation        *rankIndex
+}
+
+func newIndexes() indexes {
+	return indexes{
+		email:             make(index),
+		uploader:          make(index),
+		subject:           make(index),
+		tag:               make(index),
+		ratingsByResource: make(index),
+		ratingsByUser:     make(index),
+		reputation:        newRankIndex(),
+	}
+}
+
+func (ix *indexes) addResource(resource *models.Resource) {
+	id := string(resource.ID)
+	ix.uploader.add(string(resource.UploadedBy), id)
+	ix.subject.add(strings.ToLower(resource.Subject), id)
+	for _, tag := range resource.Tags {
+		ix.tag.add(strings.ToLower(tag), id)
+	}
+}
+
+func (ix *indexes) removeResource(resource *models.Resource) {
+	id := string(resource.ID)
+	ix.uploader.remove(string(resource.UploadedBy), id)
+	ix.subject.remove(strings.ToLower(resource.Subject), id)
+	for _, tag := range resource.Tags {
+		ix.tag.remove(strings.ToLower(tag), id)
+	}
+}
+
+func (ix *indexes) addUser(user *models.User) {
+	ix.email.add(user.Email, string(user.ID))
+	ix.reputation.add(user.Reputation, user.ID)
+}
+
+func (ix *indexes) removeUser(user *models.User) {
+	ix.email.remove(user.Email, string(user.ID))
+	ix.reputation.remove(user.Reputation, user.ID)
+}
+
+func (ix *indexes) addRating(rating *models.ResourceRating) {
+	ix.ratingsByResource.add(string(rating.ResourceID), rating.ID)
+	ix.ratingsByUser.add(string(rating.UserID), rating.ID)
+}
+
+func (ix *indexes) removeRating(rating *models.ResourceRating) {
+	ix.ratingsByResource.remove(string(rating.ResourceID), rating.ID)
+	ix.ratingsByUser.remove(string(rating.UserID), rating.ID)
+}
+
+// ============================================================================
+// REPUTATION INDEX
+// ============================================================================
+
+// rank is one user's place in the reputation index
+type rank struct {
+	reputation models.ReputationScore
+	id         models.UserID
+}
+
+// before orders ranks by reputation, highest first; users with the same
+// reputation are ordered by ID so the leaderboard is stable
+func (r rank) before(other rank) bool {
+	if r.reputation != other.reputation {
+		return r.reputation > other.reputation
+	}
+	return r.id < other.id
+}
+
+// maxRankLevel bounds the skip list height; 2^20 users and beyond still
+// average O(log n) steps per operation
+const maxRankLevel = 20
+
+// rankNode is one user in the rank skip list. next[i] is the following
+// node on level i; level 0 links every node in order.
+type rankNode struct {
+	rank
+	next []*rankNode
+}
+
+// rankIndex keeps every user sorted by reputation in a skip list.
+// Reputation changes on every upload, download and rating, so both moving
+// a user and reading the leaderboard off the front take O(log n) steps
+// instead of sorting all users or shifting a sorted slice.
+type rankIndex struct {
+	head   rankNode
+	levels int
+	length int
+}
+
+func newRankIndex() *rankIndex {
+	return &rankIndex{head: rankNode{next: make([]*rankNode, maxRankLevel)}, levels: 1}
+}
+
+// path returns, for every level, the last node that sorts before r
+func (ri *rankIndex) path(r rank) [maxRankLevel]*rankNode {
+	var prev [maxRankLevel]*rankNode
+	node := &ri.head
+	for level := ri.levels - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].before(r) {
+			node = node.next[level]
+		}
+		prev[level] = node
+	}
+	return prev
+}
+
+func (ri *rankIndex) add(reputation models.ReputationScore, id models.UserID) {
+	r := rank{reputation, id}
+	prev := ri.path(r)
+
+	// Each node reaches one level higher with probability 1/2
+	levels := 1
+	for levels < maxRankLevel && rand.Intn(2) == 0 {
+		levels++
+	}
+	for ; ri.levels < levels; ri.levels++ {
+		prev[ri.levels] = &ri.head
+	}
+
+	node := &rankNode{rank: r, next: make([]*rankNode, levels)}
+	for level := 0; level < levels; level++ {
+		node.next[level] = prev[level].next[level]
+		prev[level].next[level] = node
+	}
+	ri.length++
+}
+
+func (ri *rankIndex) remove(reputation models.ReputationScore, id models.UserID) {
+	r := rank{reputation, id}
+	prev := ri.path(r)
+
+	node := prev[0].next[0]
+	if node == nil || node.rank != r {
+		return
+	}
+	for level := range node.next {
+		prev[level].next[level] = node.next[level]
+	}
+	for ri.levels > 1 && ri.head.next[ri.levels-1] == nil {
+		ri.levels--
+	}
+	ri.length--
+}
+
+// top returns the IDs of the limit highest ranked users, best first
+func (ri *rankIndex) top(limit int) []models.UserID {
+	if limit > ri.length {
+		limit = ri.length
+	}
+	ids := make([]models.UserID, 0, limit)
+	for node := ri.head.next[0]; len(ids) < limit; node = node.next[0] {
+		ids = append(ids, node.id)
+	}
+	return ids
+}
@@ -0,0 +1,310 @@
+// Package store - Unit tests and benchmarks for the MemoryStore indexes
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"p2p-library/models"
+)
+
+// resourceIDs returns the IDs of resources as a set
+func resourceIDs(resources []*models.Resource) map[models.ContentID]bool {
+	ids := make(map[models.ContentID]bool)
+	for _, resource := range resources {
+		ids[resource.ID] = true
+	}
+	return ids
+}
+
+// leaderboardIDs returns the IDs on a leaderboard in order
+func leaderboardIDs(t *testing.T, m *MemoryStore, limit int) []models.UserID {
+	t.Helper()
+
+	users, err := m.GetLeaderboard(limit)
+	if err != nil {
+		t.Fatalf("GetLeaderboard failed: %v", err)
+	}
+	ids := make([]models.UserID, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+	return ids
+}
+
+// ============================================================================
+// TESTS
+// ============================================================================
+
+func TestResourceIndexesFollowUpdateAndDelete(t *testing.T) {
+	m := NewMemoryStore()
+
+	notes := models.NewResource("notes.pdf", 1024, "user-alice")
+	notes.Subject = "Mathematics"
+	notes.Tags = []string{"Exam", "algebra"}
+	slides := models.NewResource("slides.pdf", 2048, "user-alice")
+	slides.Subject = "Physics"
+	m.Store(notes)
+	m.Store(slides)
+
+	if got := resourceIDs(mustResources(m.GetBySubject("mathematics"))); len(got) != 1 || !got[notes.ID] {
+		t.Errorf("GetBySubject(mathematics) = %v; want the notes, ignoring case", got)
+	}
+	if got := resourceIDs(mustResources(m.GetByTag("EXAM"))); len(got) != 1 || !got[notes.ID] {
+		t.Errorf("GetByTag(EXAM) = %v; want the notes, ignoring case", got)
+	}
+	if got := mustResources(m.GetByUser("user-alice")); len(got) != 2 {
+		t.Errorf("GetByUser(alice) returned %d resources; want 2", len(got))
+	}
+
+	// Moving the notes to another subject, tag and owner refiles them
+	err := m.UpdateResource(notes.ID, func(r *models.Resource) error {
+		r.Subject = "Physics"
+		r.Tags = []string{"revision"}
+		r.UploadedBy = "user-bob"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateResource failed: %v", err)
+	}
+	if got := mustResources(m.GetBySubject("Mathematics")); len(got) != 0 {
+		t.Errorf("GetBySubject(Mathematics) returned %d resources after the move; want 0", len(got))
+	}
+	if got := mustResources(m.GetBySubject("Physics")); len(got) != 2 {
+		t.Errorf("GetBySubject(Physics) returned %d resources; want 2", len(got))
+	}
+	if got := mustResources(m.GetByTag("exam")); len(got) != 0 {
+		t.Errorf("GetByTag(exam) returned %d resources after the tag was dropped; want 0", len(got))
+	}
+	if got := resourceIDs(mustResources(m.GetByUser("user-bob"))); len(got) != 1 || !got[notes.ID] {
+		t.Errorf("GetByUser(bob) = %v; want the notes", got)
+	}
+
+	m.Delete(slides.ID)
+	if got := mustResources(m.GetByUser("user-alice")); len(got) != 0 {
+		t.Errorf("GetByUser(alice) returned %d resources after the delete; want 0", len(got))
+	}
+	if got := resourceIDs(mustResources(m.GetBySubject("Physics"))); len(got) != 1 || !got[notes.ID] {
+		t.Errorf("GetBySubject(Physics) = %v after the delete; want only the notes", got)
+	}
+}
+
+func TestRatingIndexesFollowUpdateAndDelete(t *testing.T) {
+	m := NewMemoryStore()
+
+	first := models.NewResourceRating("cid-notes", "user-alice", 4, "")
+	second := models.NewResourceRating("cid-notes", "user-bob", 5, "")
+	m.CreateRating(first)
+	m.CreateRating(second)
+
+	if got, _ := m.GetByResource("cid-notes"); len(got) != 2 {
+		t.Errorf("GetByResource returned %d ratings; want 2", len(got))
+	}
+
+	first.ResourceID = "cid-slides"
+	m.UpdateRating(first)
+	if got, _ := m.GetByResource("cid-notes"); len(got) != 1 || got[0].ID != second.ID {
+		t.Errorf("GetByResource(notes) = %d ratings after the update; want only Bob's", len(got))
+	}
+	if got, _ := m.GetRatingsByUser("user-alice"); len(got) != 1 || got[0].ResourceID != "cid-slides" {
+		t.Errorf("GetRatingsByUser(alice) = %d ratings; want her updated one", len(got))
+	}
+
+	m.DeleteRating(second.ID)
+	if got, _ := m.GetRatingsByUser("user-bob"); len(got) != 0 {
+		t.Errorf("GetRatingsByUser(bob) returned %d ratings after the delete; want 0", len(got))
+	}
+}
+
+func TestUserIndexesFollowUpdateAndDelete(t *testing.T) {
+	m := NewMemoryStore()
+
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		user := models.NewUser(models.UserID("user-"+name), name, name+"@test.com")
+		user.Reputation = 10
+		m.Create(user)
+	}
+
+	// Equal scores are ordered by ID
+	if got := fmt.Sprint(leaderboardIDs(t, m, 10)); got != "[user-alice user-bob user-carol user-dave]" {
+		t.Errorf("Leaderboard = %s; want the tie broken by ID", got)
+	}
+
+	m.ModifyUser("user-carol", func(u *models.User) error {
+		u.Reputation = 90
+		u.Email = "carol@uni.edu"
+		return nil
+	})
+	m.ModifyUser("user-alice", func(u *models.User) error {
+		u.Reputation = 5
+		return nil
+	})
+	if got := fmt.Sprint(leaderboardIDs(t, m, 3)); got != "[user-carol user-bob user-dave]" {
+		t.Errorf("Leaderboard = %s; want Carol first and Alice off the top 3", got)
+	}
+	if _, err := m.GetByEmail("carol@test.com"); err == nil {
+		t.Error("GetByEmail still finds Carol by her old email")
+	}
+	if user, err := m.GetByEmail("carol@uni.edu"); err != nil || user.ID != "user-carol" {
+		t.Errorf("GetByEmail(carol@uni.edu) = %v, %v; want Carol", user, err)
+	}
+
+	m.DeleteUser("user-carol")
+	if got := fmt.Sprint(leaderboardIDs(t, m, 10)); got != "[user-bob user-dave user-alice]" {
+		t.Errorf("Leaderboard = %s after the delete; want Carol gone", got)
+	}
+	if _, err := m.GetByEmail("carol@uni.edu"); err == nil {
+		t.Error("GetByEmail finds a deleted user")
+	}
+
+	m.Clear()
+	if got := leaderboardIDs(t, m, 10); len(got) != 0 {
+		t.Errorf("Leaderboard = %v after Clear; want it empty", got)
+	}
+}
+
+func TestLeaderboardMatchesSortedUsers(t *testing.T) {
+	m := NewMemoryStore()
+	rng := rand.New(rand.NewSource(1))
+
+	// Random creates, score changes and deletes; the index must always
+	// agree with sorting every user
+	for i := 0; i < 2000; i++ {
+		id := models.UserID(fmt.Sprintf("user-%d", rng.Intn(300)))
+		switch rng.Intn(4) {
+		case 0:
+			m.DeleteUser(id)
+		default:
+			if err := m.ModifyUser(id, func(u *models.User) error {
+				u.Reputation = models.ReputationScore(rng.Intn(50))
+				return nil
+			}); err != nil {
+				m.Create(models.NewUser(id, string(id), string(id)+"@test.com"))
+			}
+		}
+	}
+
+	users, _ := m.GetAllUsers()
+	sort.Slice(users, func(i, j int) bool {
+		return rank{users[i].Reputation, users[i].ID}.before(rank{users[j].Reputation, users[j].ID})
+	})
+	want := make([]models.UserID, len(users))
+	for i, user := range users {
+		want[i] = user.ID
+	}
+	if got := leaderboardIDs(t, m, len(users)+10); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Leaderboard = %v; want %v", got, want)
+	}
+}
+
+func TestIndexesAreRebuiltFromTheLog(t *testing.T) {
+	dir := t.TempDir()
+	m := openWALStore(t, dir, WALConfig{SnapshotEvery: 3, NoSync: true})
+
+	for i := 0; i < 5; i++ {
+		user := models.NewUser(models.UserID(fmt.Sprintf("user-%d", i)), fmt.Sprintf("u%d", i), fmt.Sprintf("u%d@test.com", i))
+		user.Reputation = models.ReputationScore(i * 10)
+		m.Create(user)
+
+		resource := models.NewResource(fmt.Sprintf("file-%d.pdf", i), 1024, user.ID)
+		resource.Subject = "Chemistry"
+		resource.Tags = []string{"lab"}
+		m.Store(resource)
+	}
+	crashed(m)
+
+	got := openWALStore(t, dir, WALConfig{})
+	defer got.Close()
+
+	if ids := leaderboardIDs(t, got, 2); fmt.Sprint(ids) != "[user-4 user-3]" {
+		t.Errorf("Leaderboard = %v after recovery; want user-4 and user-3", ids)
+	}
+	if user, err := got.GetByEmail("u2@test.com"); err != nil || user.ID != "user-2" {
+		t.Errorf("GetByEmail(u2) = %v, %v after recovery; want user-2", user, err)
+	}
+	if resources := mustResources(got.GetByTag("lab")); len(resources) != 5 {
+		t.Errorf("GetByTag(lab) returned %d resources after recovery; want 5", len(resources))
+	}
+	if resources := mustResources(got.GetByUser("user-1")); len(resources) != 1 {
+		t.Errorf("GetByUser(user-1) returned %d resources after recovery; want 1", len(resources))
+	}
+}
+
+// mustResources drops the error of a lookup that cannot fail
+func mustResources(resources []*models.Resource, _ error) []*models.Resource {
+	return resources
+}
+
+// ============================================================================
+// BENCHMARKS
+// ============================================================================
+// Each lookup runs against stores of growing size. With the indexes the
+// time per lookup stays flat instead of growing with the store.
+
+var benchmarkSizes = []int{1000, 10000, 100000}
+
+// populatedStore returns a store with n users, each with one resource and
+// one rating
+func populatedStore(n int) *MemoryStore {
+	m := NewMemoryStore()
+	for i := 0; i < n; i++ {
+		user := models.NewUser(models.UserID(fmt.Sprintf("user-%d", i)), fmt.Sprintf("u%d", i), fmt.Sprintf("u%d@test.com", i))
+		user.Reputation = models.ReputationScore(i % 100)
+		m.Create(user)
+
+		resource := models.NewResource(fmt.Sprintf("file-%d.pdf", i), int64(1024+i), user.ID)
+		resource.Subject = fmt.Sprintf("subject-%d", i%50)
+		resource.Tags = []string{fmt.Sprintf("tag-%d", i%200)}
+		m.Store(resource)
+
+		m.CreateRating(models.NewResourceRating(resource.ID, user.ID, 4, ""))
+	}
+	return m
+}
+
+// benchmarkLookup runs lookup against every benchmark size
+func benchmarkLookup(b *testing.B, lookup func(m *MemoryStore, i int)) {
+	for _, n := range benchmarkSizes {
+		m := populatedStore(n)
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				lookup(m, i%n)
+			}
+		})
+	}
+}
+
+func BenchmarkGetByEmail(b *testing.B) {
+	benchmarkLookup(b, func(m *MemoryStore, i int) {
+		m.GetByEmail(fmt.Sprintf("u%d@test.com", i))
+	})
+}
+
+func BenchmarkGetByUser(b *testing.B) {
+	benchmarkLookup(b, func(m *MemoryStore, i int) {
+		m.GetByUser(models.UserID(fmt.Sprintf("user-%d", i)))
+	})
+}
+
+func BenchmarkGetRatingsByUser(b *testing.B) {
+	benchmarkLookup(b, func(m *MemoryStore, i int) {
+		m.GetRatingsByUser(models.UserID(fmt.Sprintf("user-%d", i)))
+	})
+}
+
+func BenchmarkGetLeaderboard(b *testing.B) {
+	benchmarkLookup(b, func(m *MemoryStore, i int) {
+		m.GetLeaderboard(10)
+	})
+}
+
+func BenchmarkUpdateReputation(b *testing.B) {
+	benchmarkLookup(b, func(m *MemoryStore, i int) {
+		m.ModifyUser(models.UserID(fmt.Sprintf("user-%d", i)), func(u *models.User) error {
+			u.Reputation = (u.Reputation + 1) % 100
+			return nil
+		})
+	})
+}
@@ -11,11 +11,12 @@
 package store
 
 import (
-	"sort"
 	"strings"
 	"sync"
 	
 	"p2p-library/errors"
+	"p2p-library/events"
+	"p2p-library/interfaces"
 	"p2p-library/models"
 )
 
@@ -24,6 +25,11 @@ import (
 // ============================================================================
 // MemoryStore implements the storage interfaces using in-memory maps.
 // This demonstrates how a concrete type can implement multiple interfaces.
+// Values go in and come out as copies, so no caller ever holds a pointer
+// into the maps; read-modify-write goes through UpdateResource and
+// ModifyUser, which run under the store's lock. Every stored record has a
+// Version that each change increments, so Update and friends can refuse a
+// change based on a copy that has gone stale.
 
 // MemoryStore provides in-memory storage for all data types
 type MemoryStore struct {
@@ -32,17 +38,48 @@ type MemoryStore struct {
 	users     map[models.UserID]*models.User
 	ratings   map[string]*models.ResourceRating
 	
+	// The transfer ledger is append-only, kept in the order recorded
+	transfers   []*models.TransferRecord
+	transferIDs map[string]bool
+	
+	// Secondary indexes over the maps; see index.go
+	index indexes
+	
+	// Optional write-ahead log; see OpenMemoryStore
+	wal *wal
+	
 	// Mutex for thread-safe operations
 	// This prevents race conditions when multiple goroutines access the store
-	mu sync.RWMutex
+	mu rwLocker
+	
+	// Set on the view of the store a transaction works on; see tx.go
+	tx *memoryTx
+	
+	// Committed changes are published here; see events.go
+	bus *events.Bus
 }
 
-// NewMemoryStore creates a new in-memory store
+// rwLocker is the lock a MemoryStore takes. It is a *sync.RWMutex, except
+// in a transaction's view of the store, which runs with the lock already
+// held by RunInTx.
+type rwLocker interface {
+	Lock()
+	Unlock()
+	RLock()
+	RUnlock()
+}
+
+// NewMemoryStore creates a new in-memory store. Its data is lost when the
+// process exits; OpenMemoryStore creates one that survives.
 func NewMemoryStore() *MemoryStore {
 	return &MemoryStore{
-		resources: make(map[models.ContentID]*models.Resource),
-		users:     make(map[models.UserID]*models.User),
-		ratings:   make(map[string]*models.ResourceRating),
+		resources:   make(map[models.ContentID]*models.Resource),
+		users:       make(map[models.UserID]*models.User),
+		ratings:     make(map[string]*models.ResourceRating),
+		transferIDs: make(map[string]bool),
+		index:       newIndexes(),
+		mu:          &sync.RWMutex{},
+		bus:         events.NewBus(),
 	}
 }
 
@@ -62,13 +99,14 @@ func (m *MemoryStore) Store(resource *models.Resource) error {
 		return errors.ErrAlreadyExists
 	}
 	
-	// Store pointer to resource
-	m.resources[resource.ID] = resource
-	return nil
+	// Store a copy so later changes by the caller are not seen
+	resource.Version = 1
+	return m.commit(walEntry{Op: opStoreResource, Resource: resource.Clone()})
 }
 
 // Get retrieves a resource by ID
-// Returns pointer to allow modification of original
+// Returns a copy: changing it does nothing until it is passed to Update,
+// and concurrent callers never share one
 func (m *MemoryStore) Get(id models.ContentID) (*models.Resource, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -78,22 +116,53 @@ func (m *MemoryStore) Get(id models.ContentID) (*models.Resource, error) {
 		return nil, errors.NewNotFoundError("resource", string(id))
 	}
 	
-	return resource, nil
+	return resource.Clone(), nil
 }
 
-// Update modifies an existing resource
+// Update modifies an existing resource. resource.Version must be the
+// stored version, otherwise someone changed it since it was read and a
+// ConflictError is returned. On success resource gets the new version.
 func (m *MemoryStore) Update(resource *models.Resource) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
-	if _, exists := m.resources[resource.ID]; !exists {
+	current, exists := m.resources[resource.ID]
+	if !exists {
 		return errors.ErrResourceNotFound
 	}
+	if resource.Version != current.Version {
+		return errors.NewConflictError("resource", string(resource.ID), resource.Version, current.Version)
+	}
 	
-	m.resources[resource.ID] = resource
+	updated := resource.Clone()
+	updated.Version++
+	if err := m.commit(walEntry{Op: opUpdateResource, Resource: updated}); err != nil {
+		return err
+	}
+	resource.Version = updated.Version
 	return nil
 }
 
+// UpdateResource changes a stored resource atomically. change gets a copy
+// and may keep it; the result is stored only if change returns nil.
+// change runs under the store's lock and must not call the store.
+func (m *MemoryStore) UpdateResource(id models.ContentID, change func(*models.Resource) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	resource, exists := m.resources[id]
+	if !exists {
+		return errors.NewNotFoundError("resource", string(id))
+	}
+	
+	updated := resource.Clone()
+	if err := change(updated); err != nil {
+		return err
+	}
+	updated.Version = resource.Version + 1
+	return m.commit(walEntry{Op: opUpdateResource, Resource: updated.Clone()})
+}
+
 // Delete removes a resource from storage
 func (m *MemoryStore) Delete(id models.ContentID) error {
 	m.mu.Lock()
@@ -103,8 +172,7 @@ func (m *MemoryStore) Delete(id models.ContentID) error {
 		return errors.ErrResourceNotFound
 	}
 	
-	delete(m.resources, id)
-	return nil
+	return m.commit(walEntry{Op: opDeleteResource, ID: string(id)})
 }
 
 // GetAll returns all resources
@@ -116,7 +184,7 @@ func (m *MemoryStore) GetAll() ([]*models.Resource, error) {
 	result := make([]*models.Resource, 0, len(m.resources))
 	
 	for _, resource := range m.resources {
-		result = append(result, resource)
+		result = append(result, resource.Clone())
 	}
 	
 	return result, nil
@@ -133,40 +201,66 @@ func (m *MemoryStore) Search(query string) ([]*models.Resource, error) {
 	
 	// Linear search through all resources
 	for _, resource := range m.resources {
-		// Check if query matches filename, title, or subject
-		if strings.Contains(strings.ToLower(resource.Filename), query) ||
-		   strings.Contains(strings.ToLower(resource.Title), query) ||
-		   strings.Contains(strings.ToLower(resource.Subject), query) ||
-		   strings.Contains(strings.ToLower(resource.Description), query) {
-			result = append(result, resource)
-		}
-		
-		// Check tags
-		for _, tag := range resource.Tags {
-			if strings.Contains(strings.ToLower(tag), query) {
-				result = append(result, resource)
-				break
-			}
+		if matchesQuery(resource, query) {
+			result = append(result, resource.Clone())
 		}
 	}
 	
 	return result, nil
 }
 
+// matchesQuery reports whether a lowercase query occurs in a resource's
+// filename, title, subject, description or tags. Every backend searches
+// with it so they all find the same resources.
+func matchesQuery(resource *models.Resource, query string) bool {
+	// Check if query matches filename, title, or subject
+	if strings.Contains(strings.ToLower(resource.Filename), query) ||
+	   strings.Contains(strings.ToLower(resource.Title), query) ||
+	   strings.Contains(strings.ToLower(resource.Subject), query) ||
+	   strings.Contains(strings.ToLower(resource.Description), query) {
+		return true
+	}
+	
+	// Check tags
+	for _, tag := range resource.Tags {
+		if strings.Contains(strings.ToLower(tag), query) {
+			return true
+		}
+	}
+	return false
+}
+
 // GetByUser returns resources uploaded by a specific user
 func (m *MemoryStore) GetByUser(userID models.UserID) ([]*models.Resource, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	
-	result := make([]*models.Resource, 0)
+	return m.resourcesIn(m.index.uploader[string(userID)]), nil
+}
+
+// GetBySubject returns the resources in a subject, ignoring case
+func (m *MemoryStore) GetBySubject(subject string) ([]*models.Resource, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	
-	for _, resource := range m.resources {
-		if resource.UploadedBy == userID {
-			result = append(result, resource)
-		}
-	}
+	return m.resourcesIn(m.index.subject[strings.ToLower(subject)]), nil
+}
+
+// GetByTag returns the resources carrying a tag, ignoring case
+func (m *MemoryStore) GetByTag(tag string) ([]*models.Resource, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	
-	return result, nil
+	return m.resourcesIn(m.index.tag[strings.ToLower(tag)]), nil
+}
+
+// resourcesIn returns copies of the resources with the given IDs (mu held)
+func (m *MemoryStore) resourcesIn(ids map[string]bool) []*models.Resource {
+	result := make([]*models.Resource, 0, len(ids))
+	for id := range ids {
+		result = append(result, m.resources[models.ContentID(id)].Clone())
+	}
+	return result
 }
 
 // ============================================================================
@@ -182,8 +276,8 @@ func (m *MemoryStore) Create(user *models.User) error {
 		return errors.ErrUserAlreadyExists
 	}
 	
-	m.users[user.ID] = user
-	return nil
+	user.Version = 1
+	return m.commit(walEntry{Op: opCreateUser, User: &storedUser{user.Clone(), user.Password}})
 }
 
 // GetUser retrieves a user by ID (renamed to avoid conflict)
@@ -196,7 +290,7 @@ func (m *MemoryStore) GetUser(id models.UserID) (*models.User, error) {
 		return nil, errors.NewNotFoundError("user", string(id))
 	}
 	
-	return user, nil
+	return user.Clone(), nil
 }
 
 // GetByEmail retrieves a user by email
@@ -204,28 +298,53 @@ func (m *MemoryStore) GetByEmail(email string) (*models.User, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	
-	for _, user := range m.users {
-		if user.Email == email {
-			return user, nil
-		}
+	for id := range m.index.email[email] {
+		return m.users[models.UserID(id)].Clone(), nil
 	}
 	
 	return nil, errors.NewNotFoundError("user", email)
 }
 
-// UpdateUser modifies user data
+// UpdateUser modifies user data, checking the version like Update
 func (m *MemoryStore) UpdateUser(user *models.User) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
-	if _, exists := m.users[user.ID]; !exists {
+	current, exists := m.users[user.ID]
+	if !exists {
 		return errors.ErrUserNotFound
 	}
+	if user.Version != current.Version {
+		return errors.NewConflictError("user", string(user.ID), user.Version, current.Version)
+	}
 	
-	m.users[user.ID] = user
+	updated := user.Clone()
+	updated.Version++
+	if err := m.commit(walEntry{Op: opUpdateUser, User: &storedUser{updated, user.Password}}); err != nil {
+		return err
+	}
+	user.Version = updated.Version
 	return nil
 }
 
+// ModifyUser changes a stored user atomically, like UpdateResource
+func (m *MemoryStore) ModifyUser(id models.UserID, change func(*models.User) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	user, exists := m.users[id]
+	if !exists {
+		return errors.NewNotFoundError("user", string(id))
+	}
+	
+	updated := user.Clone()
+	if err := change(updated); err != nil {
+		return err
+	}
+	updated.Version = user.Version + 1
+	return m.commit(walEntry{Op: opUpdateUser, User: &storedUser{updated.Clone(), updated.Password}})
+}
+
 // DeleteUser removes a user
 func (m *MemoryStore) DeleteUser(id models.UserID) error {
 	m.mu.Lock()
@@ -235,8 +354,7 @@ func (m *MemoryStore) DeleteUser(id models.UserID) error {
 		return errors.ErrUserNotFound
 	}
 	
-	delete(m.users, id)
-	return nil
+	return m.commit(walEntry{Op: opDeleteUser, ID: string(id)})
 }
 
 // GetAllUsers returns all users
@@ -247,7 +365,7 @@ func (m *MemoryStore) GetAllUsers() ([]*models.User, error) {
 	result := make([]*models.User, 0, len(m.users))
 	
 	for _, user := range m.users {
-		result = append(result, user)
+		result = append(result, user.Clone())
 	}
 	
 	return result, nil
@@ -258,23 +376,14 @@ func (m *MemoryStore) GetLeaderboard(limit int) ([]*models.User, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	
-	// Get all users
-	users := make([]*models.User, 0, len(m.users))
-	for _, user := range m.users {
-		users = append(users, user)
-	}
-	
-	// Sort by reputation (descending)
-	sort.Slice(users, func(i, j int) bool {
-		return users[i].Reputation > users[j].Reputation
-	})
-	
-	// Return top N
-	if limit > len(users) {
-		limit = len(users)
+	// The reputation index is already sorted, highest first
+	ids := m.index.reputation.top(limit)
+	users := make([]*models.User, 0, len(ids))
+	for _, id := range ids {
+		users = append(users, m.users[id].Clone())
 	}
 	
-	return users[:limit], nil
+	return users, nil
 }
 
 // ============================================================================
@@ -290,8 +399,8 @@ func (m *MemoryStore) CreateRating(rating *models.ResourceRating) error {
 		return errors.ErrAlreadyExists
 	}
 	
-	m.ratings[rating.ID] = rating
-	return nil
+	rating.Version = 1
+	return m.commit(walEntry{Op: opCreateRating, Rating: rating.Clone()})
 }
 
 // GetRating retrieves a rating by ID
@@ -304,7 +413,7 @@ func (m *MemoryStore) GetRating(id string) (*models.ResourceRating, error) {
 		return nil, errors.ErrRatingNotFound
 	}
 	
-	return rating, nil
+	return rating.Clone(), nil
 }
 
 // GetByResource returns all ratings for a resource
@@ -312,15 +421,7 @@ func (m *MemoryStore) GetByResource(resourceID models.ContentID) ([]*models.Reso
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	
-	result := make([]*models.ResourceRating, 0)
-	
-	for _, rating := range m.ratings {
-		if rating.ResourceID == resourceID {
-			result = append(result, rating)
-		}
-	}
-	
-	return result, nil
+	return m.ratingsIn(m.index.ratingsByResource[string(resourceID)]), nil
 }
 
 // GetRatingsByUser returns all ratings by a user
@@ -328,27 +429,50 @@ func (m *MemoryStore) GetRatingsByUser(userID models.UserID) ([]*models.Resource
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	
-	result := make([]*models.ResourceRating, 0)
+	return m.ratingsIn(m.index.ratingsByUser[string(userID)]), nil
+}
+
+// GetAllRatings returns all ratings
+func (m *MemoryStore) GetAllRatings() ([]*models.ResourceRating, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	
+	result := make([]*models.ResourceRating, 0, len(m.ratings))
 	for _, rating := range m.ratings {
-		if rating.UserID == userID {
-			result = append(result, rating)
-		}
+		result = append(result, rating.Clone())
 	}
 	
 	return result, nil
 }
 
-// UpdateRating modifies a rating
+// ratingsIn returns copies of the ratings with the given IDs (mu held)
+func (m *MemoryStore) ratingsIn(ids map[string]bool) []*models.ResourceRating {
+	result := make([]*models.ResourceRating, 0, len(ids))
+	for id := range ids {
+		result = append(result, m.ratings[id].Clone())
+	}
+	return result
+}
+
+// UpdateRating modifies a rating, checking the version like Update
 func (m *MemoryStore) UpdateRating(rating *models.ResourceRating) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
-	if _, exists := m.ratings[rating.ID]; !exists {
+	current, exists := m.ratings[rating.ID]
+	if !exists {
 		return errors.ErrRatingNotFound
 	}
+	if rating.Version != current.Version {
+		return errors.NewConflictError("rating", rating.ID, rating.Version, current.Version)
+	}
 	
-	m.ratings[rating.ID] = rating
+	updated := rating.Clone()
+	updated.Version++
+	if err := m.commit(walEntry{Op: opUpdateRating, Rating: updated}); err != nil {
+		return err
+	}
+	rating.Version = updated.Version
 	return nil
 }
 
@@ -361,8 +485,60 @@ func (m *MemoryStore) DeleteRating(id string) error {
 		return errors.ErrRatingNotFound
 	}
 	
-	delete(m.ratings, id)
-	return nil
+	return m.commit(walEntry{Op: opDeleteRating, ID: id})
+}
+
+// ============================================================================
+// TRANSFER LEDGER STORAGE
+// ============================================================================
+
+// AddTransfer appends a record to the transfer ledger
+func (m *MemoryStore) AddTransfer(record *models.TransferRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	if m.transferIDs[record.ID] {
+		return errors.ErrAlreadyExists
+	}
+	
+	return m.commit(walEntry{Op: opAddTransfer, Transfer: record.Clone()})
+}
+
+// HasTransfer reports whether a record with this ID is in the ledger
+func (m *MemoryStore) HasTransfer(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	
+	return m.transferIDs[id]
+}
+
+// GetTransfers returns the whole ledger, oldest first
+func (m *MemoryStore) GetTransfers() ([]*models.TransferRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	
+	result := make([]*models.TransferRecord, 0, len(m.transfers))
+	for _, record := range m.transfers {
+		result = append(result, record.Clone())
+	}
+	
+	return result, nil
+}
+
+// GetTransfersByUser returns the ledger entries a user served or
+// received, oldest first
+func (m *MemoryStore) GetTransfersByUser(userID models.UserID) ([]*models.TransferRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	
+	result := make([]*models.TransferRecord, 0)
+	for _, record := range m.transfers {
+		if record.Involves(userID) {
+			result = append(result, record.Clone())
+		}
+	}
+	
+	return result, nil
 }
 
 // ============================================================================
@@ -382,7 +558,88 @@ func (m *MemoryStore) Clear() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
-	m.resources = make(map[models.ContentID]*models.Resource)
-	m.users = make(map[models.UserID]*models.User)
-	m.ratings = make(map[string]*models.ResourceRating)
+	// Clear has no error to report; a failed log write leaves the data
+	_ = m.commit(walEntry{Op: opClear})
+}
+
+// ============================================================================
+// STORAGE BACKEND
+// ============================================================================
+// MemoryStore's resource methods already satisfy ResourceStorage. User,
+// rating and ledger methods carry prefixes to avoid name clashes, so small
+// views map the interface names onto them.
+
+// Resources returns the store as ResourceStorage
+func (m *MemoryStore) Resources() interfaces.ResourceStorage { return m }
+
+// Users returns the store as UserStorage
+func (m *MemoryStore) Users() interfaces.UserStorage { return memoryUsers{m} }
+
+// Ratings returns the store as RatingStorage
+func (m *MemoryStore) Ratings() interfaces.RatingStorage { return memoryRatings{m} }
+
+// Events returns the bus the store publishes its changes on
+func (m *MemoryStore) Events() *events.Bus { return m.bus }
+
+// Transfers returns the store as TransferStorage
+func (m *MemoryStore) Transfers() interfaces.TransferStorage { return memoryTransfers{m} }
+
+// Close snapshots a durable store and closes its log. A store without a
+// log has nothing to flush.
+func (m *MemoryStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.wal == nil {
+		return nil
+	}
+	err := m.snapshot()
+	if closeErr := m.wal.file.Close(); err == nil {
+		err = closeErr
+	}
+	m.wal = nil
+	return err
+}
+
+// memoryUsers is the UserStorage view of a MemoryStore
+type memoryUsers struct{ m *MemoryStore }
+
+func (u memoryUsers) Create(user *models.User) error                { return u.m.Create(user) }
+func (u memoryUsers) Get(id models.UserID) (*models.User, error)    { return u.m.GetUser(id) }
+func (u memoryUsers) GetByEmail(email string) (*models.User, error) { return u.m.GetByEmail(email) }
+func (u memoryUsers) Update(user *models.User) error                { return u.m.UpdateUser(user) }
+func (u memoryUsers) Delete(id models.UserID) error                 { return u.m.DeleteUser(id) }
+func (u memoryUsers) GetAll() ([]*models.User, error)               { return u.m.GetAllUsers() }
+func (u memoryUsers) GetLeaderboard(limit int) ([]*models.User, error) {
+	return u.m.GetLeaderboard(limit)
+}
+func (u memoryUsers) UpdateUser(id models.UserID, change func(*models.User) error) error {
+	return u.m.ModifyUser(id, change)
+}
+
+// memoryRatings is the RatingStorage view of a MemoryStore
+type memoryRatings struct{ m *MemoryStore }
+
+func (r memoryRatings) Create(rating *models.ResourceRating) error    { return r.m.CreateRating(rating) }
+func (r memoryRatings) Get(id string) (*models.ResourceRating, error) { return r.m.GetRating(id) }
+func (r memoryRatings) GetByResource(resourceID models.ContentID) ([]*models.ResourceRating, error) {
+	return r.m.GetByResource(resourceID)
+}
+func (r memoryRatings) GetByUser(userID models.UserID) ([]*models.ResourceRating, error) {
+	return r.m.GetRatingsByUser(userID)
+}
+func (r memoryRatings) GetAll() ([]*models.ResourceRating, error)  { return r.m.GetAllRatings() }
+func (r memoryRatings) Update(rating *models.ResourceRating) error { return r.m.UpdateRating(rating) }
+func (r memoryRatings) Delete(id string) error                     { return r.m.DeleteRating(id) }
+
+// memoryTransfers is the TransferStorage view of a MemoryStore
+type memoryTransfers struct{ m *MemoryStore }
+
+func (t memoryTransfers) Add(record *models.TransferRecord) error { return t.m.AddTransfer(record) }
+func (t memoryTransfers) Has(id string) bool                      { return t.m.HasTransfer(id) }
+func (t memoryTransfers) GetAll() ([]*models.TransferRecord, error) {
+	return t.m.GetTransfers()
+}
+func (t memoryTransfers) GetByUser(userID models.UserID) ([]*models.TransferRecord, error) {
+	return t.m.GetTransfersByUser(userID)
 }
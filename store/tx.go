@@ -0,0 +1,138 @@
+// Package store - Transactions over MemoryStore
+//
+// RunInTx holds the store's write lock for the whole transaction, so no
+// one else sees its changes before it commits. The transaction works on a
+// view of the store that shares its maps but takes no lock of its own;
+// every change it makes is applied at once, and the entry that would undo
+// it is kept. Transfers appended to the ledger go to the view's own copy
+// of the ledger slice, which replaces the store's when the transaction
+// commits. If the transaction fails, the undo entries are applied in
+// reverse. If it succeeds, its entries go to the write-ahead log as a
+// single batch entry, so after a crash either all of them come back or
+// none do. Only then are its changes published on the event bus; a
+// transaction that rolls back publishes nothing.
+package store
+
+import (
+	"p2p-library/errors"
+	"p2p-library/interfaces"
+	"p2p-library/models"
+)
+
+// memoryTx collects the changes of a running transaction
+type memoryTx struct {
+	entries []walEntry // changes, in the order they were made
+	undo    []walEntry // undo[i] reverts entries[i]
+}
+
+// record remembers a change and how to revert it
+func (tx *memoryTx) record(undo, entry walEntry) {
+	tx.entries = append(tx.entries, entry)
+	tx.undo = append(tx.undo, undo)
+}
+
+// noLock is the lock of a transaction's view; RunInTx already holds the
+// store's real one
+type noLock struct{}
+
+func (noLock) Lock()    {}
+func (noLock) Unlock()  {}
+func (noLock) RLock()   {}
+func (noLock) RUnlock() {}
+
+// RunInTx runs fn as one transaction over resources, users, ratings and
+// the transfer ledger. If fn returns an error or panics, every change it
+// made is reverted.
+// fn must only use tx: the store itself is locked until fn returns.
+func (m *MemoryStore) RunInTx(fn func(tx interfaces.Tx) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	view := &MemoryStore{
+		resources:   m.resources,
+		users:       m.users,
+		ratings:     m.ratings,
+		transfers:   m.transfers,
+		transferIDs: m.transferIDs,
+		index:       m.index,
+		mu:          noLock{},
+		tx:          &memoryTx{},
+		bus:         m.bus,
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			m.rollback(view.tx)
+			panic(p)
+		}
+	}()
+	if err := fn(view); err != nil {
+		m.rollback(view.tx)
+		return err
+	}
+	if len(view.tx.entries) == 0 {
+		return nil
+	}
+
+	batch := walEntry{Op: opBatch, Batch: view.tx.entries}
+	if m.wal != nil {
+		if err := m.wal.append(&batch); err != nil {
+			m.rollback(view.tx)
+			return errors.NewOperationError("RunInTx", "failed to write the write-ahead log", err)
+		}
+	}
+	m.transfers = view.transfers
+	m.publish(&batch)
+	m.snapshotIfDue()
+	return nil
+}
+
+// rollback reverts a transaction's changes, newest first (mu held)
+func (m *MemoryStore) rollback(tx *memoryTx) {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		m.apply(&tx.undo[i])
+	}
+}
+
+// undoFor returns the entry that puts back what entry is about to
+// overwrite or delete. Stored values are never changed in place, so the
+// old pointer can be put back as it is. (mu held)
+func (m *MemoryStore) undoFor(entry *walEntry) walEntry {
+	switch entry.Op {
+	case opStoreResource, opUpdateResource, opDeleteResource:
+		id := models.ContentID(entry.ID)
+		if entry.Resource != nil {
+			id = entry.Resource.ID
+		}
+		if old, ok := m.resources[id]; ok {
+			return walEntry{Op: opUpdateResource, Resource: old}
+		}
+		return walEntry{Op: opDeleteResource, ID: string(id)}
+
+	case opCreateUser, opUpdateUser, opDeleteUser:
+		id := models.UserID(entry.ID)
+		if entry.User != nil {
+			id = entry.User.User.ID
+		}
+		if old, ok := m.users[id]; ok {
+			return walEntry{Op: opUpdateUser, User: &storedUser{old, old.Password}}
+		}
+		return walEntry{Op: opDeleteUser, ID: string(id)}
+
+	case opCreateRating, opUpdateRating, opDeleteRating:
+		id := entry.ID
+		if entry.Rating != nil {
+			id = entry.Rating.ID
+		}
+		if old, ok := m.ratings[id]; ok {
+			return walEntry{Op: opUpdateRating, Rating: old}
+		}
+		return walEntry{Op: opDeleteRating, ID: id}
+
+	case opAddTransfer:
+		return walEntry{Op: opDropTransfer, ID: entry.Transfer.ID}
+	}
+
+	// Transactions only reach resources, users, ratings and the ledger
+	panic("store: " + entry.Op + " cannot run in a transaction")
+}
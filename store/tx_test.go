@@ -0,0 +1,237 @@
+// Package store - Unit tests for MemoryStore transactions
+package store
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"p2p-library/interfaces"
+	"p2p-library/models"
+)
+
+// uploadInTx stores a resource and credits its uploader in one
+// transaction, then returns fail
+func uploadInTx(m *MemoryStore, resource *models.Resource, fail error) error {
+	return m.RunInTx(func(tx interfaces.Tx) error {
+		if err := tx.Resources().Store(resource); err != nil {
+			return err
+		}
+		err := tx.Users().UpdateUser(resource.UploadedBy, func(u *models.User) error {
+			u.TotalUploads++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return fail
+	})
+}
+
+// ============================================================================
+// TESTS
+// ============================================================================
+
+func TestTxCommitsAllChanges(t *testing.T) {
+	m := NewMemoryStore()
+	m.Create(models.NewUser("user-alice", "alice", "alice@test.com"))
+
+	notes := models.NewResource("notes.pdf", 1024, "user-alice")
+	if err := uploadInTx(m, notes, nil); err != nil {
+		t.Fatalf("RunInTx failed: %v", err)
+	}
+
+	if _, err := m.Get(notes.ID); err != nil {
+		t.Errorf("Resource stored in the transaction is missing: %v", err)
+	}
+	if user, _ := m.GetUser("user-alice"); user.TotalUploads != 1 {
+		t.Errorf("TotalUploads = %d; want 1", user.TotalUploads)
+	}
+}
+
+func TestTxRollsBackOnError(t *testing.T) {
+	m := NewMemoryStore()
+	m.Create(models.NewUser("user-alice", "alice", "alice@test.com"))
+	kept := models.NewResource("kept.pdf", 1024, "user-alice")
+	kept.Subject = "Biology"
+	m.Store(kept)
+	m.CreateRating(models.NewResourceRating(kept.ID, "user-alice", 3, ""))
+
+	failed := fmt.Errorf("step three failed")
+	err := m.RunInTx(func(tx interfaces.Tx) error {
+		notes := models.NewResource("notes.pdf", 1024, "user-alice")
+		notes.Subject = "Biology"
+		tx.Resources().Store(notes)
+		tx.Resources().UpdateResource(kept.ID, func(r *models.Resource) error {
+			r.Subject = "Chemistry"
+			return nil
+		})
+		tx.Users().UpdateUser("user-alice", func(u *models.User) error {
+			u.Reputation = 99
+			return nil
+		})
+		tx.Users().Create(models.NewUser("user-bob", "bob", "bob@test.com"))
+		ratings, _ := tx.Ratings().GetByResource(kept.ID)
+		tx.Ratings().Delete(ratings[0].ID)
+
+		// The transaction sees its own changes
+		if got, _ := tx.Resources().GetBySubject("Chemistry"); len(got) != 1 {
+			t.Errorf("Transaction sees %d Chemistry resources; want its own change", len(got))
+		}
+		return failed
+	})
+	if err != failed {
+		t.Errorf("RunInTx error = %v; want fn's error", err)
+	}
+
+	if resources, users, ratings := m.Count(); resources != 1 || users != 1 || ratings != 1 {
+		t.Errorf("Count = %d resources, %d users, %d ratings; want 1 each", resources, users, ratings)
+	}
+	if got, _ := m.Get(kept.ID); got.Subject != "Biology" || got.Version != 1 {
+		t.Errorf("Kept resource = %q version %d; want it untouched", got.Subject, got.Version)
+	}
+	if got, _ := m.GetBySubject("Biology"); len(got) != 1 {
+		t.Errorf("Subject index holds %d Biology resources; want 1", len(got))
+	}
+	if got, _ := m.GetLeaderboard(10); len(got) != 1 || got[0].Reputation != 0 {
+		t.Errorf("Leaderboard = %d users; want only Alice with her old score", len(got))
+	}
+	if _, err := m.GetByEmail("bob@test.com"); err == nil {
+		t.Error("User created in the failed transaction can be found by email")
+	}
+}
+
+func TestTxRollsBackOnPanic(t *testing.T) {
+	m := NewMemoryStore()
+	m.Create(models.NewUser("user-alice", "alice", "alice@test.com"))
+
+	func() {
+		defer func() { recover() }()
+		m.RunInTx(func(tx interfaces.Tx) error {
+			tx.Users().UpdateUser("user-alice", func(u *models.User) error {
+				u.TotalUploads = 5
+				return nil
+			})
+			panic("boom")
+		})
+	}()
+
+	if user, _ := m.GetUser("user-alice"); user.TotalUploads != 0 {
+		t.Errorf("TotalUploads = %d after the panic; want 0", user.TotalUploads)
+	}
+	// The store is unlocked again
+	if err := m.Create(models.NewUser("user-bob", "bob", "bob@test.com")); err != nil {
+		t.Errorf("Create after the panic failed: %v", err)
+	}
+}
+
+func TestTxIsLoggedAsOneEntry(t *testing.T) {
+	dir := t.TempDir()
+	m := openWALStore(t, dir, WALConfig{NoSync: true})
+	m.Create(models.NewUser("user-alice", "alice", "alice@test.com"))
+
+	notes := models.NewResource("notes.pdf", 1024, "user-alice")
+	if err := uploadInTx(m, notes, nil); err != nil {
+		t.Fatalf("RunInTx failed: %v", err)
+	}
+	if m.wal.entries != 2 {
+		t.Errorf("Log holds %d entries; want the user and one for the transaction", m.wal.entries)
+	}
+	uploadInTx(m, models.NewResource("failed.pdf", 1024, "user-alice"), fmt.Errorf("failed"))
+	crashed(m)
+
+	got := openWALStore(t, dir, WALConfig{})
+	defer got.Close()
+	if resources, _, _ := got.Count(); resources != 1 {
+		t.Errorf("Recovered %d resources; want only the committed one", resources)
+	}
+	if user, _ := got.GetUser("user-alice"); user.TotalUploads != 1 {
+		t.Errorf("TotalUploads = %d after recovery; want 1", user.TotalUploads)
+	}
+}
+
+func TestTxRollsBackFailedLogWrite(t *testing.T) {
+	dir := t.TempDir()
+	m := openWALStore(t, dir, WALConfig{NoSync: true})
+	m.Create(models.NewUser("user-alice", "alice", "alice@test.com"))
+
+	restore := writeFrame
+	writeFrame = func(f *os.File, frame []byte) error { return io.ErrShortWrite }
+	notes := models.NewResource("notes.pdf", 1024, "user-alice")
+	err := uploadInTx(m, notes, nil)
+	writeFrame = restore
+	if err == nil {
+		t.Fatal("RunInTx succeeded although the log write failed")
+	}
+
+	if _, err := m.Get(notes.ID); err == nil {
+		t.Error("Resource whose transaction was not logged was kept")
+	}
+	if user, _ := m.GetUser("user-alice"); user.TotalUploads != 0 {
+		t.Errorf("TotalUploads = %d; want the unlogged change reverted", user.TotalUploads)
+	}
+}
+
+func TestTxCoversTheTransferLedger(t *testing.T) {
+	eachEventBackend(t, func(t *testing.T, db interfaces.StorageBackend) {
+		db.Users().Create(models.NewUser("user-alice", "alice", "alice@test.com"))
+		serve := func(record *models.TransferRecord, fail error) error {
+			return db.RunInTx(func(tx interfaces.Tx) error {
+				if err := tx.Transfers().Add(record); err != nil {
+					return err
+				}
+				if !tx.Transfers().Has(record.ID) {
+					t.Error("Transaction does not see its own ledger entry")
+				}
+				err := tx.Users().UpdateUser("user-alice", func(u *models.User) error {
+					u.BytesServed += record.Bytes
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				return fail
+			})
+		}
+
+		failed := models.NewTransferRecord("cid", 0, 100, "peer-a", "peer-b")
+		serve(failed, fmt.Errorf("failed"))
+		if db.Transfers().Has(failed.ID) {
+			t.Error("Ledger entry of a failed transaction was kept")
+		}
+		if all, _ := db.Transfers().GetAll(); len(all) != 0 {
+			t.Errorf("Ledger holds %d entries after a failed transaction; want 0", len(all))
+		}
+
+		// The record can be added once its first attempt rolled back
+		if err := serve(failed, nil); err != nil {
+			t.Fatalf("RunInTx failed: %v", err)
+		}
+		if all, _ := db.Transfers().GetAll(); len(all) != 1 || all[0].ID != failed.ID {
+			t.Errorf("Ledger = %d entries; want the committed one", len(all))
+		}
+		if user, _ := db.Users().Get("user-alice"); user.BytesServed != 100 {
+			t.Errorf("BytesServed = %d; want 100", user.BytesServed)
+		}
+	})
+}
+
+func TestTxTransfersSurviveRecovery(t *testing.T) {
+	dir := t.TempDir()
+	m := openWALStore(t, dir, WALConfig{NoSync: true})
+	record := models.NewTransferRecord("cid", 0, 100, "peer-a", "peer-b")
+	err := m.RunInTx(func(tx interfaces.Tx) error {
+		return tx.Transfers().Add(record)
+	})
+	if err != nil {
+		t.Fatalf("RunInTx failed: %v", err)
+	}
+	crashed(m)
+
+	got := openWALStore(t, dir, WALConfig{})
+	defer got.Close()
+	if !got.HasTransfer(record.ID) {
+		t.Error("Ledger entry added in a transaction was lost in recovery")
+	}
+}
@@ -0,0 +1,447 @@
+// Package store - Write-ahead log and snapshots for MemoryStore
+//
+// A durable MemoryStore keeps serving every read from its maps, but each
+// mutation is first appended to a write-ahead log in its directory and
+// only then applied. Every SnapshotEvery entries the whole store is
+// written to a snapshot and the log starts over, so the log never grows
+// without bound.
+//
+// Each log entry is framed as a 4-byte length, a 4-byte CRC-32 and the
+// JSON-encoded entry, and carries a sequence number. On open the store
+// loads the snapshot and replays the entries newer than it. A crash in
+// the middle of a write leaves a short or corrupt last entry; replay
+// stops there and cuts it off, so the store comes back with every write
+// that was acknowledged before the crash.
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"p2p-library/errors"
+	"p2p-library/models"
+)
+
+// File names inside a durable store's directory
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+)
+
+// maxWALEntrySize bounds a single log entry; anything larger is corrupt
+const maxWALEntrySize = 64 << 20
+
+// WALConfig tunes a durable MemoryStore
+type WALConfig struct {
+	// SnapshotEvery is how many log entries are written before the store
+	// is snapshotted and the log compacted. Default 1000.
+	SnapshotEvery int
+
+	// NoSync skips fsync after each entry. Writes then survive a crash of
+	// the process but not of the machine.
+	NoSync bool
+}
+
+// withDefaults fills in zero fields
+func (c WALConfig) withDefaults() WALConfig {
+	if c.SnapshotEvery <= 0 {
+		c.SnapshotEvery = 1000
+	}
+	return c
+}
+
+// Log entry operations
+const (
+	opStoreResource  = "store_resource"
+	opUpdateResource = "update_resource"
+	opDeleteResource = "delete_resource"
+	opCreateUser     = "create_user"
+	opUpdateUser     = "update_user"
+	opDeleteUser     = "delete_user"
+	opCreateRating   = "create_rating"
+	opUpdateRating   = "update_rating"
+	opDeleteRating   = "delete_rating"
+	opAddTransfer    = "add_transfer"
+	opDropTransfer   = "drop_transfer" // undoes add_transfer in a rolled back transaction; never logged
+	opClear          = "clear"
+	opBatch          = "batch" // a transaction's entries, applied together
+)
+
+// walEntry is one mutation. Only the field its Op needs is set.
+type walEntry struct {
+	Seq      uint64                 `json:"seq"`
+	Op       string                 `json:"op"`
+	ID       string                 `json:"id,omitempty"` // deletes
+	Resource *models.Resource       `json:"resource,omitempty"`
+	User     *storedUser            `json:"user,omitempty"`
+	Rating   *models.ResourceRating `json:"rating,omitempty"`
+	Transfer *models.TransferRecord `json:"transfer,omitempty"`
+	Batch    []walEntry             `json:"batch,omitempty"`
+}
+
+// snapshot is the whole store as of log entry Seq
+type snapshot struct {
+	Seq       uint64                   `json:"seq"`
+	Resources []*models.Resource       `json:"resources"`
+	Users     []storedUser             `json:"users"`
+	Ratings   []*models.ResourceRating `json:"ratings"`
+	Transfers []*models.TransferRecord `json:"transfers"`
+}
+
+// wal is the open log of a durable MemoryStore. It is only used with the
+// store's mutex held.
+type wal struct {
+	dir     string
+	cfg     WALConfig
+	file    *os.File
+	size    int64  // length of the intact log
+	seq     uint64 // sequence number of the last entry written
+	entries int    // entries written since the last snapshot
+}
+
+// ============================================================================
+// OPENING AND RECOVERY
+// ============================================================================
+
+// OpenMemoryStore opens a durable MemoryStore kept in dir, creating the
+// directory if needed. The store is rebuilt from the snapshot and the log
+// left by the last run.
+func OpenMemoryStore(dir string, cfg WALConfig) (*MemoryStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.NewOperationError("OpenMemoryStore", "failed to create "+dir, err)
+	}
+
+	m := NewMemoryStore()
+	seq, err := m.loadSnapshot(filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		return nil, errors.NewOperationError("OpenMemoryStore", "failed to load snapshot", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.NewOperationError("OpenMemoryStore", "failed to open write-ahead log", err)
+	}
+	replayed, size, lastSeq, err := m.replay(file, seq)
+	if err != nil {
+		file.Close()
+		return nil, errors.NewOperationError("OpenMemoryStore", "failed to replay write-ahead log", err)
+	}
+	if lastSeq > seq {
+		seq = lastSeq
+	}
+
+	m.wal = &wal{dir: dir, cfg: cfg.withDefaults(), file: file, size: size, seq: seq, entries: replayed}
+	return m, nil
+}
+
+// loadSnapshot fills the store from a snapshot file and returns the
+// sequence number it covers. A missing file is an empty store.
+func (m *MemoryStore) loadSnapshot(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return 0, err
+	}
+	for _, resource := range snap.Resources {
+		m.resources[resource.ID] = resource
+		m.index.addResource(resource)
+	}
+	for _, stored := range snap.Users {
+		stored.User.Password = stored.Password
+		m.users[stored.User.ID] = stored.User
+		m.index.addUser(stored.User)
+	}
+	for _, rating := range snap.Ratings {
+		m.ratings[rating.ID] = rating
+		m.index.addRating(rating)
+	}
+	for _, record := range snap.Transfers {
+		m.transfers = append(m.transfers, record)
+		m.transferIDs[record.ID] = true
+	}
+	return snap.Seq, nil
+}
+
+// replay applies the log entries newer than after. The log is cut off at
+// the first entry that is incomplete or fails its checksum, which is
+// where a crash interrupted a write. It returns how many entries were
+// kept, the length of the log they fill and the last sequence number seen.
+func (m *MemoryStore) replay(file *os.File, after uint64) (int, int64, uint64, error) {
+	r := bufio.NewReader(file)
+	var (
+		good    int64 // offset just past the last intact entry
+		kept    int
+		lastSeq uint64
+	)
+	for {
+		entry, size, err := readWALEntry(r)
+		if err != nil {
+			break
+		}
+		good += size
+		kept++
+		lastSeq = entry.Seq
+		if entry.Seq > after {
+			m.apply(entry)
+		}
+	}
+
+	if err := truncateTo(file, good); err != nil {
+		return 0, 0, 0, err
+	}
+	return kept, good, lastSeq, nil
+}
+
+// readWALEntry reads one framed entry and returns it with its size on
+// disk. Any error means there is no intact entry at this point.
+func readWALEntry(r io.Reader) (*walEntry, int64, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	sum := binary.BigEndian.Uint32(header[4:])
+	if size > maxWALEntrySize {
+		return nil, 0, errors.ErrInvalidInput
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, 0, errors.ErrChecksumMismatch
+	}
+
+	var entry walEntry
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return nil, 0, err
+	}
+	return &entry, int64(len(header)) + int64(size), nil
+}
+
+// ============================================================================
+// WRITING
+// ============================================================================
+
+// commit makes a mutation: it is logged first, if the store is durable,
+// then applied and published on the event bus. Inside a transaction it
+// is applied at once, and logged and published with the rest of the
+// transaction when that commits. (mu held)
+func (m *MemoryStore) commit(entry walEntry) error {
+	if m.tx != nil {
+		m.tx.record(m.undoFor(&entry), entry)
+		m.apply(&entry)
+		return nil
+	}
+
+	if m.wal != nil {
+		if err := m.wal.append(&entry); err != nil {
+			return errors.NewOperationError("MemoryStore", "failed to write the write-ahead log", err)
+		}
+	}
+	m.apply(&entry)
+	m.publish(&entry)
+	m.snapshotIfDue()
+	return nil
+}
+
+// snapshotIfDue compacts the log once it holds SnapshotEvery entries.
+// The entries are safely logged; a failed snapshot only means the log
+// keeps growing until the next attempt. (mu held)
+func (m *MemoryStore) snapshotIfDue() {
+	if m.wal != nil && m.wal.entries >= m.wal.cfg.SnapshotEvery {
+		_ = m.snapshot()
+	}
+}
+
+// append writes an entry to the end of the log
+func (w *wal) append(entry *walEntry) error {
+	entry.Seq = w.seq + 1
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 8+len(body))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(body))
+	copy(frame[8:], body)
+
+	err = writeFrame(w.file, frame)
+	if err == nil && !w.cfg.NoSync {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		// Drop whatever part of the frame made it out, so later entries
+		// are not written after a torn one
+		truncateTo(w.file, w.size)
+		return err
+	}
+	w.size += int64(len(frame))
+	w.seq = entry.Seq
+	w.entries++
+	return nil
+}
+
+// writeFrame writes one framed entry to the log. Tests replace it to stop
+// a write halfway.
+var writeFrame = func(f *os.File, frame []byte) error {
+	_, err := f.Write(frame)
+	return err
+}
+
+// apply performs a logged mutation on the maps and their indexes (mu held)
+func (m *MemoryStore) apply(entry *walEntry) {
+	switch entry.Op {
+	case opStoreResource, opUpdateResource:
+		if old, ok := m.resources[entry.Resource.ID]; ok {
+			m.index.removeResource(old)
+		}
+		m.resources[entry.Resource.ID] = entry.Resource
+		m.index.addResource(entry.Resource)
+	case opDeleteResource:
+		if old, ok := m.resources[models.ContentID(entry.ID)]; ok {
+			m.index.removeResource(old)
+			delete(m.resources, old.ID)
+		}
+	case opCreateUser, opUpdateUser:
+		entry.User.User.Password = entry.User.Password
+		if old, ok := m.users[entry.User.User.ID]; ok {
+			m.index.removeUser(old)
+		}
+		m.users[entry.User.User.ID] = entry.User.User
+		m.index.addUser(entry.User.User)
+	case opDeleteUser:
+		if old, ok := m.users[models.UserID(entry.ID)]; ok {
+			m.index.removeUser(old)
+			delete(m.users, old.ID)
+		}
+	case opCreateRating, opUpdateRating:
+		if old, ok := m.ratings[entry.Rating.ID]; ok {
+			m.index.removeRating(old)
+		}
+		m.ratings[entry.Rating.ID] = entry.Rating
+		m.index.addRating(entry.Rating)
+	case opDeleteRating:
+		if old, ok := m.ratings[entry.ID]; ok {
+			m.index.removeRating(old)
+			delete(m.ratings, old.ID)
+		}
+	case opAddTransfer:
+		m.transfers = append(m.transfers, entry.Transfer)
+		m.transferIDs[entry.Transfer.ID] = true
+	case opDropTransfer:
+		delete(m.transferIDs, entry.ID)
+		if n := len(m.transfers); n > 0 && m.transfers[n-1].ID == entry.ID {
+			m.transfers = m.transfers[:n-1]
+		}
+	case opBatch:
+		for i := range entry.Batch {
+			m.apply(&entry.Batch[i])
+		}
+	case opClear:
+		m.resources = make(map[models.ContentID]*models.Resource)
+		m.users = make(map[models.UserID]*models.User)
+		m.ratings = make(map[string]*models.ResourceRating)
+		m.transfers = nil
+		m.transferIDs = make(map[string]bool)
+		m.index = newIndexes()
+	}
+}
+
+// ============================================================================
+// SNAPSHOTS
+// ============================================================================
+
+// Snapshot writes the whole store to its snapshot file and empties the
+// log. It does nothing for a store without a log.
+func (m *MemoryStore) Snapshot() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snapshot()
+}
+
+// snapshot writes the snapshot next to the log, then truncates the log.
+// The snapshot replaces the old one with a rename, so a crash leaves
+// either the old or the new one; entries it already covers are skipped
+// on replay by their sequence number. (mu held)
+func (m *MemoryStore) snapshot() error {
+	if m.wal == nil {
+		return nil
+	}
+
+	snap := snapshot{
+		Seq:       m.wal.seq,
+		Resources: make([]*models.Resource, 0, len(m.resources)),
+		Users:     make([]storedUser, 0, len(m.users)),
+		Ratings:   make([]*models.ResourceRating, 0, len(m.ratings)),
+		Transfers: m.transfers,
+	}
+	for _, resource := range m.resources {
+		snap.Resources = append(snap.Resources, resource)
+	}
+	for _, user := range m.users {
+		snap.Users = append(snap.Users, storedUser{user, user.Password})
+	}
+	for _, rating := range m.ratings {
+		snap.Ratings = append(snap.Ratings, rating)
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(m.wal.dir, snapshotFileName)
+	if err := writeFileSync(path+".tmp", data); err != nil {
+		return errors.NewOperationError("Snapshot", "failed to write snapshot", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return errors.NewOperationError("Snapshot", "failed to replace snapshot", err)
+	}
+
+	if err := truncateTo(m.wal.file, 0); err != nil {
+		return errors.NewOperationError("Snapshot", "failed to compact write-ahead log", err)
+	}
+	m.wal.size = 0
+	m.wal.entries = 0
+	return nil
+}
+
+// truncateTo cuts a file to size and moves the write position there
+func truncateTo(f *os.File, size int64) error {
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	_, err := f.Seek(size, io.SeekStart)
+	return err
+}
+
+// writeFileSync writes a file and flushes it to disk
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,271 @@
+// Package store - Unit tests for the MemoryStore write-ahead log
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"p2p-library/models"
+)
+
+// openWALStore opens a durable store in dir and fails the test on error
+func openWALStore(t *testing.T, dir string, cfg WALConfig) *MemoryStore {
+	t.Helper()
+
+	m, err := OpenMemoryStore(dir, cfg)
+	if err != nil {
+		t.Fatalf("OpenMemoryStore failed: %v", err)
+	}
+	return m
+}
+
+// crashed abandons a store without closing it, as a killed process would
+func crashed(m *MemoryStore) {
+	m.wal.file.Close()
+}
+
+// ============================================================================
+// TESTS
+// ============================================================================
+
+func TestWALRebuildsStoreAfterCrash(t *testing.T) {
+	for _, every := range []int{1000, 3} {
+		t.Run(fmt.Sprintf("snapshot every %d", every), func(t *testing.T) {
+			dir := t.TempDir()
+			m := openWALStore(t, dir, WALConfig{SnapshotEvery: every, NoSync: true})
+
+			alice := models.NewUser("user-alice", "alice", "alice@test.com")
+			alice.Password = "secret"
+			m.Create(alice)
+			alice.TotalUploads = 2
+			m.UpdateUser(alice)
+			m.Create(models.NewUser("user-bob", "bob", "bob@test.com"))
+			m.DeleteUser("user-bob")
+
+			notes := models.NewResource("notes.pdf", 1024, alice.ID)
+			m.Store(notes)
+			notes.DownloadCount = 5
+			m.Update(notes)
+			slides := models.NewResource("slides.pdf", 2048, alice.ID)
+			m.Store(slides)
+			m.Delete(slides.ID)
+
+			m.CreateRating(models.NewResourceRating(notes.ID, "user-carol", 4, "useful"))
+			m.AddTransfer(models.NewTransferRecord(notes.ID, 0, models.ChunkSize, "peer-a", "peer-b"))
+			m.AddTransfer(models.NewTransferRecord(notes.ID, 1, models.ChunkSize, "peer-a", "peer-b"))
+			crashed(m)
+
+			got := openWALStore(t, dir, WALConfig{SnapshotEvery: every})
+			defer got.Close()
+
+			if resources, users, ratings := got.Count(); resources != 1 || users != 1 || ratings != 1 {
+				t.Errorf("Count = %d resources, %d users, %d ratings; want 1 each", resources, users, ratings)
+			}
+			user, err := got.GetUser(alice.ID)
+			if err != nil || user.TotalUploads != 2 || user.Password != "secret" {
+				t.Errorf("Alice = %+v, %v; want 2 uploads and her password", user, err)
+			}
+			resource, err := got.Get(notes.ID)
+			if err != nil || resource.DownloadCount != 5 {
+				t.Errorf("Notes = %+v, %v; want 5 downloads", resource, err)
+			}
+			transfers, _ := got.GetTransfers()
+			if len(transfers) != 2 || transfers[0].ChunkIndex != 0 || transfers[1].ChunkIndex != 1 {
+				t.Errorf("Ledger has %d records; want chunks 0 and 1 in order", len(transfers))
+			}
+		})
+	}
+}
+
+func TestWALCompactsIntoSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	m := openWALStore(t, dir, WALConfig{SnapshotEvery: 5, NoSync: true})
+
+	for i := 0; i < 12; i++ {
+		m.Store(models.NewResource(fmt.Sprintf("file-%d.pdf", i), 1024, "user-alice"))
+	}
+	if m.wal.entries != 2 {
+		t.Errorf("Log holds %d entries after 12 writes; want 2 past the last snapshot", m.wal.entries)
+	}
+	crashed(m)
+
+	got := openWALStore(t, dir, WALConfig{})
+	defer got.Close()
+	if resources, _, _ := got.Count(); resources != 12 {
+		t.Errorf("Recovered %d resources; want 12", resources)
+	}
+}
+
+func TestWALSkipsEntriesCoveredBySnapshot(t *testing.T) {
+	dir := t.TempDir()
+	m := openWALStore(t, dir, WALConfig{NoSync: true})
+	m.AddTransfer(models.NewTransferRecord("cid", 0, 100, "peer-a", "peer-b"))
+
+	// A crash between writing the snapshot and truncating the log leaves
+	// entries that are in both
+	log, _ := os.ReadFile(filepath.Join(dir, walFileName))
+	if err := m.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	crashed(m)
+	os.WriteFile(filepath.Join(dir, walFileName), log, 0600)
+
+	got := openWALStore(t, dir, WALConfig{})
+	defer got.Close()
+	if transfers, _ := got.GetTransfers(); len(transfers) != 1 {
+		t.Errorf("Ledger has %d records; want 1", len(transfers))
+	}
+}
+
+func TestWALCutsOffTornEntry(t *testing.T) {
+	dir := t.TempDir()
+	m := openWALStore(t, dir, WALConfig{NoSync: true})
+	m.Store(models.NewResource("kept.pdf", 1024, "user-alice"))
+	crashed(m)
+
+	// Half of a second entry, as if the process died while writing it
+	path := filepath.Join(dir, walFileName)
+	intact, _ := os.ReadFile(path)
+	os.WriteFile(path, append(intact, intact[:len(intact)/2]...), 0600)
+
+	got := openWALStore(t, dir, WALConfig{NoSync: true})
+	if resources, _, _ := got.Count(); resources != 1 {
+		t.Errorf("Recovered %d resources; want 1", resources)
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(intact)) {
+		t.Errorf("Log is %d bytes; want the torn entry cut off at %d", info.Size(), len(intact))
+	}
+
+	// New writes go after the intact entries and survive another restart
+	got.Store(models.NewResource("after.pdf", 1024, "user-alice"))
+	crashed(got)
+	again := openWALStore(t, dir, WALConfig{})
+	defer again.Close()
+	if resources, _, _ := again.Count(); resources != 2 {
+		t.Errorf("Recovered %d resources after the second restart; want 2", resources)
+	}
+}
+
+func TestWALRollsBackFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	m := openWALStore(t, dir, WALConfig{NoSync: true})
+	m.Store(models.NewResource("first.pdf", 1024, "user-alice"))
+
+	// The disk fills up halfway through the next entry
+	restore := writeFrame
+	writeFrame = func(f *os.File, frame []byte) error {
+		f.Write(frame[:len(frame)/2])
+		return io.ErrShortWrite
+	}
+	failed := models.NewResource("failed.pdf", 1024, "user-alice")
+	err := m.Store(failed)
+	writeFrame = restore
+	if err == nil {
+		t.Fatal("Store succeeded although the log write failed")
+	}
+	if _, err := m.Get(failed.ID); err == nil {
+		t.Error("Resource whose log write failed was stored anyway")
+	}
+
+	m.Store(models.NewResource("third.pdf", 1024, "user-alice"))
+	crashed(m)
+
+	got := openWALStore(t, dir, WALConfig{})
+	defer got.Close()
+	if resources, _, _ := got.Count(); resources != 2 {
+		t.Errorf("Recovered %d resources; want the 2 written around the failure", resources)
+	}
+}
+
+// TestWALCrashWriter is the process TestCrashInTheMiddleOfAWrite kills.
+// It stores resources and prints the ID of each one once Store returns,
+// and stops halfway through writing entry tornAt to wait for the kill.
+func TestWALCrashWriter(t *testing.T) {
+	dir := os.Getenv("WAL_CRASH_DIR")
+	if dir == "" {
+		t.Skip("only runs as the child of TestCrashInTheMiddleOfAWrite")
+	}
+
+	const tornAt = 23
+	written := 0
+	writeFrame = func(f *os.File, frame []byte) error {
+		written++
+		if written == tornAt {
+			f.Write(frame[:len(frame)/2])
+			fmt.Println("torn")
+			select {}
+		}
+		_, err := f.Write(frame)
+		return err
+	}
+
+	m, err := OpenMemoryStore(dir, WALConfig{SnapshotEvery: 10})
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	for i := 0; ; i++ {
+		resource := models.NewResource(fmt.Sprintf("file-%d.pdf", i), int64(1024+i), "user-alice")
+		resource.Description = strings.Repeat("lecture notes ", 1000)
+		if err := m.Store(resource); err != nil {
+			fmt.Println("error", err)
+			return
+		}
+		fmt.Println("ack", resource.ID)
+	}
+}
+
+func TestCrashInTheMiddleOfAWrite(t *testing.T) {
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWALCrashWriter$")
+	cmd.Env = append(os.Environ(), "WAL_CRASH_DIR="+dir)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe failed: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Starting the writer failed: %v", err)
+	}
+
+	var acked []models.ContentID
+	torn := false
+	lines := bufio.NewScanner(out)
+	for !torn && lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		switch {
+		case len(fields) == 2 && fields[0] == "ack":
+			acked = append(acked, models.ContentID(fields[1]))
+		case len(fields) == 1 && fields[0] == "torn":
+			torn = true
+		default:
+			t.Logf("Writer: %s", lines.Text())
+		}
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	if !torn {
+		t.Fatalf("Writer exited before the torn write, after %d acknowledged writes", len(acked))
+	}
+
+	got := openWALStore(t, dir, WALConfig{})
+	defer got.Close()
+
+	// Every acknowledged write survives, and the torn one is gone
+	for _, id := range acked {
+		if _, err := got.Get(id); err != nil {
+			t.Errorf("Acknowledged resource %s was lost", id)
+		}
+	}
+	if resources, _, _ := got.Count(); resources != len(acked) {
+		t.Errorf("Recovered %d resources; want the %d acknowledged", resources, len(acked))
+	}
+	if err := got.Store(models.NewResource("after.pdf", 1024, "user-alice")); err != nil {
+		t.Errorf("Store after recovery failed: %v", err)
+	}
+}